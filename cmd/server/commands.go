@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/backup"
+	"github.com/shiftregister-vg/gopad/pkg/loadtest"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/sanitize"
+	"github.com/shiftregister-vg/gopad/pkg/server"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/storage/migrate"
+	"github.com/shiftregister-vg/gopad/pkg/webhook"
+)
+
+// loadBatch is how many documents the commands load at once
+const loadBatch = 500
+
+// migrateDocuments loads and saves every stored document, which rewrites it in the
+// current format: documents stored with an older schema are upgraded, logged
+// operations are folded into the snapshot and, with ENCRYPTION_MASTER_KEY
+// set, plaintext documents are encrypted
+func migrateDocuments(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate")
+	dryRun := fs.Bool("dry-run", false, "list the documents that would be rewritten without saving them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ids, err := store.ListDocumentIDs(ctx)
+	if err != nil {
+		return err
+	}
+	var migrated, upgraded, failed int
+	eachDocument(ctx, store, ids, func(id string, state *storage.DocumentState, err error) {
+		if err != nil {
+			logger.Error("Error loading document", "doc_id", id, "error", err)
+			failed++
+			return
+		}
+		// Loading upgraded it already; saving stores the upgraded shape
+		outdated := state.Schema < migrate.Current
+		if *dryRun {
+			fmt.Println(id)
+			migrated++
+			return
+		}
+		if err := store.SaveDocument(ctx, id, state); err != nil {
+			if errors.Is(err, storage.ErrVersionConflict) {
+				// A running server saved it in the meantime, which rewrote it anyway
+				logger.Info("Document changed while migrating, skipping", "doc_id", id)
+				return
+			}
+			logger.Error("Error saving document", "doc_id", id, "error", err)
+			failed++
+			return
+		}
+		if outdated {
+			upgraded++
+		}
+		migrated++
+	})
+	logger.Info("Migration finished", "documents", len(ids), "migrated", migrated, "upgraded", upgraded, "failed", failed, "dry_run", *dryRun)
+	if failed > 0 {
+		return fmt.Errorf("%d documents could not be migrated", failed)
+	}
+	return nil
+}
+
+// eachDocument calls fn with the stored state of every document in ids, or
+// the error loading it, loading them in batches
+func eachDocument(ctx context.Context, store *storage.Storage, ids []string, fn func(id string, state *storage.DocumentState, err error)) {
+	for start := 0; start < len(ids); start += loadBatch {
+		batch := ids[start:min(start+loadBatch, len(ids))]
+		states, errs := store.LoadDocuments(ctx, batch)
+		for i, id := range batch {
+			fn(id, states[i], errs[i])
+		}
+	}
+}
+
+// export writes a document in the format of the export endpoint
+func export(ctx context.Context, args []string) error {
+	fs := newFlagSet("export")
+	output := fs.String("o", "", "file to write to (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: gopad export [-o file] <docID>")
+	}
+	docID := fs.Arg(0)
+	store, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	state, err := store.LoadDocument(ctx, docID)
+	if err != nil {
+		return err
+	}
+	if state.Version == 0 && len(state.Tabs) == 0 {
+		return storage.ErrNotFound
+	}
+	cfg := server.ConfigFromEnv()
+	archive := server.NewExport(docID, state, sanitize.New(cfg.SanitizePolicy, cfg.MaxNameLength))
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(archive)
+}
+
+// purgeExpired deletes documents that haven't been modified within max-age,
+// or within the TTL their settings or workspace policy give them.
+// Saved documents expire from Redis on their own; this catches ones whose
+// expiry was lost, e.g. after restoring a backup.
+func purgeExpired(ctx context.Context, args []string) error {
+	fs := newFlagSet("purge-expired")
+	maxAge := fs.Duration("max-age", 7*24*time.Hour, "delete documents last modified longer ago than this")
+	dryRun := fs.Bool("dry-run", false, "list the documents that would be deleted without deleting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ids, err := store.ListDocumentIDs(ctx)
+	if err != nil {
+		return err
+	}
+	cfg := server.ConfigFromEnv()
+	// Report purged documents like ones Redis expires on its own
+	var webhooks *webhook.Sender
+	if len(cfg.WebhookURLs) > 0 && !*dryRun {
+		webhooks = webhook.New(cfg.WebhookURLs, []byte(cfg.WebhookSecret))
+		defer webhooks.Close()
+	}
+	ttls := newTTLResolver(store, cfg.DefaultWorkspace)
+	var purged int
+	eachDocument(ctx, store, ids, func(id string, state *storage.DocumentState, err error) {
+		if err != nil {
+			logger.Error("Error loading document", "doc_id", id, "error", err)
+			return
+		}
+		ttl, err := ttls.resolve(ctx, state)
+		if err != nil {
+			logger.Error("Error loading workspace policy", "doc_id", id, "error", err)
+			return
+		}
+		age := *maxAge
+		if ttl > 0 {
+			age = ttl
+		}
+		if state.LastModified >= time.Now().Add(-age).UnixMilli() {
+			return
+		}
+		if *dryRun {
+			fmt.Println(id)
+			purged++
+			return
+		}
+		if err := store.DeleteDocument(ctx, id); err != nil {
+			logger.Error("Error deleting document", "doc_id", id, "error", err)
+			return
+		}
+		if webhooks != nil {
+			webhooks.Deliver(webhook.Event{Type: webhook.DocumentExpired, DocumentID: id})
+		}
+		purged++
+	})
+	logger.Info("Purge finished", "documents", len(ids), "purged", purged, "dry_run", *dryRun)
+	return nil
+}
+
+// backupDocuments writes a dump of every stored document, like the scheduled backups
+func backupDocuments(ctx context.Context, args []string) error {
+	fs := newFlagSet("backup")
+	output := fs.String("o", "", "file to write to (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := backup.Write(ctx, store, w)
+	if err != nil {
+		return err
+	}
+	logger.Info("Backup finished", "documents", n)
+	return nil
+}
+
+// restoreBackup loads the documents of a dump back into storage. Documents that
+// still exist are left alone unless -overwrite is given, so restoring after
+// partial data loss doesn't undo newer edits.
+func restoreBackup(ctx context.Context, args []string) error {
+	fs := newFlagSet("restore")
+	overwrite := fs.Bool("overwrite", false, "replace documents that still exist with their backed up state")
+	dryRun := fs.Bool("dry-run", false, "list the documents that would be restored without saving them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: gopad restore [-overwrite] [-dry-run] <file>")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	store, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ttls := newTTLResolver(store, server.ConfigFromEnv().DefaultWorkspace)
+	var total, restored, skipped, failed int
+	err = backup.Read(f, func(id string, state *storage.DocumentState) error {
+		total++
+		current, err := store.LoadDocument(ctx, id)
+		if err != nil {
+			logger.Error("Error loading document", "doc_id", id, "error", err)
+			failed++
+			return nil
+		}
+		exists := current.Version > 0 || len(current.Tabs) > 0
+		if exists && !*overwrite {
+			skipped++
+			return nil
+		}
+		if *dryRun {
+			fmt.Println(id)
+			restored++
+			return nil
+		}
+		// Saved over whatever is stored now, expiring as its settings say from today
+		state.Version = current.Version
+		if state.Expiry, err = ttls.resolve(ctx, state); err != nil {
+			logger.Error("Error loading workspace policy", "doc_id", id, "error", err)
+			failed++
+			return nil
+		}
+		if err := store.SaveDocument(ctx, id, state); err != nil {
+			if errors.Is(err, storage.ErrVersionConflict) {
+				// A running server saved it in the meantime, so it's in use again
+				logger.Info("Document changed while restoring, skipping", "doc_id", id)
+				skipped++
+				return nil
+			}
+			logger.Error("Error saving document", "doc_id", id, "error", err)
+			failed++
+			return nil
+		}
+		// Keep listing pinned documents for the admin API
+		if state.Pinned {
+			if err := store.SetPinned(ctx, id, true); err != nil {
+				logger.Error("Error listing pinned document", "doc_id", id, "error", err)
+			}
+		}
+		restored++
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Restore finished", "documents", total, "restored", restored, "skipped", skipped, "failed", failed, "dry_run", *dryRun)
+	if failed > 0 {
+		return fmt.Errorf("%d documents could not be restored", failed)
+	}
+	return nil
+}
+
+// runLoadTest connects many viewers to a document on a running server, edits
+// it and prints how quickly the edits reached them
+func runLoadTest(ctx context.Context, args []string) error {
+	opts := loadtest.DefaultOptions()
+	fs := newFlagSet("loadtest")
+	fs.StringVar(&opts.URL, "url", opts.URL, "base URL of the server")
+	fs.StringVar(&opts.Doc, "doc", opts.Doc, "document to edit")
+	fs.IntVar(&opts.Viewers, "viewers", opts.Viewers, "number of viewer connections")
+	fs.IntVar(&opts.Edits, "edits", opts.Edits, "number of edits to send")
+	fs.DurationVar(&opts.Interval, "interval", opts.Interval, "pause between edits")
+	fs.IntVar(&opts.Size, "size", opts.Size, "bytes of content per edit")
+	fs.StringVar(&opts.Caps, "caps", opts.Caps, "capabilities the viewers advertise, such as compression,binary")
+	fs.DurationVar(&opts.Drain, "drain", opts.Drain, "how long to wait for the last edits")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	result, err := loadtest.Run(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+// ttlResolver works out the TTL documents get from their own settings and
+// their workspace's policy, loading each policy once
+type ttlResolver struct {
+	store            *storage.Storage
+	defaultWorkspace string
+	policies         map[string]*policy.Policy
+}
+
+func newTTLResolver(store *storage.Storage, defaultWorkspace string) *ttlResolver {
+	return &ttlResolver{store: store, defaultWorkspace: defaultWorkspace, policies: make(map[string]*policy.Policy)}
+}
+
+// resolve returns the document's TTL, or zero when nothing sets one
+func (r *ttlResolver) resolve(ctx context.Context, state *storage.DocumentState) (time.Duration, error) {
+	workspace := state.Workspace
+	if workspace == "" {
+		workspace = r.defaultWorkspace
+	}
+	p, cached := r.policies[workspace]
+	if !cached && workspace != "" {
+		var err error
+		if p, err = r.store.WorkspacePolicy(ctx, workspace); err != nil {
+			return 0, fmt.Errorf("workspace %s: %w", workspace, err)
+		}
+		r.policies[workspace] = p
+	}
+	var own policy.Settings
+	if state.Settings != nil {
+		own = *state.Settings
+	}
+	return time.Duration(p.Resolve(own).TTL), nil
+}
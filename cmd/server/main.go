@@ -1,909 +1,247 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"encoding/base64"
+	"flag"
 	"fmt"
-	"log"
-	"math/rand"
-	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
+	"github.com/shiftregister-vg/gopad/pkg/envelope"
 	"github.com/shiftregister-vg/gopad/pkg/logger"
-
-	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
+	"github.com/shiftregister-vg/gopad/pkg/mirror"
 	"github.com/shiftregister-vg/gopad/pkg/storage"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
-}
-
-var colorPalette = []string{
-	"#e57373", // Red
-	"#64b5f6", // Blue
-	"#81c784", // Green
-	"#ffd54f", // Yellow
-	"#ba68c8", // Purple
-	"#4db6ac", // Teal
-	"#ffb74d", // Orange
-	"#a1887f", // Brown
-	"#90a4ae", // Gray
-}
-var colorIndex = 0
-var colorMu sync.Mutex
-
-type Document struct {
-	ID           string
-	Content      string
-	Language     string
-	Users        map[string]*Client
-	clients      map[*Client]bool
-	broadcast    chan BroadcastMessage
-	register     chan *Client
-	unregister   chan *Client
-	lastModified int64 // unix timestamp (ms)
-	mu           sync.RWMutex
-	// Peer recovery additions:
-	waitingForState []*Client // clients waiting for state
-	Tabs            []Tab
-	ActiveTabId     string
-	usedColors      map[string]bool // Track used colors in this document
+// command is a gopad subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctx context.Context, args []string) error
 }
 
-type Tab struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Content string `json:"content"`
-	Notes   string `json:"notes"`
+var commands = []command{
+	{"serve", "serve [-port N] [-restore file]", "Run the server (the default when no command is given)", serve},
+	{"migrate", "migrate [-dry-run]", "Rewrite every stored document in the current format", migrateDocuments},
+	{"export", "export [-o file] <docID>", "Write a document's export as JSON", export},
+	{"purge-expired", "purge-expired [-max-age 168h] [-dry-run]", "Delete documents not modified within max-age", purgeExpired},
+	{"backup", "backup [-o file]", "Write every stored document to a backup tarball", backupDocuments},
+	{"restore", "restore [-overwrite] [-dry-run] <file>", "Load the documents of a backup tarball into storage", restoreBackup},
+	{"loadtest", "loadtest [-url URL] [-viewers N]", "Measure how fast a running server fans edits out to viewers", runLoadTest},
 }
 
-type Client struct {
-	conn           *websocket.Conn
-	docID          string
-	uuid           string
-	name           string
-	color          string
-	send           chan []byte
-	doc            *Document
-	disconnected   bool
-	disconnectedAt time.Time
-}
-
-type BroadcastMessage struct {
-	Sender  *Client
-	Message []byte
-}
-
-type UserListMessage struct {
-	Type  string                            `json:"type"`
-	Users map[string]map[string]interface{} `json:"users"` // name -> {name, color, disconnected}
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: gopad [command] [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-42s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'gopad <command> -h' for a command's flags. Settings are read from the environment, see README.md.\n")
 }
 
-var (
-	documents = make(map[string]*Document)
-	store     *storage.Storage
-)
-
 func main() {
-	// Initialize logger with LOG_LEVEL environment variable
-	logLevel := os.Getenv("LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = "INFO"
+	// Initialize logger from the LOG_* environment variables
+	if err := logger.Setup(logger.ConfigFromEnv()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize logger: %v\n", err)
+		os.Exit(1)
 	}
-	logger.Init(logLevel)
 
-	// Initialize Redis storage
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379/0"
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-	var err error
-	store, err = storage.New(redisURL)
-	if err != nil {
-		logger.Fatal("Failed to initialize storage", "error", err)
+	if name == "help" {
+		usage()
+		return
 	}
-	defer store.Close()
-
-	r := gin.Default()
 
-	// Check if we're in development mode
-	isDev := os.Getenv("GO_ENV") == "development"
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if isDev {
-		// In development, proxy all non-WebSocket requests to the React dev server
-		r.Use(func(c *gin.Context) {
-			if strings.ToLower(c.Request.Header.Get("Upgrade")) == "websocket" || c.Request.URL.Path == "/ws" {
-				if c.Request.URL.Path == "/ws" {
-					logger.Debug("WebSocket request handled", "path", c.Request.URL.Path)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(ctx, args); err != nil {
+				if err == flag.ErrHelp {
+					return
 				}
-				c.Next()
-				return
+				logger.Fatal("Command failed", "command", name, "error", err)
 			}
-			logger.Debug("Proxying request to React dev server", "path", c.Request.URL.Path)
-			// Proxy to React dev server
-			proxy := &http.Client{
-				Timeout: 10 * time.Second,
-			}
-			req, err := http.NewRequest(c.Request.Method, "http://localhost:3000"+c.Request.URL.Path, c.Request.Body)
-			if err != nil {
-				c.AbortWithError(http.StatusInternalServerError, err)
-				return
-			}
-			req.Header = c.Request.Header
-			resp, err := proxy.Do(req)
-			if err != nil {
-				c.AbortWithError(http.StatusInternalServerError, err)
-				return
-			}
-			defer resp.Body.Close()
-
-			// Copy response headers
-			for k, v := range resp.Header {
-				c.Writer.Header()[k] = v
-			}
-			c.Writer.WriteHeader(resp.StatusCode)
-			c.Writer.Write([]byte{}) // Flush headers
-			c.Writer.Flush()
-		})
-	} else {
-		// In production, serve static files
-		r.Static("/static", "./web/dist/static")
-		r.StaticFile("/", "./web/dist/index.html")
-		r.StaticFile("/index.html", "./web/dist/index.html")
-	}
-
-	// Debug endpoint to check document state
-	r.GET("/debug/doc/:id", func(c *gin.Context) {
-		docID := c.Param("id")
-		if doc, exists := documents[docID]; exists {
-			doc.mu.RLock()
-			content := doc.Content
-			users := make(map[string]string)
-			for name, client := range doc.Users {
-				users[name] = client.name
-			}
-			doc.mu.RUnlock()
-			c.JSON(200, gin.H{
-				"id":      docID,
-				"content": content,
-				"users":   users,
-			})
-		} else {
-			c.JSON(404, gin.H{"error": "document not found"})
+			return
 		}
-	})
-
-	// WebSocket endpoint
-	r.GET("/ws", handleWebSocket)
-
-	// SPA fallback: serve index.html for all other routes (only in production)
-	if !isDev {
-		r.NoRoute(func(c *gin.Context) {
-			c.File("./web/dist/index.html")
-		})
 	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-	// Start the server
-	port := "3030"
-	if os.Getenv("PORT") != "" {
-		port = os.Getenv("PORT")
-	}
-	log.Fatal(r.Run(fmt.Sprintf(":%s", port)))
+// newFlagSet creates the flag set for a subcommand
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("gopad "+name, flag.ContinueOnError)
 }
 
-// ensureMinimumTabs ensures there is always at least one tab in the document
-func (doc *Document) ensureMinimumTabs() {
-	if len(doc.Tabs) == 0 {
-		doc.Tabs = []Tab{
-			{
-				ID:      "1",
-				Name:    "Untitled",
-				Content: "",
-				Notes:   "",
-			},
-		}
-		doc.ActiveTabId = "1"
+// redisURL returns the Redis URL from REDIS_URL
+func redisURL() string {
+	if url := os.Getenv("REDIS_URL"); url != "" {
+		return url
 	}
+	return "redis://localhost:6379/0"
 }
 
-func getOrCreateDocument(docID string) *Document {
-	doc, exists := documents[docID]
-	if !exists {
-		// Try to load from storage
-		state, err := store.LoadDocument(docID)
-		if err != nil {
-			log.Printf("Error loading document state: %v", err)
-			state = &storage.DocumentState{
-				Content:      "",
-				Language:     "plaintext",
-				LastModified: time.Now().UnixMilli(),
-				Users:        make(map[string]string),
-				Version:      0,
-				Tabs: []storage.Tab{
-					{
-						ID:      "1",
-						Name:    "Untitled",
-						Content: "",
-						Notes:   "",
-					},
-				},
-				ActiveTabId: "1",
+// redisOptions returns how to connect to Redis beyond its URL: the mode from
+// REDIS_MODE (REDIS_CLUSTER_MODE=true still picks cluster mode), the
+// Sentinel master from REDIS_MASTER_NAME, TLS files from REDIS_TLS_CA_FILE,
+// REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE, pool and retry settings, and
+// the longest a command may take from REDIS_OPERATION_TIMEOUT
+func redisOptions() (storage.Options, error) {
+	opts := storage.Options{
+		Mode:             os.Getenv("REDIS_MODE"),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		TLSCAFile:        os.Getenv("REDIS_TLS_CA_FILE"),
+		TLSCertFile:      os.Getenv("REDIS_TLS_CERT_FILE"),
+		TLSKeyFile:       os.Getenv("REDIS_TLS_KEY_FILE"),
+		OperationTimeout: 5 * time.Second,
+		SlowOperation:    250 * time.Millisecond,
+	}
+	if opts.Mode == "" && os.Getenv("REDIS_CLUSTER_MODE") == "true" {
+		opts.Mode = storage.ModeCluster
+	}
+	for name, dst := range map[string]*int{
+		"REDIS_POOL_SIZE":        &opts.PoolSize,
+		"REDIS_MIN_IDLE_CONNS":   &opts.MinIdleConns,
+		"REDIS_CONNECT_ATTEMPTS": &opts.ConnectAttempts,
+	} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid %s: %q", name, v)
 			}
+			*dst = n
 		}
-
-		doc = &Document{
-			ID:           docID,
-			Content:      state.Content,
-			Language:     state.Language,
-			Users:        make(map[string]*Client),
-			clients:      make(map[*Client]bool),
-			broadcast:    make(chan BroadcastMessage),
-			register:     make(chan *Client),
-			unregister:   make(chan *Client),
-			lastModified: state.LastModified,
-			Tabs:         make([]Tab, len(state.Tabs)),
-			ActiveTabId:  state.ActiveTabId,
-			usedColors:   make(map[string]bool),
+	}
+	if v := os.Getenv("REDIS_MAX_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < -1 {
+			return opts, fmt.Errorf("invalid REDIS_MAX_RETRIES: %q", v)
 		}
-		// Convert storage.Tabs to Document.Tabs
-		for i, t := range state.Tabs {
-			doc.Tabs[i] = Tab{
-				ID:      t.ID,
-				Name:    t.Name,
-				Content: t.Content,
-				Notes:   t.Notes,
+		opts.MaxRetries = n
+	}
+	for name, dst := range map[string]*time.Duration{
+		"REDIS_MIN_RETRY_BACKOFF": &opts.MinRetryBackoff,
+		"REDIS_MAX_RETRY_BACKOFF": &opts.MaxRetryBackoff,
+		"REDIS_OPERATION_TIMEOUT": &opts.OperationTimeout,
+		"REDIS_SLOW_OPERATION":    &opts.SlowOperation,
+	} {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return opts, fmt.Errorf("invalid %s: %q", name, v)
 			}
+			*dst = d
 		}
-		doc.ensureMinimumTabs() // Ensure minimum tabs after loading
-		documents[docID] = doc
-		go doc.broadcastMessages()
-
-		// Subscribe to Redis updates for this document
-		go func() {
-			err := store.SubscribeToUpdates(docID, func(update *storage.DocumentState) {
-				doc.mu.Lock()
-				// Only apply update if it's newer than our current state
-				if update.Version > doc.lastModified {
-					doc.Content = update.Content
-					doc.Language = update.Language
-					doc.lastModified = update.LastModified
-					doc.ActiveTabId = update.ActiveTabId
-
-					// Update tabs
-					doc.Tabs = make([]Tab, len(update.Tabs))
-					for i, t := range update.Tabs {
-						doc.Tabs[i] = Tab{
-							ID:      t.ID,
-							Name:    t.Name,
-							Content: t.Content,
-							Notes:   t.Notes,
-						}
-					}
-
-					// Update users
-					for uuid, name := range update.Users {
-						if client, exists := doc.Users[uuid]; exists {
-							client.name = name
-						}
-					}
-					doc.mu.Unlock()
-
-					// Broadcast update to all clients
-					updateMsg := map[string]interface{}{
-						"type":         "update",
-						"tabs":         doc.Tabs,
-						"activeTabId":  doc.ActiveTabId,
-						"language":     update.Language,
-						"lastModified": update.LastModified,
-					}
-					jsonMsg, err := json.Marshal(updateMsg)
-					if err == nil {
-						doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-					}
-				} else {
-					doc.mu.Unlock()
-				}
-			})
-			if err != nil {
-				log.Printf("Error subscribing to updates for doc %s: %v", docID, err)
-			}
-		}()
 	}
-	return doc
+	return opts, nil
 }
 
-func handleWebSocket(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+// openStorage connects to Redis, enabling encryption at rest when ENCRYPTION_MASTER_KEY is set
+// and pub/sub sharding when PUBSUB_SHARDS is, and keeping deleted documents for TRASH_TTL
+func openStorage(ctx context.Context) (*storage.Storage, error) {
+	opts, err := redisOptions()
 	if err != nil {
-		log.Println(err)
-		return
-	}
-	docID := c.Query("doc")
-	if docID == "" {
-		docID = "default"
+		return nil, err
 	}
-	logger.Debug("New client connected to document", "doc_id", docID)
-	doc := getOrCreateDocument(docID)
-	client := &Client{
-		conn:  conn,
-		docID: docID,
-		send:  make(chan []byte, 256),
-		doc:   doc,
-	}
-	// Peer recovery: if doc has no state, queue client and request state from others
-	doc.mu.Lock()
-	noState := doc.Content == "" && len(doc.Users) == 0
-	if noState && len(doc.clients) > 0 {
-		doc.waitingForState = append(doc.waitingForState, client)
-		doc.mu.Unlock()
-		// Ask existing clients for state
-		requestMsg := map[string]interface{}{"type": "requestState"}
-		jsonMsg, _ := json.Marshal(requestMsg)
-		for c := range doc.clients {
-			c.send <- jsonMsg
-		}
-	} else {
-		// Send initial document state to the new client
-		initialState := map[string]interface{}{
-			"type":         "init",
-			"content":      doc.Content,
-			"tabs":         doc.Tabs,
-			"activeTabId":  doc.ActiveTabId,
-			"language":     doc.Language,
-			"lastModified": doc.lastModified,
-			"users":        doc.Users,
-		}
-		logger.Debug("Sending initial state to client", "state", initialState)
-		if err := conn.WriteJSON(initialState); err != nil {
-			log.Printf("error sending initial state: %v", err)
-			conn.Close()
-			return
-		}
-		doc.mu.Unlock()
+	store, err := storage.New(ctx, redisURL(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
 	}
-	doc.register <- client
-	// Start goroutines for reading and writing
-	go client.writePump()
-	go client.readPump()
-}
 
-func (c *Client) readPump() {
-	defer func() {
-		// Mark as disconnected, broadcast, and schedule removal
-		c.doc.mu.Lock()
-		if c.uuid != "" {
-			c.disconnected = true
-			c.disconnectedAt = time.Now()
-			// Remove the color from used colors if this is the last client using it
-			if c.color != "" {
-				stillInUse := false
-				for _, otherClient := range c.doc.Users {
-					if otherClient != c && otherClient.color == c.color {
-						stillInUse = true
-						break
-					}
-				}
-				if !stillInUse {
-					delete(c.doc.usedColors, c.color)
-				}
-			}
-		}
-		c.doc.mu.Unlock()
-		c.doc.broadcastUserList()
-		go func(client *Client) {
-			time.Sleep(2 * time.Minute)
-			client.doc.mu.Lock()
-			// Only remove if still disconnected and no reconnection has occurred
-			if client.disconnected && time.Since(client.disconnectedAt) >= 2*time.Minute {
-				// Check if this client is still in the Users map and hasn't reconnected
-				if existingClient, exists := client.doc.Users[client.uuid]; exists && existingClient == client {
-					delete(client.doc.Users, client.uuid)
-					client.doc.mu.Unlock()
-					client.doc.broadcastUserList()
-				} else {
-					client.doc.mu.Unlock()
-				}
-			} else {
-				client.doc.mu.Unlock()
-			}
-		}(c)
-		c.doc.unregister <- c
-		c.conn.Close()
-		log.Printf("Client disconnected from document: %s", c.docID)
-	}()
-	for {
-		_, message, err := c.conn.ReadMessage()
+	// Encrypt documents at rest with per-document keys when a master key is configured
+	if masterKey := os.Getenv("ENCRYPTION_MASTER_KEY"); masterKey != "" {
+		key, err := base64.StdEncoding.DecodeString(masterKey)
 		if err != nil {
-			logger.Debug("WebSocket read error for doc %s: %v", c.docID, err)
-			break
-		}
-		logger.Debug("Received message from client", "doc_id", c.docID, "message", string(message))
-		// Parse the message
-		var msg map[string]interface{}
-		if err := json.Unmarshal(message, &msg); err != nil {
-			logger.Debug("Error parsing message as JSON", "error", err)
-			continue
-		}
-		logger.Debug("Received message from client", "message", string(message))
-
-		// Handle different message types
-		msgType, ok := msg["type"].(string)
-		if !ok {
-			logger.Debug("Message missing type field")
-			continue
-		}
-
-		switch msgType {
-		case "setName":
-			if name, ok := msg["name"].(string); ok {
-				uuid, _ := msg["uuid"].(string)
-				c.doc.mu.Lock()
-				c.uuid = uuid
-				oldClient, exists := c.doc.Users[uuid]
-				if exists && oldClient != c {
-					// If old client is disconnected, replace with new client
-					if oldClient.disconnected {
-						c.color = oldClient.color
-					}
-					// Remove old client from clients map and close its send channel
-					if _, ok := c.doc.clients[oldClient]; ok {
-						delete(c.doc.clients, oldClient)
-						close(oldClient.send)
-					}
-				}
-				c.name = name
-				if c.color == "" {
-					// Get a new color for this client
-					c.color = c.doc.getNextAvailableColor()
-					logger.Debug("Assigned color to user", "color", c.color, "name", name)
-				}
-				c.disconnected = false
-				c.disconnectedAt = time.Time{}
-				c.doc.Users[uuid] = c
-				c.doc.mu.Unlock()
-				c.doc.broadcastUserList()
-			}
-		case "setLanguage":
-			if lang, ok := msg["language"].(string); ok {
-				c.doc.mu.Lock()
-				c.doc.Language = lang
-				c.doc.mu.Unlock()
-				langMsg := map[string]interface{}{
-					"type":     "language",
-					"language": lang,
-				}
-				jsonMsg, err := json.Marshal(langMsg)
-				if err != nil {
-					logger.Debug("Error marshaling language message", "error", err)
-					continue
-				}
-				c.doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-			}
-		case "language":
-			if lang, ok := msg["language"].(string); ok {
-				c.doc.mu.Lock()
-				c.doc.Language = lang
-				c.doc.mu.Unlock()
-				langMsg := map[string]interface{}{
-					"type":     "language",
-					"language": lang,
-				}
-				jsonMsg, err := json.Marshal(langMsg)
-				if err != nil {
-					logger.Debug("Error marshaling language message", "error", err)
-					continue
-				}
-				c.doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-			}
-		case "update":
-			if tabId, ok := msg["tabId"].(string); ok {
-				if content, ok := msg["content"].(string); ok {
-					c.doc.mu.Lock()
-					// Update the tab content
-					for i, tab := range c.doc.Tabs {
-						if tab.ID == tabId {
-							c.doc.Tabs[i].Content = content
-							break
-						}
-					}
-					c.doc.mu.Unlock()
-
-					broadcastMsg := map[string]interface{}{
-						"type":    "update",
-						"tabId":   tabId,
-						"content": content,
-					}
-					jsonMsg, err := json.Marshal(broadcastMsg)
-					if err != nil {
-						logger.Debug("Error marshaling update message", "error", err)
-						continue
-					}
-					c.doc.broadcast <- BroadcastMessage{Sender: c, Message: jsonMsg}
-
-					// Save state after update
-					if err := c.doc.saveState(); err != nil {
-						logger.Error("Error saving document state", "error", err)
-					}
-				}
-			}
-		case "cursor":
-			// Broadcast cursor/selection update to all other clients
-			c.doc.broadcast <- BroadcastMessage{Sender: c, Message: message}
-		case "tabCreate":
-			if tab, ok := msg["tab"].(map[string]interface{}); ok {
-				c.doc.mu.Lock()
-				newTab := Tab{
-					ID:      tab["id"].(string),
-					Name:    tab["name"].(string),
-					Content: tab["content"].(string),
-					Notes:   tab["notes"].(string),
-				}
-				c.doc.Tabs = append(c.doc.Tabs, newTab)
-				c.doc.mu.Unlock()
-
-				msg := map[string]interface{}{
-					"type": "tabCreate",
-					"tab":  newTab,
-				}
-				jsonMsg, err := json.Marshal(msg)
-				if err != nil {
-					logger.Debug("Error marshaling tabCreate message", "error", err)
-					continue
-				}
-				c.doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-
-				// Also broadcast tabFocus for the new tab
-				focusMsg := map[string]interface{}{
-					"type":  "tabFocus",
-					"tabId": newTab.ID,
-				}
-				focusJson, err := json.Marshal(focusMsg)
-				if err == nil {
-					c.doc.broadcast <- BroadcastMessage{Sender: nil, Message: focusJson}
-				}
-
-				// Save state after creating tab
-				if err := c.doc.saveState(); err != nil {
-					logger.Error("Error saving document state", "error", err)
-				}
-			}
-		case "tabDelete":
-			if tabId, ok := msg["tabId"].(string); ok {
-				c.doc.mu.Lock()
-				// Find and remove the tab
-				for i, tab := range c.doc.Tabs {
-					if tab.ID == tabId {
-						c.doc.Tabs = append(c.doc.Tabs[:i], c.doc.Tabs[i+1:]...)
-						break
-					}
-				}
-				// If we deleted the active tab, set active tab to the first tab
-				if c.doc.ActiveTabId == tabId {
-					if len(c.doc.Tabs) > 0 {
-						c.doc.ActiveTabId = c.doc.Tabs[0].ID
-					}
-				}
-				c.doc.ensureMinimumTabs() // Ensure we still have at least one tab
-				c.doc.mu.Unlock()
-
-				// Broadcast the updated tab list and active tab
-				updateMsg := map[string]interface{}{
-					"type":        "tabUpdate",
-					"tabs":        c.doc.Tabs,
-					"activeTabId": c.doc.ActiveTabId,
-				}
-				jsonMsg, err := json.Marshal(updateMsg)
-				if err == nil {
-					c.doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-				}
-
-				// Save state after deleting tab
-				if err := c.doc.saveState(); err != nil {
-					logger.Error("Error saving document state", "error", err)
-				}
-			}
-		case "tabFocus":
-			if tabId, ok := msg["tabId"].(string); ok {
-				c.doc.mu.Lock()
-				c.doc.ActiveTabId = tabId
-				c.doc.mu.Unlock()
-
-				msg := map[string]interface{}{
-					"type":  "tabFocus",
-					"tabId": tabId,
-				}
-				jsonMsg, err := json.Marshal(msg)
-				if err != nil {
-					logger.Debug("Error marshaling tabFocus message", "error", err)
-					continue
-				}
-				c.doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-
-				// Save state after changing active tab
-				if err := c.doc.saveState(); err != nil {
-					logger.Error("Error saving document state", "error", err)
-				}
-			}
-		case "tabRename":
-			if tabId, ok := msg["tabId"].(string); ok {
-				if name, ok := msg["name"].(string); ok {
-					c.doc.mu.Lock()
-					// Update the tab name
-					for i, tab := range c.doc.Tabs {
-						if tab.ID == tabId {
-							c.doc.Tabs[i].Name = name
-							break
-						}
-					}
-					c.doc.mu.Unlock()
-
-					// Send a tabUpdate message with the complete tab state
-					updateMsg := map[string]interface{}{
-						"type":        "tabUpdate",
-						"tabs":        c.doc.Tabs,
-						"activeTabId": c.doc.ActiveTabId,
-					}
-					jsonMsg, err := json.Marshal(updateMsg)
-					if err != nil {
-						logger.Debug("Error marshaling tabUpdate message", "error", err)
-						continue
-					}
-					c.doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-
-					// Save state after renaming tab
-					if err := c.doc.saveState(); err != nil {
-						logger.Error("Error saving document state", "error", err)
-					}
-				}
-			}
-		case "requestState":
-			// Ignore: only sent by server
-		case "fullState":
-			// Only accept if there are clients waiting for state
-			doc := c.doc
-			doc.mu.Lock()
-			waiting := doc.waitingForState
-			doc.waitingForState = nil
-			doc.mu.Unlock()
-			if len(waiting) > 0 {
-				// Change type to 'init' before sending
-				var state map[string]interface{}
-				if err := json.Unmarshal(message, &state); err == nil {
-					state["type"] = "init"
-					initMsg, _ := json.Marshal(state)
-					for _, waitingClient := range waiting {
-						if waitingClient.conn != nil {
-							waitingClient.conn.WriteMessage(websocket.TextMessage, initMsg)
-						}
-					}
-				}
-			}
-		case "tabNotesUpdate":
-			if tabId, ok := msg["tabId"].(string); ok {
-				if notes, ok := msg["notes"].(string); ok {
-					c.doc.mu.Lock()
-					for i, tab := range c.doc.Tabs {
-						if tab.ID == tabId {
-							c.doc.Tabs[i].Notes = notes
-							break
-						}
-					}
-					c.doc.mu.Unlock()
-
-					// Broadcast to all clients
-					broadcastMsg := map[string]interface{}{
-						"type":  "tabNotesUpdate",
-						"tabId": tabId,
-						"notes": notes,
-					}
-					jsonMsg, err := json.Marshal(broadcastMsg)
-					if err == nil {
-						c.doc.broadcast <- BroadcastMessage{Sender: c, Message: jsonMsg}
-					}
-
-					// Save state after update
-					if err := c.doc.saveState(); err != nil {
-						logger.Error("Error saving document state", "error", err)
-					}
-				}
-			}
+			store.Close()
+			return nil, fmt.Errorf("invalid ENCRYPTION_MASTER_KEY: %w", err)
 		}
-	}
-}
-
-func (c *Client) writePump() {
-	defer func() {
-		c.conn.Close()
-	}()
-	for message := range c.send {
-		if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			logger.Error("Failed to send message to client", "error", err)
-			return
+		wrapper, err := envelope.NewLocalKeyWrapper(key)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("invalid ENCRYPTION_MASTER_KEY: %w", err)
 		}
-		logger.Debug("Message sent to client")
+		store.EnableEncryption(wrapper)
 	}
-}
 
-func (doc *Document) broadcastMessages() {
-	defer func() {
-		if r := recover(); r != nil {
-			logger.Error("Recovered from panic in broadcastMessages", "error", r)
-		}
-	}()
-	for {
-		select {
-		case client := <-doc.register:
-			doc.clients[client] = true
-			doc.mu.RLock()
-			initialState := map[string]interface{}{
-				"type":         "init",
-				"content":      doc.Content,
-				"tabs":         doc.Tabs,
-				"activeTabId":  doc.ActiveTabId,
-				"language":     doc.Language,
-				"lastModified": doc.lastModified,
-				"users":        doc.Users,
-			}
-			doc.mu.RUnlock()
-			client.conn.WriteJSON(initialState)
-			logger.Debug("Client registered", "doc_id", doc.ID, "total_clients", len(doc.clients))
-		case client := <-doc.unregister:
-			doc.mu.Lock()
-			if client.uuid != "" {
-				client.disconnected = true
-				client.disconnectedAt = time.Now()
-				// Remove the color from used colors if this is the last client using it
-				if client.color != "" {
-					stillInUse := false
-					for _, otherClient := range doc.Users {
-						if otherClient != client && otherClient.color == client.color {
-							stillInUse = true
-							break
-						}
-					}
-					if !stillInUse {
-						delete(doc.usedColors, client.color)
-					}
-				}
-			}
-			doc.mu.Unlock()
-			logger.Debug("Client unregistered", "doc_id", doc.ID, "total_clients", len(doc.clients))
-		case bmsg := <-doc.broadcast:
-			var msgType string
-			var msgObj map[string]interface{}
-			if err := json.Unmarshal(bmsg.Message, &msgObj); err == nil {
-				if t, ok := msgObj["type"].(string); ok {
-					msgType = t
-				}
+	// Keep large tab contents out of Redis when a blob store is configured
+	if blobs := offloadStoreFromEnv(); blobs != nil {
+		threshold := 256 * 1024
+		if v := os.Getenv("OFFLOAD_THRESHOLD"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				store.Close()
+				return nil, fmt.Errorf("invalid OFFLOAD_THRESHOLD: %q", v)
 			}
-
-			// Save state after certain message types
-			if msgType == "update" || msgType == "language" {
-				if err := doc.saveState(); err != nil {
-					logger.Error("Error saving document state", "error", err)
-				}
-			}
-
-			for client := range doc.clients {
-				if client == bmsg.Sender && msgType == "update" {
-					logger.Debug("Skipping sender for update message")
-					continue
-				}
-				select {
-				case client.send <- bmsg.Message:
-					logger.Debug("Message sent to client")
-				default:
-					logger.Error("Client buffer full or dead, removing client")
-					delete(doc.clients, client)
-					close(client.send)
-				}
+			threshold = n
+		}
+		cacheSize := 64 << 20
+		if v := os.Getenv("OFFLOAD_CACHE_SIZE"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				store.Close()
+				return nil, fmt.Errorf("invalid OFFLOAD_CACHE_SIZE: %q", v)
 			}
+			cacheSize = n
 		}
+		store.EnableOffload(blobs, threshold, cacheSize)
 	}
-}
 
-func (doc *Document) broadcastUserList() {
-	userList := make(map[string]map[string]interface{})
-	doc.mu.RLock()
-	for uuid, client := range doc.Users {
-		userList[uuid] = map[string]interface{}{
-			"uuid":         client.uuid,
-			"name":         client.name,
-			"color":        client.color,
-			"disconnected": client.disconnected,
+	// Keep deleted documents restorable for TRASH_TTL, or delete them right away with 0
+	if v := os.Getenv("TRASH_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			store.Close()
+			return nil, fmt.Errorf("invalid TRASH_TTL: %q", v)
 		}
+		store.SetTrashTTL(ttl)
 	}
-	doc.mu.RUnlock()
-	userListMsg := UserListMessage{
-		Type:  "userList",
-		Users: userList,
-	}
-	jsonMsg, err := json.Marshal(userListMsg)
-	if err != nil {
-		log.Printf("Error marshaling user list: %v", err)
-		return
-	}
-	doc.broadcast <- BroadcastMessage{Sender: nil, Message: jsonMsg}
-}
 
-func (doc *Document) saveState() error {
-	state := &storage.DocumentState{
-		Content:      doc.Content,
-		Language:     doc.Language,
-		LastModified: doc.lastModified,
-		Users:        make(map[string]string),
-		Tabs:         make([]storage.Tab, len(doc.Tabs)),
-		ActiveTabId:  doc.ActiveTabId,
-	}
-
-	doc.mu.RLock()
-	for uuid, client := range doc.Users {
-		state.Users[uuid] = client.name
-	}
-	// Convert Document.Tabs to storage.Tabs
-	for i, t := range doc.Tabs {
-		state.Tabs[i] = storage.Tab{
-			ID:      t.ID,
-			Name:    t.Name,
-			Content: t.Content,
-			Notes:   t.Notes,
+	// Multiplex document notifications over a fixed set of channels on busy deployments
+	if v := os.Getenv("PUBSUB_SHARDS"); v != "" {
+		shards, err := strconv.Atoi(v)
+		if err != nil || shards < 0 {
+			store.Close()
+			return nil, fmt.Errorf("invalid PUBSUB_SHARDS: %q", v)
 		}
-	}
-	doc.mu.RUnlock()
-
-	return store.SaveDocument(doc.ID, state)
-}
-
-// getNextAvailableColor returns a random available color from the palette that isn't used in this document
-// Note: Caller must hold doc.mu.Lock()
-func (doc *Document) getNextAvailableColor() string {
-	logger.Debug("Getting next available color",
-		"used_colors", doc.usedColors,
-		"users", doc.Users)
-
-	// First, check which colors are actually in use by active users
-	activeColors := make(map[string]bool)
-	for _, client := range doc.Users {
-		if client.color != "" {
-			activeColors[client.color] = true
+		if shards > 0 {
+			store.EnableSharding(shards)
 		}
 	}
-	logger.Debug("Active colors", "colors", activeColors)
+	return store, nil
+}
 
-	// Create a slice of available colors
-	var availableColors []string
-	for _, color := range colorPalette {
-		if !activeColors[color] {
-			availableColors = append(availableColors, color)
+// offloadStoreFromEnv returns the blob store configured for large tab
+// contents: an S3 bucket, using the same AWS credentials as the mirror, or a
+// local directory. It returns nil when neither is set.
+func offloadStoreFromEnv() storage.BlobStore {
+	if bucket := os.Getenv("OFFLOAD_S3_BUCKET"); bucket != "" {
+		region := os.Getenv("OFFLOAD_S3_REGION")
+		if region == "" {
+			region = "us-east-1"
 		}
+		return mirror.NewS3(mirror.S3Config{
+			Bucket:       bucket,
+			Region:       region,
+			Endpoint:     os.Getenv("OFFLOAD_S3_ENDPOINT"),
+			Prefix:       os.Getenv("OFFLOAD_S3_PREFIX"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		})
 	}
-
-	// If we have available colors, randomly select one
-	if len(availableColors) > 0 {
-		selectedColor := availableColors[rand.Intn(len(availableColors))]
-		doc.usedColors[selectedColor] = true
-		logger.Debug("Selected new color", "color", selectedColor)
-		return selectedColor
+	if dir := os.Getenv("OFFLOAD_DIR"); dir != "" {
+		return mirror.NewDir(dir)
 	}
-
-	// If all colors are used, randomly select from all colors
-	// This is a fallback that should rarely happen
-	logger.Debug("All colors used, selecting from all colors")
-	selectedColor := colorPalette[rand.Intn(len(colorPalette))]
-	doc.usedColors[selectedColor] = true
-	logger.Debug("Selected reused color", "color", selectedColor)
-	return selectedColor
-}
-
-func init() {
-	// Initialize random seed
-	rand.Seed(time.Now().UnixNano())
+	return nil
 }
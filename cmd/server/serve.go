@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/backup"
+	"github.com/shiftregister-vg/gopad/pkg/gitbackup"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/mirror"
+	"github.com/shiftregister-vg/gopad/pkg/presence"
+	"github.com/shiftregister-vg/gopad/pkg/server"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/tracing"
+)
+
+// serve runs the server until ctx is cancelled
+func serve(ctx context.Context, args []string) error {
+	fs := newFlagSet("serve")
+	defaultPort := "3030"
+	if os.Getenv("PORT") != "" {
+		defaultPort = os.Getenv("PORT")
+	}
+	port := fs.String("port", defaultPort, "port to listen on (env PORT)")
+	restore := fs.String("restore", "", "load documents from a recovery file written by POST /admin/recovery-snapshot before serving")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Export traces when an OTLP endpoint is configured
+	if tracing.Enabled() {
+		shutdown, err := tracing.Init(ctx, "gopad")
+		if err != nil {
+			return fmt.Errorf("failed to initialize tracing: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				logger.Error("Failed to flush traces", "error", err)
+			}
+		}()
+	}
+
+	store, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// Also commit saved documents to git when a backup directory is configured
+	var backend server.Store = store
+	if dir := os.Getenv("GIT_BACKUP_DIR"); dir != "" {
+		interval, _ := time.ParseDuration(os.Getenv("GIT_BACKUP_INTERVAL"))
+		backup, err := gitbackup.New(ctx, store, gitbackup.Config{
+			Dir:      dir,
+			Remote:   os.Getenv("GIT_BACKUP_REMOTE"),
+			Branch:   os.Getenv("GIT_BACKUP_BRANCH"),
+			Interval: interval,
+		})
+		if err != nil {
+			return err
+		}
+		// Deferred after store.Close, so it runs first and commits the final saves
+		defer backup.Stop()
+		backend = backup
+	}
+
+	// Dump every document on a schedule when a backup directory or bucket is configured
+	if scheduler := backup.Start(store, backupConfigFromEnv()); scheduler != nil {
+		defer scheduler.Stop()
+	}
+
+	srv, err := server.New(server.ConfigFromEnv(), backend)
+	if err != nil {
+		return err
+	}
+
+	// Share presence between instances unless it's configured to stay in memory
+	if os.Getenv("PRESENCE_BACKEND") != "memory" {
+		opts, err := redisOptions()
+		if err != nil {
+			return err
+		}
+		client, err := storage.Connect(ctx, redisURL(), opts)
+		if err != nil {
+			return fmt.Errorf("failed to initialize presence: %w", err)
+		}
+		defer client.Close()
+		srv.UsePresence(presence.NewRedis(client))
+	}
+
+	// Bring back documents, unsaved changes included, from before an emergency restart
+	if *restore != "" {
+		if _, err := srv.Restore(*restore); err != nil {
+			return fmt.Errorf("failed to restore documents: %w", err)
+		}
+	}
+
+	// Terminate TLS ourselves when a certificate or autocert domain is configured
+	addr := fmt.Sprintf(":%s", *port)
+	if settings := tlsSettingsFromEnv(); settings.enabled() {
+		tlsConfig, redirect, err := settings.config()
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		if settings.redirectAddr != "" {
+			go runRedirect(ctx, settings.redirectAddr, redirect)
+		}
+		err = srv.RunTLS(ctx, addr, tlsConfig)
+		if err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+
+	// Start the server
+	if err := srv.Run(ctx, addr); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// backupConfigFromEnv reads the scheduled backup settings from the BACKUP_*
+// variables, using the same AWS credentials as the mirror
+func backupConfigFromEnv() backup.Config {
+	interval, _ := time.ParseDuration(os.Getenv("BACKUP_INTERVAL"))
+	keep, _ := strconv.Atoi(os.Getenv("BACKUP_KEEP"))
+	config := backup.Config{
+		Interval: interval,
+		Dir:      os.Getenv("BACKUP_DIR"),
+		Keep:     keep,
+		S3: mirror.S3Config{
+			Bucket:       os.Getenv("BACKUP_S3_BUCKET"),
+			Region:       os.Getenv("BACKUP_S3_REGION"),
+			Endpoint:     os.Getenv("BACKUP_S3_ENDPOINT"),
+			Prefix:       os.Getenv("BACKUP_S3_PREFIX"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	if config.S3.Region == "" {
+		config.S3.Region = "us-east-1"
+	}
+	return config
+}
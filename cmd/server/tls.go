@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsSettings configures built-in TLS termination
+type tlsSettings struct {
+	certFile       string // TLS_CERT
+	keyFile        string // TLS_KEY
+	autocertDomain string // TLS_AUTOCERT_DOMAIN, obtains certificates from Let's Encrypt
+	autocertCache  string // TLS_AUTOCERT_CACHE, directory certificates are kept in
+	redirectAddr   string // TLS_REDIRECT_ADDR, plain HTTP listener redirecting to HTTPS
+}
+
+// tlsSettingsFromEnv reads the TLS_* environment variables
+func tlsSettingsFromEnv() tlsSettings {
+	settings := tlsSettings{
+		certFile:       os.Getenv("TLS_CERT"),
+		keyFile:        os.Getenv("TLS_KEY"),
+		autocertDomain: os.Getenv("TLS_AUTOCERT_DOMAIN"),
+		autocertCache:  os.Getenv("TLS_AUTOCERT_CACHE"),
+		redirectAddr:   ":80",
+	}
+	if settings.autocertCache == "" {
+		settings.autocertCache = "./certs"
+	}
+	if addr, ok := os.LookupEnv("TLS_REDIRECT_ADDR"); ok {
+		settings.redirectAddr = addr
+	}
+	return settings
+}
+
+// enabled reports whether the server should terminate TLS itself
+func (t tlsSettings) enabled() bool {
+	return t.certFile != "" || t.autocertDomain != ""
+}
+
+// config builds the TLS configuration and the handler for the plain HTTP
+// listener, which answers ACME challenges when autocert is used and
+// otherwise redirects to HTTPS
+func (t tlsSettings) config() (*tls.Config, http.Handler, error) {
+	if t.autocertDomain != "" {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(t.autocertDomain),
+			Cache:      autocert.DirCache(t.autocertCache),
+		}
+		return manager.TLSConfig(), manager.HTTPHandler(http.HandlerFunc(redirectToHTTPS)), nil
+	}
+	if t.keyFile == "" {
+		return nil, nil, errors.New("TLS_CERT is set but TLS_KEY is not")
+	}
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return config, http.HandlerFunc(redirectToHTTPS), nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// runRedirect serves handler on addr until ctx is cancelled
+func runRedirect(ctx context.Context, addr string, handler http.Handler) {
+	redirect := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		redirect.Shutdown(shutdownCtx)
+	}()
+	if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error("HTTP redirect listener stopped", "addr", addr, "error", err)
+	}
+}
@@ -0,0 +1,130 @@
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Code identifies a class of error that callers can branch on
+type Code string
+
+// Error codes shared by storage, the document hub and the HTTP API
+const (
+	CodeInternal      Code = "INTERNAL"
+	CodeNotFound      Code = "NOT_FOUND"
+	CodeConflict      Code = "CONFLICT"
+	CodeUnauthorized  Code = "UNAUTHORIZED"
+	CodeForbidden     Code = "FORBIDDEN"
+	CodeValidation    Code = "VALIDATION"
+	CodeLimitExceeded Code = "LIMIT_EXCEEDED"
+	CodeUnavailable   Code = "UNAVAILABLE"
+
+	// Codes sent in WebSocket error frames when a client message is rejected
+	CodeInvalidMessage  Code = "INVALID_MESSAGE"
+	CodeInvalidTab      Code = "INVALID_TAB"
+	CodeVersionConflict Code = "VERSION_CONFLICT"
+	CodeDocLocked       Code = "DOC_LOCKED"
+	CodeRateLimited     Code = "RATE_LIMITED"
+	CodeBanned          Code = "BANNED"
+)
+
+// httpStatus maps each code to the HTTP status used by the API
+var httpStatus = map[Code]int{
+	CodeInternal:      http.StatusInternalServerError,
+	CodeNotFound:      http.StatusNotFound,
+	CodeConflict:      http.StatusConflict,
+	CodeUnauthorized:  http.StatusUnauthorized,
+	CodeForbidden:     http.StatusForbidden,
+	CodeValidation:    http.StatusBadRequest,
+	CodeLimitExceeded: http.StatusRequestEntityTooLarge,
+	CodeUnavailable:   http.StatusServiceUnavailable,
+
+	CodeInvalidMessage:  http.StatusBadRequest,
+	CodeInvalidTab:      http.StatusNotFound,
+	CodeVersionConflict: http.StatusConflict,
+	CodeDocLocked:       http.StatusLocked,
+	CodeRateLimited:     http.StatusTooManyRequests,
+	CodeBanned:          http.StatusForbidden,
+}
+
+// Error is an error carrying a machine-readable code
+type Error struct {
+	Code    Code
+	Message string
+	Err     error
+
+	// format and args are the unformatted message, kept so it can be translated
+	format string
+	args   []any
+}
+
+// New creates an error with the given code and message
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message, format: message}
+}
+
+// Newf creates an error with the given code and a formatted message
+func Newf(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), format: format, args: args}
+}
+
+// Wrap attaches a code and message to an underlying error
+func Wrap(code Code, err error, message string) *Error {
+	return &Error{Code: code, Message: message, Err: err, format: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error with the same code, so sentinel
+// errors can be matched with errors.Is regardless of their message
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// CodeOf returns the code of the first *Error in err's chain, or CodeInternal
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+// MessageOf returns a message that is safe to show to users.
+// Errors without a code are reported generically so internals don't leak.
+func MessageOf(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return "internal error"
+}
+
+// TemplateOf returns the unformatted message and arguments of the first *Error in
+// err's chain, falling back to the generic message used by MessageOf
+func TemplateOf(err error) (string, []any) {
+	var e *Error
+	if errors.As(err, &e) && e.format != "" {
+		return e.format, e.args
+	}
+	return MessageOf(err), nil
+}
+
+// HTTPStatus returns the HTTP status matching err's code
+func HTTPStatus(err error) int {
+	if status, ok := httpStatus[CodeOf(err)]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
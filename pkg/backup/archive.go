@@ -0,0 +1,34 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// Documents about to expire are archived one file each, in the format of a
+// dump's entries, so they can be restored after Redis dropped them.
+
+// ArchiveName returns the name of a document's archive file
+func ArchiveName(docID string) string {
+	return "archive/" + entryName(docID)
+}
+
+// EncodeArchive returns the archive file of a document
+func EncodeArchive(docID string, state *storage.DocumentState) ([]byte, error) {
+	return json.Marshal(entry{ID: docID, State: state})
+}
+
+// DecodeArchive reads an archive file written by EncodeArchive
+func DecodeArchive(data []byte) (string, *storage.DocumentState, error) {
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return "", nil, fmt.Errorf("not an archive file: %w", err)
+	}
+	if e.ID == "" || e.State == nil {
+		return "", nil, errors.New("archive file holds no document")
+	}
+	return e.ID, e.State, nil
+}
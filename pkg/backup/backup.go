@@ -0,0 +1,285 @@
+// Package backup dumps every stored document to a gzipped tarball and reads
+// such dumps back, so documents survive losing Redis' data or outliving
+// their TTL. Dumps are taken on a schedule and written to a directory, an
+// S3 bucket or both; the restore command loads them back into storage.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/mirror"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/storage/migrate"
+)
+
+// loadBatch is how many documents are loaded at once while dumping
+const loadBatch = 500
+
+// dumpTimeout bounds how long taking and uploading one scheduled dump may take
+const dumpTimeout = 30 * time.Minute
+
+// filePrefix and fileSuffix surround the time a scheduled dump was taken in its file name
+const (
+	filePrefix = "gopad-backup-"
+	fileSuffix = ".tar.gz"
+)
+
+var dumps = metrics.NewCounter("gopad_backups_total", "Number of scheduled backups by target and result")
+
+// Source is the storage documents are dumped from
+type Source interface {
+	ListDocumentIDs(ctx context.Context) ([]string, error)
+	LoadDocuments(ctx context.Context, docIDs []string) ([]*storage.DocumentState, []error)
+}
+
+// entry is one document of a dump
+type entry struct {
+	ID    string                 `json:"id"`
+	State *storage.DocumentState `json:"state"`
+}
+
+// UnmarshalJSON reads states dumped by older versions in the current shape
+func (e *entry) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		ID    string          `json:"id"`
+		State json.RawMessage `json:"state"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	e.ID = raw.ID
+	if len(raw.State) == 0 || string(raw.State) == "null" {
+		return nil
+	}
+	state, err := migrate.Upgrade(raw.State)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(state, &e.State)
+}
+
+// Write dumps every document of src to w and returns how many it wrote.
+// Documents that fail to load are logged and left out rather than failing
+// the whole dump.
+func Write(ctx context.Context, src Source, w io.Writer) (int, error) {
+	ids, err := src.ListDocumentIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(ids)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	var written int
+	for start := 0; start < len(ids); start += loadBatch {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		batch := ids[start:min(start+loadBatch, len(ids))]
+		states, errs := src.LoadDocuments(ctx, batch)
+		for i, id := range batch {
+			if errs[i] != nil {
+				logger.Error("Error loading document for backup", "doc_id", id, "error", errs[i])
+				continue
+			}
+			// Expired between listing and loading
+			state := states[i]
+			if state.Version == 0 && len(state.Tabs) == 0 {
+				continue
+			}
+			data, err := json.Marshal(entry{ID: id, State: state})
+			if err != nil {
+				return written, err
+			}
+			header := &tar.Header{
+				Name:    "documents/" + entryName(id),
+				Mode:    0o644,
+				Size:    int64(len(data)),
+				ModTime: now,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return written, err
+			}
+			if _, err := tw.Write(data); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return written, err
+	}
+	return written, gz.Close()
+}
+
+// Read calls fn with every document of a dump written by Write, stopping at
+// the first error fn returns
+func Read(r io.Reader, fn func(docID string, state *storage.DocumentState) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("not a backup file: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !strings.HasPrefix(header.Name, "documents/") {
+			continue
+		}
+		var e entry
+		if err := json.NewDecoder(tr).Decode(&e); err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+		if e.ID == "" || e.State == nil {
+			return fmt.Errorf("%s: missing document", header.Name)
+		}
+		if err := fn(e.ID, e.State); err != nil {
+			return err
+		}
+	}
+}
+
+// entryName returns the file name of a document in a dump. IDs are escaped
+// so they stay a single path segment.
+func entryName(docID string) string {
+	return url.PathEscape(docID) + ".json"
+}
+
+// FileName returns the name of a scheduled dump taken at t; names sort by time
+func FileName(t time.Time) string {
+	return filePrefix + t.UTC().Format("20060102T150405Z") + fileSuffix
+}
+
+// Config says how often dumps are taken and where they go
+type Config struct {
+	Interval time.Duration // default 24h
+	Dir      string        // directory dumps are written to; empty for none
+	Keep     int           // dumps kept in Dir, oldest removed first; zero keeps all
+	S3       mirror.S3Config
+}
+
+// Scheduler takes dumps in the background
+type Scheduler struct {
+	src     Source
+	config  Config
+	targets map[string]mirror.Target
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start begins taking a dump every interval. It returns nil when no
+// directory or bucket is configured.
+func Start(src Source, config Config) *Scheduler {
+	if config.Interval <= 0 {
+		config.Interval = 24 * time.Hour
+	}
+	targets := make(map[string]mirror.Target)
+	if config.Dir != "" {
+		targets["dir"] = mirror.NewDir(config.Dir)
+	}
+	if config.S3.Bucket != "" {
+		targets["s3"] = mirror.NewS3(config.S3)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scheduler{
+		src:     src,
+		config:  config,
+		targets: targets,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go s.run(ctx)
+	return s
+}
+
+// Stop stops taking dumps, abandoning one in progress
+func (s *Scheduler) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *Scheduler) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.dump(ctx)
+		}
+	}
+}
+
+// dump takes a dump and writes it to every target
+func (s *Scheduler) dump(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, dumpTimeout)
+	defer cancel()
+	start := time.Now()
+	var buf bytes.Buffer
+	n, err := Write(ctx, s.src, &buf)
+	if err != nil {
+		dumps.Inc(metrics.Labels{"target": "all", "result": "failed"})
+		logger.Error("Error taking backup", "error", err)
+		return
+	}
+	name := FileName(start)
+	for kind, target := range s.targets {
+		if err := target.Put(ctx, name, buf.Bytes(), "application/gzip"); err != nil {
+			dumps.Inc(metrics.Labels{"target": kind, "result": "failed"})
+			logger.Error("Error writing backup", "target", kind, "name", name, "error", err)
+			continue
+		}
+		dumps.Inc(metrics.Labels{"target": kind, "result": "written"})
+	}
+	logger.Info("Backup taken", "name", name, "documents", n, "bytes", buf.Len(), "duration", time.Since(start))
+	if s.config.Dir != "" && s.config.Keep > 0 {
+		if err := prune(s.config.Dir, s.config.Keep); err != nil {
+			logger.Warn("Error removing old backups", "dir", s.config.Dir, "error", err)
+		}
+	}
+}
+
+// prune removes all but the newest keep dumps from dir
+func prune(dir string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return err
+	}
+	if len(matches) <= keep {
+		return nil
+	}
+	// Glob sorts its matches, which puts the oldest first
+	for _, old := range matches[:len(matches)-keep] {
+		if err := os.Remove(old); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
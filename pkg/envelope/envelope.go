@@ -0,0 +1,104 @@
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// DataKeySize is the size in bytes of generated per-document data keys (AES-256)
+const DataKeySize = 32
+
+// KeyWrapper protects data keys with a master key.
+// LocalKeyWrapper keeps the master key in process; a KMS-backed implementation
+// can satisfy the same interface.
+type KeyWrapper interface {
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyWrapper wraps data keys with an AES-256-GCM master key held in memory
+type LocalKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyWrapper creates a wrapper from a 32 byte master key
+func NewLocalKeyWrapper(masterKey []byte) (*LocalKeyWrapper, error) {
+	if len(masterKey) != DataKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", DataKeySize, len(masterKey))
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKeyWrapper{aead: aead}, nil
+}
+
+// Wrap encrypts a data key with the master key
+func (w *LocalKeyWrapper) Wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	return seal(w.aead, dataKey, nil)
+}
+
+// Unwrap decrypts a data key previously returned by Wrap
+func (w *LocalKeyWrapper) Unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	return open(w.aead, wrapped, nil)
+}
+
+// GenerateDataKey returns a new random data key
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext with a data key, binding it to additionalData
+func Seal(dataKey, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return seal(aead, plaintext, additionalData)
+}
+
+// Open decrypts ciphertext produced by Seal
+func Open(dataKey, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, ciphertext, additionalData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal prepends a random nonce to the ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
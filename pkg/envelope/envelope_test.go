@@ -0,0 +1,101 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("tab content")
+	sealed, err := Seal(key, plaintext, []byte("doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		key        []byte
+		ciphertext []byte
+		ad         []byte
+		wantErr    bool
+	}{
+		{"round trip", key, sealed, []byte("doc"), false},
+		{"other key", other, sealed, []byte("doc"), true},
+		{"other additional data", key, sealed, []byte("other doc"), true},
+		{"missing additional data", key, sealed, nil, true},
+		{"tampered", key, tampered, []byte("doc"), true},
+		{"truncated", key, sealed[:8], []byte("doc"), true},
+		{"empty", key, nil, []byte("doc"), true},
+		{"invalid key size", key[:7], sealed, []byte("doc"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Open(tt.key, tt.ciphertext, tt.ad)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && !bytes.Equal(got, plaintext) {
+				t.Errorf("expected %q, got %q", plaintext, got)
+			}
+		})
+	}
+
+	// Each seal uses a fresh nonce
+	again, err := Seal(key, plaintext, []byte("doc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+}
+
+func TestLocalKeyWrapper(t *testing.T) {
+	for _, size := range []int{0, 16, 31, 33} {
+		if _, err := NewLocalKeyWrapper(make([]byte, size)); err == nil {
+			t.Errorf("expected a %d byte master key to be refused", size)
+		}
+	}
+
+	ctx := context.Background()
+	w, err := NewLocalKeyWrapper(bytes.Repeat([]byte{1}, DataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewLocalKeyWrapper(bytes.Repeat([]byte{2}, DataKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := w.Wrap(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Fatal("wrapped key contains the data key")
+	}
+	unwrapped, err := w.Unwrap(ctx, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Error("unwrapped key differs from the data key")
+	}
+	if _, err := other.Unwrap(ctx, wrapped); err == nil {
+		t.Error("another master key unwrapped the data key")
+	}
+}
@@ -0,0 +1,213 @@
+// Package fetch retrieves text files from URLs so they can be imported into
+// documents. GitHub gists become one file per gist file, and pages of GitHub
+// and GitLab files and of paste sites are fetched through their raw URLs;
+// anything else is fetched as it is. Only public addresses are contacted.
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/safehttp"
+)
+
+// gistAPI is where gists are looked up
+const gistAPI = "https://api.github.com/gists/"
+
+var (
+	// ErrInvalidURL is returned for URLs that aren't absolute http(s) URLs
+	ErrInvalidURL = apperr.New(apperr.CodeValidation, "imports need an http or https URL")
+	// ErrBlockedAddress is returned when a URL resolves to a private or local address
+	ErrBlockedAddress = apperr.New(apperr.CodeValidation, "imports are not available for this address")
+	// ErrFetchFailed is returned when the URL can't be retrieved
+	ErrFetchFailed = apperr.New(apperr.CodeValidation, "could not fetch the URL to import")
+	// ErrTooLarge is returned when the files exceed the size limit
+	ErrTooLarge = apperr.New(apperr.CodeLimitExceeded, "the imported files are too large")
+	// ErrNotText is returned for binary files
+	ErrNotText = apperr.New(apperr.CodeValidation, "only text files can be imported")
+)
+
+// File is a fetched text file
+type File struct {
+	Name    string
+	Content string
+}
+
+// Fetcher retrieves files up to a total size
+type Fetcher struct {
+	client  *http.Client
+	maxSize int64
+}
+
+// New creates a fetcher refusing to read more than maxSize bytes per import
+func New(maxSize int64) *Fetcher {
+	return &Fetcher{
+		client:  safehttp.NewClient(20 * time.Second),
+		maxSize: maxSize,
+	}
+}
+
+// Files fetches the files behind rawURL
+func (f *Fetcher) Files(ctx context.Context, rawURL string) ([]File, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, ErrInvalidURL
+	}
+	u.Fragment = ""
+	if id, ok := gistID(u); ok {
+		return f.gist(ctx, id)
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = u.Hostname()
+	}
+	content, err := f.get(ctx, rawFileURL(u).String(), f.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return []File{{Name: name, Content: content}}, nil
+}
+
+// gistID returns the ID of a gist page URL such as https://gist.github.com/<user>/<id>
+func gistID(u *url.URL) (string, bool) {
+	if u.Host != "gist.github.com" {
+		return "", false
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) == 0 || len(segments) > 2 || segments[len(segments)-1] == "" {
+		return "", false
+	}
+	return segments[len(segments)-1], true
+}
+
+// rawFileURL returns the URL of the raw content shown on a file or paste page
+func rawFileURL(u *url.URL) *url.URL {
+	raw := *u
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch u.Host {
+	case "github.com":
+		// /<owner>/<repo>/blob/<ref>/<path>
+		if len(segments) > 4 && segments[2] == "blob" {
+			raw.Host = "raw.githubusercontent.com"
+			raw.Path = "/" + strings.Join(append(segments[:2:2], segments[3:]...), "/")
+			raw.RawQuery = ""
+		}
+	case "gitlab.com":
+		// /<group>/<project>/-/blob/<ref>/<path>
+		for i := 0; i+1 < len(segments); i++ {
+			if segments[i] == "-" && segments[i+1] == "blob" {
+				segments[i+1] = "raw"
+				raw.Path = "/" + strings.Join(segments, "/")
+				break
+			}
+		}
+	case "pastebin.com":
+		if len(segments) == 1 && segments[0] != "" {
+			raw.Path = "/raw/" + segments[0]
+		}
+	case "dpaste.org":
+		if len(segments) == 1 && segments[0] != "" {
+			raw.Path = "/" + segments[0] + "/raw"
+		}
+	}
+	return &raw
+}
+
+// gist fetches every file of a gist, in name order
+func (f *Fetcher) gist(ctx context.Context, id string) ([]File, error) {
+	// The listing holds the files JSON-escaped, along with the gist's metadata
+	body, err := f.get(ctx, gistAPI+url.PathEscape(id), 2*f.maxSize+64<<10)
+	if err != nil {
+		return nil, err
+	}
+	var gist struct {
+		Files map[string]struct {
+			Content   string `json:"content"`
+			Truncated bool   `json:"truncated"`
+			RawURL    string `json:"raw_url"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal([]byte(body), &gist); err != nil {
+		return nil, apperr.Wrap(apperr.CodeValidation, err, ErrFetchFailed.Message)
+	}
+	if len(gist.Files) == 0 {
+		return nil, ErrFetchFailed
+	}
+	names := make([]string, 0, len(gist.Files))
+	for name := range gist.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]File, 0, len(names))
+	remaining := f.maxSize
+	for _, name := range names {
+		file := gist.Files[name]
+		content := file.Content
+		if file.Truncated {
+			// Large files only come in full from their raw URL
+			if content, err = f.get(ctx, file.RawURL, remaining); err != nil {
+				return nil, err
+			}
+		}
+		if remaining -= int64(len(content)); remaining < 0 {
+			return nil, ErrTooLarge
+		}
+		if !isText(content) {
+			return nil, ErrNotText
+		}
+		files = append(files, File{Name: name, Content: content})
+	}
+	return files, nil
+}
+
+// get fetches a text body of up to limit bytes
+func (f *Fetcher) get(ctx context.Context, rawURL string, limit int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+	req.Header.Set("User-Agent", "gopad-import/1.0")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		switch {
+		case errors.Is(err, safehttp.ErrBlockedAddress):
+			return "", ErrBlockedAddress
+		case errors.Is(err, safehttp.ErrInvalidScheme):
+			return "", ErrInvalidURL
+		}
+		return "", apperr.Wrap(apperr.CodeValidation, err, ErrFetchFailed.Message)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", ErrFetchFailed
+	}
+	if resp.ContentLength > limit {
+		return "", ErrTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "", apperr.Wrap(apperr.CodeValidation, err, ErrFetchFailed.Message)
+	}
+	if int64(len(body)) > limit {
+		return "", ErrTooLarge
+	}
+	if !isText(string(body)) {
+		return "", ErrNotText
+	}
+	return string(body), nil
+}
+
+// isText reports whether content looks like text rather than a binary file
+func isText(content string) bool {
+	return utf8.ValidString(content) && strings.IndexByte(content, 0) < 0
+}
@@ -0,0 +1,334 @@
+// Package gitbackup keeps a copy of every saved document in a git repository,
+// giving their history as diffs and, when the repository has a remote, an
+// off-site backup. Each document is a directory holding one file per tab and a
+// document.json with the rest of its state. Saves are collected and committed
+// together on a schedule rather than one commit per save.
+package gitbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+)
+
+// commitTimeout bounds how long writing, committing and pushing one batch may take
+const commitTimeout = 2 * time.Minute
+
+// metaFile holds a document's state other than its tab contents
+const metaFile = "document.json"
+
+var commits = metrics.NewCounter("gopad_git_backup_commits_total", "Number of git backup commits and pushes by result")
+
+// Config says where documents are committed
+type Config struct {
+	Dir      string        // working tree, created and initialized when missing
+	Remote   string        // pushed to after every commit; empty to keep commits local
+	Branch   string        // default "main"
+	Interval time.Duration // how often saves are committed, default 5m
+}
+
+// Store is storage that also commits each saved document to git. Documents
+// that expire in Redis stay in the repository; deleted and shredded ones are
+// removed from the tree but remain in its history.
+type Store struct {
+	*storage.Storage
+	config Config
+
+	mu      sync.Mutex
+	pending map[string]*storage.DocumentState // nil state for a removed document
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New prepares the repository and starts committing saves to it
+func New(ctx context.Context, store *storage.Storage, config Config) (*Store, error) {
+	if config.Branch == "" {
+		config.Branch = "main"
+	}
+	if config.Interval <= 0 {
+		config.Interval = 5 * time.Minute
+	}
+	s := &Store{
+		Storage: store,
+		config:  config,
+		pending: make(map[string]*storage.DocumentState),
+		done:    make(chan struct{}),
+	}
+	if err := s.init(ctx); err != nil {
+		return nil, fmt.Errorf("failed to prepare git backup repository: %w", err)
+	}
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run(ctx)
+	return s, nil
+}
+
+// SaveDocument saves the document and queues its new state for the next commit
+func (s *Store) SaveDocument(ctx context.Context, docID string, state *storage.DocumentState) error {
+	if err := s.Storage.SaveDocument(ctx, docID, state); err != nil {
+		return err
+	}
+	// The caller may keep changing its state after the save
+	saved := *state
+	saved.Tabs = append([]storage.Tab(nil), state.Tabs...)
+	s.queue(docID, &saved)
+	return nil
+}
+
+// DeleteDocument deletes the document and queues its removal from the tree
+func (s *Store) DeleteDocument(ctx context.Context, docID string) error {
+	if err := s.Storage.DeleteDocument(ctx, docID); err != nil {
+		return err
+	}
+	s.queue(docID, nil)
+	return nil
+}
+
+// ShredDocument shreds the document and queues its removal from the tree.
+// Earlier commits still hold its content, so rewrite the history where that matters.
+func (s *Store) ShredDocument(ctx context.Context, docID string) error {
+	if err := s.Storage.ShredDocument(ctx, docID); err != nil {
+		return err
+	}
+	s.queue(docID, nil)
+	return nil
+}
+
+// Stop commits the saves still queued and stops committing
+func (s *Store) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *Store) queue(docID string, state *storage.DocumentState) {
+	s.mu.Lock()
+	s.pending[docID] = state
+	s.mu.Unlock()
+}
+
+func (s *Store) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.commit()
+			return
+		case <-ticker.C:
+			s.commit()
+		}
+	}
+}
+
+// commit writes the queued documents to the tree and commits and pushes them
+func (s *Store) commit() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]*storage.DocumentState)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+	defer cancel()
+	ids := make([]string, 0, len(pending))
+	for docID, state := range pending {
+		if err := s.write(docID, state); err != nil {
+			commits.Inc(metrics.Labels{"result": "failed"})
+			logger.Error("Error writing document to git backup", "doc_id", docID, "error", err)
+			// Try again next time unless the document was saved again meanwhile
+			s.mu.Lock()
+			if _, saved := s.pending[docID]; !saved {
+				s.pending[docID] = state
+			}
+			s.mu.Unlock()
+			continue
+		}
+		ids = append(ids, docID)
+	}
+	sort.Strings(ids)
+	if err := s.git(ctx, "add", "--all"); err != nil {
+		commits.Inc(metrics.Labels{"result": "failed"})
+		logger.Error("Error staging git backup", "error", err)
+		return
+	}
+	// Saves that changed nothing leave nothing to commit
+	if err := s.git(ctx, "diff", "--cached", "--quiet"); err == nil {
+		return
+	}
+	message := fmt.Sprintf("Back up %d document(s)\n\n%s\n", len(ids), strings.Join(ids, "\n"))
+	if err := s.git(ctx, "commit", "--quiet", "--no-verify", "-m", message); err != nil {
+		commits.Inc(metrics.Labels{"result": "failed"})
+		logger.Error("Error committing git backup", "error", err)
+		return
+	}
+	commits.Inc(metrics.Labels{"result": "committed"})
+	logger.Debug("Committed git backup", "documents", len(ids))
+	if s.config.Remote == "" {
+		return
+	}
+	// Commits that couldn't be pushed go out with the next push
+	if err := s.git(ctx, "push", "--quiet", "origin", "HEAD:refs/heads/"+s.config.Branch); err != nil {
+		commits.Inc(metrics.Labels{"result": "push_failed"})
+		logger.Warn("Error pushing git backup", "remote", s.config.Remote, "error", err)
+		return
+	}
+	commits.Inc(metrics.Labels{"result": "pushed"})
+}
+
+// documentMeta is the document.json of a document
+type documentMeta struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title,omitempty"`
+	Language     string    `json:"language"`
+	Workspace    string    `json:"workspace,omitempty"`
+	Version      int64     `json:"version"`
+	LastModified time.Time `json:"lastModified"`
+	ActiveTabID  string    `json:"activeTabId"`
+	Tabs         []tabMeta `json:"tabs"`
+}
+
+// tabMeta describes a tab and names the file holding its content
+type tabMeta struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Kind    string `json:"kind,omitempty"`
+	Runtime string `json:"runtime,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+}
+
+// write replaces a document's directory with its state, or removes it for a nil state
+func (s *Store) write(docID string, state *storage.DocumentState) error {
+	dir := filepath.Join(s.config.Dir, dirName(docID))
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if state == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	meta := documentMeta{
+		ID:           docID,
+		Title:        state.DisplayTitle(),
+		Language:     state.Language,
+		Workspace:    state.Workspace,
+		Version:      state.Version,
+		LastModified: time.UnixMilli(state.LastModified).UTC(),
+		ActiveTabID:  state.ActiveTabId,
+		Tabs:         make([]tabMeta, len(state.Tabs)),
+	}
+	names := fileNames(state)
+	for i, tab := range state.Tabs {
+		meta.Tabs[i] = tabMeta{ID: tab.ID, Name: tab.Name, File: names[i], Kind: tab.Kind, Runtime: tab.Runtime, Notes: tab.Notes}
+		if err := os.WriteFile(filepath.Join(dir, names[i]), []byte(tab.Content), 0o644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, metaFile), append(data, '\n'), 0o644)
+}
+
+// dirName returns the directory of a document. IDs are escaped so they can't
+// reach outside the repository or into .git.
+func dirName(docID string) string {
+	name := url.PathEscape(docID)
+	if strings.HasPrefix(name, ".") {
+		name = strings.Replace(name, ".", "%2E", 1)
+	}
+	return name
+}
+
+// fileNames names the files of a document's tabs after the tabs, adding the
+// document language's extension where a name has none
+func fileNames(state *storage.DocumentState) []string {
+	ext := suggest.Extension(state.Language)
+	used := map[string]bool{metaFile: true}
+	names := make([]string, len(state.Tabs))
+	for i, tab := range state.Tabs {
+		// Names become single path segments and never hidden files
+		name := strings.Trim(strings.NewReplacer("/", "-", "\\", "-").Replace(tab.Name), " .")
+		if name == "" {
+			name = "tab-" + tab.ID
+		}
+		if ext != "" && tab.Kind == "" && !suggest.HasExtension(name) {
+			name += "." + ext
+		}
+		unique := name
+		for n := 2; used[strings.ToLower(unique)]; n++ {
+			stem := strings.TrimSuffix(name, path.Ext(name))
+			unique = stem + "-" + strconv.Itoa(n) + path.Ext(name)
+		}
+		used[strings.ToLower(unique)] = true
+		names[i] = unique
+	}
+	return names
+}
+
+// init creates the working tree when it doesn't exist yet, fetching the
+// branch from the remote if it has one
+func (s *Store) init(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(s.config.Dir, ".git")); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(s.config.Dir, 0o755); err != nil {
+		return err
+	}
+	if err := s.git(ctx, "init", "--quiet"); err != nil {
+		return err
+	}
+	if err := s.git(ctx, "symbolic-ref", "HEAD", "refs/heads/"+s.config.Branch); err != nil {
+		return err
+	}
+	if s.config.Remote == "" {
+		return nil
+	}
+	if err := s.git(ctx, "remote", "add", "origin", s.config.Remote); err != nil {
+		return err
+	}
+	// A new remote has no branch yet, which the first push creates
+	if err := s.git(ctx, "fetch", "--quiet", "origin", s.config.Branch); err != nil {
+		logger.Info("Git backup branch not fetched, starting a new one", "remote", s.config.Remote, "branch", s.config.Branch, "error", err)
+		return nil
+	}
+	return s.git(ctx, "reset", "--quiet", "--hard", "FETCH_HEAD")
+}
+
+// git runs a git command in the working tree as the gopad user
+func (s *Store) git(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", s.config.Dir, "-c", "user.name=gopad", "-c", "user.email=gopad@localhost"}, args...)...)
+	// Never wait for credentials on a terminal
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
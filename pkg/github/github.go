@@ -0,0 +1,191 @@
+// Package github publishes documents to GitHub, either as a new Gist or as a
+// commit to a repository branch, so pads can graduate into versioned code.
+// It talks to the REST API directly with a personal access token and works
+// with GitHub Enterprise Server when given its API URL.
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultAPIURL is the API of github.com
+const DefaultAPIURL = "https://api.github.com"
+
+// ErrUnauthorized is returned when GitHub rejects the token
+var ErrUnauthorized = errors.New("GitHub rejected the token")
+
+// File is a file to publish
+type File struct {
+	Name    string
+	Content string
+}
+
+// Client calls the GitHub API with a token
+type Client struct {
+	apiURL string
+	token  string
+	client *http.Client
+}
+
+// New creates a client for the API at apiURL, or github.com if empty
+func New(apiURL, token string) *Client {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+	return &Client{
+		apiURL: strings.TrimSuffix(apiURL, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// CreateGist creates a gist holding files and returns its URL
+func (c *Client) CreateGist(ctx context.Context, description string, public bool, files []File) (string, error) {
+	contents := make(map[string]map[string]string, len(files))
+	for _, file := range files {
+		contents[file.Name] = map[string]string{"content": file.Content}
+	}
+	var gist struct {
+		HTMLURL string `json:"html_url"`
+	}
+	err := c.do(ctx, http.MethodPost, "/gists", map[string]interface{}{
+		"description": description,
+		"public":      public,
+		"files":       contents,
+	}, &gist)
+	return gist.HTMLURL, err
+}
+
+// Commit adds files below dir on a branch of repo ("owner/name") in a single
+// commit and returns the commit's URL. An empty branch means the repository's
+// default branch; files already there are replaced, others are kept.
+func (c *Client) Commit(ctx context.Context, repo, branch, dir, message string, files []File) (string, error) {
+	owner, name, ok := strings.Cut(repo, "/")
+	if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("repository %q is not of the form owner/name", repo)
+	}
+	base := "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(name)
+	if branch == "" {
+		var info struct {
+			DefaultBranch string `json:"default_branch"`
+		}
+		if err := c.do(ctx, http.MethodGet, base, nil, &info); err != nil {
+			return "", err
+		}
+		branch = info.DefaultBranch
+	}
+
+	var ref struct {
+		Object struct {
+			SHA string `json:"sha"`
+		} `json:"object"`
+	}
+	if err := c.do(ctx, http.MethodGet, base+"/git/ref/heads/"+escapePath(branch), nil, &ref); err != nil {
+		return "", err
+	}
+	var parent struct {
+		Tree struct {
+			SHA string `json:"sha"`
+		} `json:"tree"`
+	}
+	if err := c.do(ctx, http.MethodGet, base+"/git/commits/"+ref.Object.SHA, nil, &parent); err != nil {
+		return "", err
+	}
+
+	entries := make([]map[string]string, len(files))
+	for i, file := range files {
+		entries[i] = map[string]string{
+			"path":    path.Join(dir, file.Name),
+			"mode":    "100644",
+			"type":    "blob",
+			"content": file.Content,
+		}
+	}
+	var tree struct {
+		SHA string `json:"sha"`
+	}
+	if err := c.do(ctx, http.MethodPost, base+"/git/trees", map[string]interface{}{
+		"base_tree": parent.Tree.SHA,
+		"tree":      entries,
+	}, &tree); err != nil {
+		return "", err
+	}
+	var commit struct {
+		SHA     string `json:"sha"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := c.do(ctx, http.MethodPost, base+"/git/commits", map[string]interface{}{
+		"message": message,
+		"tree":    tree.SHA,
+		"parents": []string{ref.Object.SHA},
+	}, &commit); err != nil {
+		return "", err
+	}
+	// Not forced, so commits pushed in the meantime make this fail rather than vanish
+	if err := c.do(ctx, http.MethodPatch, base+"/git/refs/heads/"+escapePath(branch), map[string]interface{}{
+		"sha": commit.SHA,
+	}, nil); err != nil {
+		return "", err
+	}
+	return commit.HTMLURL, nil
+}
+
+// do sends a request with a JSON body and decodes the JSON response into out
+func (c *Client) do(ctx context.Context, method, endpoint string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.StatusCode >= 300 {
+		var detail struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&detail)
+		return fmt.Errorf("%s %s: unexpected status %s: %s", method, endpoint, resp.Status, detail.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// escapePath escapes each segment of a slash-separated name such as a branch
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,134 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// DefaultLocale is the language server messages are written in
+const DefaultLocale = "en"
+
+//go:embed locales/*.json
+var locales embed.FS
+
+// locale holds the translations for one language, keyed by the English message
+type locale struct {
+	TimeLayout string            `json:"timeLayout"`
+	Messages   map[string]string `json:"messages"`
+}
+
+// Catalog translates server-generated messages into the locales it knows
+type Catalog struct {
+	fallback string
+	locales  map[string]locale
+}
+
+// New loads the built-in translations. Messages in locales without a
+// translation are shown in fallback, or English when fallback is unknown.
+func New(fallback string) (*Catalog, error) {
+	catalog := &Catalog{
+		fallback: DefaultLocale,
+		locales: map[string]locale{
+			DefaultLocale: {TimeLayout: "Jan 2, 2006 3:04 PM MST"},
+		},
+	}
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read locales: %w", err)
+	}
+	for _, file := range files {
+		data, err := locales.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read locale %s: %w", file.Name(), err)
+		}
+		var l locale
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, fmt.Errorf("failed to parse locale %s: %w", file.Name(), err)
+		}
+		catalog.locales[strings.TrimSuffix(file.Name(), ".json")] = l
+	}
+	if _, ok := catalog.locales[fallback]; ok {
+		catalog.fallback = fallback
+	}
+	return catalog, nil
+}
+
+// Negotiate picks the best supported locale from the candidates in order of
+// preference. Each candidate may be a single tag ("de") or an Accept-Language
+// header value ("de-CH,de;q=0.9,en;q=0.8").
+func (c *Catalog) Negotiate(candidates ...string) string {
+	for _, candidate := range candidates {
+		for _, tag := range parseAcceptLanguage(candidate) {
+			base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+			if _, ok := c.locales[base]; ok {
+				return base
+			}
+		}
+	}
+	return c.fallback
+}
+
+// Translate formats message in the given locale, falling back to the English text
+func (c *Catalog) Translate(loc, message string, args ...any) string {
+	if translated, ok := c.locales[loc].Messages[message]; ok {
+		message = translated
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// Error returns the user-facing message of err in the given locale
+func (c *Catalog) Error(loc string, err error) string {
+	format, args := apperr.TemplateOf(err)
+	return c.Translate(loc, format, args...)
+}
+
+// FormatTime formats t the way the given locale writes dates and times
+func (c *Catalog) FormatTime(loc string, t time.Time) string {
+	layout := c.locales[loc].TimeLayout
+	if layout == "" {
+		layout = c.locales[DefaultLocale].TimeLayout
+	}
+	return t.Format(layout)
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language value,
+// most preferred first
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	result := make([]string, len(tags))
+	for i, t := range tags {
+		result[i] = t.tag
+	}
+	return result
+}
@@ -0,0 +1,269 @@
+// Package loadtest measures how a gopad server fans edits out to many viewers
+// of one document. An editor connection sends updates of a tab while the
+// viewers time how long each takes to reach them.
+package loadtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Options configure a run
+type Options struct {
+	URL      string        // base URL of the server, such as http://localhost:8080
+	Doc      string        // document to edit and view
+	Viewers  int           // connections receiving the edits
+	Edits    int           // updates the editor sends
+	Interval time.Duration // pause between edits
+	Size     int           // bytes of content in each edit
+	Caps     string        // capabilities the viewers advertise, comma-separated
+	Drain    time.Duration // how long to wait for the last edits to arrive
+}
+
+// DefaultOptions returns the options of a run with 500 viewers
+func DefaultOptions() Options {
+	return Options{
+		URL:      "http://localhost:8080",
+		Doc:      "loadtest",
+		Viewers:  500,
+		Edits:    200,
+		Interval: 20 * time.Millisecond,
+		Size:     2048,
+		Caps:     "compression",
+		Drain:    10 * time.Second,
+	}
+}
+
+// Result summarizes a run
+type Result struct {
+	Viewers   int
+	Edits     int
+	Connected time.Duration // until every viewer had its init message
+	Delivered int           // edits received, over all viewers
+	Elapsed   time.Duration // from the first edit until the last arrived or the drain ran out
+	P50       time.Duration // latency from sending an edit until a viewer received it
+	P99       time.Duration
+	Max       time.Duration
+}
+
+// String formats the result for printing
+func (r *Result) String() string {
+	expected := r.Viewers * r.Edits
+	rate := float64(r.Delivered) / r.Elapsed.Seconds()
+	return fmt.Sprintf("viewers=%d connected=%s edits=%d delivered=%d/%d (%.1f%%) elapsed=%s frames/s=%.0f p50=%s p99=%s max=%s",
+		r.Viewers, r.Connected.Round(time.Millisecond), r.Edits, r.Delivered, expected, 100*float64(r.Delivered)/float64(max(expected, 1)),
+		r.Elapsed.Round(time.Millisecond), rate, r.P50, r.P99, r.Max)
+}
+
+// update is the part of a frame a viewer reads
+type update struct {
+	Type    string `json:"type" msgpack:"type"`
+	Content string `json:"content" msgpack:"content"`
+}
+
+// seqWidth is the number of digits that start each edit's content
+const seqWidth = 8
+
+// viewer is a connection timing the edits it receives
+type viewer struct {
+	conn      *websocket.Conn
+	latencies []time.Duration
+	last      chan struct{} // closed when the last edit arrives
+}
+
+// Run connects the viewers and the editor, sends the edits and reports how
+// they were delivered
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Viewers <= 0 || opts.Edits <= 0 {
+		return nil, errors.New("viewers and edits must be positive")
+	}
+	if opts.Size < seqWidth {
+		opts.Size = seqWidth
+	}
+	base, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch base.Scheme {
+	case "https":
+		base.Scheme = "wss"
+	default:
+		base.Scheme = "ws"
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/ws"
+	dialURL := func(caps string) string {
+		u := *base
+		q := url.Values{"doc": {opts.Doc}}
+		if caps != "" {
+			q.Set("caps", caps)
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+
+	editor, _, err := dialer.DialContext(ctx, dialURL(""), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect the editor: %w", err)
+	}
+	defer editor.Close()
+	tabID, err := readInit(editor)
+	if err != nil {
+		return nil, err
+	}
+	go discard(editor)
+
+	sent := make([]atomic.Int64, opts.Edits) // unix nanoseconds each edit was sent
+	viewers := make([]*viewer, 0, opts.Viewers)
+	defer func() {
+		for _, v := range viewers {
+			v.conn.Close()
+		}
+	}()
+	var wg sync.WaitGroup
+	connecting := time.Now()
+	for i := 0; i < opts.Viewers; i++ {
+		conn, _, err := dialer.DialContext(ctx, dialURL(opts.Caps), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect viewer %d: %w", i+1, err)
+		}
+		v := &viewer{conn: conn, last: make(chan struct{})}
+		viewers = append(viewers, v)
+		if _, err := readInit(conn); err != nil {
+			return nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.receive(sent)
+		}()
+	}
+	connected := time.Since(connecting)
+
+	padding := strings.Repeat("x", opts.Size-seqWidth)
+	start := time.Now()
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for seq := 0; seq < opts.Edits; seq++ {
+		content := fmt.Sprintf("%0*d", seqWidth, seq) + padding
+		sent[seq].Store(time.Now().UnixNano())
+		if err := editor.WriteJSON(map[string]interface{}{"type": "update", "tabId": tabID, "content": content}); err != nil {
+			return nil, fmt.Errorf("failed to send edit: %w", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// Updates a slow viewer hasn't read yet are coalesced, so not every
+	// viewer sees every edit; wait for the last one or the drain to run out
+	drain := time.After(opts.Drain)
+	for _, v := range viewers {
+		select {
+		case <-v.last:
+		case <-drain:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	elapsed := time.Since(start)
+	for _, v := range viewers {
+		v.conn.Close()
+	}
+	wg.Wait()
+
+	var latencies []time.Duration
+	for _, v := range viewers {
+		latencies = append(latencies, v.latencies...)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result := &Result{Viewers: opts.Viewers, Edits: opts.Edits, Connected: connected, Delivered: len(latencies), Elapsed: elapsed}
+	if n := len(latencies); n > 0 {
+		result.P50 = latencies[n/2]
+		result.P99 = latencies[n*99/100]
+		result.Max = latencies[n-1]
+	}
+	return result, nil
+}
+
+// receive records the latency of every edit until the connection closes
+func (v *viewer) receive(sent []atomic.Int64) {
+	for {
+		messageType, data, err := v.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		var msg update
+		if messageType == websocket.BinaryMessage {
+			err = msgpack.Unmarshal(data, &msg)
+		} else {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil || msg.Type != "update" || len(msg.Content) < seqWidth {
+			continue
+		}
+		seq, err := strconv.Atoi(msg.Content[:seqWidth])
+		if err != nil || seq < 0 || seq >= len(sent) {
+			continue
+		}
+		v.latencies = append(v.latencies, received.Sub(time.Unix(0, sent[seq].Load())))
+		if seq == len(sent)-1 {
+			close(v.last)
+		}
+	}
+}
+
+// readInit waits for a connection's init message and returns the ID of the
+// first tab
+func readInit(conn *websocket.Conn) (string, error) {
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return "", fmt.Errorf("failed to read init message: %w", err)
+		}
+		var init struct {
+			Type string `json:"type" msgpack:"type"`
+			Tabs []struct {
+				ID string `json:"id" msgpack:"id"`
+			} `json:"tabs" msgpack:"tabs"`
+		}
+		if messageType == websocket.BinaryMessage {
+			err = msgpack.Unmarshal(data, &init)
+		} else {
+			err = json.Unmarshal(data, &init)
+		}
+		if err != nil || init.Type != "init" {
+			continue
+		}
+		if len(init.Tabs) == 0 {
+			return "", errors.New("document has no tabs")
+		}
+		return init.Tabs[0].ID, nil
+	}
+}
+
+// discard reads and drops everything sent to the editor, so its buffer
+// doesn't fill up
+func discard(conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
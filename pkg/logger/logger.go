@@ -1,49 +1,163 @@
 package logger
 
 import (
+	"context"
+	"io"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	// Logger is the global slog logger instance
 	Logger *slog.Logger
+
+	level  = new(slog.LevelVar)
+	format = "text"
+	// files holds the log files opened by Setup so they can be closed on reconfiguration
+	files []io.Closer
 )
 
-// Init initializes the logger with the specified level
-func Init(level string) {
+// Config describes where and how logs are written
+type Config struct {
+	Level  string // DEBUG, INFO, WARN or ERROR
+	Format string // text or json
+	// Outputs lists the destinations: "stdout", "stderr" or file paths. Logs are
+	// written to all of them; stdout is used when empty.
+	Outputs []string
+	// File rotation limits; zero disables each
+	MaxFileSize    int64
+	RotateInterval time.Duration
+	MaxBackups     int
+}
+
+// ConfigFromEnv reads LOG_LEVEL, LOG_FORMAT, LOG_OUTPUT (comma separated),
+// LOG_FILE_MAX_SIZE (bytes), LOG_FILE_ROTATE_INTERVAL and LOG_FILE_MAX_BACKUPS
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Level:       os.Getenv("LOG_LEVEL"),
+		Format:      os.Getenv("LOG_FORMAT"),
+		MaxFileSize: 100 << 20,
+		MaxBackups:  7,
+	}
+	if cfg.Level == "" {
+		cfg.Level = "INFO"
+	}
+	for _, output := range strings.Split(os.Getenv("LOG_OUTPUT"), ",") {
+		if output = strings.TrimSpace(output); output != "" {
+			cfg.Outputs = append(cfg.Outputs, output)
+		}
+	}
+	if n, err := strconv.ParseInt(os.Getenv("LOG_FILE_MAX_SIZE"), 10, 64); err == nil {
+		cfg.MaxFileSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOG_FILE_ROTATE_INTERVAL")); err == nil {
+		cfg.RotateInterval = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOG_FILE_MAX_BACKUPS")); err == nil {
+		cfg.MaxBackups = n
+	}
+	return cfg
+}
+
+// Init initializes the logger with the specified level and format ("text" or "json"), writing to stdout
+func Init(levelName, formatName string) {
+	// Stdout can't fail to open
+	_ = Setup(Config{Level: levelName, Format: formatName})
+}
+
+// Setup configures the logger. Files from a previous Setup are closed.
+func Setup(cfg Config) error {
 	// Parse log level
-	var logLevel slog.Level
-	switch strings.ToUpper(level) {
+	switch strings.ToUpper(cfg.Level) {
 	case "DEBUG":
-		logLevel = slog.LevelDebug
+		level.Set(slog.LevelDebug)
 	case "INFO":
-		logLevel = slog.LevelInfo
+		level.Set(slog.LevelInfo)
 	case "WARN", "WARNING":
-		logLevel = slog.LevelWarn
+		level.Set(slog.LevelWarn)
 	case "ERROR":
-		logLevel = slog.LevelError
+		level.Set(slog.LevelError)
 	default:
-		logLevel = slog.LevelInfo
+		level.Set(slog.LevelInfo)
+	}
+	if strings.ToLower(cfg.Format) == "json" {
+		format = "json"
+	} else {
+		format = "text"
 	}
 
-	// Create a handler with the specified level
-	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: logLevel,
-	})
+	var writers []io.Writer
+	var opened []io.Closer
+	for _, output := range cfg.Outputs {
+		switch output {
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		default:
+			file, err := OpenRotatingFile(output, cfg.MaxFileSize, cfg.RotateInterval, cfg.MaxBackups)
+			if err != nil {
+				for _, c := range opened {
+					c.Close()
+				}
+				return err
+			}
+			writers = append(writers, file)
+			opened = append(opened, file)
+		}
+	}
+	var w io.Writer = os.Stdout
+	if len(writers) == 1 {
+		w = writers[0]
+	} else if len(writers) > 1 {
+		w = teeWriter(writers)
+	}
 
 	// Create the logger
-	Logger = slog.New(handler)
+	Logger = slog.New(newHandler(w))
+	for _, c := range files {
+		c.Close()
+	}
+	files = opened
+	return nil
+}
+
+// teeWriter writes to every writer even if some fail, so one broken
+// destination doesn't silence the others
+type teeWriter []io.Writer
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	var firstErr error
+	for _, w := range t {
+		if _, err := w.Write(p); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return len(p), firstErr
+}
+
+// newHandler creates a handler writing to w with the configured level and format
+func newHandler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
 }
 
 // SetOutput sets the output destination for the logger
 func SetOutput(w *os.File) {
-	// Create a new handler with the same level as the current logger
-	handler := slog.NewTextHandler(w, &slog.HandlerOptions{
-		Level: slog.LevelInfo, // Default to INFO level
-	})
-	Logger = slog.New(handler)
+	// Create a new handler with the same level and format as the current logger
+	Logger = slog.New(newHandler(w))
+}
+
+// DebugEnabled reports whether debug messages are logged, so callers can skip
+// building expensive debug fields such as message bodies
+func DebugEnabled() bool {
+	return Logger.Enabled(context.Background(), slog.LevelDebug)
 }
 
 // Debug logs a debug message
@@ -71,3 +185,8 @@ func Fatal(msg string, args ...any) {
 	Logger.Error(msg, args...)
 	os.Exit(1)
 }
+
+// With returns a logger that adds args to every message, such as IDs correlating a request's log lines
+func With(args ...any) *slog.Logger {
+	return Logger.With(args...)
+}
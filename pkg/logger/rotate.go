@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file that is rotated once it grows past maxSize bytes or
+// has been open longer than interval. Rotated files are renamed with a timestamp
+// suffix and only the newest maxBackups are kept. Zero values disable each limit.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenRotatingFile opens (or creates) the log file at path
+func OpenRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends p to the file, rotating first if a limit has been reached
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.due(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// due reports whether writing n more bytes calls for a rotation
+// Note: Caller must hold f.mu
+func (f *RotatingFile) due(n int64) bool {
+	if f.maxSize > 0 && f.size > 0 && f.size+n > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.openedAt) >= f.interval
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// rotate renames the current file aside and starts a new one
+// Note: Caller must hold f.mu
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	backup := f.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(f.path, backup); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes the oldest backups beyond maxBackups
+// Note: Caller must hold f.mu
+func (f *RotatingFile) prune() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	// Timestamp suffixes sort chronologically
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if !strings.HasPrefix(backups[0], f.path+".") {
+			break
+		}
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
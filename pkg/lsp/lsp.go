@@ -0,0 +1,374 @@
+// Package lsp runs language servers such as gopls or pyright and talks to them
+// over the Language Server Protocol, so documents can offer completions, hover
+// information and diagnostics computed by real tooling. Results are passed on
+// as the server sent them. Each server gets its own empty workspace directory
+// and only learns about files through didOpen and didChange notifications.
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// initializeTimeout bounds how long a server may take to start up
+const initializeTimeout = 30 * time.Second
+
+// shutdownTimeout bounds how long a server may take to shut down before it's killed
+const shutdownTimeout = 2 * time.Second
+
+// maxMessageSize bounds the messages read from a server
+const maxMessageSize = 16 << 20
+
+// ErrClosed is returned for requests to a server that has exited
+var ErrClosed = errors.New("language server exited")
+
+// languageIDs maps gopad languages to LSP language identifiers where they differ
+var languageIDs = map[string]string{
+	"shell": "shellscript",
+}
+
+// LanguageID returns the LSP identifier of a gopad language
+func LanguageID(language string) string {
+	if id, ok := languageIDs[language]; ok {
+		return id
+	}
+	return language
+}
+
+// Position is a zero-based line and UTF-16 character offset in a file
+type Position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+// ResponseError is an error returned by a language server
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("language server error %d: %s", e.Code, e.Message)
+}
+
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *ResponseError   `json:"error,omitempty"`
+}
+
+type response struct {
+	result json.RawMessage
+	err    error
+}
+
+// Client is a running language server
+type Client struct {
+	cmd         *exec.Cmd
+	stdin       io.WriteCloser
+	root        string // workspace directory
+	diagnostics func(uri string, diagnostics json.RawMessage)
+	done        chan struct{}
+
+	writeMu sync.Mutex // serializes messages to the server
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan response
+	closed  bool
+}
+
+// Start launches a language server with command and initializes it.
+// diagnostics is called with the diagnostics the server publishes for a file.
+// The server is killed when ctx is cancelled or the client is closed.
+func Start(ctx context.Context, command []string, diagnostics func(uri string, diagnostics json.RawMessage)) (*Client, error) {
+	if len(command) == 0 {
+		return nil, errors.New("no command configured")
+	}
+	root, err := os.MkdirTemp("", "gopad-lsp-")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = root
+	// Run in its own process group so tools started by the server are killed too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+
+	c := &Client{
+		cmd:         cmd,
+		stdin:       stdin,
+		root:        root,
+		diagnostics: diagnostics,
+		done:        make(chan struct{}),
+		pending:     make(map[int64]chan response),
+	}
+	go c.read(stdout)
+
+	rootURI := c.URI("")
+	initCtx, cancel := context.WithTimeout(ctx, initializeTimeout)
+	defer cancel()
+	_, err = c.call(initCtx, "initialize", map[string]interface{}{
+		"processId": os.Getpid(),
+		"rootUri":   rootURI,
+		"workspaceFolders": []map[string]string{
+			{"uri": rootURI, "name": "gopad"},
+		},
+		"capabilities": map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"synchronization":    map[string]interface{}{"didSave": false},
+				"completion":         map[string]interface{}{"completionItem": map[string]interface{}{"snippetSupport": false}},
+				"hover":              map[string]interface{}{"contentFormat": []string{"markdown", "plaintext"}},
+				"publishDiagnostics": map[string]interface{}{},
+			},
+		},
+	})
+	if err == nil {
+		err = c.notify("initialized", map[string]interface{}{})
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// URI returns the URI of a file in the server's workspace
+func (c *Client) URI(name string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.Join(c.root, name)}).String()
+}
+
+// Open tells the server about a file and its content
+func (c *Client) Open(uri, languageID string, version int, text string) error {
+	return c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{
+			"uri":        uri,
+			"languageId": languageID,
+			"version":    version,
+			"text":       text,
+		},
+	})
+}
+
+// Change replaces the content of an open file
+func (c *Client) Change(uri string, version int, text string) error {
+	return c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": version},
+		"contentChanges": []map[string]string{{"text": text}},
+	})
+}
+
+// CloseFile tells the server a file is gone
+func (c *Client) CloseFile(uri string) error {
+	return c.notify("textDocument/didClose", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+	})
+}
+
+// Completion asks for the completions at a position in an open file
+func (c *Client) Completion(ctx context.Context, uri string, pos Position) (json.RawMessage, error) {
+	return c.call(ctx, "textDocument/completion", positionParams(uri, pos))
+}
+
+// Hover asks for information about the symbol at a position in an open file
+func (c *Client) Hover(ctx context.Context, uri string, pos Position) (json.RawMessage, error) {
+	return c.call(ctx, "textDocument/hover", positionParams(uri, pos))
+}
+
+func positionParams(uri string, pos Position) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     pos,
+	}
+}
+
+// Done is closed once the server has exited
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close asks the server to shut down, kills it if it doesn't in time and
+// removes its workspace
+func (c *Client) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if _, err := c.call(ctx, "shutdown", nil); err == nil {
+		c.notify("exit", nil)
+	}
+	c.stdin.Close()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+		<-c.done
+	}
+	os.RemoveAll(c.root)
+}
+
+// call sends a request and waits for its result
+func (c *Client) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextID++
+	id := c.nextID
+	ch := make(chan response, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	rawID := json.RawMessage(strconv.FormatInt(id, 10))
+	if err := c.write(message{ID: &rawID, Method: method, Params: marshal(params)}); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		return resp.result, resp.err
+	case <-ctx.Done():
+		// Let the server stop working on it; it still answers, which is ignored
+		c.notify("$/cancelRequest", map[string]int64{"id": id})
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// notify sends a notification
+func (c *Client) notify(method string, params interface{}) error {
+	return c.write(message{Method: method, Params: marshal(params)})
+}
+
+func (c *Client) write(msg message) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := fmt.Fprintf(c.stdin, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.stdin.Write(body)
+	return err
+}
+
+func marshal(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// read dispatches the server's messages until it exits
+func (c *Client) read(stdout io.Reader) {
+	defer func() {
+		c.cmd.Wait()
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.done)
+	}()
+	reader := bufio.NewReader(stdout)
+	headers := textproto.NewReader(reader)
+	for {
+		header, err := headers.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil || length < 0 || length > maxMessageSize {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			continue
+		}
+		c.handle(msg)
+	}
+}
+
+func (c *Client) handle(msg message) {
+	switch {
+	case msg.Method != "" && msg.ID != nil:
+		// Requests from the server, e.g. for configuration or progress
+		// reporting, get empty answers so it doesn't wait on them
+		result := json.RawMessage("null")
+		if msg.Method == "workspace/configuration" {
+			var params struct {
+				Items []json.RawMessage `json:"items"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			result = marshal(make([]interface{}, len(params.Items)))
+		}
+		c.write(message{ID: msg.ID, Result: result})
+	case msg.Method == "textDocument/publishDiagnostics":
+		var params struct {
+			URI         string          `json:"uri"`
+			Diagnostics json.RawMessage `json:"diagnostics"`
+		}
+		if json.Unmarshal(msg.Params, &params) == nil && c.diagnostics != nil {
+			c.diagnostics(params.URI, params.Diagnostics)
+		}
+	case msg.ID != nil:
+		id, err := strconv.ParseInt(string(*msg.ID), 10, 64)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		if msg.Error != nil {
+			ch <- response{err: msg.Error}
+		} else {
+			ch <- response{result: msg.Result}
+		}
+	}
+}
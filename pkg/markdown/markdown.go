@@ -0,0 +1,21 @@
+// Package markdown renders the markdown of tab notes to HTML with goldmark:
+// CommonMark plus GitHub's strikethrough. Raw HTML in notes is left out of the
+// output, which should still be sanitized before it's served.
+package markdown
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var renderer = goldmark.New(goldmark.WithExtensions(extension.Strikethrough))
+
+// Render returns the HTML for a markdown document
+func Render(source string) string {
+	var buf bytes.Buffer
+	// Converting only fails when writing does, which a buffer doesn't
+	_ = renderer.Convert([]byte(source), &buf)
+	return buf.String()
+}
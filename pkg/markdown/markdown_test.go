@@ -0,0 +1,47 @@
+package markdown
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name, source, want string
+	}{
+		{
+			"link",
+			`See [the *docs*](https://example.com/a_(b) "Docs").`,
+			"<p>See <a href=\"https://example.com/a_(b)\" title=\"Docs\">the <em>docs</em></a>.</p>\n",
+		},
+		{
+			"image",
+			`![a *diagram*](/img/d.png)`,
+			"<p><img src=\"/img/d.png\" alt=\"a diagram\"></p>\n",
+		},
+		{
+			"nested list",
+			"- one\n  1. first\n  2. second\n- two\n",
+			"<ul>\n<li>one\n<ol>\n<li>first</li>\n<li>second</li>\n</ol>\n</li>\n<li>two</li>\n</ul>\n",
+		},
+		{
+			"fence",
+			"```go\nif a < b {\n}\n```\n",
+			"<pre><code class=\"language-go\">if a &lt; b {\n}\n</code></pre>\n",
+		},
+		{
+			"strikethrough",
+			"~~gone~~",
+			"<p><del>gone</del></p>\n",
+		},
+		{
+			"raw html",
+			"<script>alert(1)</script>\n",
+			"<!-- raw HTML omitted -->\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Render(tt.source); got != tt.want {
+				t.Errorf("Render(%q)\n got %q\nwant %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Labels holds the label set attached to a single metric sample
+type Labels map[string]string
+
+// key returns a stable string representation of the label set
+func (l Labels) key() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%q", name, l[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// Registry holds a set of named metrics
+type Registry struct {
+	mu         sync.RWMutex
+	counters   map[string]*Counter
+	gauges     map[string]*Gauge
+	histograms map[string]*Histogram
+}
+
+// Default is the registry used by the package level constructors
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]*Counter),
+		gauges:     make(map[string]*Gauge),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	name   string
+	help   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Counter returns the counter with the given name, creating it if needed
+func (r *Registry) Counter(name, help string) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.counters[name]; ok {
+		return c
+	}
+	c := &Counter{name: name, help: help, values: make(map[string]float64)}
+	r.counters[name] = c
+	return c
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc(labels Labels) {
+	c.Add(1, labels)
+}
+
+// Add increments the counter by v
+func (c *Counter) Add(v float64, labels Labels) {
+	if c == nil || v < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.values[labels.key()] += v
+	c.mu.Unlock()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	name   string
+	help   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Gauge returns the gauge with the given name, creating it if needed
+func (r *Registry) Gauge(name, help string) *Gauge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if g, ok := r.gauges[name]; ok {
+		return g
+	}
+	g := &Gauge{name: name, help: help, values: make(map[string]float64)}
+	r.gauges[name] = g
+	return g
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64, labels Labels) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.values[labels.key()] = v
+	g.mu.Unlock()
+}
+
+// Add adds v (which may be negative) to the gauge
+func (g *Gauge) Add(v float64, labels Labels) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.values[labels.key()] += v
+	g.mu.Unlock()
+}
+
+// DefaultBuckets are latency buckets in seconds
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Histogram tracks the distribution of observed values
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram returns the histogram with the given name, creating it if needed
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h, ok := r.histograms[name]; ok {
+		return h
+	}
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{name: name, help: help, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.histograms[name] = h
+	return h
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64, labels Labels) {
+	if h == nil {
+		return
+	}
+	key := labels.key()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// NewCounter registers a counter with the default registry
+func NewCounter(name, help string) *Counter {
+	return Default.Counter(name, help)
+}
+
+// NewGauge registers a gauge with the default registry
+func NewGauge(name, help string) *Gauge {
+	return Default.Gauge(name, help)
+}
+
+// NewHistogram registers a histogram with the default registry
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.Histogram(name, help, buckets)
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, name := range sortedKeys(r.counters) {
+		c := r.counters[name]
+		c.mu.Lock()
+		err := writeSimple(w, c.name, c.help, "counter", c.values)
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(r.gauges) {
+		g := r.gauges[name]
+		g.mu.Lock()
+		err := writeSimple(w, g.name, g.help, "gauge", g.values)
+		g.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(r.histograms) {
+		h := r.histograms[name]
+		h.mu.Lock()
+		err := writeHistogram(w, h)
+		h.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns an http.Handler serving the registry contents
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+func writeSimple(w io.Writer, name, help, kind string, values map[string]float64) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(values) {
+		if _, err := fmt.Fprintf(w, "%s%s %g\n", name, braces(key), values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHistogram(w io.Writer, h *Histogram) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			le := fmt.Sprintf("le=%q", fmt.Sprintf("%g", bound))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(join(key, le)), s.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, braces(join(key, `le="+Inf"`)), s.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", h.name, braces(key), s.sum, h.name, braces(key), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func braces(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "{" + key + "}"
+}
+
+func join(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,69 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Dir publishes pages to a local directory, for a web server or sync job to pick up
+type Dir struct {
+	root string
+}
+
+// NewDir creates a target writing below root
+func NewDir(root string) *Dir {
+	return &Dir{root: root}
+}
+
+// Put writes a page, replacing any previous version atomically so readers
+// never see a partial page
+func (d *Dir) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	path := filepath.Join(d.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mirror-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads a file, returning an error matching fs.ErrNotExist when there is none
+func (d *Dir) Get(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(d.root, filepath.FromSlash(name)))
+}
+
+// Size returns a file's size, returning an error matching fs.ErrNotExist when there is none
+func (d *Dir) Size(ctx context.Context, name string) (int64, error) {
+	info, err := os.Stat(filepath.Join(d.root, filepath.FromSlash(name)))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Delete removes a page and its directory once empty
+func (d *Dir) Delete(ctx context.Context, name string) error {
+	path := filepath.Join(d.root, filepath.FromSlash(name))
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	// Leave the directory if something else was put there
+	os.Remove(filepath.Dir(path))
+	return nil
+}
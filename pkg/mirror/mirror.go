@@ -0,0 +1,173 @@
+// Package mirror renders documents to static HTML pages and publishes them to
+// a local directory or an S3 bucket set up for website hosting, giving curated
+// documents such as runbooks a read-only copy that stays available without
+// the server. Each document is published as <id>/index.html.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+const (
+	// queueSize bounds the pages waiting to be published; more are dropped
+	queueSize = 64
+	// publishTimeout bounds how long publishing one page to all targets may take
+	publishTimeout = 30 * time.Second
+)
+
+var publishes = metrics.NewCounter("gopad_mirror_publishes_total", "Number of mirror page publishes and removals by result")
+
+// Target stores published pages
+type Target interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	Delete(ctx context.Context, name string) error
+}
+
+// Page is what a document's mirror page shows
+type Page struct {
+	ID           string
+	Title        string
+	Language     string
+	Tabs         []storage.Tab
+	LastModified time.Time
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}{{.ID}}{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 60rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+pre { background: #f6f8fa; padding: 1rem; overflow-x: auto; border-radius: 4px; }
+.notes { white-space: pre-wrap; }
+footer { color: #666; font-size: 0.875rem; margin-top: 2rem; }
+</style>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}{{.ID}}{{end}}</h1>
+{{range .Tabs}}{{if not .Kind}}<section>
+<h2>{{.Name}}</h2>
+<pre><code class="language-{{$.Language}}">{{.Content}}</code></pre>
+{{if .Notes}}<div class="notes">{{.Notes}}</div>
+{{end}}</section>
+{{end}}{{end}}<footer>Read-only copy{{if not .LastModified.IsZero}}, last updated {{.LastModified.UTC.Format "2006-01-02 15:04 MST"}}{{end}}</footer>
+</body>
+</html>
+`))
+
+// Render returns a page as a standalone HTML document. REPL tabs are left out.
+func Render(page *Page) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := pageTemplate.Execute(&buf, page); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pageName returns where a document's page is stored. IDs are escaped so
+// they can't reach outside the target.
+func pageName(docID string) string {
+	name := url.PathEscape(docID)
+	if strings.Trim(name, ".") == "" {
+		name = strings.ReplaceAll(name, ".", "%2E")
+	}
+	return name + "/index.html"
+}
+
+// job publishes a page, or removes the page of docID when page is nil
+type job struct {
+	docID string
+	page  *Page
+}
+
+// Publisher keeps the pages of mirrored documents up to date on its targets in
+// the background
+type Publisher struct {
+	targets []Target
+	queue   chan job
+	done    chan struct{}
+}
+
+// New creates a publisher writing to every target and starts publishing
+func New(targets ...Target) *Publisher {
+	p := &Publisher{
+		targets: targets,
+		queue:   make(chan job, queueSize),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish queues a document's page for publishing without waiting for it
+func (p *Publisher) Publish(page *Page) {
+	p.enqueue(job{docID: page.ID, page: page})
+}
+
+// Remove queues the removal of a document's page
+func (p *Publisher) Remove(docID string) {
+	p.enqueue(job{docID: docID})
+}
+
+// Close publishes the pages already queued and stops the publisher
+func (p *Publisher) Close() {
+	close(p.queue)
+	<-p.done
+}
+
+func (p *Publisher) enqueue(j job) {
+	select {
+	case p.queue <- j:
+	default:
+		publishes.Inc(metrics.Labels{"result": "dropped"})
+		logger.Warn("Mirror queue full, dropping page", "doc_id", j.docID)
+	}
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+	for j := range p.queue {
+		p.process(j)
+	}
+}
+
+func (p *Publisher) process(j job) {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	var data []byte
+	if j.page != nil {
+		var err error
+		if data, err = Render(j.page); err != nil {
+			publishes.Inc(metrics.Labels{"result": "failed"})
+			logger.Error("Error rendering mirror page", "doc_id", j.docID, "error", err)
+			return
+		}
+	}
+	for _, target := range p.targets {
+		var err error
+		if j.page != nil {
+			err = target.Put(ctx, pageName(j.docID), data, "text/html; charset=utf-8")
+		} else {
+			err = target.Delete(ctx, pageName(j.docID))
+		}
+		if err != nil {
+			publishes.Inc(metrics.Labels{"result": "failed"})
+			logger.Warn("Mirror publish failed", "doc_id", j.docID, "removed", j.page == nil, "error", err)
+			continue
+		}
+		publishes.Inc(metrics.Labels{"result": "ok"})
+	}
+}
@@ -0,0 +1,185 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config locates a bucket and holds the credentials for using it
+type S3Config struct {
+	Bucket string
+	Region string
+	// Endpoint is the host of an S3-compatible service; empty uses AWS
+	Endpoint     string
+	Prefix       string // put before every page name, e.g. "pads/"
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary credentials
+}
+
+// S3 publishes pages to an S3 bucket, signing requests with AWS Signature Version 4
+type S3 struct {
+	config S3Config
+	client *http.Client
+}
+
+// NewS3 creates a target writing to the configured bucket
+func NewS3(config S3Config) *S3 {
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("s3.%s.amazonaws.com", config.Region)
+	}
+	return &S3{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Put uploads a page
+func (s *S3) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	_, err := s.do(ctx, http.MethodPut, name, data, contentType)
+	return err
+}
+
+// Get downloads an object, returning an error matching fs.ErrNotExist when there is none
+func (s *S3) Get(ctx context.Context, name string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, name, nil, "")
+}
+
+// Size returns an object's size, returning an error matching fs.ErrNotExist when there is none
+func (s *S3) Size(ctx context.Context, name string) (int64, error) {
+	resp, err := s.send(ctx, http.MethodHead, name, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Delete removes a page; S3 doesn't complain about pages that don't exist
+func (s *S3) Delete(ctx context.Context, name string) error {
+	_, err := s.do(ctx, http.MethodDelete, name, nil, "")
+	return err
+}
+
+func (s *S3) do(ctx context.Context, method, name string, body []byte, contentType string) ([]byte, error) {
+	resp, err := s.send(ctx, method, name, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if method != http.MethodGet {
+		return nil, nil
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// send makes a signed request, returning the response of a successful one for
+// the caller to close
+func (s *S3) send(ctx context.Context, method, name string, body []byte, contentType string) (*http.Response, error) {
+	// Path-style URLs work with bucket names containing dots and with most S3-compatible services
+	path := "/" + awsEscape(s.config.Bucket) + "/" + awsEscape(s.config.Prefix+name)
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+s.config.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Cache-Control", "max-age=60")
+	}
+	s.sign(req, path, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && (method == http.MethodGet || method == http.MethodHead) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to a request
+func (s *S3) sign(req *http.Request, path string, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	// Every header set above is signed, along with the host
+	headers := map[string]string{"host": s.config.Endpoint}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, "", canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// awsEscape percent-encodes everything but unreserved characters and slashes,
+// as Signature Version 4 expects for object keys
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,240 @@
+// Package moderation checks what users write on public instances before it
+// is shared: tab content edits and display names. Moderators can let text
+// through, reject it or redact parts of it. A deny-list of regular
+// expressions is built in, and an external service can be asked over HTTP.
+package moderation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/webhook"
+)
+
+// Kinds of text that are moderated
+const (
+	KindContent = "content" // a tab's content or notes as written or added
+	KindName    = "name"    // a display name sent with setName
+)
+
+// Action is what a moderator decides to do with text
+type Action string
+
+const (
+	Allow  Action = "allow"
+	Reject Action = "reject"
+	Redact Action = "redact" // let it through with Verdict.Text instead
+)
+
+// maxResponseSize bounds the response read from a moderation service, which
+// may hold a redacted copy of a whole tab
+const maxResponseSize = 16 << 20
+
+var verdicts = metrics.NewCounter("gopad_moderation_verdicts_total", "Number of moderation verdicts by moderator, kind and action")
+
+// Request is text to moderate
+type Request struct {
+	Kind       string `json:"kind"` // KindContent or KindName
+	DocumentID string `json:"documentId"`
+	TabID      string `json:"tabId,omitempty"` // for content
+	User       string `json:"user,omitempty"`  // display name of the author, if known
+	Text       string `json:"text"`
+}
+
+// Verdict is a moderator's decision
+type Verdict struct {
+	Action Action `json:"action"`
+	Text   string `json:"text,omitempty"`   // the redacted text, for Redact
+	Reason string `json:"reason,omitempty"` // logged, not shown to users
+}
+
+// Moderator decides on text before it's shared
+type Moderator interface {
+	Moderate(ctx context.Context, req Request) (Verdict, error)
+}
+
+// Config selects the moderators to use. The zero value uses none.
+type Config struct {
+	// DenyListFile holds regular expressions, one per line; empty lines and
+	// lines starting with # are ignored. Matching is case-insensitive.
+	DenyListFile string
+	// DenyListAction is Reject (the default) or Redact, which masks matches with asterisks
+	DenyListAction Action
+	// WebhookURL is a moderation service asked after the deny-list, with
+	// requests signed like webhooks using WebhookSecret
+	WebhookURL     string
+	WebhookSecret  []byte
+	WebhookTimeout time.Duration // default 2s
+}
+
+// New builds the configured moderators, returning nil when there are none
+func New(config Config) (Moderator, error) {
+	var chain Chain
+	if config.DenyListFile != "" {
+		patterns, err := readDenyList(config.DenyListFile)
+		if err != nil {
+			return nil, err
+		}
+		action := config.DenyListAction
+		if action == "" {
+			action = Reject
+		}
+		if action != Reject && action != Redact {
+			return nil, fmt.Errorf("deny-list action must be %q or %q", Reject, Redact)
+		}
+		chain = append(chain, NewDenyList(patterns, action))
+	}
+	if config.WebhookURL != "" {
+		chain = append(chain, NewWebhook(config.WebhookURL, config.WebhookSecret, config.WebhookTimeout))
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// readDenyList compiles the patterns of a deny-list file
+func readDenyList(path string) ([]*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []*regexp.Regexp
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, scanner.Err()
+}
+
+// Chain asks moderators in order. The first rejection wins, and each
+// moderator sees the text as redacted by the ones before it.
+type Chain []Moderator
+
+// Moderate implements Moderator
+func (c Chain) Moderate(ctx context.Context, req Request) (Verdict, error) {
+	verdict := Verdict{Action: Allow}
+	for _, m := range c {
+		v, err := m.Moderate(ctx, req)
+		if err != nil {
+			return Verdict{}, err
+		}
+		switch v.Action {
+		case Reject:
+			return v, nil
+		case Redact:
+			req.Text = v.Text
+			verdict = v
+		}
+	}
+	return verdict, nil
+}
+
+// DenyList rejects or redacts text matching any of its patterns
+type DenyList struct {
+	patterns []*regexp.Regexp
+	action   Action
+}
+
+// NewDenyList creates a deny-list taking action on matches
+func NewDenyList(patterns []*regexp.Regexp, action Action) *DenyList {
+	return &DenyList{patterns: patterns, action: action}
+}
+
+// Moderate implements Moderator
+func (d *DenyList) Moderate(ctx context.Context, req Request) (Verdict, error) {
+	text, matched := req.Text, false
+	for _, re := range d.patterns {
+		if !re.MatchString(text) {
+			continue
+		}
+		matched = true
+		if d.action == Reject {
+			verdicts.Inc(metrics.Labels{"moderator": "denylist", "kind": req.Kind, "action": string(Reject)})
+			return Verdict{Action: Reject, Reason: "matches " + re.String()}, nil
+		}
+		// Masks keep the length in characters, so cursors elsewhere stay put
+		text = re.ReplaceAllStringFunc(text, func(match string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(match))
+		})
+	}
+	if !matched {
+		return Verdict{Action: Allow}, nil
+	}
+	verdicts.Inc(metrics.Labels{"moderator": "denylist", "kind": req.Kind, "action": string(Redact)})
+	return Verdict{Action: Redact, Text: text, Reason: "deny-list"}, nil
+}
+
+// Webhook asks an external moderation service. The service receives a
+// Request as JSON and answers with a Verdict; any other answer is an error.
+type Webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhook creates a moderator posting to url
+func NewWebhook(url string, secret []byte, timeout time.Duration) *Webhook {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &Webhook{url: url, secret: secret, client: &http.Client{Timeout: timeout}}
+}
+
+// Moderate implements Moderator
+func (w *Webhook) Moderate(ctx context.Context, req Request) (Verdict, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "gopad-moderation/1.0")
+	httpReq.Header.Set("X-GoPad-Signature", webhook.Sign(w.secret, body))
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		verdicts.Inc(metrics.Labels{"moderator": "webhook", "kind": req.Kind, "action": "failed"})
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		verdicts.Inc(metrics.Labels{"moderator": "webhook", "kind": req.Kind, "action": "failed"})
+		return Verdict{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var verdict Verdict
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&verdict); err != nil {
+		verdicts.Inc(metrics.Labels{"moderator": "webhook", "kind": req.Kind, "action": "failed"})
+		return Verdict{}, fmt.Errorf("invalid verdict: %w", err)
+	}
+	switch verdict.Action {
+	case Allow, Reject, Redact:
+	default:
+		verdicts.Inc(metrics.Labels{"moderator": "webhook", "kind": req.Kind, "action": "failed"})
+		return Verdict{}, fmt.Errorf("invalid verdict action %q", verdict.Action)
+	}
+	verdicts.Inc(metrics.Labels{"moderator": "webhook", "kind": req.Kind, "action": string(verdict.Action)})
+	return verdict, nil
+}
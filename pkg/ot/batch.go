@@ -0,0 +1,61 @@
+package ot
+
+import "fmt"
+
+// Batch is a group of operations applied as one unit: either every operation
+// applies or the content is left untouched. Scripted edits such as find and
+// replace or formatting use it so a failure never leaves a half-edited document.
+type Batch struct {
+	Ops []Operation `json:"ops"`
+}
+
+// NewBatch creates a batch of the given operations
+func NewBatch(ops ...Operation) *Batch {
+	return &Batch{Ops: ops}
+}
+
+// Add appends an operation to the batch. Its position refers to the content
+// as left by the operations before it.
+func (b *Batch) Add(op Operation) {
+	b.Ops = append(b.Ops, op)
+}
+
+// Len returns the number of operations in the batch
+func (b *Batch) Len() int {
+	return len(b.Ops)
+}
+
+// Validate checks that every operation is well formed without applying it,
+// so malformed batches can be refused before the content is locked
+func (b *Batch) Validate() error {
+	for i, op := range b.Ops {
+		if err := op.Validate(); err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Apply applies the operations in order to content and returns the result.
+// If any operation doesn't apply, content is returned unchanged with an error
+// naming the operation.
+func (b *Batch) Apply(content string) (string, error) {
+	scratch := &Document{Content: content}
+	for i, op := range b.Ops {
+		if err := scratch.Apply(op); err != nil {
+			return content, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return scratch.Content, nil
+}
+
+// ApplyTo applies the batch to d, recording its operations only if all of them apply
+func (b *Batch) ApplyTo(d *Document) error {
+	content, err := b.Apply(d.Content)
+	if err != nil {
+		return err
+	}
+	d.Content = content
+	d.Operations = append(d.Operations, b.Ops...)
+	return nil
+}
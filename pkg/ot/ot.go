@@ -3,6 +3,7 @@ package ot
 import (
 	"encoding/json"
 	"errors"
+	"unicode/utf8"
 )
 
 // Operation represents a single edit operation
@@ -27,23 +28,44 @@ func NewDocument() *Document {
 	}
 }
 
-// Apply applies an operation to the document
+// Apply applies an operation to the document. Positions and lengths are
+// byte offsets that must fall on UTF-8 sequence boundaries of the content.
 func (d *Document) Apply(op Operation) error {
+	if err := op.Validate(); err != nil {
+		return err
+	}
 	switch op.Type {
 	case "insert":
-		if op.Position < 0 || op.Position > len(d.Content) {
+		if op.Position > len(d.Content) || !runeStart(d.Content, op.Position) {
 			return errors.New("invalid position for insert")
 		}
 		d.Content = d.Content[:op.Position] + op.Text + d.Content[op.Position:]
 	case "delete":
-		if op.Position < 0 || op.Position+op.Length > len(d.Content) {
+		if op.Position > len(d.Content) || op.Length > len(d.Content)-op.Position ||
+			!runeStart(d.Content, op.Position) || !runeStart(d.Content, op.Position+op.Length) {
 			return errors.New("invalid position or length for delete")
 		}
 		d.Content = d.Content[:op.Position] + d.Content[op.Position+op.Length:]
+	}
+	d.Operations = append(d.Operations, op)
+	return nil
+}
+
+// Validate checks the parts of an operation that don't depend on the content
+// it's applied to
+func (op Operation) Validate() error {
+	switch op.Type {
+	case "insert":
+		if op.Position < 0 {
+			return errors.New("invalid position for insert")
+		}
+	case "delete":
+		if op.Position < 0 || op.Length < 0 {
+			return errors.New("invalid position or length for delete")
+		}
 	default:
 		return errors.New("unknown operation type")
 	}
-	d.Operations = append(d.Operations, op)
 	return nil
 }
 
@@ -90,3 +112,38 @@ func DeserializeOperation(data []byte) (Operation, error) {
 	err := json.Unmarshal(data, &op)
 	return op, err
 }
+
+// Diff returns the operations that turn oldText into newText by replacing the
+// region between their common prefix and common suffix. The region never
+// splits a UTF-8 sequence, so inserted text stays valid when encoded as JSON.
+func Diff(oldText, newText string) []Operation {
+	prefix := 0
+	for prefix < len(oldText) && prefix < len(newText) && oldText[prefix] == newText[prefix] {
+		prefix++
+	}
+	for prefix > 0 && (!runeStart(oldText, prefix) || !runeStart(newText, prefix)) {
+		prefix--
+	}
+	suffix := 0
+	for suffix < len(oldText)-prefix && suffix < len(newText)-prefix &&
+		oldText[len(oldText)-1-suffix] == newText[len(newText)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !runeStart(oldText, len(oldText)-suffix) {
+		suffix--
+	}
+
+	var ops []Operation
+	if deleted := len(oldText) - prefix - suffix; deleted > 0 {
+		ops = append(ops, Operation{Type: "delete", Position: prefix, Length: deleted})
+	}
+	if inserted := newText[prefix : len(newText)-suffix]; inserted != "" {
+		ops = append(ops, Operation{Type: "insert", Position: prefix, Text: inserted})
+	}
+	return ops
+}
+
+// runeStart reports whether i is at the start of a UTF-8 sequence in s or at its end
+func runeStart(s string, i int) bool {
+	return i == len(s) || utf8.RuneStart(s[i])
+}
@@ -0,0 +1,44 @@
+package ot
+
+import "testing"
+
+func TestApplyRejectsMalformedOperations(t *testing.T) {
+	tests := []struct {
+		name string
+		op   Operation
+	}{
+		{"negative insert position", Operation{Type: "insert", Position: -1, Text: "x"}},
+		{"insert past end", Operation{Type: "insert", Position: 7, Text: "x"}},
+		{"insert inside rune", Operation{Type: "insert", Position: 2, Text: "x"}},
+		{"negative delete length", Operation{Type: "delete", Position: 3, Length: -2}},
+		{"delete past end", Operation{Type: "delete", Position: 3, Length: 4}},
+		{"delete from inside rune", Operation{Type: "delete", Position: 2, Length: 1}},
+		{"delete into rune", Operation{Type: "delete", Position: 0, Length: 2}},
+		{"unknown type", Operation{Type: "replace"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// é is two bytes, at offsets 1 and 2
+			d := &Document{Content: "héllo"}
+			if err := d.Apply(tt.op); err == nil {
+				t.Fatalf("expected an error, content is now %q", d.Content)
+			}
+			if d.Content != "héllo" || len(d.Operations) != 0 {
+				t.Errorf("document changed to %q", d.Content)
+			}
+		})
+	}
+}
+
+func TestBatchValidate(t *testing.T) {
+	b := NewBatch(
+		Operation{Type: "insert", Position: 0, Text: "a"},
+		Operation{Type: "delete", Position: 0, Length: -1},
+	)
+	if err := b.Validate(); err == nil {
+		t.Fatal("expected a negative length to be refused")
+	}
+	if err := NewBatch(Operation{Type: "insert", Position: 0, Text: "a"}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Package policy resolves a document's settings from the policy of the
+// workspace it belongs to. Workspace admins set defaults, which documents
+// inherit unless they choose their own value, and limits, which they can't exceed.
+package policy
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Features a workspace can switch off for its documents
+const (
+	FeatureExport    = "export"    // the export endpoint
+	FeaturePromote   = "promote"   // promoting a tab to its own document
+	FeatureUnfurl    = "unfurl"    // link previews
+	FeatureExecution = "execution" // REPL tabs running code
+	FeatureImport    = "import"    // importing tabs from URLs
+)
+
+// Features lists every feature name
+var Features = []string{FeatureExport, FeaturePromote, FeatureUnfurl, FeatureExecution, FeatureImport}
+
+// Visibility levels of a document
+const (
+	// VisibilityPublic documents are served by the raw and export endpoints to anyone with the link
+	VisibilityPublic = "public"
+	// VisibilityPrivate documents are only served to admin or signed requests
+	VisibilityPrivate = "private"
+)
+
+// Who may change a document's structure: create, delete, rename and reorder
+// its tabs and change its language. Everyone may always edit tab content.
+const (
+	// TabChangesEveryone lets every editor change the structure
+	TabChangesEveryone = "everyone"
+	// TabChangesElevated only lets editors connected with an editor token change it
+	TabChangesElevated = "elevated"
+)
+
+// Duration is a time.Duration written as a string such as "72h" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Settings are options of a document. Zero values are unset: documents
+// inherit them from the workspace defaults, and features are on unless switched off.
+type Settings struct {
+	TTL        Duration        `json:"ttl,omitempty"`        // how long the document is kept after its last change
+	Visibility string          `json:"visibility,omitempty"` // VisibilityPublic or VisibilityPrivate
+	Features   map[string]bool `json:"features,omitempty"`   // feature name -> enabled
+	TabChanges string          `json:"tabChanges,omitempty"` // TabChangesEveryone or TabChangesElevated
+}
+
+// Enabled reports whether feature is turned on
+func (s Settings) Enabled(feature string) bool {
+	enabled, ok := s.Features[feature]
+	return enabled || !ok
+}
+
+// Validate checks that the settings only use known values
+func (s Settings) Validate() error {
+	if s.TTL < 0 || (s.TTL > 0 && s.TTL < Duration(time.Minute)) {
+		return apperr.New(apperr.CodeValidation, "ttl must be at least a minute")
+	}
+	switch s.Visibility {
+	case "", VisibilityPublic, VisibilityPrivate:
+	default:
+		return apperr.Newf(apperr.CodeValidation, "unknown visibility %q", s.Visibility)
+	}
+	for feature := range s.Features {
+		if !slices.Contains(Features, feature) {
+			return apperr.Newf(apperr.CodeValidation, "unknown feature %q", feature)
+		}
+	}
+	switch s.TabChanges {
+	case "", TabChangesEveryone, TabChangesElevated:
+	default:
+		return apperr.Newf(apperr.CodeValidation, "unknown tabChanges %q", s.TabChanges)
+	}
+	return nil
+}
+
+// Limits are hard caps a workspace puts on its documents; zero values are unlimited
+type Limits struct {
+	MaxTabs    int      `json:"maxTabs,omitempty"`
+	MaxTabSize int      `json:"maxTabSize,omitempty"`
+	MaxDocSize int      `json:"maxDocSize,omitempty"`
+	MaxTTL     Duration `json:"maxTtl,omitempty"`
+	Visibility string   `json:"visibility,omitempty"` // when set, the only visibility documents may use
+	Disabled   []string `json:"disabled,omitempty"`   // features documents can't turn on
+}
+
+// Policy is what a workspace admin sets for the documents in the workspace
+type Policy struct {
+	Defaults Settings `json:"defaults"`
+	Limits   Limits   `json:"limits"`
+}
+
+// Validate checks that the policy only uses known values and that its
+// defaults are within its own limits
+func (p *Policy) Validate() error {
+	if p.Limits.MaxTabs < 0 || p.Limits.MaxTabSize < 0 || p.Limits.MaxDocSize < 0 || p.Limits.MaxTTL < 0 {
+		return apperr.New(apperr.CodeValidation, "limits must not be negative")
+	}
+	if err := (Settings{Visibility: p.Limits.Visibility}).Validate(); err != nil {
+		return err
+	}
+	for _, feature := range p.Limits.Disabled {
+		if !slices.Contains(Features, feature) {
+			return apperr.Newf(apperr.CodeValidation, "unknown feature %q", feature)
+		}
+	}
+	if err := p.Defaults.Validate(); err != nil {
+		return err
+	}
+	return p.Check(p.Defaults)
+}
+
+// Check returns an error if a document's settings exceed the policy's limits.
+// A nil policy allows anything.
+func (p *Policy) Check(s Settings) error {
+	if p == nil {
+		return nil
+	}
+	if max := p.Limits.MaxTTL; max > 0 && s.TTL > max {
+		return apperr.Newf(apperr.CodeLimitExceeded, "ttl exceeds the workspace limit of %s", time.Duration(max))
+	}
+	if only := p.Limits.Visibility; only != "" && s.Visibility != "" && s.Visibility != only {
+		return apperr.Newf(apperr.CodeLimitExceeded, "the workspace only allows %s documents", only)
+	}
+	for feature, enabled := range s.Features {
+		if enabled && slices.Contains(p.Limits.Disabled, feature) {
+			return apperr.Newf(apperr.CodeLimitExceeded, "%s is disabled by the workspace policy", feature)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the settings in effect for a document with settings s:
+// its own values, falling back to the workspace defaults, then held to the
+// limits. Visibility resolves to public and tab changes to everyone when
+// nothing sets them. A nil policy has no defaults or limits.
+func (p *Policy) Resolve(s Settings) Settings {
+	if p == nil {
+		p = &Policy{}
+	}
+	resolved := Settings{
+		TTL:        s.TTL,
+		Visibility: s.Visibility,
+		Features:   make(map[string]bool),
+		TabChanges: s.TabChanges,
+	}
+	if resolved.TTL == 0 {
+		resolved.TTL = p.Defaults.TTL
+	}
+	if max := p.Limits.MaxTTL; max > 0 && (resolved.TTL == 0 || resolved.TTL > max) {
+		resolved.TTL = max
+	}
+	if resolved.Visibility == "" {
+		resolved.Visibility = p.Defaults.Visibility
+	}
+	if p.Limits.Visibility != "" {
+		resolved.Visibility = p.Limits.Visibility
+	}
+	if resolved.Visibility == "" {
+		resolved.Visibility = VisibilityPublic
+	}
+	if resolved.TabChanges == "" {
+		resolved.TabChanges = p.Defaults.TabChanges
+	}
+	if resolved.TabChanges == "" {
+		resolved.TabChanges = TabChangesEveryone
+	}
+	for _, feature := range Features {
+		enabled := p.Defaults.Enabled(feature)
+		if own, ok := s.Features[feature]; ok {
+			enabled = own
+		}
+		resolved.Features[feature] = enabled && !slices.Contains(p.Limits.Disabled, feature)
+	}
+	return resolved
+}
+
+// Cap returns the stricter of two limits, where zero means unlimited
+func Cap(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
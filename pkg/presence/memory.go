@@ -0,0 +1,68 @@
+package presence
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a Store kept in process memory, for single instance deployments
+type Memory struct {
+	mu   sync.Mutex
+	docs map[string]map[string]memoryEntry // doc ID -> uuid -> entry
+}
+
+type memoryEntry struct {
+	Entry
+	expires time.Time
+}
+
+// NewMemory creates an empty in-memory presence store
+func NewMemory() *Memory {
+	return &Memory{docs: make(map[string]map[string]memoryEntry)}
+}
+
+// Heartbeat records that a user is present until ttl passes
+func (m *Memory) Heartbeat(ctx context.Context, docID string, entry Entry, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users, ok := m.docs[docID]
+	if !ok {
+		users = make(map[string]memoryEntry)
+		m.docs[docID] = users
+	}
+	users[entry.UUID] = memoryEntry{Entry: entry, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+// Remove drops a user's entry
+func (m *Memory) Remove(ctx context.Context, docID, uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if users, ok := m.docs[docID]; ok {
+		delete(users, uuid)
+		if len(users) == 0 {
+			delete(m.docs, docID)
+		}
+	}
+	return nil
+}
+
+// List returns the unexpired entries for a document, pruning expired ones
+func (m *Memory) List(ctx context.Context, docID string) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var entries []Entry
+	for uuid, e := range m.docs[docID] {
+		if now.After(e.expires) {
+			delete(m.docs[docID], uuid)
+			continue
+		}
+		entries = append(entries, e.Entry)
+	}
+	if len(m.docs[docID]) == 0 {
+		delete(m.docs, docID)
+	}
+	return entries, nil
+}
@@ -0,0 +1,33 @@
+// Package presence tracks who is connected to each document. It is kept apart
+// from document storage so presence can live in its own short-lived keys and
+// be shared between server instances without touching document content.
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Entry describes one user present in a document
+type Entry struct {
+	UUID     string          `json:"uuid"`
+	Name     string          `json:"name"`
+	Color    string          `json:"color"`
+	Cursor   json.RawMessage `json:"cursor,omitempty"` // last cursor message the user sent
+	Instance string          `json:"instance"`         // server instance the user is connected to
+	Peer     string          `json:"peer,omitempty"`   // federated instance the user connects through, if any
+
+	AvatarURL    string `json:"avatarUrl,omitempty"`
+	GravatarHash string `json:"gravatarHash,omitempty"`
+}
+
+// Store records presence entries that expire unless they are renewed
+type Store interface {
+	// Heartbeat records that a user is present until ttl passes without another heartbeat
+	Heartbeat(ctx context.Context, docID string, entry Entry, ttl time.Duration) error
+	// Remove drops a user's entry before it expires
+	Remove(ctx context.Context, docID, uuid string) error
+	// List returns the unexpired entries for a document
+	List(ctx context.Context, docID string) ([]Entry, error)
+}
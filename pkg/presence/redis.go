@@ -0,0 +1,97 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Redis is a Store that keeps each user in its own key with a short TTL, so
+// entries outlive a server restart but disappear once heartbeats stop.
+// A sorted set indexes the users of a document by expiry. Keys share a hash
+// tag so a document's presence stays in one cluster slot.
+type Redis struct {
+	client redis.UniversalClient
+}
+
+// NewRedis creates a presence store on the given Redis connection
+func NewRedis(client redis.UniversalClient) *Redis {
+	return &Redis{client: client}
+}
+
+func indexKey(docID string) string {
+	return fmt.Sprintf("presence:{%s}", docID)
+}
+
+func entryKey(docID, uuid string) string {
+	return fmt.Sprintf("presence:{%s}:%s", docID, uuid)
+}
+
+// Heartbeat writes the user's entry and renews its TTL
+func (r *Redis) Heartbeat(ctx context.Context, docID string, entry Entry, ttl time.Duration) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal presence entry")
+	}
+	expires := time.Now().Add(ttl).UnixMilli()
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, entryKey(docID, entry.UUID), data, ttl)
+	pipe.ZAdd(ctx, indexKey(docID), redis.Z{Score: float64(expires), Member: entry.UUID})
+	pipe.PExpire(ctx, indexKey(docID), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to record presence")
+	}
+	return nil
+}
+
+// Remove deletes the user's entry
+func (r *Redis) Remove(ctx context.Context, docID, uuid string) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, entryKey(docID, uuid))
+	pipe.ZRem(ctx, indexKey(docID), uuid)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to remove presence")
+	}
+	return nil
+}
+
+// List returns the unexpired entries for a document
+func (r *Redis) List(ctx context.Context, docID string) ([]Entry, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := r.client.ZRemRangeByScore(ctx, indexKey(docID), "-inf", "("+now).Err(); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to prune presence")
+	}
+	uuids, err := r.client.ZRange(ctx, indexKey(docID), 0, -1).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list presence")
+	}
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(uuids))
+	for i, uuid := range uuids {
+		keys[i] = entryKey(docID, uuid)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load presence")
+	}
+	entries := make([]Entry, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // expired between the index read and the lookup
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
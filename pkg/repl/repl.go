@@ -0,0 +1,116 @@
+// Package repl runs interactive interpreter sessions for REPL tabs. The
+// server doesn't sandbox anything itself: each runtime is started with a
+// command configured by the operator, which is expected to confine the
+// interpreter, e.g. by running it in a container without network access.
+package repl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// chunkSize is the most output passed to the output callback at once
+const chunkSize = 4096
+
+// Session is a running interpreter whose output is streamed to a callback
+type Session struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Start launches command and calls output with everything it writes to
+// stdout and stderr, in order, until it exits. The process is killed when ctx
+// is cancelled or the session is closed.
+func Start(ctx context.Context, command []string, output func([]byte)) (*Session, error) {
+	if len(command) == 0 {
+		return nil, errors.New("no command configured")
+	}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	// Run in its own process group so children of the interpreter are killed too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait on output held open by processes the interpreter left behind
+	cmd.WaitDelay = time.Second
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	s := &Session{cmd: cmd, stdin: stdin, done: make(chan struct{})}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				output(chunk)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		cmd.Wait()
+		writer.Close()
+		// Deliver all output before reporting the exit
+		<-drained
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// Write sends input to the interpreter's stdin
+func (s *Session) Write(input string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("session is closed")
+	}
+	_, err := io.WriteString(s.stdin, input)
+	return err
+}
+
+// Done is closed once the interpreter has exited
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// ExitCode returns the interpreter's exit code once Done is closed, or -1 if it was killed
+func (s *Session) ExitCode() int {
+	return s.cmd.ProcessState.ExitCode()
+}
+
+// Close kills the interpreter and waits for it to exit
+func (s *Session) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.stdin.Close()
+		if s.cmd.Process != nil {
+			syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	s.mu.Unlock()
+	<-s.done
+}
@@ -0,0 +1,41 @@
+package runner
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// DisplayPrefix starts a line of stdout carrying rich output, followed by a
+// JSON Display, e.g. `@gopad-display {"mimeType": "image/png", "data": "iVBOR..."}`.
+// Programs print such lines to show images, tables or formatted text below
+// their tab like a notebook cell.
+const DisplayPrefix = "@gopad-display "
+
+// Display is rich output a program printed. Data is base64 for binary types
+// such as images and the text itself otherwise.
+type Display struct {
+	MIMEType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// SplitDisplays separates the display lines of a program's stdout from its
+// plain text. Lines that start with DisplayPrefix but don't hold valid JSON
+// are left in the text.
+func SplitDisplays(stdout string) (string, []Display) {
+	if !strings.Contains(stdout, DisplayPrefix) {
+		return stdout, nil
+	}
+	var text strings.Builder
+	var displays []Display
+	for _, line := range strings.SplitAfter(stdout, "\n") {
+		if payload, ok := strings.CutPrefix(line, DisplayPrefix); ok {
+			var d Display
+			if err := json.Unmarshal([]byte(strings.TrimSpace(payload)), &d); err == nil && d.MIMEType != "" {
+				displays = append(displays, d)
+				continue
+			}
+		}
+		text.WriteString(line)
+	}
+	return text.String(), displays
+}
@@ -0,0 +1,230 @@
+// Package runner executes programs in a sandbox, one run per request, and
+// streams their output. Unlike REPL sessions, whose commands must confine
+// themselves, the runner puts every program in a Docker container or an nsjail
+// with no network, a read-only filesystem and limits on CPU, memory and time.
+// The program is mounted read-only at /code/main.<ext>.
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+)
+
+// Sandboxes
+const (
+	SandboxDocker = "docker"
+	SandboxNsjail = "nsjail"
+)
+
+const (
+	// chunkSize is the most output passed to the output callback at once
+	chunkSize = 4096
+	// outputLimit is how much output a run may produce before it's killed
+	outputLimit = 1 << 20
+	// codeDir is where the program is mounted in the sandbox
+	codeDir = "/code"
+)
+
+// Config selects the sandbox and what runs in it
+type Config struct {
+	Sandbox string // SandboxDocker or SandboxNsjail
+	// Commands maps languages to the command running a program inside the
+	// sandbox, e.g. "python" -> ["python3", "/code/main.py"]. Languages
+	// without a command can't be run.
+	Commands map[string][]string
+	// Images maps languages to the Docker image their command runs in
+	Images   map[string]string
+	Timeout  time.Duration
+	MemoryMB int
+	CPUs     float64
+}
+
+// Result describes how a run ended
+type Result struct {
+	ExitCode  int  `json:"exitCode"`
+	TimedOut  bool `json:"timedOut,omitempty"`
+	Truncated bool `json:"truncated,omitempty"` // killed for producing too much output
+}
+
+// Runner executes programs according to its configuration
+type Runner struct {
+	config Config
+}
+
+// New creates a runner
+func New(config Config) *Runner {
+	return &Runner{config: config}
+}
+
+// Supports reports whether programs in language can be run
+func (r *Runner) Supports(language string) bool {
+	if len(r.config.Commands[language]) == 0 {
+		return false
+	}
+	return r.config.Sandbox != SandboxDocker || r.config.Images[language] != ""
+}
+
+// Run executes code written in language and calls output with what it writes
+// to "stdout" and "stderr" until it exits, is killed for exceeding its limits
+// or ctx is cancelled.
+func (r *Runner) Run(ctx context.Context, language, code string, output func(stream string, data []byte)) (Result, error) {
+	if !r.Supports(language) {
+		return Result{}, fmt.Errorf("no command configured for %s", language)
+	}
+	dir, err := os.MkdirTemp("", "gopad-run-")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+	// The sandbox runs as nobody, which must be able to read the program
+	if err := os.Chmod(dir, 0o755); err != nil {
+		return Result{}, err
+	}
+	name := "main"
+	if ext := suggest.Extension(language); ext != "" {
+		name += "." + ext
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(code), 0o644); err != nil {
+		return Result{}, err
+	}
+
+	if r.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, r.config.Timeout, errTimeout)
+		defer cancel()
+	}
+	ctx, kill := context.WithCancelCause(ctx)
+	defer kill(nil)
+
+	cmd := r.command(ctx, language, dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return Result{}, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return Result{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return Result{}, err
+	}
+
+	var mu sync.Mutex
+	written := 0
+	forward := func(stream string, reader io.Reader, wg *sync.WaitGroup) {
+		defer wg.Done()
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				mu.Lock()
+				if written+n > outputLimit {
+					n = outputLimit - written
+					kill(errOutputLimit)
+				}
+				written += n
+				if n > 0 {
+					chunk := make([]byte, n)
+					copy(chunk, buf[:n])
+					output(stream, chunk)
+				}
+				mu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go forward("stdout", stdout, &wg)
+	go forward("stderr", stderr, &wg)
+	// Output must be read completely before waiting
+	wg.Wait()
+	err = cmd.Wait()
+
+	result := Result{ExitCode: cmd.ProcessState.ExitCode()}
+	switch context.Cause(ctx) {
+	case errTimeout:
+		result.TimedOut = true
+	case errOutputLimit:
+		result.Truncated = true
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) && !result.TimedOut && !result.Truncated && ctx.Err() == nil {
+		return result, err
+	}
+	return result, nil
+}
+
+var (
+	errTimeout     = errors.New("run timed out")
+	errOutputLimit = errors.New("run produced too much output")
+)
+
+// command builds the sandboxed command for a program in dir
+func (r *Runner) command(ctx context.Context, language, dir string) *exec.Cmd {
+	var args []string
+	var cleanup func()
+	switch r.config.Sandbox {
+	case SandboxNsjail:
+		args = []string{"nsjail", "--mode", "o", "--quiet",
+			"--chroot", "/", "--user", "65534", "--group", "65534",
+			"--bindmount_ro", dir + ":" + codeDir, "--tmpfsmount", "/tmp", "--env", "HOME=/tmp",
+		}
+		if r.config.Timeout > 0 {
+			// Backs up the context deadline in case the server dies mid-run
+			args = append(args, "--time_limit", strconv.Itoa(int(r.config.Timeout.Seconds())+1))
+		}
+		if r.config.MemoryMB > 0 {
+			args = append(args, "--rlimit_as", strconv.Itoa(r.config.MemoryMB))
+		}
+		if r.config.CPUs > 0 {
+			args = append(args, "--cgroup_cpu_ms_per_sec", strconv.Itoa(int(r.config.CPUs*1000)))
+		}
+		args = append(args, "--")
+	default:
+		name := fmt.Sprintf("gopad-run-%s", filepath.Base(dir))
+		args = []string{"docker", "run", "--rm", "--name", name,
+			"--network", "none", "--read-only", "--tmpfs", "/tmp:rw,exec,size=64m",
+			"--cap-drop", "ALL", "--security-opt", "no-new-privileges", "--pids-limit", "64",
+			"--user", "65534:65534", "--env", "HOME=/tmp", "--volume", dir + ":" + codeDir + ":ro",
+		}
+		if r.config.MemoryMB > 0 {
+			memory := fmt.Sprintf("%dm", r.config.MemoryMB)
+			args = append(args, "--memory", memory, "--memory-swap", memory)
+		}
+		if r.config.CPUs > 0 {
+			args = append(args, "--cpus", strconv.FormatFloat(r.config.CPUs, 'f', -1, 64))
+		}
+		args = append(args, r.config.Images[language])
+		// Killing the docker client leaves the container running
+		cleanup = func() {
+			exec.Command("docker", "rm", "--force", name).Run()
+		}
+	}
+	args = append(args, r.config.Commands[language]...)
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		if cleanup != nil {
+			cleanup()
+		}
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait on output held open by processes the program left behind
+	cmd.WaitDelay = time.Second
+	return cmd
+}
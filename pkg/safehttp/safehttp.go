@@ -0,0 +1,76 @@
+// Package safehttp provides HTTP clients for fetching URLs supplied by users
+// without letting them reach the server's own network. Connections to
+// loopback, private, link-local and other non-public addresses are refused
+// after DNS resolution and on every redirect, so neither hostnames pointing
+// inwards nor redirects can get around the check.
+package safehttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// maxRedirects bounds the redirects followed for one request
+const maxRedirects = 3
+
+var (
+	// ErrBlockedAddress is returned when a URL resolves to a non-public address
+	ErrBlockedAddress = errors.New("address is not public")
+	// ErrInvalidScheme is returned when a redirect leads away from http(s)
+	ErrInvalidScheme = errors.New("only http and https URLs can be fetched")
+)
+
+// NewClient returns a client that only connects to public addresses and gives
+// up on a request after timeout
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		// Checked after DNS resolution, so hostnames can't be used to reach internal addresses
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !IsPublic(ip) {
+				return ErrBlockedAddress
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		Proxy:                 nil, // a proxy would hide the real destination from the address check
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrInvalidScheme
+			}
+			return nil
+		},
+	}
+}
+
+// carrierGradeNAT is 100.64.0.0/10, shared address space not covered by net.IP.IsPrivate
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublic reports whether ip is a globally routable unicast address
+func IsPublic(ip net.IP) bool {
+	return ip.IsGlobalUnicast() &&
+		!ip.IsPrivate() &&
+		!ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() &&
+		!carrierGradeNAT.Contains(ip)
+}
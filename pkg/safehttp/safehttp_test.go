@@ -0,0 +1,88 @@
+package safehttp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := IsPublic(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("IsPublic(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, err := NewClient(time.Second).Get(srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("expected ErrBlockedAddress, got %v", err)
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	client := NewClient(time.Second)
+	request := func(rawURL string) *http.Request {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Request{URL: u}
+	}
+	via := func(n int) []*http.Request {
+		return make([]*http.Request, n)
+	}
+
+	tests := []struct {
+		name    string
+		req     *http.Request
+		via     []*http.Request
+		wantErr bool
+	}{
+		{"https", request("https://example.com/a"), via(1), false},
+		{"http", request("http://example.com/a"), via(2), false},
+		{"too many", request("https://example.com/a"), via(maxRedirects), true},
+		{"file scheme", request("file:///etc/passwd"), via(1), true},
+		{"gopher scheme", request("gopher://example.com/"), via(1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := client.CheckRedirect(tt.req, tt.via)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
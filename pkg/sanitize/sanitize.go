@@ -0,0 +1,70 @@
+package sanitize
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// Policy selects how much HTML is allowed through when rendering user content
+type Policy string
+
+const (
+	// PolicyStrict removes all markup
+	PolicyStrict Policy = "strict"
+	// PolicyUGC allows the formatting elements commonly produced by markdown
+	PolicyUGC Policy = "ugc"
+)
+
+// Sanitizer cleans user-controlled strings before they are re-served
+type Sanitizer struct {
+	html        *bluemonday.Policy
+	labels      *bluemonday.Policy
+	maxLabelLen int
+}
+
+// New creates a sanitizer for the given policy. Labels (user and tab names)
+// are truncated to maxLabelLen runes; zero leaves them untruncated.
+func New(policy Policy, maxLabelLen int) *Sanitizer {
+	var htmlPolicy *bluemonday.Policy
+	switch policy {
+	case PolicyStrict:
+		htmlPolicy = bluemonday.StrictPolicy()
+	default:
+		htmlPolicy = bluemonday.UGCPolicy()
+		htmlPolicy.RequireNoFollowOnLinks(true)
+		htmlPolicy.AddTargetBlankToFullyQualifiedLinks(true)
+	}
+	return &Sanitizer{
+		html:        htmlPolicy,
+		labels:      bluemonday.StrictPolicy(),
+		maxLabelLen: maxLabelLen,
+	}
+}
+
+// HTML sanitizes an HTML fragment that will be served to browsers
+func (s *Sanitizer) HTML(in string) string {
+	return s.html.Sanitize(in)
+}
+
+// Label cleans a short plain-text string such as a user or tab name: markup and
+// control characters are removed, whitespace is collapsed and the length is capped
+func (s *Sanitizer) Label(in string) string {
+	// Strip tags, then undo the entity escaping so clients don't show "&amp;"
+	text := html.UnescapeString(s.labels.Sanitize(in))
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+	if s.maxLabelLen > 0 {
+		if runes := []rune(text); len(runes) > s.maxLabelLen {
+			text = string(runes[:s.maxLabelLen])
+		}
+	}
+	return text
+}
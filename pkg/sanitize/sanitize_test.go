@@ -0,0 +1,65 @@
+package sanitize
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		maxLen int
+		want   string
+	}{
+		{"plain", "main.go", 0, "main.go"},
+		{"tags stripped", "<b>bold</b> name", 0, "bold name"},
+		{"script removed", "a<script>alert(1)</script>b", 0, "ab"},
+		{"entities unescaped", "Tom &amp; Jerry", 0, "Tom & Jerry"},
+		{"escaped markup stays text", "&lt;b&gt;", 0, "<b>"},
+		{"control characters", "a\x00b\tc\nd", 0, "a b c d"},
+		{"whitespace collapsed", "  lots   of space  ", 0, "lots of space"},
+		{"truncated", "abcdefgh", 5, "abcde"},
+		{"truncated by rune", "héllo wörld", 7, "héllo w"},
+		{"short enough", "abc", 5, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := New(PolicyUGC, tt.maxLen).Label(tt.in); got != tt.want {
+				t.Errorf("Label(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		in       string
+		contains []string
+		excludes []string
+	}{
+		{"ugc keeps formatting", PolicyUGC, "<p><b>hi</b> <em>there</em></p>", []string{"<b>hi</b>", "<em>there</em>"}, nil},
+		{"ugc drops scripts", PolicyUGC, `<p onclick="x()">hi</p><script>alert(1)</script>`, []string{"<p>hi</p>"}, []string{"script", "onclick"}},
+		{"ugc marks links", PolicyUGC, `<a href="https://example.com">x</a>`, []string{`rel="nofollow`, `target="_blank"`}, nil},
+		{"ugc drops javascript links", PolicyUGC, `<a href="javascript:alert(1)">x</a>`, nil, []string{"javascript"}},
+		{"strict removes markup", PolicyStrict, "<p><b>hi</b></p>", []string{"hi"}, []string{"<"}},
+		{"unknown policy is ugc", Policy("other"), "<b>hi</b>", []string{"<b>hi</b>"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := New(tt.policy, 0).HTML(tt.in)
+			for _, want := range tt.contains {
+				if !strings.Contains(got, want) {
+					t.Errorf("HTML(%q) = %q, missing %q", tt.in, got, want)
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(got, unwanted) {
+					t.Errorf("HTML(%q) = %q, contains %q", tt.in, got, unwanted)
+				}
+			}
+		})
+	}
+}
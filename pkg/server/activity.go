@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// recordActivity adds an event to the document's activity feed. Clients of
+// every instance receive it through SubscribeToActivity.
+func (doc *Document) recordActivity(event storage.ActivityEvent) {
+	event.Time = time.Now().UnixMilli()
+	doc.mu.RLock()
+	ttl := time.Duration(doc.effective().TTL)
+	doc.mu.RUnlock()
+	if err := doc.server.store.AppendActivity(doc.ctx, doc.ID, &event, ttl); err != nil && doc.ctx.Err() == nil {
+		logger.Error("Error recording activity", "doc_id", doc.ID, "activity", event.Type, "error", err)
+	}
+}
+
+// applyActivity sends an event recorded by any instance to the document's clients
+func (doc *Document) applyActivity(event *storage.ActivityEvent) {
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":  "activity",
+		"event": event,
+	})
+	if err != nil {
+		logger.Debug("Error marshaling activity message", "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
+
+// handleActivity serves a document's activity feed, oldest event first.
+// ?limit= returns only the most recent events.
+func (s *Server) handleActivity(c *gin.Context) {
+	limit := storage.ActivityLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			abortWithError(c, apperr.New(apperr.CodeValidation, "invalid limit"))
+			return
+		}
+		limit = n
+	}
+	docID := c.Param("id")
+	if _, _, err := s.publishedState(c, docID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	events, err := s.store.Activity(c.Request.Context(), docID, limit)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
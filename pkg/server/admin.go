@@ -0,0 +1,249 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// requireAdminToken rejects requests that don't carry the configured admin bearer token
+func requireAdminToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			abortWithError(c, apperr.New(apperr.CodeUnauthorized, "unauthorized"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleStorageUsageList reports Redis usage for every persisted document, largest first
+func (s *Server) handleStorageUsageList(c *gin.Context) {
+	ids, err := s.store.ListDocumentIDs(c.Request.Context())
+	if err != nil {
+		requestLog(c).Error("Error listing documents", "error", err)
+		abortWithError(c, err)
+		return
+	}
+	usages := make([]*storage.DocumentUsage, 0, len(ids))
+	for _, id := range ids {
+		usage, err := s.store.DocumentUsage(c.Request.Context(), id)
+		if err != nil {
+			requestLog(c).Error("Error inspecting document", "doc_id", id, "error", err)
+			continue
+		}
+		usages = append(usages, usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].MemoryUsage > usages[j].MemoryUsage
+	})
+	c.JSON(http.StatusOK, gin.H{"documents": usages})
+}
+
+// handleStorageUsage reports Redis usage for a single document
+func (s *Server) handleStorageUsage(c *gin.Context) {
+	usage, err := s.store.DocumentUsage(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if apperr.CodeOf(err) == apperr.CodeInternal {
+			requestLog(c).Error("Error inspecting document", "doc_id", c.Param("id"), "error", err)
+		}
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// handleShredDocument destroys a document's encryption key and content
+func (s *Server) handleShredDocument(c *gin.Context) {
+	docID := c.Param("id")
+	// Drop the in-memory copy first so it can't be written back with a fresh key
+	s.evictDocument(docID, false)
+	if err := s.store.ShredDocument(c.Request.Context(), docID); err != nil {
+		requestLog(c).Error("Error shredding document", "doc_id", docID, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	if err := s.unmirror(c.Request.Context(), docID); err != nil {
+		requestLog(c).Error("Error unmirroring document", "doc_id", docID, "error", err)
+	}
+	requestLog(c).Info("Document shredded", "doc_id", docID)
+	c.Status(http.StatusNoContent)
+}
+
+// errDocumentNotLoaded is returned by admin actions on documents this instance isn't serving
+var errDocumentNotLoaded = apperr.New(apperr.CodeNotFound, "document is not loaded on this instance")
+
+// errUserNotConnected is returned when disconnecting a user who isn't connected
+var errUserNotConnected = apperr.New(apperr.CodeNotFound, "user is not connected")
+
+// documentStats summarizes a loaded document for operators
+type documentStats struct {
+	ID           string `json:"id"`
+	Title        string `json:"title,omitempty"`
+	Clients      int    `json:"clients"` // connected users, excluding disconnected ones
+	Users        int    `json:"users"`
+	Tabs         int    `json:"tabs"`
+	Bytes        int    `json:"bytes"`
+	Version      int64  `json:"version"`
+	LastModified int64  `json:"lastModified"`
+	PendingSave  bool   `json:"pendingSave"`
+}
+
+// userView describes a user of a loaded document for operators
+type userView struct {
+	UUID         string `json:"uuid"`
+	Name         string `json:"name"`
+	Color        string `json:"color"`
+	Disconnected bool   `json:"disconnected"`
+	IP           string `json:"ip,omitempty"`
+	Instance     string `json:"instance,omitempty"` // set for users connected through another instance
+}
+
+// loadedDocument returns the in-memory document with the given ID, if any
+func (s *Server) loadedDocument(docID string) (*Document, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, exists := s.documents[docID]
+	return doc, exists
+}
+
+// stats summarizes the document for the admin API
+func (doc *Document) stats() documentStats {
+	pending := doc.saver.hasPending()
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	stats := documentStats{
+		ID:           doc.ID,
+		Title:        doc.displayTitle(),
+		Users:        len(doc.users.clients),
+		Tabs:         len(doc.Tabs),
+		Bytes:        doc.totalSize(),
+		Version:      doc.version,
+		LastModified: doc.lastModified,
+		PendingSave:  pending,
+		Clients:      len(doc.users.connected()),
+	}
+	return stats
+}
+
+// handleListDocuments reports the documents loaded in this instance's memory
+func (s *Server) handleListDocuments(c *gin.Context) {
+	s.mu.RLock()
+	docs := make([]*Document, 0, len(s.documents))
+	for _, doc := range s.documents {
+		docs = append(docs, doc)
+	}
+	s.mu.RUnlock()
+	stats := make([]documentStats, 0, len(docs))
+	for _, doc := range docs {
+		stats = append(stats, doc.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ID < stats[j].ID
+	})
+	c.JSON(http.StatusOK, gin.H{"documents": stats})
+}
+
+// handleListUsers reports the users of a loaded document, including those seen through other instances
+func (s *Server) handleListUsers(c *gin.Context) {
+	doc, exists := s.loadedDocument(c.Param("id"))
+	if !exists {
+		abortWithError(c, errDocumentNotLoaded)
+		return
+	}
+	doc.mu.RLock()
+	users := make([]userView, 0, len(doc.users.clients)+len(doc.remoteUsers))
+	for uuid, client := range doc.users.clients {
+		users = append(users, userView{
+			UUID:         uuid,
+			Name:         client.name,
+			Color:        client.color,
+			Disconnected: client.disconnected,
+			IP:           client.ip,
+		})
+	}
+	for uuid, entry := range doc.remoteUsers {
+		if _, local := doc.users.clients[uuid]; local {
+			continue
+		}
+		users = append(users, userView{
+			UUID:     uuid,
+			Name:     entry.Name,
+			Color:    entry.Color,
+			Instance: entry.Instance,
+		})
+	}
+	doc.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UUID < users[j].UUID
+	})
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+// handleDisconnectUser closes a user's connection to a document. The client
+// goes through the normal disconnect path and may reconnect.
+func (s *Server) handleDisconnectUser(c *gin.Context) {
+	doc, exists := s.loadedDocument(c.Param("id"))
+	if !exists {
+		abortWithError(c, errDocumentNotLoaded)
+		return
+	}
+	uuid := c.Param("uuid")
+	doc.mu.RLock()
+	client, connected := doc.users.clients[uuid]
+	if connected && client.disconnected {
+		connected = false
+	}
+	stopCollaborator := doc.collaborators[client]
+	doc.mu.RUnlock()
+	if !connected {
+		abortWithError(c, errUserNotConnected)
+		return
+	}
+	if stopCollaborator != nil {
+		stopCollaborator()
+	} else {
+		client.conn.Close()
+	}
+	requestLog(c).Info("Disconnected user", "doc_id", doc.ID, "client_uuid", uuid, "conn_id", client.connID)
+	c.Status(http.StatusNoContent)
+}
+
+// handleSaveDocument writes a loaded document to storage immediately
+func (s *Server) handleSaveDocument(c *gin.Context) {
+	doc, exists := s.loadedDocument(c.Param("id"))
+	if !exists {
+		abortWithError(c, errDocumentNotLoaded)
+		return
+	}
+	if err := doc.saveState(c.Request.Context()); err != nil {
+		requestLog(c).Error("Error saving document", "doc_id", doc.ID, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, doc.stats())
+}
+
+// handlePurgeDocument drops a document from memory without saving it and
+// deletes it from storage, where it stays in the trash for a while,
+// disconnecting its clients on every instance
+func (s *Server) handlePurgeDocument(c *gin.Context) {
+	docID := c.Param("id")
+	s.evictDocument(docID, false)
+	if err := s.store.DeleteDocument(c.Request.Context(), docID); err != nil {
+		requestLog(c).Error("Error deleting document", "doc_id", docID, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	if err := s.unmirror(c.Request.Context(), docID); err != nil {
+		requestLog(c).Error("Error unmirroring document", "doc_id", docID, "error", err)
+	}
+	requestLog(c).Info("Document purged", "doc_id", docID)
+	c.Status(http.StatusNoContent)
+}
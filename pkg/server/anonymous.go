@@ -0,0 +1,27 @@
+package server
+
+import "hash/fnv"
+
+// anonymousAnimals name the users who haven't chosen a name yet
+var anonymousAnimals = []string{
+	"Axolotl", "Badger", "Capybara", "Dolphin", "Echidna", "Fennec", "Gecko", "Heron",
+	"Ibex", "Jackal", "Kiwi", "Lemur", "Manatee", "Narwhal", "Okapi", "Pangolin",
+	"Quokka", "Raccoon", "Sloth", "Tapir", "Urchin", "Vulture", "Wombat", "Yak",
+}
+
+// anonymousName returns the name shown for a user who hasn't sent setName.
+// It's derived from their ID, so every instance shows the same name.
+func anonymousName(uuid string) string {
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	return "Anonymous " + anonymousAnimals[h.Sum32()%uint32(len(anonymousAnimals))]
+}
+
+// joinAnonymously lists a new client under a generated ID and name, so
+// everyone sees it from its first frame; setName replaces them
+// Note: Caller must hold doc.mu
+func (c *Client) joinAnonymously() {
+	c.anonymous = true
+	c.name = anonymousName(c.connID)
+	c.doc.users.join(c, c.connID, "", c.doc.remoteColors(c.connID))
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/markdown"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/sanitize"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/telemetry"
+)
+
+// documentState returns the current state of a document, preferring the
+// in-memory copy over storage so unsaved edits are included
+func (s *Server) documentState(ctx context.Context, docID string) (*storage.DocumentState, error) {
+	s.mu.RLock()
+	doc, exists := s.documents[docID]
+	s.mu.RUnlock()
+	if exists {
+		return doc.snapshot(), nil
+	}
+	state, err := s.store.LoadDocument(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	if state.Version == 0 && len(state.Tabs) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return state, nil
+}
+
+// requireSignedURL only lets requests through that carry a valid signature or
+// the admin token. Without a signing secret configured the endpoints are open.
+func (s *Server) requireSignedURL(c *gin.Context) {
+	if s.signer == nil || s.isAdmin(c) {
+		c.Next()
+		return
+	}
+	if err := s.signer.Verify(c.Request.URL.Path, c.Request.URL.Query(), time.Now()); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeUnauthorized, err, err.Error()))
+		return
+	}
+	c.Next()
+}
+
+// isAdmin reports whether the request carries the admin token
+func (s *Server) isAdmin(c *gin.Context) bool {
+	if s.config.AdminToken == "" {
+		return false
+	}
+	provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(s.config.AdminToken)) == 1
+}
+
+// publishedState returns a document for the raw, export and activity endpoints
+// along with its settings. Private documents are only served through signed URLs
+// or to admins; to anyone else they don't exist.
+func (s *Server) publishedState(c *gin.Context, docID string) (*storage.DocumentState, policy.Settings, error) {
+	state, err := s.documentState(c.Request.Context(), docID)
+	if err != nil {
+		return nil, policy.Settings{}, err
+	}
+	settings, err := s.stateSettings(c.Request.Context(), state)
+	if err != nil {
+		return nil, policy.Settings{}, err
+	}
+	// With signing enabled requireSignedURL has already checked the request
+	if settings.Visibility == policy.VisibilityPrivate && s.signer == nil && !s.isAdmin(c) {
+		return nil, policy.Settings{}, storage.ErrNotFound
+	}
+	return state, settings, nil
+}
+
+// handleRaw serves a single tab as plain text, defaulting to the active tab
+func (s *Server) handleRaw(c *gin.Context) {
+	state, _, err := s.publishedState(c, c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	tabId := c.DefaultQuery("tab", state.ActiveTabId)
+	for _, tab := range state.Tabs {
+		if tab.ID == tabId {
+			// Never let a browser sniff or execute stored content as HTML
+			c.Header("X-Content-Type-Options", "nosniff")
+			c.Header("Content-Security-Policy", "sandbox")
+			c.String(http.StatusOK, tab.Content)
+			return
+		}
+	}
+	abortWithError(c, errTabNotFound)
+}
+
+// handleNotesHTML serves the notes of a tab rendered from markdown to
+// sanitized HTML, as a fragment for embedding or previews
+func (s *Server) handleNotesHTML(c *gin.Context) {
+	state, _, err := s.publishedState(c, c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	for _, tab := range state.Tabs {
+		if tab.ID == c.Param("tabId") {
+			c.Header("X-Content-Type-Options", "nosniff")
+			c.Header("Content-Security-Policy", "sandbox")
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(s.sanitizer.HTML(markdown.Render(tab.Notes))))
+			return
+		}
+	}
+	abortWithError(c, errTabNotFound)
+}
+
+// createDocumentRequest is the optional body of POST /api/v1/documents
+type createDocumentRequest struct {
+	Workspace string `json:"workspace"` // admins only; empty for the default workspace
+	Template  string `json:"template"`  // built-in template or template document to start from
+}
+
+// handleCreateDocument creates a document under an ID picked by the configured
+// strategy and returns the ID. It starts empty or as a copy of a template.
+func (s *Server) handleCreateDocument(c *gin.Context) {
+	var req createDocumentRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+			return
+		}
+	}
+	// Picking a workspace picks the policy, which is for operators to decide
+	if req.Workspace != "" && !s.isAdmin(c) {
+		abortWithError(c, apperr.New(apperr.CodeUnauthorized, "only admins can create documents in a workspace"))
+		return
+	}
+	var seed *storage.DocumentState
+	if req.Template != "" {
+		var err error
+		if seed, err = s.templateState(c.Request.Context(), req.Template); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	docID, err := s.createDocument(c.Request.Context(), req.Workspace, seed)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Document created", "doc_id", docID, "workspace", req.Workspace, "template", req.Template)
+	c.JSON(http.StatusCreated, gin.H{"id": docID})
+}
+
+// handleExport serves the whole document as JSON, or with ?format=zip or tar
+// as an archive, with its activity feed for ?include=activity. The server
+// keeps no comment threads or chat history, so requests asking to include
+// them are refused rather than answered with an incomplete record. With
+// ?since= only what changed since then is exported, along with the activity
+// of that time.
+func (s *Server) handleExport(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if _, ok := exportFormats[format]; !ok {
+		abortWithError(c, apperr.Newf(apperr.CodeValidation, "unknown export format %q", format))
+		return
+	}
+	activity := false
+	if include := c.Query("include"); include != "" {
+		for _, part := range strings.Split(include, ",") {
+			if part = strings.TrimSpace(part); part != "activity" {
+				abortWithError(c, apperr.Newf(apperr.CodeValidation, "export cannot include %q: only document content and activity are recorded", part))
+				return
+			}
+		}
+		activity = true
+	}
+	var since int64
+	if v := c.Query("since"); v != "" {
+		var err error
+		if since, err = parseSince(v); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		activity = true
+	}
+	// Taken before reading the document, so changes made meanwhile are in the next export
+	until := time.Now().UnixMilli()
+	docID := c.Param("id")
+	state, settings, err := s.publishedState(c, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !settings.Enabled(policy.FeatureExport) {
+		abortWithError(c, featureDisabled(policy.FeatureExport))
+		return
+	}
+	export := NewExport(docID, state, s.sanitizer)
+	if activity {
+		if export.Activity, err = s.store.Activity(c.Request.Context(), docID, 0); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	if since > 0 {
+		export.keepChangesSince(since, until)
+	}
+	s.usage.Record(docID, telemetry.FeatureExport)
+	c.Header("X-Content-Type-Options", "nosniff")
+	if format == "json" {
+		c.JSON(http.StatusOK, export)
+		return
+	}
+	data, err := export.archive(format)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": docID + exportFormats[format].ext}))
+	c.Data(http.StatusOK, exportFormats[format].contentType, data)
+}
+
+// Export is the archive format of a document returned by the export endpoint
+type Export struct {
+	ID           string        `json:"id"`
+	Title        string        `json:"title,omitempty"`
+	Language     string        `json:"language"`
+	Tabs         []storage.Tab `json:"tabs"`
+	ActiveTabID  string        `json:"activeTabId"`
+	LastModified int64         `json:"lastModified"`
+	Parent       string        `json:"parent,omitempty"` // document this one was forked from, if recorded
+
+	Outputs  map[string]*storage.RunOutput `json:"outputs,omitempty"`  // result of each tab's last run, by tab ID
+	Activity []storage.ActivityEvent       `json:"activity,omitempty"` // only with ?include=activity or ?since
+
+	// Differential exports made with ?since only hold the tabs, outputs and
+	// activity from Since on. TabOrder lists all tabs, so archives can drop
+	// deleted ones, and Until is the since to ask for next time.
+	Since    int64    `json:"since,omitempty"`
+	Until    int64    `json:"until,omitempty"`
+	TabOrder []string `json:"tabOrder,omitempty"`
+}
+
+// NewExport builds the export of a document state, cleaning tab names with sanitizer
+func NewExport(docID string, state *storage.DocumentState, sanitizer *sanitize.Sanitizer) *Export {
+	// Names may predate sanitization, so clean them again on the way out
+	tabs := make([]storage.Tab, len(state.Tabs))
+	for i, tab := range state.Tabs {
+		tab.Name = sanitizer.Label(tab.Name)
+		tabs[i] = tab
+	}
+	return &Export{
+		ID:           docID,
+		Title:        sanitizer.Label(state.DisplayTitle()),
+		Language:     state.Language,
+		Tabs:         tabs,
+		ActiveTabID:  state.ActiveTabId,
+		LastModified: state.LastModified,
+		Parent:       state.Parent,
+		Outputs:      state.Outputs,
+	}
+}
+
+// parseSince reads the since parameter of a differential export: unix
+// milliseconds or an RFC 3339 time
+func parseSince(value string) (int64, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+		return ms, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil && t.UnixMilli() > 0 {
+		return t.UnixMilli(), nil
+	}
+	return 0, apperr.New(apperr.CodeValidation, "since must be unix milliseconds or an RFC 3339 time")
+}
+
+// keepChangesSince reduces the export to the tabs, outputs and activity from since on
+func (e *Export) keepChangesSince(since, until int64) {
+	e.Since, e.Until = since, until
+	e.TabOrder = make([]string, len(e.Tabs))
+	tabs := make([]storage.Tab, 0, len(e.Tabs))
+	for i, tab := range e.Tabs {
+		e.TabOrder[i] = tab.ID
+		if tab.Modified >= since {
+			tabs = append(tabs, tab)
+		}
+	}
+	e.Tabs = tabs
+	outputs := make(map[string]*storage.RunOutput)
+	for tabID, output := range e.Outputs {
+		if output.Finished >= since {
+			outputs[tabID] = output
+		}
+	}
+	e.Outputs = outputs
+	activity := make([]storage.ActivityEvent, 0, len(e.Activity))
+	for _, event := range e.Activity {
+		if event.Time >= since {
+			activity = append(activity, event)
+		}
+	}
+	e.Activity = activity
+}
+
+// signedURLRequest asks for a signed link to one of a document's export endpoints
+type signedURLRequest struct {
+	Endpoint string `json:"endpoint"` // "raw", "export", "export/gist", "import/url", "activity" or "session.ics"
+	TTL      string `json:"ttl"`      // e.g. "15m"
+}
+
+// handleCreateSignedURL mints a time-limited URL for a document's raw, export, export/gist, import/url, activity or session.ics endpoint
+func (s *Server) handleCreateSignedURL(c *gin.Context) {
+	if s.signer == nil {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "signed URLs are not configured"))
+		return
+	}
+	var req signedURLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	switch req.Endpoint {
+	case "raw", "export", "export/gist", "import/url", "activity", "session.ics":
+	default:
+		abortWithError(c, apperr.New(apperr.CodeValidation, `endpoint must be "raw", "export", "export/gist", "import/url", "activity" or "session.ics"`))
+		return
+	}
+	ttl := 15 * time.Minute
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			abortWithError(c, apperr.New(apperr.CodeValidation, "invalid ttl"))
+			return
+		}
+		ttl = d
+	}
+	expires := time.Now().Add(ttl)
+	path := "/api/v1/documents/" + c.Param("id") + "/" + req.Endpoint
+	requestLog(c).Info("Signed URL created", "doc_id", c.Param("id"), "endpoint", req.Endpoint, "expires", expires)
+	c.JSON(http.StatusOK, gin.H{
+		"url":       s.signer.Sign(path, expires),
+		"expires":   expires.Unix(),
+		"expiresAt": s.messages.FormatTime(c.GetString(localeKey), expires),
+	})
+}
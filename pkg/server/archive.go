@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/backup"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/mirror"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+var archives = metrics.NewCounter("gopad_archives_total", "Number of documents archived before expiring by target and result")
+
+var (
+	// errNoArchive is returned when restoring a document that was never archived
+	errNoArchive = apperr.New(apperr.CodeNotFound, "no archive of this document")
+	// errDocumentExists is returned when restoring a document that hasn't expired
+	errDocumentExists = apperr.New(apperr.CodeConflict, "the document still exists")
+)
+
+// archiveStore keeps archived documents
+type archiveStore interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// archiveTarget is a configured archive store, named for metrics and logs
+type archiveTarget struct {
+	kind  string
+	store archiveStore
+}
+
+// archiveTargets returns the targets configured for archiving documents, in
+// the order restores look for a document in them
+func archiveTargets(config Config) []archiveTarget {
+	var targets []archiveTarget
+	if config.ArchiveDir != "" {
+		targets = append(targets, archiveTarget{kind: "dir", store: mirror.NewDir(config.ArchiveDir)})
+	}
+	if config.ArchiveS3.Bucket != "" {
+		targets = append(targets, archiveTarget{kind: "s3", store: mirror.NewS3(config.ArchiveS3)})
+	}
+	return targets
+}
+
+// watchExpiring warns the clients of loaded documents about to expire and
+// archives documents about to expire until the server shuts down
+func (s *Server) watchExpiring() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.warnExpiring(s.ctx)
+		if len(s.archive) > 0 {
+			s.archiveExpiring(s.ctx)
+		}
+	}
+}
+
+// warnExpiring checks the TTL of every document loaded here
+func (s *Server) warnExpiring(ctx context.Context) {
+	s.mu.RLock()
+	docs := make([]*Document, 0, len(s.documents))
+	for _, doc := range s.documents {
+		docs = append(docs, doc)
+	}
+	s.mu.RUnlock()
+	for _, doc := range docs {
+		ttl, err := s.store.DocumentTTL(ctx, doc.ID)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("Error checking document expiry", "doc_id", doc.ID, "error", err)
+			}
+			return
+		}
+		doc.refreshExpiry(ttl)
+	}
+}
+
+// refreshExpiry tells the document's clients when it expires once its TTL
+// drops to ExpiryWarning, and that it no longer does once it was saved.
+// Expiry times moved by less than expiryCheckInterval aren't sent again.
+func (doc *Document) refreshExpiry(ttl time.Duration) {
+	var expiresAt int64
+	if ttl > 0 && ttl <= doc.server.config.ExpiryWarning {
+		expiresAt = time.Now().Add(ttl).UnixMilli()
+	}
+	doc.mu.Lock()
+	moved := time.Duration(expiresAt-doc.expiresAt) * time.Millisecond
+	if (expiresAt == 0) == (doc.expiresAt == 0) && moved.Abs() < expiryCheckInterval {
+		doc.mu.Unlock()
+		return
+	}
+	doc.expiresAt = expiresAt
+	doc.mu.Unlock()
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":      "expiring",
+		"expiresAt": expiresAt,
+	})
+	if err != nil {
+		logger.Debug("Error marshaling expiring message", "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Message: jsonMsg})
+}
+
+// archiveExpiring archives the documents whose TTL passes within ArchiveBefore
+func (s *Server) archiveExpiring(ctx context.Context) {
+	expiring, err := s.store.ClaimArchivableDocuments(ctx, s.config.ArchiveBefore)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("Error checking for documents to archive", "error", err)
+		}
+		return
+	}
+	for _, doc := range expiring {
+		s.archiveDocument(ctx, doc.ID)
+	}
+}
+
+// archiveDocument writes a document to every archive target
+func (s *Server) archiveDocument(ctx context.Context, docID string) {
+	state, err := s.documentState(ctx, docID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			logger.Error("Error loading document to archive", "doc_id", docID, "error", err)
+		}
+		return
+	}
+	data, err := backup.EncodeArchive(docID, state)
+	if err != nil {
+		logger.Error("Error encoding document to archive", "doc_id", docID, "error", err)
+		return
+	}
+	for _, target := range s.archive {
+		if err := target.store.Put(ctx, backup.ArchiveName(docID), data, "application/json"); err != nil {
+			archives.Inc(metrics.Labels{"target": target.kind, "result": "failed"})
+			logger.Error("Error archiving document", "doc_id", docID, "target", target.kind, "error", err)
+			continue
+		}
+		archives.Inc(metrics.Labels{"target": target.kind, "result": "written"})
+	}
+	logger.Info("Document archived before expiring", "doc_id", docID)
+}
+
+// handleRestoreDocument saves a deleted document again from the trash, or an
+// expired one from its archive, expiring as its settings say from now on
+func (s *Server) handleRestoreDocument(c *gin.Context) {
+	docID := c.Param("id")
+	ctx := c.Request.Context()
+	// Documents loaded somewhere are saved again from memory anyway
+	if _, loaded := s.loadedDocument(docID); loaded {
+		abortWithError(c, errDocumentExists)
+		return
+	}
+	version, err := s.store.DocumentVersion(ctx, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if version > 0 {
+		abortWithError(c, errDocumentExists)
+		return
+	}
+	source := "trash"
+	state, err := s.restoreTrashed(ctx, docID)
+	if errors.Is(err, storage.ErrNotInTrash) && len(s.archive) > 0 {
+		source = "archive"
+		state, err = s.restoreArchived(ctx, docID)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrVersionConflict) {
+			err = errDocumentExists
+		}
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Document restored", "doc_id", docID, "from", source)
+	c.JSON(http.StatusOK, gin.H{"id": docID, "from": source, "tabs": len(state.Tabs), "lastModified": state.LastModified})
+}
+
+// restoreArchived saves an expired document again from the first archive
+// target holding it
+func (s *Server) restoreArchived(ctx context.Context, docID string) (*storage.DocumentState, error) {
+	var data []byte
+	var err error
+	for _, target := range s.archive {
+		data, err = target.store.Get(ctx, backup.ArchiveName(docID))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Error("Error reading archived document", "doc_id", docID, "target", target.kind, "error", err)
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to read archive")
+		}
+	}
+	if data == nil {
+		return nil, errNoArchive
+	}
+	_, state, err := backup.DecodeArchive(data)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to read archive")
+	}
+	settings, err := s.stateSettings(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	state.Version = 0
+	state.Expiry = time.Duration(settings.TTL)
+	if err := s.store.SaveDocument(ctx, docID, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
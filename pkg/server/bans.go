@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+var bannedClients = metrics.NewCounter("gopad_banned_clients_total", "Number of clients refused or disconnected by the ban list, by stage")
+
+// Errors for banned clients, by the scope of their ban
+var (
+	errBannedFromDocument = apperr.New(apperr.CodeBanned, "you are banned from this document")
+	errBannedFromServer   = apperr.New(apperr.CodeBanned, "you are banned from this server")
+)
+
+// banRequest bans a client address or user ID
+type banRequest struct {
+	Kind   string `json:"kind"` // "ip" or "uuid"
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl"` // e.g. "24h"; empty for a permanent ban
+}
+
+// normalizeBanValue validates a banned value, returning IP addresses in
+// their canonical form so they match c.ClientIP()
+func normalizeBanValue(kind, value string) (string, error) {
+	switch kind {
+	case storage.BanIP:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", apperr.Newf(apperr.CodeValidation, "invalid IP address %q", value)
+		}
+		return ip.String(), nil
+	case storage.BanUUID:
+		if value == "" {
+			return "", apperr.New(apperr.CodeValidation, "value is required")
+		}
+		return value, nil
+	default:
+		return "", apperr.New(apperr.CodeValidation, `kind must be "ip" or "uuid"`)
+	}
+}
+
+// checkBan returns the error to refuse a client with when its address or
+// user ID is banned from the document. Failing lookups are only logged, so
+// a storage outage doesn't lock everyone out.
+func (s *Server) checkBan(ctx context.Context, docID, ip, uuid string) error {
+	ban, err := s.store.FindBan(ctx, docID, ip, uuid)
+	if err != nil {
+		logger.Error("Error checking bans", "doc_id", docID, "error", err)
+		return nil
+	}
+	if ban == nil {
+		return nil
+	}
+	if ban.DocID == "" {
+		return errBannedFromServer
+	}
+	return errBannedFromDocument
+}
+
+// closeBanned closes a banned client's connection with 1008 (policy
+// violation) and the BANNED code as the reason, telling it not to reconnect
+func (c *Client) closeBanned() {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, string(apperr.CodeBanned))
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		c.log.Debug("Error sending close frame", "error", err)
+	}
+	c.conn.Close()
+}
+
+// handleAddBan bans a client address or user ID from a document or, on
+// /admin/bans, from every document. Matching clients connected to this
+// instance are disconnected.
+func (s *Server) handleAddBan(c *gin.Context) {
+	docID := c.Param("id")
+	var req banRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	value, err := normalizeBanValue(req.Kind, req.Value)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	now := time.Now()
+	ban := &storage.Ban{
+		Kind:    req.Kind,
+		Value:   value,
+		DocID:   docID,
+		Reason:  s.sanitizer.Label(req.Reason),
+		Created: now.UnixMilli(),
+	}
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			abortWithError(c, apperr.New(apperr.CodeValidation, "invalid ttl"))
+			return
+		}
+		ban.Expires = now.Add(d).UnixMilli()
+	}
+	if err := s.store.AddBan(c.Request.Context(), ban); err != nil {
+		requestLog(c).Error("Error adding ban", "doc_id", docID, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	disconnected := s.disconnectBanned(ban)
+	requestLog(c).Info("Ban added", "doc_id", docID, "kind", ban.Kind, "value", ban.Value, "disconnected", disconnected)
+	c.JSON(http.StatusOK, ban)
+}
+
+// handleListBans lists the live bans of a document, or the instance-wide ones
+func (s *Server) handleListBans(c *gin.Context) {
+	bans, err := s.store.Bans(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"bans": bans})
+}
+
+// handleRemoveBan lifts a ban
+func (s *Server) handleRemoveBan(c *gin.Context) {
+	docID, kind := c.Param("id"), c.Param("kind")
+	value, err := normalizeBanValue(kind, c.Param("value"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := s.store.RemoveBan(c.Request.Context(), docID, kind, value); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Ban removed", "doc_id", docID, "kind", kind, "value", value)
+	c.Status(http.StatusNoContent)
+}
+
+// disconnectBanned closes the connections of this instance's clients that a
+// new ban covers and returns how many it closed. Clients that haven't sent
+// setName yet are caught when they do.
+func (s *Server) disconnectBanned(ban *storage.Ban) int {
+	var docs []*Document
+	if ban.DocID != "" {
+		if doc, loaded := s.loadedDocument(ban.DocID); loaded {
+			docs = append(docs, doc)
+		}
+	} else {
+		s.mu.RLock()
+		for _, doc := range s.documents {
+			docs = append(docs, doc)
+		}
+		s.mu.RUnlock()
+	}
+	var banned []*Client
+	for _, doc := range docs {
+		doc.mu.RLock()
+		for _, client := range doc.users.connected() {
+			if client.conn == nil {
+				continue
+			}
+			if (ban.Kind == storage.BanIP && client.ip == ban.Value) || (ban.Kind == storage.BanUUID && client.uuid == ban.Value) {
+				banned = append(banned, client)
+			}
+		}
+		doc.mu.RUnlock()
+	}
+	for _, client := range banned {
+		client.log.Info("Disconnecting banned client", "client_uuid", client.uuid)
+		client.closeBanned()
+		bannedClients.Inc(metrics.Labels{"stage": "banned"})
+	}
+	return len(banned)
+}
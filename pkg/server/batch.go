@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/ot"
+)
+
+// batchRequest is a group of operations to apply to one tab as a unit,
+// sent as a "batch" message or to the admin batch endpoint
+type batchRequest struct {
+	TabID string         `json:"tabId"`
+	Ops   []ot.Operation `json:"ops"`
+}
+
+// applyBatch applies every operation of batch to a tab, or none of them if
+// any doesn't apply, and broadcasts the resulting content
+func (doc *Document) applyBatch(ctx context.Context, tabId string, batch *ot.Batch, lockToken string) error {
+	// The sender only has its operations, so it gets the result too
+	_, err := doc.editTabContent(ctx, tabId, lockToken, nil, func(current string) (string, error) {
+		content, err := batch.Apply(current)
+		if err != nil {
+			return "", apperr.Wrap(apperr.CodeValidation, err, "batch does not apply, no operations were applied")
+		}
+		return content, nil
+	})
+	return err
+}
+
+// handleBatch applies a batch message from a client
+func (c *Client) handleBatch(ctx context.Context, message []byte) {
+	var req batchRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		c.sendError(apperr.Wrap(apperr.CodeInvalidMessage, err, "batch message is malformed"))
+		return
+	}
+	if req.TabID == "" {
+		c.sendError(apperr.Newf(apperr.CodeInvalidMessage, "%s message is missing field %q", "batch", "tabId"))
+		return
+	}
+	batch := ot.NewBatch(req.Ops...)
+	if err := batch.Validate(); err != nil {
+		c.sendError(apperr.Wrap(apperr.CodeValidation, err, "batch does not apply, no operations were applied"))
+		return
+	}
+	if err := c.doc.applyBatch(ctx, req.TabID, batch, ""); err != nil {
+		c.sendError(err)
+		c.resyncTab(req.TabID)
+		return
+	}
+	c.doc.presence.edited(c.name)
+}
+
+// handleBatchTab applies a batch of operations to a tab for automation,
+// as the holder of the lock in the X-Lock-Token header if one is given
+func (s *Server) handleBatchTab(c *gin.Context) {
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	batch := ot.NewBatch(req.Ops...)
+	if err := batch.Validate(); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "batch does not apply, no operations were applied"))
+		return
+	}
+	doc, err := s.getOrCreateDocument(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := doc.applyBatch(c.Request.Context(), c.Param("tabId"), batch, c.GetHeader(lockTokenHeader)); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/telemetry"
+)
+
+// errBadOrder is sent for move operations that don't list every tab exactly once
+var errBadOrder = apperr.New(apperr.CodeInvalidMessage, "order must list every tab exactly once")
+
+// bulkOp is one tab operation of a tabBulk message
+type bulkOp struct {
+	Op    string   `json:"op"`              // create, rename, delete, move or focus
+	Tab   *Tab     `json:"tab,omitempty"`   // the tab to create
+	TabID string   `json:"tabId,omitempty"` // the tab to rename, delete or focus
+	Name  string   `json:"name,omitempty"`  // the new name for rename
+	Order []string `json:"order,omitempty"` // every tab ID in their new order for move
+}
+
+// bulkRequest is a tabBulk message
+type bulkRequest struct {
+	Ops []bulkOp `json:"ops"`
+}
+
+// bulkOpError reports which operation of a tabBulk message failed, sent as
+// the "op" index of the error frame
+type bulkOpError struct {
+	index int
+	err   error
+}
+
+func (e *bulkOpError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.index, e.err)
+}
+
+func (e *bulkOpError) Unwrap() error {
+	return e.err
+}
+
+// bulkOpOf returns the index of the tabBulk operation err is about, if any
+func bulkOpOf(err error) (int, bool) {
+	var be *bulkOpError
+	if errors.As(err, &be) {
+		return be.index, true
+	}
+	return 0, false
+}
+
+// applyTabBulk applies tab operations in order as one change: either all of
+// them succeed and clients receive a single tabUpdate with the result, or the
+// document is left as it was. Tabs are checked against locks held by anyone
+// but the holder of lockToken; user is who the activity feed credits.
+func (doc *Document) applyTabBulk(ops []bulkOp, lockToken, user string) error {
+	// Kinds are checked before taking the lock, as checking reads the settings
+	for i, op := range ops {
+		if op.Op == "create" && op.Tab != nil {
+			if err := doc.checkTabKind(*op.Tab); err != nil {
+				return &bulkOpError{index: i, err: err}
+			}
+		}
+	}
+
+	doc.mu.Lock()
+	tabs, active := doc.Tabs, doc.ActiveTabId
+	// Operations change a copy, so the tabs can be put back if one fails
+	doc.Tabs = append([]Tab(nil), tabs...)
+	var created, deleted []string
+	var activity []storage.ActivityEvent
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case "create":
+			err = doc.bulkCreate(op.Tab, lockToken)
+			if err == nil {
+				created = append(created, op.Tab.ID)
+				tab := doc.Tabs[len(doc.Tabs)-1]
+				activity = append(activity, storage.ActivityEvent{Type: storage.ActivityTabCreated, User: user, TabID: tab.ID, TabName: tab.Name})
+			}
+		case "rename":
+			var previous string
+			if j := doc.findTab(op.TabID); j >= 0 {
+				previous = doc.Tabs[j].Name
+			}
+			err = doc.bulkRename(op.TabID, op.Name, lockToken)
+			if err == nil {
+				tab := doc.Tabs[doc.findTab(op.TabID)]
+				activity = append(activity, storage.ActivityEvent{Type: storage.ActivityTabRenamed, User: user, TabID: tab.ID, TabName: tab.Name, PreviousName: previous})
+			}
+		case "delete":
+			var name string
+			if j := doc.findTab(op.TabID); j >= 0 {
+				name = doc.Tabs[j].Name
+			}
+			err = doc.bulkDelete(op.TabID, lockToken)
+			if err == nil {
+				deleted = append(deleted, op.TabID)
+				activity = append(activity, storage.ActivityEvent{Type: storage.ActivityTabDeleted, User: user, TabID: op.TabID, TabName: name})
+			}
+		case "move":
+			err = doc.bulkMove(op.Order, lockToken)
+		case "focus":
+			if doc.findTab(op.TabID) < 0 {
+				err = errTabNotFound
+			} else {
+				doc.ActiveTabId = op.TabID
+			}
+		default:
+			err = apperr.Newf(apperr.CodeInvalidMessage, "unknown tab operation %q", op.Op)
+		}
+		if err != nil {
+			doc.Tabs, doc.ActiveTabId = tabs, active
+			doc.mu.Unlock()
+			return &bulkOpError{index: i, err: err}
+		}
+	}
+	if doc.findTab(doc.ActiveTabId) < 0 && len(doc.Tabs) > 0 {
+		doc.ActiveTabId = doc.Tabs[0].ID
+	}
+	doc.ensureMinimumTabs()
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":        "tabUpdate",
+		"tabs":        doc.Tabs,
+		"activeTabId": doc.ActiveTabId,
+	})
+	doc.mu.Unlock()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal tab update")
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+	doc.scheduleSave()
+	doc.checkSoftLimits()
+
+	for range created {
+		doc.server.usage.Record(doc.ID, telemetry.FeatureTabCreate)
+	}
+	for _, tabId := range deleted {
+		doc.stopREPL(tabId)
+	}
+	for _, event := range activity {
+		doc.recordActivity(event)
+	}
+	return nil
+}
+
+// bulkCreate appends a new tab
+// Note: Caller must hold doc.mu
+func (doc *Document) bulkCreate(tab *Tab, lockToken string) error {
+	if tab == nil || tab.ID == "" {
+		return apperr.Newf(apperr.CodeInvalidMessage, "%s message is missing field %q", "tabBulk", "tab.id")
+	}
+	if doc.findTab(tab.ID) >= 0 {
+		return apperr.Newf(apperr.CodeInvalidTab, "tab %q already exists", tab.ID)
+	}
+	if err := doc.checkLock(tab.ID, lockToken); err != nil {
+		return err
+	}
+	newTab := *tab
+	newTab.Name = doc.server.sanitizer.Label(newTab.Name)
+	if err := doc.checkTabChange(-1, newTab); err != nil {
+		return err
+	}
+	doc.Tabs = append(doc.Tabs, newTab)
+	return nil
+}
+
+// bulkRename renames a tab
+// Note: Caller must hold doc.mu
+func (doc *Document) bulkRename(tabId, name, lockToken string) error {
+	i := doc.findTab(tabId)
+	if i < 0 {
+		return errTabNotFound
+	}
+	if err := doc.checkLock(tabId, lockToken); err != nil {
+		return err
+	}
+	doc.Tabs[i].Name = doc.server.sanitizer.Label(name)
+	return nil
+}
+
+// bulkDelete removes a tab
+// Note: Caller must hold doc.mu
+func (doc *Document) bulkDelete(tabId, lockToken string) error {
+	i := doc.findTab(tabId)
+	if i < 0 {
+		return errTabNotFound
+	}
+	if err := doc.checkLock(tabId, lockToken); err != nil {
+		return err
+	}
+	doc.Tabs = append(doc.Tabs[:i], doc.Tabs[i+1:]...)
+	return nil
+}
+
+// bulkMove puts the tabs in the given order, which must list each of them once
+// Note: Caller must hold doc.mu
+func (doc *Document) bulkMove(order []string, lockToken string) error {
+	if len(order) != len(doc.Tabs) {
+		return errBadOrder
+	}
+	if err := doc.checkLock("", lockToken); err != nil {
+		return err
+	}
+	moved := make([]Tab, 0, len(order))
+	seen := make(map[string]bool, len(order))
+	for _, tabId := range order {
+		i := doc.findTab(tabId)
+		if i < 0 || seen[tabId] {
+			return errBadOrder
+		}
+		seen[tabId] = true
+		moved = append(moved, doc.Tabs[i])
+	}
+	doc.Tabs = moved
+	return nil
+}
+
+// handleTabBulk applies a tabBulk message from a client
+func (c *Client) handleTabBulk(ctx context.Context, message []byte) {
+	var req bulkRequest
+	if err := json.Unmarshal(message, &req); err != nil {
+		c.sendError(apperr.Wrap(apperr.CodeInvalidMessage, err, "tabBulk message is malformed"))
+		return
+	}
+	if len(req.Ops) == 0 {
+		c.sendError(apperr.Newf(apperr.CodeInvalidMessage, "%s message is missing field %q", "tabBulk", "ops"))
+		return
+	}
+	// Focusing a tab doesn't change the structure, so only the other operations are checked
+	for i, op := range req.Ops {
+		if op.Op == "focus" {
+			continue
+		}
+		c.doc.mu.RLock()
+		err := c.doc.checkStructure(c)
+		c.doc.mu.RUnlock()
+		if err != nil {
+			c.sendError(&bulkOpError{index: i, err: err})
+			return
+		}
+		break
+	}
+	for i, op := range req.Ops {
+		if op.Op != "create" || op.Tab == nil {
+			continue
+		}
+		if err := c.moderateTab(ctx, op.Tab); err != nil {
+			c.sendError(&bulkOpError{index: i, err: err})
+			return
+		}
+	}
+	if err := c.doc.applyTabBulk(req.Ops, "", c.name); err != nil {
+		c.sendError(err)
+		return
+	}
+	c.log.Debug("Applied tab operations", "ops", len(req.Ops))
+}
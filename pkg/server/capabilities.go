@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/ot"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// capability is a protocol feature a client supports, as a bit in Client.caps
+type capability uint32
+
+const (
+	capBinary      capability = 1 << iota // MessagePack frames, like ?enc=msgpack
+	capDelta                              // delta frames with the operations of an edit instead of the whole content
+	capCompression                        // permessage-deflate compressed frames
+	capLazyTabs                           // large tabs other than the active one sent without content in init
+	capManifest                           // init lists tabs with their revisions instead of content
+
+	// legacyCapabilities are assumed for clients that don't advertise any,
+	// which get what the server sent before capabilities existed
+	legacyCapabilities = capCompression
+)
+
+// capabilityNames maps the names clients advertise to capabilities
+var capabilityNames = map[string]capability{
+	"binary":      capBinary,
+	"delta":       capDelta,
+	"compression": capCompression,
+	"lazyTabs":    capLazyTabs,
+	"manifest":    capManifest,
+}
+
+// parseCapabilities converts advertised capability names to a set. Names this
+// server doesn't know are ignored, so newer clients can connect to it.
+func parseCapabilities(names []string) capability {
+	var set capability
+	for _, name := range names {
+		set |= capabilityNames[strings.TrimSpace(name)]
+	}
+	return set
+}
+
+// capabilityList returns the names of the capabilities in set, sorted
+func capabilityList(set capability) []string {
+	names := []string{}
+	for name, bit := range capabilityNames {
+		if set&bit != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// has reports whether the client advertised a capability
+func (c *Client) has(want capability) bool {
+	return c.caps&want != 0
+}
+
+// broadcastContent sends a tab's new content to all clients but sender. Clients
+// with the delta capability get the operations turning before into content
+// instead, so changes must be broadcast in the order they were made.
+func (doc *Document) broadcastContent(ctx context.Context, sender *Client, tabId, before, content string) {
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":    "update",
+		"tabId":   tabId,
+		"content": content,
+	})
+	if err != nil {
+		logger.Debug("Error marshaling update message", "error", err)
+		return
+	}
+	bmsg := BroadcastMessage{Sender: sender, Message: jsonMsg, Trace: trace.SpanContextFromContext(ctx)}
+	if ops := ot.Diff(before, content); len(ops) > 0 {
+		bmsg.Delta, err = json.Marshal(map[string]interface{}{
+			"type":  "delta",
+			"tabId": tabId,
+			"ops":   ops,
+		})
+		if err != nil {
+			logger.Debug("Error marshaling delta message", "error", err)
+		}
+	}
+	doc.send(bmsg)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// channel is a set of message types a client can subscribe to, as a bit in Client.channels
+type channel uint32
+
+const (
+	channelContent  channel = 1 << iota // edits, tabs, language, settings, locks, REPLs, link previews, activity and expiry
+	channelPresence                     // user list, cursors, reactions, highlights and presence digests
+	channelStats                        // load reports such as backpressure
+
+	allChannels = channelContent | channelPresence | channelStats
+)
+
+// channelNames maps the names clients use to channels
+var channelNames = map[string]channel{
+	"content":  channelContent,
+	"presence": channelPresence,
+	"stats":    channelStats,
+}
+
+// messageChannels maps broadcast message types to the channel carrying them.
+// Types not listed, such as init and error frames, are always delivered.
+var messageChannels = map[string]channel{
+	"update":         channelContent,
+	"tabUpdate":      channelContent,
+	"tabCreate":      channelContent,
+	"tabDelete":      channelContent,
+	"tabRename":      channelContent,
+	"tabFocus":       channelContent,
+	"tabNotesUpdate": channelContent,
+	"language":       channelContent,
+	"title":          channelContent,
+	"unfurl":         channelContent,
+	"lockUpdate":     channelContent,
+	"validation":     channelContent,
+	"secretWarning":  channelContent,
+	"limitWarning":   channelContent,
+	"saveConflict":   channelContent,
+	"settings":       channelContent,
+	"expiring":       channelContent,
+	"pinned":         channelContent,
+	"replOutput":     channelContent,
+	"replExit":       channelContent,
+	"runStart":       channelContent,
+	"runOutput":      channelContent,
+	"runExit":        channelContent,
+	"tabOutput":      channelContent,
+	"lspDiagnostics": channelContent,
+	"activity":       channelContent,
+	"userList":       channelPresence,
+	"cursor":         channelPresence,
+	"reaction":       channelPresence,
+	"highlight":      channelPresence,
+	"presenceDigest": channelPresence,
+	"backpressure":   channelStats,
+}
+
+// parseChannels converts channel names to a channel set
+func parseChannels(names []string) (channel, error) {
+	var set channel
+	for _, name := range names {
+		ch, ok := channelNames[strings.TrimSpace(name)]
+		if !ok {
+			return 0, apperr.Newf(apperr.CodeInvalidMessage, "unknown channel %q", name)
+		}
+		set |= ch
+	}
+	return set, nil
+}
+
+// channelList returns the names of the channels in set, sorted
+func channelList(set channel) []string {
+	names := []string{}
+	for name, ch := range channelNames {
+		if set&ch != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wants reports whether the client subscribes to messages of the given type
+func (c *Client) wants(msgType string) bool {
+	ch, ok := messageChannels[msgType]
+	return !ok || channel(c.channels.Load())&ch != 0
+}
+
+// handleSubscription adds (subscribe) or removes channels from the client's
+// subscriptions and confirms the resulting set
+func (c *Client) handleSubscription(msg map[string]interface{}, subscribe bool) {
+	raw, ok := msg["channels"].([]interface{})
+	if !ok {
+		c.sendError(apperr.Newf(apperr.CodeInvalidMessage, "%s message is missing field %q", msg["type"], "channels"))
+		return
+	}
+	names := make([]string, 0, len(raw))
+	for _, v := range raw {
+		name, _ := v.(string)
+		names = append(names, name)
+	}
+	set, err := parseChannels(names)
+	if err != nil {
+		c.sendError(err)
+		return
+	}
+	current := channel(c.channels.Load())
+	if subscribe {
+		current |= set
+	} else {
+		current &^= set
+	}
+	c.channels.Store(uint32(current))
+	c.reply(map[string]interface{}{
+		"type":     "subscriptions",
+		"channels": channelList(current),
+	})
+}
@@ -0,0 +1,845 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/moderation"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/telemetry"
+	"github.com/shiftregister-vg/gopad/pkg/tracing"
+	"github.com/shiftregister-vg/gopad/pkg/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// wsProtocol is the subprotocol clients offer when they pass credentials as
+// "<kind>.<value>" subprotocols, which browsers send in the
+// Sec-WebSocket-Protocol header where URLs and access logs don't record them.
+// Only wsProtocol is ever selected, so credentials aren't echoed back.
+const wsProtocol = "gopad"
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Negotiate permessage-deflate with clients that offer it
+	EnableCompression: true,
+	Subprotocols:      []string{wsProtocol},
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow all origins for development
+	},
+}
+
+// protocolCredential returns the value of the "<kind>.<value>" subprotocol
+// offered with a WebSocket request, or "" when there is none
+func protocolCredential(r *http.Request, kind string) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if value, ok := strings.CutPrefix(protocol, kind+"."); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// credential returns a credential passed either as a subprotocol or, for
+// clients that can't set one, as a query parameter named after its kind
+func credential(c *gin.Context, kind string) string {
+	if value := protocolCredential(c.Request, kind); value != "" {
+		return value
+	}
+	return c.Query(kind)
+}
+
+type Client struct {
+	conn           *websocket.Conn // nil for synthetic collaborators
+	connID         string          // identifies this connection in logs and error frames
+	log            *slog.Logger    // tagged with the document and connection IDs
+	docID          string
+	ip             string // client address, as forwarded by a trusted proxy
+	uuid           string
+	name           string
+	color          string
+	avatarURL      string          // optional picture shown next to the user's name
+	gravatarHash   string          // hex hash of the user's email address, for clients to show their Gravatar
+	cursor         json.RawMessage // last cursor message, shared through the presence store
+	send           chan *frame
+	session        string        // token for resuming after a reconnect, empty when resuming is disabled
+	backlog        []queuedFrame // frames waiting for room in send; hub only
+	stalledSince   time.Time     // when the client last made room in send while it had a backlog; hub only
+	encoding       string        // encodingJSON or encodingMsgpack
+	caps           capability    // protocol features the client supports
+	locale         string        // language for server-generated messages
+	presenceDigest bool          // receive periodic activity summaries
+	elevated       bool          // connected with an editor token, so may change the structure of documents that restrict it
+	anonymous      bool          // listed under a generated name until it sends setName
+	peer           string        // public URL of the federated instance the client connects through, empty for local clients
+	readOnly       bool          // may only send presence and requests that don't change the document
+	channels       atomic.Uint32 // channel set the client subscribes to
+	span           trace.Span    // span of the message readPump is handling
+	doc            *Document
+	disconnected   bool
+	disconnectedAt time.Time
+
+	// bases holds the content of each tab as the client last saw it in full,
+	// to merge its whole-tab updates against; guarded by doc.mu
+	bases map[string]string
+
+	following string          // uuid of the user whose view the client follows; guarded by doc.mu
+	view      json.RawMessage // last view message, sent to new followers; guarded by doc.mu
+
+	reactions      int       // reactions and highlights sent since reactionsSince; readPump only
+	reactionsSince time.Time // start of the current rate limit window; readPump only
+}
+
+func (s *Server) handleWebSocket(c *gin.Context) {
+	if s.draining.Load() {
+		// Send the client to an instance that isn't shutting down
+		c.Header("Retry-After", "1")
+		abortWithError(c, errDraining)
+		return
+	}
+	channels := allChannels
+	if names := c.Query("channels"); names != "" {
+		var err error
+		if channels, err = parseChannels(strings.Split(names, ",")); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	// Peers name the document in the path
+	docID := c.Param("id")
+	if docID == "" {
+		docID = c.Query("doc")
+	}
+	if docID == "" {
+		docID = "default"
+	}
+	peer := peerOf(c)
+	if follow := s.followed(c, docID); follow != nil {
+		if peer != nil {
+			// Peers follow the instance hosting a document, not other followers
+			abortWithError(c, storage.ErrNotFound)
+			return
+		}
+		s.proxyFollowed(c, docID, follow)
+		return
+	}
+	if !s.routeToOwner(c, docID) {
+		return
+	}
+	ip := clientIP(c)
+	// Refused before upgrading, so a bad token is a plain HTTP error
+	token := credential(c, "editor")
+	if token != "" {
+		if err := s.verifyEditorToken(docID, token); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	if err := s.checkBan(c.Request.Context(), docID, ip, ""); err != nil {
+		requestLog(c).Info("Refused banned client", "doc_id", docID)
+		bannedClients.Inc(metrics.Labels{"stage": "connect"})
+		abortWithError(c, err)
+		return
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		requestLog(c).Error("WebSocket upgrade failed", "error", err)
+		return
+	}
+	// Refuse frames larger than a whole document could ever be
+	if s.config.MaxDocSize > 0 {
+		conn.SetReadLimit(int64(s.config.MaxDocSize) + 64*1024)
+	}
+	caps := legacyCapabilities
+	if names, ok := c.GetQuery("caps"); ok {
+		caps = parseCapabilities(strings.Split(names, ","))
+	}
+	// Only compress for clients that can take it, even if the browser negotiated it
+	conn.EnableWriteCompression(caps&capCompression != 0)
+	encoding := encodingJSON
+	if enc := c.Query("enc"); enc == encodingMsgpack || (enc == "" && caps&capBinary != 0) {
+		encoding = encodingMsgpack
+	}
+	connID := newID()
+	clientLog := requestLog(c).With("doc_id", docID, "conn_id", connID, "client_ip", ip)
+	clientLog.Debug("New client connected to document", "encoding", encoding, "capabilities", strings.Join(capabilityList(caps), ","))
+	doc, err := s.getOrCreateDocument(c.Request.Context(), docID)
+	if err != nil {
+		clientLog.Warn("Error loading document", "error", err)
+		conn.Close()
+		return
+	}
+	client := &Client{
+		conn:           conn,
+		connID:         connID,
+		log:            clientLog,
+		docID:          docID,
+		ip:             ip,
+		send:           make(chan *frame, 256),
+		encoding:       encoding,
+		caps:           caps,
+		locale:         c.GetString(localeKey),
+		presenceDigest: c.Query("presence") == "digest",
+		elevated:       token != "",
+		doc:            doc,
+	}
+	if peer != nil {
+		client.peer, client.readOnly = peer.instance, peer.readOnly
+		client.log = client.log.With("peer", peer.instance)
+	}
+	client.channels.Store(uint32(channels))
+	resumed := false
+	if s.config.ResumeWindow > 0 {
+		client.session = newID()
+		// Catch up on missed broadcasts instead of starting over; unknown or
+		// expired sessions fall back to a full init
+		if token := credential(c, "resume"); token != "" {
+			resumed = doc.resumeSession(token, client)
+		}
+	}
+	if !resumed {
+		// Clients start from the server's copy, never another client's; catch
+		// up with storage first in case an update from another instance was missed
+		doc.reconcile()
+		doc.mu.Lock()
+		client.joinAnonymously()
+		// Latecomers join the audience of a presentation
+		client.following = doc.presenter
+		lazy := client.lazyTabs()
+		for _, tab := range doc.Tabs {
+			if _, deferred := lazy[tab.ID]; !deferred {
+				client.rememberContent(tab.ID, tab.Content)
+			}
+		}
+		entry := client.presenceEntry()
+		// Send initial document state to the new client
+		initialState := client.initMessage()
+		if logger.DebugEnabled() {
+			client.log.Debug("Sending initial state to client", "state", initialState)
+		}
+		initJson, err := json.Marshal(initialState)
+		if err == nil {
+			err = client.writeFrame(initJson)
+		}
+		if err != nil {
+			client.log.Error("Error sending initial state", "error", err)
+			doc.mu.Unlock()
+			conn.Close()
+			return
+		}
+		doc.mu.Unlock()
+		select {
+		case doc.register <- client:
+		case <-doc.ctx.Done():
+			conn.Close()
+			return
+		}
+		doc.broadcastUserList()
+		doc.recordPresence(entry)
+	}
+	doc.connections.Add(1)
+	s.events.clients.Add(1)
+	s.events.publish(adminEvent{Type: "connect", DocID: docID, ConnID: connID})
+	// Start goroutines for reading and writing
+	go client.writePump()
+	go client.readPump()
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		// Mark as disconnected and broadcast; the roster keeps the user for a grace period
+		c.doc.mu.Lock()
+		if c.uuid != "" {
+			// Anonymous users never showed up in the digest as having joined
+			if !c.anonymous {
+				c.doc.presence.left(c.name)
+			}
+			c.doc.users.leave(c, time.Now())
+		}
+		c.doc.mu.Unlock()
+		c.doc.broadcastUserList()
+		if c.uuid != "" {
+			c.removePresence()
+		}
+		select {
+		case c.doc.unregister <- c:
+		case <-c.doc.ctx.Done():
+		}
+		c.conn.Close()
+		// Interpreters are only kept while someone is around to use them
+		if c.doc.connections.Add(-1) == 0 {
+			c.doc.stopREPLs()
+			c.doc.stopLanguageServer()
+		}
+		// Persist pending changes when a client leaves
+		c.doc.saver.flush(c.doc.ctx)
+		c.log.Info("Client disconnected from document", "client_uuid", c.uuid)
+		c.doc.server.events.clients.Add(-1)
+		c.doc.server.events.publish(adminEvent{Type: "disconnect", DocID: c.docID, ConnID: c.connID})
+	}()
+	// A message that makes a handler panic disconnects its client rather than
+	// crashing the server; handlers release their locks as they unwind
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Error("Recovered from panic handling client message", "client_uuid", c.uuid, "error", r)
+		}
+	}()
+	for {
+		messageType, frame, err := c.conn.ReadMessage()
+		if err != nil {
+			c.log.Debug("WebSocket read error", "client_uuid", c.uuid, "error", err)
+			break
+		}
+		message, err := decodeFrame(messageType, frame)
+		if err != nil {
+			c.sendError(err)
+			continue
+		}
+		// Parse the message
+		var msg map[string]interface{}
+		if err := json.Unmarshal(message, &msg); err != nil {
+			c.log.Debug("Error parsing message as JSON", "client_uuid", c.uuid, "error", err)
+			c.sendError(errInvalidJSON)
+			continue
+		}
+
+		// Handle different message types
+		msgType, ok := msg["type"].(string)
+		if !ok {
+			c.log.Debug("Message missing type field", "client_uuid", c.uuid)
+			c.sendError(errMissingType)
+			continue
+		}
+		// Message bodies can hold whole documents, so they're only logged at debug level
+		if logger.DebugEnabled() {
+			c.log.Debug("Received message from client", "client_uuid", c.uuid, "msg_type", msgType, "message", string(message))
+		}
+
+		// Continue the client's trace when it sent a traceparent with the message
+		traceparent, _ := msg["traceparent"].(string)
+		ctx, span := tracing.StartRemote(c.doc.ctx, traceparent, "ws."+msgType,
+			attribute.String("doc_id", c.docID),
+			attribute.String("msg_type", msgType),
+		)
+		c.span = span
+		c.handleWithBudget(ctx, msgType, msg, message)
+		c.span = nil
+		span.End()
+	}
+}
+
+// handleWithBudget handles a message within the configured processing budget,
+// cancelling its storage calls and recording the overrun if it takes longer
+func (c *Client) handleWithBudget(ctx context.Context, msgType string, msg map[string]interface{}, message []byte) {
+	budget := c.doc.server.config.MessageBudget
+	if budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+	start := time.Now()
+	c.handleMessage(ctx, msgType, msg, message)
+	elapsed := time.Since(start)
+	labels := metrics.Labels{"type": msgType}
+	messageDuration.Observe(elapsed.Seconds(), labels)
+	if budget > 0 && elapsed > budget {
+		messageBudgetExceeded.Inc(labels)
+		c.log.Warn("Message exceeded processing budget", "client_uuid", c.uuid, "msg_type", msgType, "elapsed", elapsed)
+	}
+}
+
+// handleMessage dispatches a parsed client message. ctx carries the message's trace span.
+func (c *Client) handleMessage(ctx context.Context, msgType string, msg map[string]interface{}, message []byte) {
+	if c.readOnly && !viewerMessages[msgType] {
+		c.sendError(errReadOnly)
+		return
+	}
+	switch msgType {
+	case "setName":
+		if name, ok := c.stringField(msg, "name"); ok {
+			uuid, _ := msg["uuid"].(string)
+			// Users banned by ID are only known once they name themselves
+			if err := c.doc.server.checkBan(ctx, c.docID, c.ip, uuid); err != nil {
+				c.log.Info("Disconnecting banned client", "client_uuid", uuid)
+				bannedClients.Inc(metrics.Labels{"stage": "setName"})
+				c.closeBanned()
+				return
+			}
+			// Returning users keep their color and avatar, and their name
+			// unless they send a new one
+			var identity *storage.Identity
+			if uuid != "" {
+				identity = c.doc.server.loadIdentity(ctx, uuid)
+			}
+			avatarURL, hasAvatarURL := msg["avatarUrl"].(string)
+			gravatarHash, hasGravatarHash := msg["gravatarHash"].(string)
+			if identity != nil {
+				if name == "" {
+					name = identity.Name
+				}
+				if !hasAvatarURL {
+					avatarURL = identity.AvatarURL
+				}
+				if !hasGravatarHash {
+					gravatarHash = identity.GravatarHash
+				}
+			}
+			if err := checkAvatar(avatarURL, gravatarHash); err != nil {
+				c.sendError(err)
+				return
+			}
+			name, err := c.moderate(ctx, moderation.KindName, "", c.doc.server.sanitizer.Label(name))
+			if err != nil {
+				c.sendError(err)
+				return
+			}
+			c.doc.mu.Lock()
+			// Clients that don't send their own ID keep the generated one
+			persistent := uuid != ""
+			if uuid == "" {
+				uuid = c.uuid
+			}
+			anonymousID := ""
+			if c.anonymous && c.uuid != uuid {
+				anonymousID = c.uuid
+			}
+			preferred := ""
+			if identity != nil {
+				preferred = identity.Color
+			}
+			previous := c.uuid
+			replaced := c.doc.users.join(c, uuid, preferred, c.doc.remoteColors(uuid))
+			if previous != uuid {
+				c.doc.moveFollowers(previous, uuid)
+			}
+			if c.following == uuid {
+				// A returning presenter doesn't follow themselves
+				c.following = ""
+			}
+			joined := c.anonymous
+			c.anonymous = false
+			if joined {
+				c.doc.presence.joined(c.doc.server.sanitizer.Label(name))
+			}
+			c.name = c.doc.server.sanitizer.Label(name)
+			c.avatarURL, c.gravatarHash = avatarURL, gravatarHash
+			c.log.Debug("Assigned color to user", "color", c.color, "name", name)
+			entry := c.presenceEntry()
+			c.doc.mu.Unlock()
+			if replaced != nil {
+				// The hub stops sending to the user's previous connection, which closes it
+				select {
+				case c.doc.unregister <- replaced:
+				case <-c.doc.ctx.Done():
+				}
+			}
+			c.doc.broadcastUserList()
+			c.doc.recordPresence(entry)
+			if persistent {
+				c.saveIdentity(ctx, storage.Identity{UUID: uuid, Name: entry.Name, Color: entry.Color, AvatarURL: avatarURL, GravatarHash: gravatarHash})
+			}
+			if anonymousID != "" {
+				c.doc.removeAnonymousPresence(anonymousID)
+			}
+			if joined {
+				c.doc.recordActivity(storage.ActivityEvent{Type: storage.ActivityUserJoined, User: c.name})
+				c.doc.server.notify(webhook.UserJoined, c.docID, c.name)
+			}
+		}
+	case "setLanguage", "language":
+		if lang, ok := c.stringField(msg, "language"); ok {
+			c.doc.mu.Lock()
+			if err := c.doc.checkStructure(c); err != nil {
+				c.doc.mu.Unlock()
+				c.sendError(err)
+				return
+			}
+			if err := c.doc.checkLock("", ""); err != nil {
+				c.doc.mu.Unlock()
+				c.sendError(err)
+				return
+			}
+			c.doc.Language = lang
+			c.doc.mu.Unlock()
+			langMsg := map[string]interface{}{
+				"type":     "language",
+				"language": lang,
+			}
+			jsonMsg, err := json.Marshal(langMsg)
+			if err != nil {
+				c.log.Debug("Error marshaling language message", "error", err)
+				return
+			}
+			c.doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+			c.doc.scheduleSave()
+			c.doc.recordActivity(storage.ActivityEvent{Type: storage.ActivityLanguageChanged, User: c.name, Language: lang})
+		}
+	case "setTitle":
+		c.handleSetTitle(msg)
+	case "update":
+		if tabId, ok := c.stringField(msg, "tabId"); ok {
+			if content, ok := c.stringField(msg, "content"); ok {
+				moderated, err := c.moderate(ctx, moderation.KindContent, tabId, content)
+				if err != nil {
+					c.sendError(err)
+					c.resyncTab(tabId)
+					return
+				}
+				// Update the tab content and persist the change
+				merged, err := c.applyUpdate(ctx, tabId, moderated)
+				if err != nil {
+					c.sendError(err)
+					c.resyncTab(tabId)
+					return
+				}
+				// The sender still shows what it typed, before the redaction
+				// or changes merged in
+				if merged != content {
+					c.resyncTab(tabId)
+					content = merged
+				}
+				c.doc.presence.edited(c.name)
+				c.suggestFor(tabId, content)
+				c.doc.detectLanguage(tabId, content)
+			}
+		}
+	case "batch":
+		c.handleBatch(ctx, message)
+	case "follow":
+		c.handleFollow(msg)
+	case "unfollow":
+		c.handleUnfollow()
+	case "view":
+		c.handleView(msg, message)
+	case "present":
+		c.handlePresent(msg)
+	case "signal":
+		c.handleSignal(msg, message)
+	case "reaction":
+		c.handleReaction(msg)
+	case "highlight":
+		c.handleHighlight(msg)
+	case "fork":
+		c.handleFork(ctx, msg)
+	case "pin":
+		c.handlePin(ctx, msg)
+	case "cursor":
+		if to, _ := msg["to"].(string); to != "" {
+			c.handleCursorPing(msg, to)
+			return
+		}
+		// Broadcast cursor/selection update to all other clients
+		c.doc.mu.Lock()
+		c.cursor = message
+		c.doc.mu.Unlock()
+		if c.doc.load.shedding() {
+			shedMessages.Inc(metrics.Labels{"kind": "cursor"})
+			return
+		}
+		c.doc.send(BroadcastMessage{Sender: c, Message: message, Trace: trace.SpanContextFromContext(ctx)})
+	case "tabCreate":
+		if tab, ok := msg["tab"].(map[string]interface{}); ok {
+			id, ok := c.stringField(tab, "id")
+			if !ok {
+				return
+			}
+			// Name, content, notes and kind are optional
+			name, _ := tab["name"].(string)
+			content, _ := tab["content"].(string)
+			notes, _ := tab["notes"].(string)
+			kind, _ := tab["kind"].(string)
+			runtime, _ := tab["runtime"].(string)
+			newTab := Tab{
+				ID:      id,
+				Name:    c.doc.server.sanitizer.Label(name),
+				Content: content,
+				Notes:   notes,
+				Kind:    kind,
+				Runtime: runtime,
+			}
+			if err := c.doc.checkTabKind(newTab); err != nil {
+				c.sendError(err)
+				return
+			}
+			if err := c.moderateTab(ctx, &newTab); err != nil {
+				c.sendError(err)
+				return
+			}
+			c.doc.mu.Lock()
+			if err := c.doc.checkStructure(c); err != nil {
+				c.doc.mu.Unlock()
+				c.sendError(err)
+				return
+			}
+			if c.doc.findTab(id) >= 0 {
+				c.doc.mu.Unlock()
+				c.sendError(apperr.Newf(apperr.CodeInvalidTab, "tab %q already exists", id))
+				return
+			}
+			if err := c.doc.checkLock(id, ""); err != nil {
+				c.doc.mu.Unlock()
+				c.sendError(err)
+				return
+			}
+			if err := c.doc.checkTabChange(-1, newTab); err != nil {
+				c.doc.mu.Unlock()
+				c.sendError(err)
+				return
+			}
+			c.doc.Tabs = append(c.doc.Tabs, newTab)
+			c.doc.mu.Unlock()
+			c.doc.server.usage.Record(c.docID, telemetry.FeatureTabCreate)
+
+			msg := map[string]interface{}{
+				"type": "tabCreate",
+				"tab":  newTab,
+			}
+			jsonMsg, err := json.Marshal(msg)
+			if err != nil {
+				c.log.Debug("Error marshaling tabCreate message", "error", err)
+				return
+			}
+			c.doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+
+			// Also broadcast tabFocus for the new tab
+			focusMsg := map[string]interface{}{
+				"type":  "tabFocus",
+				"tabId": newTab.ID,
+			}
+			focusJson, err := json.Marshal(focusMsg)
+			if err == nil {
+				c.doc.send(BroadcastMessage{Sender: nil, Message: focusJson})
+			}
+
+			// Save state after creating tab
+			c.doc.scheduleSave()
+			c.doc.checkSoftLimits()
+			c.doc.recordActivity(storage.ActivityEvent{Type: storage.ActivityTabCreated, User: c.name, TabID: newTab.ID, TabName: newTab.Name})
+			if newTab.Content != "" {
+				c.suggestFor(newTab.ID, newTab.Content)
+				c.doc.detectLanguage(newTab.ID, newTab.Content)
+				c.doc.lspChanged()
+			}
+		} else {
+			c.sendError(apperr.New(apperr.CodeInvalidMessage, "tabCreate message is missing field \"tab\""))
+		}
+	case "tabDelete":
+		if tabId, ok := c.stringField(msg, "tabId"); ok {
+			c.doc.mu.Lock()
+			// Find and remove the tab
+			i := c.doc.findTab(tabId)
+			if i < 0 {
+				c.doc.mu.Unlock()
+				c.sendError(errTabNotFound)
+				return
+			}
+			if err := c.doc.checkStructure(c); err != nil {
+				c.doc.mu.Unlock()
+				c.sendError(err)
+				return
+			}
+			if err := c.doc.checkLock(tabId, ""); err != nil {
+				c.doc.mu.Unlock()
+				c.sendError(err)
+				return
+			}
+			deleted := c.doc.Tabs[i]
+			c.doc.Tabs = append(c.doc.Tabs[:i], c.doc.Tabs[i+1:]...)
+			// If we deleted the active tab, set active tab to the first tab
+			if c.doc.ActiveTabId == tabId {
+				if len(c.doc.Tabs) > 0 {
+					c.doc.ActiveTabId = c.doc.Tabs[0].ID
+				}
+			}
+			c.doc.ensureMinimumTabs() // Ensure we still have at least one tab
+			// Broadcast the updated tab list and active tab
+			update, err := c.doc.tabListUpdate()
+			c.doc.mu.Unlock()
+			if err == nil {
+				c.doc.send(update)
+			}
+
+			// Save state after deleting tab
+			c.doc.scheduleSave()
+			c.doc.checkSoftLimits()
+			c.doc.stopREPL(tabId)
+			c.doc.lspChanged()
+			c.doc.recordActivity(storage.ActivityEvent{Type: storage.ActivityTabDeleted, User: c.name, TabID: tabId, TabName: deleted.Name})
+		}
+	case "tabFocus":
+		if tabId, ok := c.stringField(msg, "tabId"); ok {
+			c.doc.mu.Lock()
+			if c.doc.findTab(tabId) < 0 {
+				c.doc.mu.Unlock()
+				c.sendError(errTabNotFound)
+				return
+			}
+			c.doc.ActiveTabId = tabId
+			c.doc.mu.Unlock()
+
+			msg := map[string]interface{}{
+				"type":  "tabFocus",
+				"tabId": tabId,
+			}
+			jsonMsg, err := json.Marshal(msg)
+			if err != nil {
+				c.log.Debug("Error marshaling tabFocus message", "error", err)
+				return
+			}
+			c.doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+
+			// Save state after changing active tab
+			c.doc.scheduleSave()
+		}
+	case "tabRename":
+		if tabId, ok := c.stringField(msg, "tabId"); ok {
+			if name, ok := c.stringField(msg, "name"); ok {
+				c.doc.mu.Lock()
+				// Update the tab name
+				i := c.doc.findTab(tabId)
+				if i < 0 {
+					c.doc.mu.Unlock()
+					c.sendError(errTabNotFound)
+					return
+				}
+				if err := c.doc.checkStructure(c); err != nil {
+					c.doc.mu.Unlock()
+					c.sendError(err)
+					return
+				}
+				if err := c.doc.checkLock(tabId, ""); err != nil {
+					c.doc.mu.Unlock()
+					c.sendError(err)
+					return
+				}
+				previous := c.doc.Tabs[i].Name
+				c.doc.Tabs[i].Name = c.doc.server.sanitizer.Label(name)
+				renamed := c.doc.Tabs[i].Name
+				// Send a tabUpdate message with the complete tab state
+				update, err := c.doc.tabListUpdate()
+				c.doc.mu.Unlock()
+				if err != nil {
+					c.log.Debug("Error marshaling tabUpdate message", "error", err)
+					return
+				}
+				c.doc.send(update)
+
+				// Save state after renaming tab
+				c.doc.scheduleSave()
+				c.doc.checkSoftLimits()
+				c.doc.recordActivity(storage.ActivityEvent{Type: storage.ActivityTabRenamed, User: c.name, TabID: tabId, TabName: renamed, PreviousName: previous})
+			}
+		}
+	case "tabDuplicate":
+		c.handleTabDuplicate(ctx, msg)
+	case "tabBulk":
+		c.handleTabBulk(ctx, message)
+	case "subscribe":
+		c.handleSubscription(msg, true)
+	case "unsubscribe":
+		c.handleSubscription(msg, false)
+	case "replInput":
+		c.handleReplInput(msg)
+	case "replReset":
+		c.handleReplReset(msg)
+	case "run":
+		c.handleRun(msg)
+	case "runStop":
+		c.handleRunStop()
+	case "lspCompletion", "lspHover":
+		c.handleLSPRequest(msgType, msg)
+	case "setSettings":
+		c.handleSetSettings(msg)
+	case "exportGist":
+		c.handleExportGist(msg)
+	case "tabContentRequest":
+		c.handleTabContentRequest(msg)
+	case "tabPromote":
+		c.handleTabPromote(ctx, msg)
+	case "unfurl":
+		c.handleUnfurl(msg)
+	case "suggestionAccept":
+		c.handleSuggestionAccept(msg)
+	case "tabNotesUpdate":
+		if tabId, ok := c.stringField(msg, "tabId"); ok {
+			if notes, ok := c.stringField(msg, "notes"); ok {
+				notes, err := c.moderate(ctx, moderation.KindContent, tabId, notes)
+				if err != nil {
+					c.sendError(err)
+					return
+				}
+				c.doc.mu.Lock()
+				i := c.doc.findTab(tabId)
+				if i < 0 {
+					c.doc.mu.Unlock()
+					c.sendError(errTabNotFound)
+					return
+				}
+				if err := c.doc.checkLock(tabId, ""); err != nil {
+					c.doc.mu.Unlock()
+					c.sendError(err)
+					return
+				}
+				updated := c.doc.Tabs[i]
+				updated.Notes = notes
+				if err := c.doc.checkTabChange(i, updated); err != nil {
+					c.doc.mu.Unlock()
+					c.sendError(err)
+					return
+				}
+				c.doc.Tabs[i].Notes = notes
+				c.doc.mu.Unlock()
+
+				// Broadcast to all clients
+				broadcastMsg := map[string]interface{}{
+					"type":  "tabNotesUpdate",
+					"tabId": tabId,
+					"notes": notes,
+				}
+				jsonMsg, err := json.Marshal(broadcastMsg)
+				if err == nil {
+					c.doc.send(BroadcastMessage{Sender: c, Message: jsonMsg})
+				}
+
+				// Save state after update
+				c.doc.scheduleSave()
+				c.doc.checkSoftLimits()
+			}
+		}
+	default:
+		c.sendError(apperr.Newf(apperr.CodeInvalidMessage, "unknown message type %q", msgType))
+	}
+}
+
+func (c *Client) writePump() {
+	defer func() {
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case <-c.doc.ctx.Done():
+			// Document is shutting down; closing the connection also stops readPump
+			return
+		case message, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if err := c.writePrepared(message); err != nil {
+				c.log.Error("Failed to send message to client", "error", err)
+				return
+			}
+			c.log.Debug("Message sent to client")
+		}
+	}
+}
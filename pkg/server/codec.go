@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Wire encodings a client can negotiate with ?enc= when connecting
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+)
+
+// Messages are built and broadcast as JSON internally; clients that asked for
+// MessagePack have them transcoded at the connection boundary.
+
+// maxPooledBuffer is the largest transcoding buffer kept for reuse, so one
+// huge message doesn't pin its memory
+const maxPooledBuffer = 1 << 20
+
+// msgpackBuffers holds buffers for transcoding outgoing messages to MessagePack
+var msgpackBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// getBuffer takes an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := msgpackBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns a buffer to the pool unless it grew too large
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		msgpackBuffers.Put(buf)
+	}
+}
+
+// encodeMsgpack transcodes an outgoing JSON message to MessagePack, appending it to buf
+func encodeMsgpack(buf *bytes.Buffer, message []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(message, &v); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to decode outgoing message")
+	}
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+	enc.Reset(buf)
+	if err := enc.Encode(v); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to encode message as msgpack")
+	}
+	return nil
+}
+
+// decodeFrame converts an incoming frame to JSON. Binary frames are MessagePack;
+// text frames are always accepted as JSON.
+func decodeFrame(messageType int, data []byte) ([]byte, error) {
+	if messageType != websocket.BinaryMessage {
+		return data, nil
+	}
+	var v interface{}
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return nil, apperr.Wrap(apperr.CodeValidation, err, "invalid msgpack message")
+	}
+	message, err := json.Marshal(v)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeValidation, err, "unsupported msgpack message")
+	}
+	return message, nil
+}
+
+// writeFrame writes a JSON message to the connection in the client's encoding.
+// Broadcasts go through frames instead; this is for messages written directly.
+func (c *Client) writeFrame(message []byte) error {
+	if c.encoding != encodingMsgpack {
+		return c.conn.WriteMessage(websocket.TextMessage, message)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := encodeMsgpack(buf, message); err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+}
+
+// writePrepared writes a frame to the connection in the client's encoding
+func (c *Client) writePrepared(f *frame) error {
+	pm, err := f.prepared(c.encoding)
+	if err != nil {
+		return err
+	}
+	return c.conn.WritePreparedMessage(pm)
+}
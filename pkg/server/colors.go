@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+)
+
+// User colors are derived from user IDs, so a user gets the same color in
+// every document unless someone there already has a similar one. They share
+// saturation and lightness and differ in hue.
+const (
+	colorSaturation = 0.65
+	colorLightness  = 0.6
+	// minHueDistance is how far apart in degrees two users' hues must be to
+	// tell them apart at a glance, which leaves room for 15 distinct colors
+	minHueDistance = 24
+	// goldenAngle steps through hues so each candidate is far from the ones before
+	goldenAngle = 137.508
+	// colorCandidates bounds the hues tried before looking for the least crowded one
+	colorCandidates = 32
+)
+
+// colorFor returns the color of user uuid: the hue derived from it if it's
+// far enough from the hues others hold, or else the first hue that is,
+// stepping by the golden angle. When none of those is, the hue furthest from
+// its nearest neighbor is used.
+func colorFor(uuid string, held []float64) string {
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	start := float64(h.Sum32() % 360)
+	for i := 0; i < colorCandidates; i++ {
+		hue := math.Mod(start+float64(i)*goldenAngle, 360)
+		if nearestHue(hue, held) >= minHueDistance {
+			return hslColor(hue)
+		}
+	}
+	best, bestDistance := start, -1.0
+	for i := 0; i < 360; i++ {
+		hue := math.Mod(start+float64(i), 360)
+		if distance := nearestHue(hue, held); distance > bestDistance {
+			best, bestDistance = hue, distance
+		}
+	}
+	return hslColor(best)
+}
+
+// nearestHue returns the distance in degrees from hue to the closest of held,
+// or 360 if there are none
+func nearestHue(hue float64, held []float64) float64 {
+	nearest := 360.0
+	for _, other := range held {
+		d := math.Abs(hue - other)
+		nearest = min(nearest, d, 360-d)
+	}
+	return nearest
+}
+
+// hslColor formats a hue at the user color saturation and lightness as #rrggbb
+func hslColor(hue float64) string {
+	c := (1 - math.Abs(2*colorLightness-1)) * colorSaturation
+	x := c * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := colorLightness - c/2
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = c, x, 0
+	case hue < 120:
+		r, g, b = x, c, 0
+	case hue < 180:
+		r, g, b = 0, c, x
+	case hue < 240:
+		r, g, b = 0, x, c
+	case hue < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	channel := func(v float64) int { return int(math.Round((v + m) * 255)) }
+	return fmt.Sprintf("#%02x%02x%02x", channel(r), channel(g), channel(b))
+}
+
+// colorHue returns the hue of a #rrggbb color. Colors that aren't in that
+// form, such as ones stored by older versions in another, are reported false.
+func colorHue(color string) (float64, bool) {
+	if len(color) != 7 || color[0] != '#' {
+		return 0, false
+	}
+	rgb, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	r, g, b := float64(rgb>>16)/255, float64(rgb>>8&0xff)/255, float64(rgb&0xff)/255
+	high, low := max(r, g, b), min(r, g, b)
+	delta := high - low
+	if delta == 0 {
+		// Grays have no hue, so they don't crowd any
+		return 0, false
+	}
+	var hue float64
+	switch high {
+	case r:
+		hue = math.Mod((g-b)/delta, 6)
+	case g:
+		hue = (b-r)/delta + 2
+	default:
+		hue = (r-g)/delta + 4
+	}
+	hue *= 60
+	if hue < 0 {
+		hue += 360
+	}
+	return hue, true
+}
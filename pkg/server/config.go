@@ -0,0 +1,523 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/github"
+	"github.com/shiftregister-vg/gopad/pkg/i18n"
+	"github.com/shiftregister-vg/gopad/pkg/mirror"
+	"github.com/shiftregister-vg/gopad/pkg/moderation"
+	"github.com/shiftregister-vg/gopad/pkg/runner"
+	"github.com/shiftregister-vg/gopad/pkg/sanitize"
+	"github.com/shiftregister-vg/gopad/pkg/validate"
+)
+
+// Config holds the settings for a gopad server
+type Config struct {
+	// Development proxies all non-WebSocket requests to DevServerURL instead of serving StaticDir
+	Development  bool
+	DevServerURL string
+	// StaticDir is the directory holding the built frontend
+	StaticDir string
+	// AdminToken enables the /admin endpoints when non-empty
+	AdminToken string
+	// RecoveryFile is where POST /admin/recovery-snapshot writes the loaded documents
+	RecoveryFile string
+	// TelemetryEnabled turns on anonymous feature usage counters
+	TelemetryEnabled bool
+	// SaveInterval is the longest a change waits before being persisted; zero saves every change immediately
+	SaveInterval time.Duration
+	// SaveMaxOps forces a save once this many changes are pending
+	SaveMaxOps int
+	// WriteBufferSize is how many documents' saves are held while Redis is
+	// unreachable, to be replayed once it's back; zero drops them
+	WriteBufferSize int
+	// WriteBufferDir, when set, keeps the held saves on disk as well, so they
+	// survive a restart
+	WriteBufferDir string
+	// DeltaPersistence appends content edits to an operation log instead of saving
+	// the whole document; snapshots are taken every SnapshotInterval or SnapshotMaxOps edits
+	DeltaPersistence bool
+	SnapshotInterval time.Duration
+	SnapshotMaxOps   int
+	// SignedURLSecret, when set, requires raw/export requests to carry an HMAC signature
+	// minted via the admin API; SignedURLSkew is the clock skew tolerated on expiry
+	SignedURLSecret string
+	SignedURLSkew   time.Duration
+	// Size limits in bytes (and tab count) enforced on incoming edits; zero disables a limit
+	MaxTabSize int
+	MaxTabs    int
+	MaxDocSize int
+	// SoftLimitRatio is the share of each size limit at which clients are warned
+	// that the document is approaching it; zero disables the warnings
+	SoftLimitRatio float64
+	// SanitizePolicy controls which markup survives when content is re-served as HTML;
+	// MaxNameLength caps user and tab names echoed to other clients
+	SanitizePolicy sanitize.Policy
+	MaxNameLength  int
+	// DefaultLocale is used for server messages when a client's preferred languages aren't available
+	DefaultLocale string
+	// PresenceDigestInterval is how often activity summaries are sent to clients
+	// connected with ?presence=digest; zero disables digests
+	PresenceDigestInterval time.Duration
+	// UnfurlEnabled lets clients request link previews, fetched by the server and cached for UnfurlCacheTTL
+	UnfurlEnabled  bool
+	UnfurlCacheTTL time.Duration
+	// ImportEnabled lets tabs be imported from URLs, fetching at most ImportMaxSize bytes per import
+	ImportEnabled bool
+	ImportMaxSize int64
+	// TrustedProxies lists the proxy addresses or CIDR ranges whose X-Forwarded-For
+	// and X-Real-IP headers are believed; requests from anywhere else are
+	// attributed to their connection's address
+	TrustedProxies []string
+	// Validation selects checks run on tab content before it is accepted;
+	// ValidationMode decides whether failures are rejected or only flagged
+	Validation     validate.Config
+	ValidationMode validate.Mode
+	// Moderation checks content updates and display names before they're
+	// shared; its WebhookSecret is taken from WebhookSecret
+	Moderation moderation.Config
+	// SecretScan controls scanning content for credentials: "warn" broadcasts a
+	// warning, "block" rejects the change and "off" disables scanning. Both
+	// record an audit log entry and admin feed event.
+	SecretScan string
+	// DefaultWorkspace is the workspace whose policy applies to documents that
+	// haven't been assigned to one; empty leaves them without a policy
+	DefaultWorkspace string
+	// ResumeWindow is how long a disconnected client's missed broadcasts are kept
+	// so it can resume its session instead of reloading; zero disables resuming
+	ResumeWindow time.Duration
+	// ReplCommands maps REPL runtimes (e.g. "python") to the command starting an
+	// interactive interpreter for them. The command must do its own sandboxing;
+	// REPL tabs are unavailable for runtimes not listed.
+	ReplCommands map[string][]string
+	// LSPCommands maps languages to the command starting a language server for
+	// them over stdio, e.g. "go" -> ["gopls"]. Documents in other languages
+	// don't get completions, hover information or diagnostics.
+	LSPCommands map[string][]string
+	// Run configures running the code of editor tabs in a sandbox; languages
+	// without a command in Run.Commands can't be run
+	Run runner.Config
+	// SendBacklog is how many frames may wait for a slow client once its send
+	// buffer is full before it is disconnected; zero disconnects immediately.
+	// SendStallTimeout disconnects clients whose backlog hasn't moved for that long.
+	SendBacklog      int
+	SendStallTimeout time.Duration
+	// LazyTabSize is the content size from which tabs other than the active one
+	// are sent without their content to clients with the lazyTabs capability,
+	// which fetch it when they open them; zero sends every tab in full
+	LazyTabSize int
+	// SuggestionsEnabled proposes tab names and languages based on tab content
+	SuggestionsEnabled bool
+	// LanguageDetection sets the language of plaintext documents from the code
+	// pasted or typed into them
+	LanguageDetection bool
+	// WebhookURLs receive document events signed with WebhookSecret; none
+	// disables webhooks. Edits after WebhookIdle without one are reported as
+	// the document becoming active again, and WebhookIdle without edits as it
+	// becoming inactive. Documents are reported WebhookExpiryWarning before
+	// their TTL passes; zero disables the warning.
+	WebhookURLs          []string
+	WebhookSecret        string
+	WebhookIdle          time.Duration
+	WebhookExpiryWarning time.Duration
+	// ExpiryWarning is how long before a loaded document's TTL passes its
+	// clients are warned; zero disables the warning
+	ExpiryWarning time.Duration
+	// ArchiveDir and ArchiveS3 are where documents are archived ArchiveBefore
+	// their TTL passes, for restoring them once they expired; neither disables
+	// archiving
+	ArchiveDir    string
+	ArchiveS3     mirror.S3Config
+	ArchiveBefore time.Duration
+	// PresenceTTL is how long a user stays listed without a heartbeat from the
+	// instance they're connected to; heartbeats are sent every third of it.
+	// Zero keeps presence local to each instance.
+	PresenceTTL time.Duration
+	// MessageBudget is how long a client message may take to handle before its
+	// storage calls are cancelled and the overrun is logged; zero disables the budget
+	MessageBudget time.Duration
+	// OverloadThreshold is how long broadcasts may wait for a document hub before it
+	// sheds cursor relays and presence digests; zero disables shedding
+	OverloadThreshold time.Duration
+	// MirrorDir and MirrorS3 are where static HTML copies of mirrored documents
+	// are published after each save, or every MirrorInterval when it's set
+	MirrorDir      string
+	MirrorS3       mirror.S3Config
+	MirrorInterval time.Duration
+	// GitHubToken is used to export documents to GitHub when an admin request
+	// brings no token of its own, committing only to GitHubRepos ("owner/name"
+	// or "owner/name/directory"); GitHubAPIURL points at GitHub Enterprise Server instead
+	GitHubToken  string
+	GitHubRepos  []string
+	GitHubAPIURL string
+	// IDStrategy picks the IDs of documents created through the API: "uuid",
+	// "words", "nanoid" or "sequential"
+	IDStrategy string
+	// ReconcileInterval is how often loaded documents are checked against storage
+	// for drift caused by missed updates; zero disables the check
+	ReconcileInterval time.Duration
+	// SubscriptionBeat is how often each instance publishes a beat for every
+	// document it has loaded, to detect dead subscriptions and lost messages;
+	// zero disables the watchdog
+	SubscriptionBeat time.Duration
+	// IdentityTTL is how long a user's name, color and avatar are remembered
+	// across documents after they last set them; zero disables remembering
+	IdentityTTL time.Duration
+	// InstanceName and PublicURL describe the instance in /.well-known/gopad.json.
+	// With both PublicURL and DirectoryURL set, the instance registers itself
+	// with the community directory at DirectoryURL.
+	InstanceName string
+	PublicURL    string
+	DirectoryURL string
+	// FederationPeers maps the public URLs of other gopad instances to the
+	// secrets shared with them for signing server-to-server requests. Peers may
+	// follow documents hosted here, read-only unless they're listed in
+	// FederationWriters, and documents here may follow theirs. Following needs
+	// PublicURL, which identifies this instance to its peers.
+	FederationPeers   map[string]string
+	FederationWriters []string
+	// AdvertiseURL is where the other instances sharing this one's Redis reach
+	// it, and ClusterSecret the secret they share for relaying clients. With both
+	// set, each loaded document is owned by one instance, holding a lease renewed
+	// every third of OwnerLease, and the others relay their clients to it.
+	AdvertiseURL  string
+	ClusterSecret string
+	OwnerLease    time.Duration
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() Config {
+	return Config{
+		DevServerURL: "http://localhost:3000",
+		StaticDir:    "./web/dist",
+		RecoveryFile: "gopad-recovery.json",
+		SaveInterval: 2 * time.Second,
+		SaveMaxOps:   50,
+
+		WriteBufferSize: 1000,
+
+		SnapshotInterval: 30 * time.Second,
+		SnapshotMaxOps:   500,
+
+		SignedURLSkew: 30 * time.Second,
+
+		MaxTabSize: 1 << 20,
+		MaxTabs:    50,
+		MaxDocSize: 5 << 20,
+
+		SoftLimitRatio: 0.8,
+
+		SanitizePolicy: sanitize.PolicyUGC,
+		MaxNameLength:  64,
+
+		DefaultLocale: i18n.DefaultLocale,
+
+		PresenceDigestInterval: 10 * time.Second,
+
+		UnfurlEnabled:  true,
+		UnfurlCacheTTL: time.Hour,
+
+		ImportEnabled: true,
+		ImportMaxSize: 1 << 20,
+
+		SuggestionsEnabled: true,
+		LanguageDetection:  true,
+
+		WebhookIdle:          30 * time.Minute,
+		WebhookExpiryWarning: 24 * time.Hour,
+
+		ExpiryWarning: 24 * time.Hour,
+		ArchiveS3:     mirror.S3Config{Region: "us-east-1"},
+		ArchiveBefore: time.Hour,
+
+		MirrorS3: mirror.S3Config{Region: "us-east-1"},
+
+		GitHubAPIURL: github.DefaultAPIURL,
+
+		IDStrategy: idStrategyUUID,
+
+		Run: runner.Config{
+			Sandbox:  runner.SandboxDocker,
+			Timeout:  10 * time.Second,
+			MemoryMB: 256,
+			CPUs:     1,
+		},
+
+		ValidationMode:    validate.ModeReject,
+		SecretScan:        secretScanWarn,
+		ResumeWindow:      2 * time.Minute,
+		SendBacklog:       1024,
+		SendStallTimeout:  30 * time.Second,
+		LazyTabSize:       16 * 1024,
+		PresenceTTL:       30 * time.Second,
+		MessageBudget:     2 * time.Second,
+		OverloadThreshold: 250 * time.Millisecond,
+		ReconcileInterval: time.Minute,
+		SubscriptionBeat:  10 * time.Second,
+		IdentityTTL:       90 * 24 * time.Hour,
+		OwnerLease:        15 * time.Second,
+	}
+}
+
+// ConfigFromEnv builds a configuration from environment variables
+func ConfigFromEnv() Config {
+	cfg := DefaultConfig()
+	cfg.Development = os.Getenv("GO_ENV") == "development"
+	if dir := os.Getenv("STATIC_DIR"); dir != "" {
+		cfg.StaticDir = dir
+	}
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	if path := os.Getenv("RECOVERY_FILE"); path != "" {
+		cfg.RecoveryFile = path
+	}
+	cfg.TelemetryEnabled = os.Getenv("TELEMETRY_ENABLED") == "true"
+	if d, err := time.ParseDuration(os.Getenv("SAVE_INTERVAL")); err == nil {
+		cfg.SaveInterval = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("SAVE_MAX_OPS")); err == nil {
+		cfg.SaveMaxOps = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("WRITE_BUFFER_SIZE")); err == nil && n >= 0 {
+		cfg.WriteBufferSize = n
+	}
+	cfg.WriteBufferDir = os.Getenv("WRITE_BUFFER_DIR")
+	cfg.DeltaPersistence = os.Getenv("DELTA_PERSISTENCE") == "true"
+	if d, err := time.ParseDuration(os.Getenv("SNAPSHOT_INTERVAL")); err == nil {
+		cfg.SnapshotInterval = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("SNAPSHOT_MAX_OPS")); err == nil {
+		cfg.SnapshotMaxOps = n
+	}
+	cfg.SignedURLSecret = os.Getenv("SIGNED_URL_SECRET")
+	if d, err := time.ParseDuration(os.Getenv("SIGNED_URL_SKEW")); err == nil {
+		cfg.SignedURLSkew = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_TAB_SIZE")); err == nil {
+		cfg.MaxTabSize = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_TABS")); err == nil {
+		cfg.MaxTabs = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_DOC_SIZE")); err == nil {
+		cfg.MaxDocSize = n
+	}
+	if f, err := strconv.ParseFloat(os.Getenv("SOFT_LIMIT_RATIO"), 64); err == nil {
+		cfg.SoftLimitRatio = f
+	}
+	if policy := os.Getenv("SANITIZE_POLICY"); policy != "" {
+		cfg.SanitizePolicy = sanitize.Policy(policy)
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_NAME_LENGTH")); err == nil {
+		cfg.MaxNameLength = n
+	}
+	if locale := os.Getenv("DEFAULT_LOCALE"); locale != "" {
+		cfg.DefaultLocale = locale
+	}
+	if d, err := time.ParseDuration(os.Getenv("PRESENCE_DIGEST_INTERVAL")); err == nil {
+		cfg.PresenceDigestInterval = d
+	}
+	if os.Getenv("UNFURL_ENABLED") == "false" {
+		cfg.UnfurlEnabled = false
+	}
+	if d, err := time.ParseDuration(os.Getenv("UNFURL_CACHE_TTL")); err == nil {
+		cfg.UnfurlCacheTTL = d
+	}
+	if os.Getenv("IMPORT_ENABLED") == "false" {
+		cfg.ImportEnabled = false
+	}
+	if n, err := strconv.ParseInt(os.Getenv("IMPORT_MAX_SIZE"), 10, 64); err == nil {
+		cfg.ImportMaxSize = n
+	}
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		for _, proxy := range strings.Split(proxies, ",") {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, strings.TrimSpace(proxy))
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv("VALIDATE_MAX_LINE_LENGTH")); err == nil {
+		cfg.Validation.MaxLineLength = n
+	}
+	if names := os.Getenv("VALIDATE_FORBIDDEN"); names != "" {
+		cfg.Validation.Forbidden = strings.Split(names, ",")
+	}
+	cfg.Validation.Pattern = os.Getenv("VALIDATE_PATTERN")
+	cfg.Validation.Syntax = os.Getenv("VALIDATE_SYNTAX") == "true"
+	if os.Getenv("VALIDATE_MODE") == string(validate.ModeFlag) {
+		cfg.ValidationMode = validate.ModeFlag
+	}
+	cfg.Moderation.DenyListFile = os.Getenv("MODERATION_DENYLIST_FILE")
+	cfg.Moderation.DenyListAction = moderation.Action(os.Getenv("MODERATION_ACTION"))
+	cfg.Moderation.WebhookURL = os.Getenv("MODERATION_WEBHOOK_URL")
+	if d, err := time.ParseDuration(os.Getenv("MODERATION_TIMEOUT")); err == nil {
+		cfg.Moderation.WebhookTimeout = d
+	}
+	switch mode := os.Getenv("SECRET_SCAN"); mode {
+	case secretScanOff, secretScanWarn, secretScanBlock:
+		cfg.SecretScan = mode
+	}
+	cfg.DefaultWorkspace = os.Getenv("DEFAULT_WORKSPACE")
+	if d, err := time.ParseDuration(os.Getenv("RESUME_WINDOW")); err == nil {
+		cfg.ResumeWindow = d
+	}
+	if commands := os.Getenv("REPL_COMMANDS"); commands != "" {
+		cfg.ReplCommands = make(map[string][]string)
+		for _, entry := range strings.Split(commands, ";") {
+			runtime, command, ok := strings.Cut(entry, "=")
+			if ok && strings.TrimSpace(runtime) != "" {
+				cfg.ReplCommands[strings.TrimSpace(runtime)] = strings.Fields(command)
+			}
+		}
+	}
+	if commands := os.Getenv("LSP_COMMANDS"); commands != "" {
+		cfg.LSPCommands = make(map[string][]string)
+		for _, entry := range strings.Split(commands, ";") {
+			language, command, ok := strings.Cut(entry, "=")
+			if ok && strings.TrimSpace(language) != "" {
+				cfg.LSPCommands[strings.TrimSpace(language)] = strings.Fields(command)
+			}
+		}
+	}
+	if sandbox := os.Getenv("RUN_SANDBOX"); sandbox == runner.SandboxDocker || sandbox == runner.SandboxNsjail {
+		cfg.Run.Sandbox = sandbox
+	}
+	if commands := os.Getenv("RUN_COMMANDS"); commands != "" {
+		cfg.Run.Commands = make(map[string][]string)
+		for _, entry := range strings.Split(commands, ";") {
+			language, command, ok := strings.Cut(entry, "=")
+			if ok && strings.TrimSpace(language) != "" {
+				cfg.Run.Commands[strings.TrimSpace(language)] = strings.Fields(command)
+			}
+		}
+	}
+	if images := os.Getenv("RUN_IMAGES"); images != "" {
+		cfg.Run.Images = make(map[string]string)
+		for _, entry := range strings.Split(images, ";") {
+			language, image, ok := strings.Cut(entry, "=")
+			if ok && strings.TrimSpace(language) != "" {
+				cfg.Run.Images[strings.TrimSpace(language)] = strings.TrimSpace(image)
+			}
+		}
+	}
+	if d, err := time.ParseDuration(os.Getenv("RUN_TIMEOUT")); err == nil {
+		cfg.Run.Timeout = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("RUN_MEMORY")); err == nil {
+		cfg.Run.MemoryMB = n
+	}
+	if f, err := strconv.ParseFloat(os.Getenv("RUN_CPUS"), 64); err == nil {
+		cfg.Run.CPUs = f
+	}
+	if n, err := strconv.Atoi(os.Getenv("SEND_BACKLOG")); err == nil {
+		cfg.SendBacklog = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("SEND_STALL_TIMEOUT")); err == nil {
+		cfg.SendStallTimeout = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("LAZY_TAB_SIZE")); err == nil && n >= 0 {
+		cfg.LazyTabSize = n
+	}
+	if os.Getenv("SUGGESTIONS_ENABLED") == "false" {
+		cfg.SuggestionsEnabled = false
+	}
+	if os.Getenv("LANGUAGE_DETECTION") == "false" {
+		cfg.LanguageDetection = false
+	}
+	if urls := os.Getenv("WEBHOOK_URLS"); urls != "" {
+		for _, url := range strings.Split(urls, ",") {
+			cfg.WebhookURLs = append(cfg.WebhookURLs, strings.TrimSpace(url))
+		}
+	}
+	cfg.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	if d, err := time.ParseDuration(os.Getenv("WEBHOOK_IDLE")); err == nil {
+		cfg.WebhookIdle = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("WEBHOOK_EXPIRY_WARNING")); err == nil {
+		cfg.WebhookExpiryWarning = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("EXPIRY_WARNING")); err == nil {
+		cfg.ExpiryWarning = d
+	}
+	cfg.ArchiveDir = os.Getenv("ARCHIVE_DIR")
+	cfg.ArchiveS3.Bucket = os.Getenv("ARCHIVE_S3_BUCKET")
+	if region := os.Getenv("ARCHIVE_S3_REGION"); region != "" {
+		cfg.ArchiveS3.Region = region
+	}
+	cfg.ArchiveS3.Endpoint = os.Getenv("ARCHIVE_S3_ENDPOINT")
+	cfg.ArchiveS3.Prefix = os.Getenv("ARCHIVE_S3_PREFIX")
+	cfg.ArchiveS3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	cfg.ArchiveS3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	cfg.ArchiveS3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if d, err := time.ParseDuration(os.Getenv("ARCHIVE_BEFORE")); err == nil {
+		cfg.ArchiveBefore = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("PRESENCE_TTL")); err == nil {
+		cfg.PresenceTTL = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("MESSAGE_BUDGET")); err == nil {
+		cfg.MessageBudget = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("OVERLOAD_THRESHOLD")); err == nil {
+		cfg.OverloadThreshold = d
+	}
+	cfg.MirrorDir = os.Getenv("MIRROR_DIR")
+	cfg.MirrorS3.Bucket = os.Getenv("MIRROR_S3_BUCKET")
+	if region := os.Getenv("MIRROR_S3_REGION"); region != "" {
+		cfg.MirrorS3.Region = region
+	}
+	cfg.MirrorS3.Endpoint = os.Getenv("MIRROR_S3_ENDPOINT")
+	cfg.MirrorS3.Prefix = os.Getenv("MIRROR_S3_PREFIX")
+	cfg.MirrorS3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	cfg.MirrorS3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	cfg.MirrorS3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if d, err := time.ParseDuration(os.Getenv("MIRROR_INTERVAL")); err == nil {
+		cfg.MirrorInterval = d
+	}
+	cfg.GitHubToken = os.Getenv("GITHUB_TOKEN")
+	if repos := os.Getenv("GITHUB_REPOS"); repos != "" {
+		for _, repo := range strings.Split(repos, ",") {
+			cfg.GitHubRepos = append(cfg.GitHubRepos, strings.TrimSpace(repo))
+		}
+	}
+	if apiURL := os.Getenv("GITHUB_API_URL"); apiURL != "" {
+		cfg.GitHubAPIURL = apiURL
+	}
+	switch strategy := os.Getenv("ID_STRATEGY"); strategy {
+	case idStrategyUUID, idStrategyWords, idStrategyNanoID, idStrategySequential:
+		cfg.IDStrategy = strategy
+	}
+	if d, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil {
+		cfg.ReconcileInterval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("SUBSCRIPTION_BEAT")); err == nil {
+		cfg.SubscriptionBeat = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("IDENTITY_TTL")); err == nil {
+		cfg.IdentityTTL = d
+	}
+	cfg.InstanceName = os.Getenv("INSTANCE_NAME")
+	cfg.PublicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	cfg.DirectoryURL = os.Getenv("DIRECTORY_URL")
+	if peers := os.Getenv("FEDERATION_PEERS"); peers != "" {
+		cfg.FederationPeers = make(map[string]string)
+		for _, entry := range strings.Split(peers, ";") {
+			peer, secret, ok := strings.Cut(entry, "=")
+			if ok && strings.TrimSpace(peer) != "" && secret != "" {
+				cfg.FederationPeers[strings.TrimSuffix(strings.TrimSpace(peer), "/")] = secret
+			}
+		}
+	}
+	if writers := os.Getenv("FEDERATION_WRITERS"); writers != "" {
+		for _, writer := range strings.Split(writers, ",") {
+			cfg.FederationWriters = append(cfg.FederationWriters, strings.TrimSuffix(strings.TrimSpace(writer), "/"))
+		}
+	}
+	cfg.AdvertiseURL = strings.TrimSuffix(os.Getenv("ADVERTISE_URL"), "/")
+	cfg.ClusterSecret = os.Getenv("CLUSTER_SECRET")
+	if d, err := time.ParseDuration(os.Getenv("OWNER_LEASE")); err == nil && d > 0 {
+		cfg.OwnerLease = d
+	}
+	return cfg
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+)
+
+// detectMinChange is how many bytes a tab's content must grow or shrink by
+// since its language was last detected before it's classified again
+const detectMinChange = 64
+
+// detectLanguage sets the language of a document that is still plaintext from
+// the content of one of its tabs, so pasted code gets highlighted without
+// anyone picking a language. Content is only classified after changing
+// significantly, which keeps typing cheap.
+func (doc *Document) detectLanguage(tabId, content string) {
+	if !doc.server.config.LanguageDetection {
+		return
+	}
+	doc.mu.Lock()
+	change := len(content) - doc.detected[tabId]
+	if change < 0 {
+		change = -change
+	}
+	i := doc.findTab(tabId)
+	if i < 0 || doc.Tabs[i].Kind != "" || doc.Language != "plaintext" || change < detectMinChange {
+		doc.mu.Unlock()
+		return
+	}
+	doc.detected[tabId] = len(content)
+	doc.mu.Unlock()
+
+	language := suggest.Detect(content)
+	if language == "" {
+		return
+	}
+	doc.mu.Lock()
+	// Someone may have picked a language while the content was classified
+	if doc.Language != "plaintext" || doc.checkLock("", "") != nil {
+		doc.mu.Unlock()
+		return
+	}
+	doc.Language = language
+	doc.mu.Unlock()
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":     "language",
+		"language": language,
+		"detected": true,
+	})
+	if err != nil {
+		logger.Debug("Error marshaling language message", "error", err)
+		return
+	}
+	logger.Debug("Language detected", "doc_id", doc.ID, "tab_id", tabId, "language", language)
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+	doc.scheduleSave()
+	doc.recordActivity(storage.ActivityEvent{Type: storage.ActivityLanguageChanged, Language: language})
+}
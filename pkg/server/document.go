@@ -0,0 +1,838 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/presence"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+	"github.com/shiftregister-vg/gopad/pkg/tracing"
+	"github.com/shiftregister-vg/gopad/pkg/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Document struct {
+	ID            string
+	Content       string
+	Language      string
+	users         *roster
+	clients       map[*Client]bool
+	broadcast     chan BroadcastMessage
+	register      chan *Client
+	unregister    chan *Client
+	lastModified  int64 // unix timestamp (ms)
+	mu            sync.RWMutex
+	server        *Server
+	ctx           context.Context // cancelled when the document is shut down
+	cancel        context.CancelFunc
+	saver         *saver
+	compactor     *saver                         // writes snapshots when delta persistence is enabled
+	load          *loadMonitor                   // detects when the hub falls behind
+	presence      *presenceDigest                // summarizes activity for clients in digest presence mode
+	opsMu         sync.Mutex                     // serializes appends to the operation log
+	contentMu     sync.Mutex                     // orders content edits with their broadcasts; taken before opsMu
+	lastEdit      time.Time                      // when content was last edited here, guarded by contentMu
+	opsCursor     string                         // last operation log entry reflected in memory
+	logged        map[string]string              // tab contents as of opsCursor, which logged operations apply to
+	saveMu        sync.Mutex                     // serializes saves and application of remote updates
+	version       int64                          // storage version the in-memory state is based on
+	base          *storage.DocumentState         // last state known to be persisted, used for merging
+	discarded     bool                           // set when the document is evicted without persisting
+	flagged       map[string]bool                // tabs with validation violations, in flag mode
+	softLimits    map[softLimit]bool             // limits clients were warned the document is approaching
+	collaborators map[*Client]context.CancelFunc // synthetic collaborators, stopped by their cancel func
+	secrets       map[string]string              // tab ID -> credential patterns last warned about
+	locks         []storage.Lock                 // edit leases held by automation
+	remoteUsers   map[string]presence.Entry      // users connected through other instances, by uuid
+	replMu        sync.Mutex
+	repls         map[string]*replSession       // tab ID -> running interpreter, guarded by replMu
+	run           *codeRun                      // program running in the sandbox, guarded by replMu
+	lspMu         sync.Mutex                    // serializes starting language servers
+	lsp           atomic.Pointer[lspSession]    // running language server, nil until first used
+	connections   atomic.Int32                  // open connections; REPLs are stopped when it drops to zero
+	suggested     map[string]suggest.Suggestion // tab ID -> name and language last suggested
+	detected      map[string]int                // tab ID -> content length when its language was last detected
+	sessions      map[string]*session           // resume token -> session of a disconnected client; hub only
+	resumes       chan resumeRequest
+	workspace     string          // workspace the document was assigned to, empty for the default
+	settings      policy.Settings // the document's own settings
+	policy        *policy.Policy  // policy of the workspace, nil when it has none
+
+	title         string // set by users; empty to show inferredTitle
+	inferredTitle string // derived from notes and code, refreshed on save
+	parent        string // document this one was forked from, if recorded
+	pinned        bool   // kept without a TTL
+	expiresAt     int64  // when clients were warned the document expires, in unix milliseconds; zero for no warning
+
+	outputs map[string]*storage.RunOutput // tab ID -> result of its last run
+
+	presenter string // uuid of the user everyone follows, empty when nobody presents
+
+	highlights map[string]*highlight // uuid -> lines the user points at, until they expire
+
+	watchdog watchdog // health of the pub/sub subscriptions
+
+	// The document's tabs and the one clients open on
+	Tabs        []Tab
+	ActiveTabId string
+}
+
+type Tab struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Notes   string `json:"notes"`
+	Kind    string `json:"kind,omitempty"`    // empty for editor tabs, tabKindREPL for interpreter sessions
+	Runtime string `json:"runtime,omitempty"` // interpreter of a REPL tab
+}
+
+type BroadcastMessage struct {
+	Sender    *Client
+	Message   []byte
+	Digest    *presenceSummary  // when set, delivered to digest presence clients instead of Message
+	Delta     []byte            // when set, delivered instead of Message to clients with the delta capability
+	Manifest  []byte            // when set, delivered instead of Message to clients with the lazyTabs or manifest capability
+	Recipient *Client           // when set, Message is sent to this client only
+	To        string            // when set, Message is sent to this user's connection only
+	Trace     trace.SpanContext // span of the client message that caused this broadcast, if any
+	queued    time.Time         // when the message was handed to send
+	handover  bool              // close every connection with a reconnect hint
+}
+
+type UserListMessage struct {
+	Type  string                            `json:"type"`
+	Users map[string]map[string]interface{} `json:"users"` // name -> {name, color, disconnected}
+}
+
+// initMessage builds the init frame sent to connecting clients
+// Note: Caller must hold doc.mu
+func (doc *Document) initMessage() map[string]interface{} {
+	return map[string]interface{}{
+		"type":              "init",
+		"content":           doc.Content,
+		"tabs":              doc.Tabs,
+		"activeTabId":       doc.ActiveTabId,
+		"language":          doc.Language,
+		"lastModified":      doc.lastModified,
+		"users":             doc.userList(),
+		"usage":             doc.usage(),
+		"locks":             lockViews(doc.locks),
+		"workspace":         doc.workspace,
+		"settings":          doc.settings,
+		"effectiveSettings": doc.effective(),
+		"repl":              doc.replTranscripts(),
+		"title":             doc.displayTitle(),
+		"titleInferred":     doc.title == "",
+		"outputs":           doc.tabOutputs(),
+		"presenter":         doc.presenter,
+		"highlights":        doc.highlightList(),
+		"parent":            doc.parent,
+		"pinned":            doc.pinned,
+		"expiresAt":         doc.expiresAt,
+	}
+}
+
+// initMessage builds the init frame for this client, carrying its resume token
+// Note: Caller must hold doc.mu
+func (c *Client) initMessage() map[string]interface{} {
+	msg := c.doc.initMessage()
+	msg["capabilities"] = capabilityList(c.caps)
+	if c.has(capManifest) {
+		msg["tabs"] = c.doc.tabManifest()
+		msg["version"] = c.doc.version
+	} else if lazy := c.lazyTabs(); len(lazy) > 0 {
+		msg["tabs"] = withoutContent(c.doc.Tabs, lazy)
+		msg["lazyTabs"] = lazy
+	}
+	if c.session != "" {
+		msg["session"] = c.session
+	}
+	if c.elevated {
+		msg["elevated"] = true
+	}
+	if c.readOnly {
+		msg["readOnly"] = true
+	}
+	if leader, ok := c.doc.users.clients[c.following]; ok && leader.view != nil {
+		// Where the followed user is looking, so the client starts there
+		msg["view"] = leader.view
+	}
+	if c.uuid != "" {
+		// The name and color the others see, generated until setName
+		msg["user"] = map[string]interface{}{
+			"uuid":         c.uuid,
+			"name":         c.name,
+			"color":        c.color,
+			"anonymous":    c.anonymous,
+			"avatarUrl":    c.avatarURL,
+			"gravatarHash": c.gravatarHash,
+		}
+	}
+	return msg
+}
+
+// ensureMinimumTabs ensures there is always at least one tab in the document
+func (doc *Document) ensureMinimumTabs() {
+	if len(doc.Tabs) == 0 {
+		doc.Tabs = []Tab{
+			{
+				ID:      "1",
+				Name:    "Untitled",
+				Content: "",
+				Notes:   "",
+			},
+		}
+		doc.ActiveTabId = "1"
+	}
+}
+
+// documentLoad is a document being loaded, which callers asking for it
+// meanwhile wait for
+type documentLoad struct {
+	done chan struct{}
+	doc  *Document // nil when the load was given up
+}
+
+// getOrCreateDocument returns the loaded document, loading it from storage
+// first if needed. Only one load per document runs at a time, outside s.mu,
+// and it's given up with an error when ctx ends first.
+func (s *Server) getOrCreateDocument(ctx context.Context, docID string) (*Document, error) {
+	for {
+		s.mu.Lock()
+		if doc, exists := s.documents[docID]; exists {
+			s.mu.Unlock()
+			return doc, nil
+		}
+		load, loading := s.loading[docID]
+		if !loading {
+			load = &documentLoad{done: make(chan struct{})}
+			s.loading[docID] = load
+		}
+		s.mu.Unlock()
+
+		if !loading {
+			return s.loadDocument(ctx, docID, load)
+		}
+		select {
+		case <-load.done:
+		case <-ctx.Done():
+			return nil, apperr.Wrap(apperr.CodeUnavailable, ctx.Err(), "failed to load document")
+		}
+		if load.doc != nil {
+			return load.doc, nil
+		}
+		// Given up by the caller that was loading it, so try again
+	}
+}
+
+// loadDocument loads a document from storage and starts its hub, finishing load
+func (s *Server) loadDocument(ctx context.Context, docID string, load *documentLoad) (*Document, error) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.loading, docID)
+		s.mu.Unlock()
+		close(load.done)
+	}()
+
+	s.awaitHandover(ctx, docID)
+	// Try to load from storage
+	state, err := s.store.LoadDocument(ctx, docID)
+	if ctx.Err() != nil {
+		// An empty document must not stand in for one that wasn't read
+		return nil, apperr.Wrap(apperr.CodeUnavailable, ctx.Err(), "failed to load document")
+	}
+	// A recovery file may hold changes that never reached storage
+	s.mu.RLock()
+	pending := s.recovered[docID]
+	s.mu.RUnlock()
+	recovered := recoveredState(pending, state, err)
+	if recovered != nil {
+		state, err = recovered.State, nil
+	}
+	if err == nil {
+		// Load the workspace policy so applyState finds it cached
+		if _, err := s.workspacePolicy(ctx, s.workspaceOf(state.Workspace)); err != nil {
+			logger.Error("Error loading workspace policy", "doc_id", docID, "error", err)
+		}
+	} else {
+		logger.Error("Error loading document state", "doc_id", docID, "error", err)
+		state = &storage.DocumentState{
+			Content:      "",
+			Language:     "plaintext",
+			LastModified: time.Now().UnixMilli(),
+			Users:        make(map[string]string),
+			Version:      0,
+			Tabs: []storage.Tab{
+				{
+					ID:      "1",
+					Name:    "Untitled",
+					Content: "",
+					Notes:   "",
+				},
+			},
+			ActiveTabId: "1",
+		}
+	}
+
+	docCtx, cancel := context.WithCancel(s.ctx)
+	doc := &Document{
+		ID:            docID,
+		users:         newRoster(),
+		clients:       make(map[*Client]bool),
+		broadcast:     make(chan BroadcastMessage),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		resumes:       make(chan resumeRequest),
+		sessions:      make(map[string]*session),
+		repls:         make(map[string]*replSession),
+		server:        s,
+		ctx:           docCtx,
+		cancel:        cancel,
+		flagged:       make(map[string]bool),
+		softLimits:    make(map[softLimit]bool),
+		collaborators: make(map[*Client]context.CancelFunc),
+		secrets:       make(map[string]string),
+		suggested:     make(map[string]suggest.Suggestion),
+		detected:      make(map[string]int),
+		highlights:    make(map[string]*highlight),
+		watchdog:      watchdog{seen: make(map[string]uint64)},
+	}
+	doc.applyState(state)
+	doc.base = state
+	if recovered != nil && recovered.Base != nil {
+		doc.base = recovered.Base
+	}
+	doc.setLogged(doc.base)
+	if doc.locks, err = s.store.Locks(ctx, docID); err != nil {
+		logger.Error("Error loading locks", "doc_id", docID, "error", err)
+	}
+	doc.saver = newSaver(doc, s.config.SaveInterval, s.config.SaveMaxOps)
+	doc.compactor = newSaver(doc, s.config.SnapshotInterval, s.config.SnapshotMaxOps)
+	doc.presence = newPresenceDigest(doc, s.config.PresenceDigestInterval)
+	doc.load = newLoadMonitor(s.config.OverloadThreshold)
+	doc.ensureMinimumTabs() // Ensure minimum tabs after loading
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Consumed now, unless a newer one was added while loading
+	if s.recovered[docID] == pending {
+		delete(s.recovered, docID)
+	}
+	s.documents[docID] = doc
+	load.doc = doc
+	s.events.publish(adminEvent{Type: "documentLoaded", DocID: docID})
+	s.hubs.Add(1)
+	go func() {
+		defer s.hubs.Done()
+		doc.broadcastMessages()
+	}()
+
+	doc.subscribe()
+	if interval := s.config.SubscriptionBeat; interval > 0 {
+		go doc.watchSubscriptions(interval)
+	}
+	if ttl := s.config.PresenceTTL; ttl > 0 {
+		go doc.heartbeatLoop(ttl)
+	}
+	if s.ownershipEnabled() {
+		go doc.holdOwnership(s.config.OwnerLease)
+	}
+	if recovered != nil {
+		logger.Info("Document restored from recovery file", "doc_id", docID, "version", state.Version, "unsaved", recovered.Unsaved)
+		if recovered.Unsaved {
+			doc.scheduleSave()
+		}
+		// Keep the users listed while they reconnect
+		go func() {
+			for _, entry := range recovered.Presence {
+				doc.recordPresence(entry)
+			}
+		}()
+	}
+	return doc, nil
+}
+
+func (doc *Document) broadcastMessages() {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Recovered from panic in broadcastMessages", "error", r)
+		}
+	}()
+	loadCheck := time.NewTicker(overloadCooldown)
+	defer loadCheck.Stop()
+	for {
+		select {
+		case <-doc.ctx.Done():
+			// Persist anything the saver hasn't written yet before stopping
+			// (flush is a no-op for discarded documents)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			doc.saver.flush(ctx)
+			doc.compactor.flush(ctx)
+			cancel()
+			logger.Debug("Document hub stopped", "doc_id", doc.ID)
+			return
+		case <-loadCheck.C:
+			// Leave shedding mode once the hub has kept up for the cooldown
+			if doc.load.observe(0) {
+				doc.announceLoad()
+			}
+			doc.expireSessions()
+			if doc.expireUsers() {
+				// The hub delivers the user list, so it can't wait for it here
+				go doc.broadcastUserList()
+			}
+			doc.checkStalls()
+		case req := <-doc.resumes:
+			req.done <- doc.resume(req)
+		case client := <-doc.register:
+			doc.clients[client] = true
+			doc.mu.RLock()
+			initialState := client.initMessage()
+			doc.mu.RUnlock()
+			// Queue through the send channel so only writePump writes to the connection
+			client.reply(initialState)
+			logger.Debug("Client registered", "doc_id", doc.ID, "total_clients", len(doc.clients))
+		case client := <-doc.unregister:
+			if doc.clients[client] {
+				doc.mu.RLock()
+				// A connection replaced by a newer one of its user can't be resumed
+				listed, ok := doc.users.clients[client.uuid]
+				replaced := ok && listed != client
+				doc.mu.RUnlock()
+				if client.session != "" && !replaced {
+					doc.detach(client)
+				} else {
+					delete(doc.clients, client)
+					close(client.send)
+				}
+			}
+			logger.Debug("Client unregistered", "doc_id", doc.ID, "total_clients", len(doc.clients))
+		case bmsg := <-doc.broadcast:
+			if bmsg.handover {
+				for client := range doc.clients {
+					client.closeForHandover()
+				}
+				continue
+			}
+			if doc.load.observe(time.Since(bmsg.queued)) {
+				doc.announceLoad()
+			}
+			if bmsg.Digest != nil {
+				for client := range doc.clients {
+					if client.presenceDigest && client.wants("presenceDigest") {
+						client.reply(bmsg.Digest.message(doc.server, client.locale))
+					}
+				}
+				continue
+			}
+			if bmsg.Recipient != nil {
+				if doc.clients[bmsg.Recipient] {
+					doc.enqueue(bmsg.Recipient, newFrame(bmsg.Message), "")
+				}
+				continue
+			}
+			if bmsg.To != "" {
+				doc.deliverTo(bmsg.To, bmsg.Message)
+				continue
+			}
+			var msgType, updateTab string
+			var header frameHeader
+			if err := json.Unmarshal(bmsg.Message, &header); err == nil {
+				msgType = header.Type
+				if msgType == "update" {
+					updateTab = header.TabID
+				}
+			}
+			// Every recipient shares the same frames, so each is encoded and
+			// compressed once however many clients receive it
+			message := newFrame(bmsg.Message)
+			var delta, manifest *frame
+			if bmsg.Delta != nil {
+				delta = newFrame(bmsg.Delta)
+			}
+			if bmsg.Manifest != nil {
+				manifest = newFrame(bmsg.Manifest)
+			}
+			_, span := tracing.StartChild(doc.ctx, bmsg.Trace, "hub.broadcast",
+				attribute.String("doc_id", doc.ID),
+				attribute.String("msg_type", msgType),
+				attribute.Int("recipients", len(doc.clients)),
+			)
+
+			for client := range doc.clients {
+				if client == bmsg.Sender && msgType == "update" {
+					logger.Debug("Skipping sender for update message")
+					continue
+				}
+				if !client.wants(msgType) {
+					continue
+				}
+				if delta != nil && client.has(capDelta) {
+					// Deltas build on each other, so they can't be coalesced
+					doc.enqueue(client, delta, "")
+					continue
+				}
+				if manifest != nil && (client.has(capLazyTabs) || client.has(capManifest)) {
+					doc.enqueue(client, manifest, "")
+					continue
+				}
+				doc.enqueue(client, message, updateTab)
+			}
+			doc.recordMissed(msgType, message)
+			span.End()
+		}
+	}
+}
+
+// userList describes the users connected here and through other instances
+// Note: Caller must hold doc.mu
+func (doc *Document) userList() map[string]map[string]interface{} {
+	userList := make(map[string]map[string]interface{})
+	for uuid, client := range doc.users.clients {
+		userList[uuid] = map[string]interface{}{
+			"uuid":         client.uuid,
+			"name":         client.name,
+			"color":        client.color,
+			"disconnected": client.disconnected,
+			"anonymous":    client.anonymous,
+			"avatarUrl":    client.avatarURL,
+			"gravatarHash": client.gravatarHash,
+			"peer":         client.peer,
+			"following":    client.following,
+			"presenting":   doc.presenter == uuid,
+		}
+	}
+	for uuid, entry := range doc.remoteUsers {
+		// A user connected here takes precedence unless they've disconnected
+		if user, exists := userList[uuid]; exists && user["disconnected"] == false {
+			continue
+		}
+		userList[uuid] = map[string]interface{}{
+			"uuid":         entry.UUID,
+			"name":         entry.Name,
+			"color":        entry.Color,
+			"cursor":       entry.Cursor,
+			"disconnected": false,
+			"avatarUrl":    entry.AvatarURL,
+			"gravatarHash": entry.GravatarHash,
+			"peer":         entry.Peer,
+		}
+	}
+	return userList
+}
+
+func (doc *Document) broadcastUserList() {
+	doc.mu.RLock()
+	userList := doc.userList()
+	doc.mu.RUnlock()
+	userListMsg := UserListMessage{
+		Type:  "userList",
+		Users: userList,
+	}
+	jsonMsg, err := json.Marshal(userListMsg)
+	if err != nil {
+		logger.Error("Error marshaling user list", "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
+
+// send queues a message for the hub, giving up if the document has been shut down
+func (doc *Document) send(msg BroadcastMessage) {
+	msg.queued = time.Now()
+	select {
+	case doc.broadcast <- msg:
+	case <-doc.ctx.Done():
+	}
+}
+
+// saveConflicts counts changes from another instance merged with local ones, by
+// whether any tab was edited in overlapping places
+var saveConflicts = metrics.NewCounter("gopad_save_conflicts_total", "Number of merges of concurrent changes from other instances by result")
+
+// maxSaveAttempts bounds how often a save is retried after merging a conflicting remote version
+const maxSaveAttempts = 3
+
+// saveState persists the document, merging and retrying when another instance saved first
+func (doc *Document) saveState(ctx context.Context) error {
+	doc.refreshTitle()
+	doc.saveMu.Lock()
+	defer doc.saveMu.Unlock()
+
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		state := doc.snapshot()
+		err := doc.server.store.SaveDocument(ctx, doc.ID, state)
+		if err == nil {
+			doc.mu.Lock()
+			doc.version = state.Version
+			doc.lastModified = state.LastModified
+			doc.base = state
+			if state.OpsCursor == doc.opsCursor {
+				// Instances loading the snapshot apply further operations to it
+				doc.setLogged(state)
+			}
+			doc.mu.Unlock()
+			if state.Version == 1 {
+				doc.server.notify(webhook.DocumentCreated, doc.ID, "")
+			}
+			doc.server.mirrorSaved(ctx, doc.ID, state)
+			if state.Pinned {
+				doc.refreshExpiry(-1)
+			} else {
+				doc.refreshExpiry(state.Expiry)
+			}
+			return nil
+		}
+		if !errors.Is(err, storage.ErrVersionConflict) {
+			return err
+		}
+		logger.Info("Version conflict saving document, merging remote changes", "doc_id", doc.ID, "attempt", attempt+1)
+		if err := doc.mergeRemote(ctx); err != nil {
+			return err
+		}
+	}
+	return storage.ErrVersionConflict
+}
+
+// snapshot returns the document as a storage state based on the current version
+func (doc *Document) snapshot() *storage.DocumentState {
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	return doc.currentState()
+}
+
+// currentState returns the document as a storage state based on the current version
+// Note: Caller must hold doc.mu
+func (doc *Document) currentState() *storage.DocumentState {
+	state := &storage.DocumentState{
+		Content:      doc.Content,
+		Language:     doc.Language,
+		LastModified: doc.lastModified,
+		Users:        make(map[string]string),
+		Version:      doc.version,
+		Tabs:         make([]storage.Tab, len(doc.Tabs)),
+		ActiveTabId:  doc.ActiveTabId,
+		OpsCursor:    doc.opsCursor,
+		Workspace:    doc.workspace,
+		Expiry:       time.Duration(doc.effective().TTL),
+
+		Title:         doc.title,
+		InferredTitle: doc.inferredTitle,
+		Parent:        doc.parent,
+		Pinned:        doc.pinned,
+		Outputs:       doc.tabOutputs(),
+	}
+	if doc.settings.TTL != 0 || doc.settings.Visibility != "" || len(doc.settings.Features) > 0 {
+		settings := doc.settings
+		state.Settings = &settings
+	}
+	for uuid, client := range doc.users.clients {
+		// Generated names are only meaningful while the client is connected
+		if client.anonymous {
+			continue
+		}
+		state.Users[uuid] = client.name
+	}
+	// Convert Document.Tabs to storage.Tabs
+	for i, t := range doc.Tabs {
+		state.Tabs[i] = storage.Tab{
+			ID:      t.ID,
+			Name:    t.Name,
+			Content: t.Content,
+			Notes:   t.Notes,
+			Kind:    t.Kind,
+			Runtime: t.Runtime,
+		}
+	}
+	stampTabs(state.Tabs, doc.base, time.Now().UnixMilli())
+	return state
+}
+
+// stampTabs sets when each tab last changed: tabs that differ from the last
+// saved or loaded state changed now, and the others keep their time from it.
+// Tabs saved before changes were tracked count as changed at base's last save.
+func stampTabs(tabs []storage.Tab, base *storage.DocumentState, now int64) {
+	saved := make(map[string]storage.Tab)
+	var lastSaved int64
+	if base != nil {
+		for _, t := range base.Tabs {
+			saved[t.ID] = t
+		}
+		lastSaved = base.LastModified
+	}
+	for i, t := range tabs {
+		prev, ok := saved[t.ID]
+		switch {
+		case !ok || prev.Name != t.Name || prev.Content != t.Content || prev.Notes != t.Notes:
+			tabs[i].Modified = now
+		case prev.Modified != 0:
+			tabs[i].Modified = prev.Modified
+		case lastSaved != 0:
+			tabs[i].Modified = lastSaved
+		default:
+			tabs[i].Modified = now
+		}
+	}
+}
+
+// applyState replaces the document content with a storage state
+// Note: Caller must hold doc.mu.Lock() unless the document isn't shared yet
+func (doc *Document) applyState(state *storage.DocumentState) {
+	doc.Content = state.Content
+	doc.Language = state.Language
+	doc.lastModified = state.LastModified
+	doc.version = state.Version
+	doc.opsCursor = state.OpsCursor
+	doc.ActiveTabId = state.ActiveTabId
+	doc.workspace = state.Workspace
+	doc.title = state.Title
+	doc.inferredTitle = state.InferredTitle
+	doc.parent = state.Parent
+	doc.pinned = state.Pinned
+	doc.outputs = maps.Clone(state.Outputs)
+	doc.settings = policy.Settings{}
+	if state.Settings != nil {
+		doc.settings = *state.Settings
+	}
+	doc.policy = doc.server.cachedPolicy(doc.server.workspaceOf(doc.workspace))
+	// Convert storage.Tabs to Document.Tabs
+	doc.Tabs = make([]Tab, len(state.Tabs))
+	for i, t := range state.Tabs {
+		doc.Tabs[i] = Tab{
+			ID:      t.ID,
+			Name:    t.Name,
+			Content: t.Content,
+			Notes:   t.Notes,
+			Kind:    t.Kind,
+			Runtime: t.Runtime,
+		}
+	}
+	doc.ensureMinimumTabs()
+}
+
+// applyRemoteUpdate applies a state published by another instance
+func (doc *Document) applyRemoteUpdate(update *storage.DocumentState) {
+	// Wait for any in-flight save so our own publications are recognised by version
+	doc.saveMu.Lock()
+	doc.mu.Lock()
+	// Only apply update if it's newer than our current state
+	if update.Version <= doc.version {
+		doc.mu.Unlock()
+		doc.saveMu.Unlock()
+		return
+	}
+	// A snapshot that predates operations we already applied would roll them
+	// back; load the snapshot with the logged operations replayed instead
+	if storage.CompareStreamIDs(update.OpsCursor, doc.opsCursor) < 0 {
+		doc.mu.Unlock()
+		latest, err := doc.server.store.LoadDocument(doc.ctx, doc.ID)
+		if err != nil {
+			logger.Error("Error reloading document", "doc_id", doc.ID, "error", err)
+			doc.saveMu.Unlock()
+			return
+		}
+		update = latest
+		doc.mu.Lock()
+	}
+	beforeTabs, beforeActive, beforeLanguage, beforeTitle := doc.Tabs, doc.ActiveTabId, doc.Language, doc.displayTitle()
+	beforeOutputs, beforePinned := doc.outputs, doc.pinned
+	// Applying the update as is would drop changes not saved yet
+	merging := doc.saver.hasPending()
+	var conflicts []string
+	if merging {
+		var merged *storage.DocumentState
+		merged, conflicts = mergeStates(doc.base, doc.currentState(), update)
+		doc.applyState(merged)
+	} else {
+		doc.applyState(update)
+	}
+	doc.base = update
+	doc.setLogged(update)
+
+	// Update users
+	for uuid, name := range update.Users {
+		if client, exists := doc.users.clients[uuid]; exists {
+			client.name = name
+		}
+	}
+	msgs := stateChanges(beforeTabs, beforeActive, beforeLanguage, beforeTitle, doc)
+	msgs = append(msgs, doc.outputChanges(beforeOutputs)...)
+	msgs = append(msgs, doc.pinChanges(beforePinned)...)
+	doc.mu.Unlock()
+	doc.saveMu.Unlock()
+
+	// Broadcast only what changed
+	doc.broadcastChanges(msgs)
+	if merging {
+		doc.reportConflict(update.Version, conflicts)
+	}
+}
+
+// broadcastChanges sends messages built by stateChanges to all clients
+func (doc *Document) broadcastChanges(msgs []map[string]interface{}) {
+	for _, msg := range msgs {
+		jsonMsg, err := json.Marshal(msg)
+		if err != nil {
+			logger.Debug("Error marshaling change message", "error", err)
+			continue
+		}
+		doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+	}
+}
+
+// mergeRemote loads the latest stored state and merges local changes onto it
+// Note: Caller must hold doc.saveMu
+func (doc *Document) mergeRemote(ctx context.Context) error {
+	remote, err := doc.server.store.LoadDocument(ctx, doc.ID)
+	if err != nil {
+		return err
+	}
+
+	doc.mu.Lock()
+	merged, conflicts := mergeStates(doc.base, doc.currentState(), remote)
+	beforeTabs, beforeActive, beforeLanguage, beforeTitle := doc.Tabs, doc.ActiveTabId, doc.Language, doc.displayTitle()
+	beforeOutputs, beforePinned := doc.outputs, doc.pinned
+	doc.applyState(merged)
+	doc.base = remote
+	doc.setLogged(remote)
+	msgs := stateChanges(beforeTabs, beforeActive, beforeLanguage, beforeTitle, doc)
+	msgs = append(msgs, doc.outputChanges(beforeOutputs)...)
+	msgs = append(msgs, doc.pinChanges(beforePinned)...)
+	doc.mu.Unlock()
+
+	// Let clients see the changes that came in from the other instance
+	doc.broadcastChanges(msgs)
+	doc.reportConflict(remote.Version, conflicts)
+	return nil
+}
+
+// reportConflict tells clients that changes saved by another instance were
+// merged with the ones made here, and which tabs had overlapping edits that
+// were resolved in favor of this instance's version
+func (doc *Document) reportConflict(version int64, conflicts []string) {
+	if len(conflicts) > 0 {
+		saveConflicts.Inc(metrics.Labels{"result": "overlapping"})
+		logger.Warn("Overlapping edits from another instance, keeping local version", "doc_id", doc.ID, "version", version, "tabs", conflicts)
+	} else {
+		saveConflicts.Inc(metrics.Labels{"result": "merged"})
+	}
+	if conflicts == nil {
+		conflicts = []string{}
+	}
+	doc.broadcastChanges([]map[string]interface{}{{
+		"type":      "saveConflict",
+		"version":   version,
+		"conflicts": conflicts,
+	}})
+}
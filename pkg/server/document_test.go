@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// newTestServer returns a server with the default configuration storing to a miniredis
+func newTestServer(t *testing.T) (*Server, *storage.Storage) {
+	t.Helper()
+	logger.Setup(logger.ConfigFromEnv())
+	mr := miniredis.RunT(t)
+	store, err := storage.New(context.Background(), "redis://"+mr.Addr(), storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(DefaultConfig(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		store.Close()
+	})
+	return s, store
+}
+
+func TestGetOrCreateDocument(t *testing.T) {
+	s, store := newTestServer(t)
+	saved := &storage.DocumentState{Language: "go", Tabs: []storage.Tab{{ID: "1", Name: "main", Content: "package main"}}, ActiveTabId: "1"}
+	if err := store.SaveDocument(context.Background(), "doc", saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// A load given up with its caller leaves nothing behind, rather than an empty document
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if doc, err := s.getOrCreateDocument(cancelled, "doc"); err == nil {
+		t.Fatalf("expected an error loading with a cancelled context, got %v", doc)
+	}
+	if _, loaded := s.loadedDocument("doc"); loaded {
+		t.Fatal("document loaded although its load was given up")
+	}
+
+	// Callers asking at once get the same document
+	docs := make([]*Document, 8)
+	var wg sync.WaitGroup
+	for i := range docs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doc, err := s.getOrCreateDocument(context.Background(), "doc")
+			if err != nil {
+				t.Error(err)
+			}
+			docs[i] = doc
+		}()
+	}
+	wg.Wait()
+	for _, doc := range docs[1:] {
+		if doc != docs[0] {
+			t.Fatal("concurrent callers got different documents")
+		}
+	}
+	docs[0].mu.RLock()
+	defer docs[0].mu.RUnlock()
+	if len(docs[0].Tabs) != 1 || docs[0].Tabs[0].Content != "package main" {
+		t.Errorf("expected the saved tab, got %+v", docs[0].Tabs)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/i18n"
+	"github.com/shiftregister-vg/gopad/pkg/tracing"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Errors sent when a WebSocket message can't be understood at all
+var (
+	errInvalidJSON = apperr.New(apperr.CodeInvalidMessage, "message is not valid JSON")
+	errMissingType = apperr.New(apperr.CodeInvalidMessage, "message has no type")
+)
+
+// errUnfurlDisabled is sent for unfurl requests when link previews are turned off
+var errUnfurlDisabled = apperr.New(apperr.CodeValidation, "link previews are disabled")
+
+// Context keys set by localize
+const (
+	localeKey  = "locale"
+	catalogKey = "catalog"
+)
+
+// localize negotiates the request's locale from ?lang= and Accept-Language
+func (s *Server) localize(c *gin.Context) {
+	c.Set(localeKey, s.messages.Negotiate(c.Query("lang"), c.GetHeader("Accept-Language")))
+	c.Set(catalogKey, s.messages)
+	c.Next()
+}
+
+// abortWithError writes err as a JSON error response with the status matching its code
+func abortWithError(c *gin.Context, err error) {
+	message := apperr.MessageOf(err)
+	if catalog, ok := c.Value(catalogKey).(*i18n.Catalog); ok {
+		message = catalog.Error(c.GetString(localeKey), err)
+	}
+	body := gin.H{
+		"error":     message,
+		"code":      apperr.CodeOf(err),
+		"requestId": c.GetString(requestIDKey),
+	}
+	if violations := violationsOf(err); violations != nil {
+		body["violations"] = violations
+	}
+	c.AbortWithStatusJSON(apperr.HTTPStatus(err), body)
+}
+
+// sendError tells this client that one of its messages was rejected.
+// The error is recorded on the message's span and the frame carries its trace ID.
+func (c *Client) sendError(err error) {
+	msg := c.errorMessage(err)
+	if c.span != nil {
+		c.span.RecordError(err)
+		c.span.SetStatus(codes.Error, apperr.MessageOf(err))
+		if traceID := tracing.TraceID(c.span); traceID != "" {
+			msg["traceId"] = traceID
+		}
+	}
+	c.doc.server.events.countError()
+	c.reply(msg)
+}
+
+// errorMessage builds the error frame for err in this client's locale
+func (c *Client) errorMessage(err error) map[string]interface{} {
+	msg := map[string]interface{}{
+		"type":         "error",
+		"code":         apperr.CodeOf(err),
+		"message":      c.doc.server.messages.Error(c.locale, err),
+		"connectionId": c.connID,
+	}
+	if violations := violationsOf(err); violations != nil {
+		msg["violations"] = violations
+	}
+	if op, ok := bulkOpOf(err); ok {
+		msg["op"] = op
+	}
+	return msg
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+// adminStatsInterval is how often the admin feed reports instance stats
+const adminStatsInterval = 5 * time.Second
+
+// adminEvent is one entry in the /ws/admin feed
+type adminEvent struct {
+	Type   string         `json:"type"` // connect, disconnect, documentLoaded, documentEvicted, secretDetected or stats
+	Time   int64          `json:"time"` // unix timestamp (ms)
+	DocID  string         `json:"docId,omitempty"`
+	ConnID string         `json:"connId,omitempty"`
+	Stats  *instanceStats `json:"stats,omitempty"`
+}
+
+// instanceStats is a periodic snapshot of this instance's activity
+type instanceStats struct {
+	Documents int     `json:"documents"`
+	Clients   int     `json:"clients"`
+	Errors    int64   `json:"errors"`    // error frames and 5xx responses since the previous snapshot
+	ErrorRate float64 `json:"errorRate"` // errors per second since the previous snapshot
+}
+
+// eventFeed fans server events out to connected admin dashboards
+type eventFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]bool
+	clients     atomic.Int64 // connected document clients
+	errors      atomic.Int64 // errors since the last stats snapshot
+}
+
+func newEventFeed() *eventFeed {
+	return &eventFeed{subscribers: make(map[chan []byte]bool)}
+}
+
+func (f *eventFeed) subscribe() chan []byte {
+	ch := make(chan []byte, 64)
+	f.mu.Lock()
+	f.subscribers[ch] = true
+	f.mu.Unlock()
+	return ch
+}
+
+func (f *eventFeed) unsubscribe(ch chan []byte) {
+	f.mu.Lock()
+	delete(f.subscribers, ch)
+	f.mu.Unlock()
+}
+
+// publish sends an event to every subscriber, dropping it for those that fall behind
+func (f *eventFeed) publish(event adminEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subscribers) == 0 {
+		return
+	}
+	event.Time = time.Now().UnixMilli()
+	jsonMsg, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Error marshaling admin event", "error", err)
+		return
+	}
+	for ch := range f.subscribers {
+		select {
+		case ch <- jsonMsg:
+		default:
+		}
+	}
+}
+
+// countError records an error for the error rate in stats events
+func (f *eventFeed) countError() {
+	f.errors.Add(1)
+}
+
+// countErrors counts server errors for the admin feed
+func (s *Server) countErrors(c *gin.Context) {
+	c.Next()
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		s.events.countError()
+	}
+}
+
+// reportStats publishes instance stats to the admin feed until the server shuts down
+func (s *Server) reportStats() {
+	ticker := time.NewTicker(adminStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.RLock()
+			documents := len(s.documents)
+			s.mu.RUnlock()
+			errors := s.events.errors.Swap(0)
+			s.events.publish(adminEvent{
+				Type: "stats",
+				Stats: &instanceStats{
+					Documents: documents,
+					Clients:   int(s.events.clients.Load()),
+					Errors:    errors,
+					ErrorRate: float64(errors) / adminStatsInterval.Seconds(),
+				},
+			})
+		}
+	}
+}
+
+// adminTokenFromWebSocket lets browsers, which can't set headers on WebSocket
+// requests, pass the admin token as a token.<value> subprotocol or ?token=
+func adminTokenFromWebSocket(c *gin.Context) {
+	if token := credential(c, "token"); token != "" && c.GetHeader("Authorization") == "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	c.Next()
+}
+
+// handleAdminFeed streams server events to an admin dashboard
+func (s *Server) handleAdminFeed(c *gin.Context) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		requestLog(c).Error("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	requestLog(c).Info("Admin feed connected")
+
+	// The feed is one way; reading only notices when the dashboard goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-closed:
+			return
+		case msg := <-events:
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// exportFormats maps the formats the export endpoint serves to their content
+// types and file name extensions
+var exportFormats = map[string]struct{ contentType, ext string }{
+	"json": {"application/json; charset=utf-8", ".json"},
+	"zip":  {"application/zip", ".zip"},
+	"tar":  {"application/gzip", ".tar.gz"},
+}
+
+// archiveFile is one file of an export archive
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+// archive packs the export as a zip or gzipped tar file. document.json holds
+// the export as served in JSON, activity included, and each editor tab is
+// also a file under tabs/ so the archive can be browsed without tooling.
+func (e *Export) archive(format string) ([]byte, error) {
+	doc, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to marshal export")
+	}
+	files := []archiveFile{{name: "document.json", data: doc}}
+	for _, file := range exportFiles(e) {
+		files = append(files, archiveFile{name: "tabs/" + file.Name, data: []byte(file.Content)})
+	}
+	modified := time.UnixMilli(e.LastModified)
+	if e.LastModified == 0 {
+		modified = time.Now()
+	}
+
+	var buf bytes.Buffer
+	if format == "zip" {
+		err = writeZip(&buf, files, modified)
+	} else {
+		err = writeTarGz(&buf, files, modified)
+	}
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to write export archive")
+	}
+	return buf.Bytes(), nil
+}
+
+func writeZip(buf *bytes.Buffer, files []archiveFile, modified time.Time) error {
+	zw := zip.NewWriter(buf)
+	for _, file := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(buf *bytes.Buffer, files []archiveFile, modified time.Time) error {
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0o644, Size: int64(len(file.data)), ModTime: modified}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/signedurl"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+const (
+	// federationTokenTTL is how long a signed request between peers is valid,
+	// and federationSkew how much later it is still accepted to tolerate clock
+	// differences between them
+	federationTokenTTL = time.Minute
+	federationSkew     = 30 * time.Second
+	// peerKey is the context key of the peer a request came through
+	peerKey = "federationPeer"
+)
+
+var federatedConnections = metrics.NewCounter("gopad_federated_connections_total", "Number of client connections proxied between federated instances, by direction and result")
+
+// Errors for federation requests
+var (
+	errFederationDisabled = apperr.New(apperr.CodeValidation, "federation is not configured")
+	errUnknownPeer        = apperr.New(apperr.CodeUnauthorized, "unknown federation peer")
+	errHostUnreachable    = apperr.New(apperr.CodeUnavailable, "the instance hosting this document can't be reached")
+	errReadOnly           = apperr.New(apperr.CodeForbidden, "this document is read-only through this instance")
+	// errRelayRefused is returned by dialRelay when the instance relayed to refused the client
+	errRelayRefused = errors.New("client refused by the instance relayed to")
+)
+
+// viewerMessages are the messages clients with read-only access may send:
+// presence and requests that don't change the document
+var viewerMessages = map[string]bool{
+	"setName":           true,
+	"cursor":            true,
+	"follow":            true,
+	"unfollow":          true,
+	"view":              true,
+	"reaction":          true,
+	"signal":            true,
+	"highlight":         true,
+	"fork":              true,
+	"subscribe":         true,
+	"unsubscribe":       true,
+	"lspCompletion":     true,
+	"lspHover":          true,
+	"unfurl":            true,
+	"exportGist":        true,
+	"tabContentRequest": true,
+}
+
+// federatedPeer is the peer instance a client connected through, as vouched
+// for by the peer's signature
+type federatedPeer struct {
+	instance string // public URL of the peer
+	clientIP string // address of the client, as the peer saw it
+	readOnly bool
+}
+
+// peerOf returns the peer a request came through, or nil for requests made
+// to this instance directly
+func peerOf(c *gin.Context) *federatedPeer {
+	peer, _ := c.Value(peerKey).(*federatedPeer)
+	return peer
+}
+
+// clientIP returns the address of the client making a request, as reported
+// by the peer or instance for clients connecting through another instance
+func clientIP(c *gin.Context) string {
+	if peer := peerOf(c); peer != nil {
+		return peer.clientIP
+	}
+	if ip := c.GetString(relayedKey); ip != "" {
+		return ip
+	}
+	return c.ClientIP()
+}
+
+// federationPath is where peers connect their clients to a document hosted here
+func federationPath(docID string) string {
+	return "/federation/v1/documents/" + docID + "/ws"
+}
+
+// federationResource is what a peer signs when connecting a client: the
+// document, the access it asks for and the client's address
+func federationResource(docID, mode, ip string) string {
+	return federationPath(docID) + "?mode=" + mode + "&ip=" + ip
+}
+
+// handleFederatedWebSocket connects a client of a peer instance, proxied by
+// the peer, to a document hosted here. The peer signs the request with the
+// secret shared with it. Clients get read-write access only when the peer
+// asks for it and is one of the FederationWriters, and are listed with the
+// peer's URL so users can tell where collaborators come from.
+func (s *Server) handleFederatedWebSocket(c *gin.Context) {
+	instance := c.GetHeader("X-GoPad-Instance")
+	secret, ok := s.config.FederationPeers[instance]
+	if !ok {
+		federatedConnections.Inc(metrics.Labels{"direction": "inbound", "result": "refused"})
+		abortWithError(c, errUnknownPeer)
+		return
+	}
+	docID, mode, ip := c.Param("id"), c.Query("mode"), c.Query("ip")
+	signer := signedurl.New([]byte(secret), federationSkew)
+	if err := signer.VerifyToken(federationResource(docID, mode, ip), c.GetHeader("X-GoPad-Federation"), time.Now()); err != nil {
+		federatedConnections.Inc(metrics.Labels{"direction": "inbound", "result": "refused"})
+		requestLog(c).Warn("Refused federation request with invalid signature", "peer", instance, "doc_id", docID, "error", err)
+		abortWithError(c, apperr.Wrap(apperr.CodeUnauthorized, err, "invalid federation signature"))
+		return
+	}
+	peer := &federatedPeer{
+		instance: instance,
+		clientIP: ip,
+		readOnly: mode != storage.FollowReadWrite || !slices.Contains(s.config.FederationWriters, instance),
+	}
+	c.Set(peerKey, peer)
+	federatedConnections.Inc(metrics.Labels{"direction": "inbound", "result": "accepted"})
+	requestLog(c).Debug("Accepted client of federation peer", "peer", instance, "doc_id", docID, "read_only", peer.readOnly)
+	s.handleWebSocket(c)
+}
+
+// proxyFollowed connects a client to the document another instance hosts for
+// a followed one, relaying frames both ways until either side closes. Nothing
+// is kept here: the hosting instance sees the client as one of its own and
+// enforces the access it granted, and the client sees everyone connected there.
+func (s *Server) proxyFollowed(c *gin.Context, docID string, follow *storage.Follow) {
+	ip := c.ClientIP()
+	if err := s.checkBan(c.Request.Context(), docID, ip, ""); err != nil {
+		requestLog(c).Info("Refused banned client", "doc_id", docID)
+		bannedClients.Inc(metrics.Labels{"stage": "connect"})
+		abortWithError(c, err)
+		return
+	}
+	secret, ok := s.config.FederationPeers[follow.Instance]
+	if !ok || s.config.PublicURL == "" {
+		requestLog(c).Error("Followed document's instance is not a federation peer", "doc_id", docID, "peer", follow.Instance)
+		abortWithError(c, errHostUnreachable)
+		return
+	}
+	target, err := url.Parse(follow.Instance)
+	if err != nil {
+		requestLog(c).Error("Invalid URL of followed instance", "doc_id", docID, "peer", follow.Instance, "error", err)
+		abortWithError(c, errHostUnreachable)
+		return
+	}
+	if target.Scheme == "https" {
+		target.Scheme = "wss"
+	} else {
+		target.Scheme = "ws"
+	}
+	target = target.JoinPath(federationPath(follow.DocID))
+	// Capabilities, encoding, channels and resume tokens are the host's business
+	query := c.Request.URL.Query()
+	query.Del("doc")
+	query.Set("mode", follow.Mode)
+	query.Set("ip", ip)
+	target.RawQuery = query.Encode()
+
+	signer := signedurl.New([]byte(secret), 0)
+	header := http.Header{}
+	header.Set("X-GoPad-Instance", s.config.PublicURL)
+	header.Set("X-GoPad-Federation", signer.Token(federationResource(follow.DocID, follow.Mode, ip), time.Now().Add(federationTokenTTL)))
+	upstream, err := dialRelay(c, target.String(), header)
+	if err != nil {
+		federatedConnections.Inc(metrics.Labels{"direction": "outbound", "result": "failed"})
+		if !errors.Is(err, errRelayRefused) {
+			requestLog(c).Warn("Error connecting to followed document", "doc_id", docID, "peer", follow.Instance, "error", err)
+			abortWithError(c, errHostUnreachable)
+		}
+		return
+	}
+	if !s.relayClient(c, upstream) {
+		return
+	}
+	federatedConnections.Inc(metrics.Labels{"direction": "outbound", "result": "connected"})
+	requestLog(c).Debug("Client connected to followed document", "doc_id", docID, "peer", follow.Instance, "remote_doc_id", follow.DocID)
+}
+
+// dialRelay connects to the WebSocket at target that a client's frames are
+// relayed to. Refusals of the client, e.g. because it's banned there, are
+// passed on to it as they are, returning errRelayRefused.
+func dialRelay(c *gin.Context, target string, header http.Header) (*websocket.Conn, error) {
+	if languages := c.GetHeader("Accept-Language"); languages != "" {
+		header.Set("Accept-Language", languages)
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout:  10 * time.Second,
+		EnableCompression: true,
+		Subprotocols:      websocket.Subprotocols(c.Request),
+	}
+	upstream, resp, err := dialer.DialContext(c.Request.Context(), target, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode < http.StatusInternalServerError {
+			body, _ := io.ReadAll(resp.Body)
+			c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+			c.Abort()
+			return nil, errRelayRefused
+		}
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// relayClient upgrades the client's connection and relays frames between it
+// and upstream until either side closes. It returns false if the upgrade failed.
+func (s *Server) relayClient(c *gin.Context, upstream *websocket.Conn) bool {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		requestLog(c).Error("WebSocket upgrade failed", "error", err)
+		upstream.Close()
+		return false
+	}
+	if s.config.MaxDocSize > 0 {
+		conn.SetReadLimit(int64(s.config.MaxDocSize) + 64*1024)
+	}
+	// Clients reconnect elsewhere when this instance shuts down
+	stop := context.AfterFunc(s.ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+	go relayFrames(upstream, conn)
+	go func() {
+		defer stop()
+		relayFrames(conn, upstream)
+	}()
+	return true
+}
+
+// relayFrames copies frames from src to dst until src fails, then closes dst
+// with the code src was closed with, so reconnect hints and bans get through
+func relayFrames(dst, src *websocket.Conn) {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			code, text := websocket.CloseGoingAway, ""
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseNoStatusReceived && closeErr.Code != websocket.CloseAbnormalClosure {
+				code, text = closeErr.Code, closeErr.Text
+			}
+			dst.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+			dst.Close()
+			return
+		}
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			src.Close()
+			return
+		}
+	}
+}
+
+// followRequest makes a document follow one hosted on a peer instance
+type followRequest struct {
+	Instance string `json:"instance"` // public URL of the peer
+	Document string `json:"document"` // ID of the document there; defaults to the same ID
+	Mode     string `json:"mode"`     // "read-only" (the default) or "read-write"
+}
+
+// handleFollowDocument makes a document follow one hosted on a peer instance.
+// Clients connected to it here are disconnected so they reconnect through the
+// proxy; what's stored for the document here is kept, but not served while it
+// follows another.
+func (s *Server) handleFollowDocument(c *gin.Context) {
+	if len(s.config.FederationPeers) == 0 || s.config.PublicURL == "" {
+		abortWithError(c, errFederationDisabled)
+		return
+	}
+	var req followRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	docID := c.Param("id")
+	instance := strings.TrimSuffix(req.Instance, "/")
+	if _, ok := s.config.FederationPeers[instance]; !ok {
+		abortWithError(c, apperr.Newf(apperr.CodeValidation, "%q is not a federation peer", req.Instance))
+		return
+	}
+	if req.Document == "" {
+		req.Document = docID
+	}
+	if req.Mode == "" {
+		req.Mode = storage.FollowReadOnly
+	}
+	if req.Mode != storage.FollowReadOnly && req.Mode != storage.FollowReadWrite {
+		abortWithError(c, apperr.New(apperr.CodeValidation, `mode must be "read-only" or "read-write"`))
+		return
+	}
+	follow := &storage.Follow{
+		Instance: instance,
+		DocID:    req.Document,
+		Mode:     req.Mode,
+		Created:  time.Now().UnixMilli(),
+	}
+	if err := s.store.SaveFollow(c.Request.Context(), docID, follow); err != nil {
+		requestLog(c).Error("Error saving follow", "doc_id", docID, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	s.evictDocument(docID, true)
+	requestLog(c).Info("Document follows peer", "doc_id", docID, "peer", instance, "remote_doc_id", follow.DocID, "mode", follow.Mode)
+	c.JSON(http.StatusOK, follow)
+}
+
+// handleGetFollow returns the document on a peer instance a document follows
+func (s *Server) handleGetFollow(c *gin.Context) {
+	follow, err := s.store.Follow(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if follow == nil {
+		abortWithError(c, storage.ErrNotFollowing)
+		return
+	}
+	c.JSON(http.StatusOK, follow)
+}
+
+// handleUnfollowDocument makes a document hosted here again. Clients proxied
+// to the peer stay connected there until they reconnect.
+func (s *Server) handleUnfollowDocument(c *gin.Context) {
+	docID := c.Param("id")
+	if err := s.store.DeleteFollow(c.Request.Context(), docID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Document unfollowed", "doc_id", docID)
+	c.Status(http.StatusNoContent)
+}
+
+// followed returns what a document follows when clients connect to it, or
+// nil when it's hosted here. Failing lookups are only logged, serving the
+// local copy rather than refusing everyone during a storage outage.
+func (s *Server) followed(c *gin.Context, docID string) *storage.Follow {
+	if len(s.config.FederationPeers) == 0 {
+		return nil
+	}
+	follow, err := s.store.Follow(c.Request.Context(), docID)
+	if err != nil {
+		requestLog(c).Error("Error checking whether document follows a peer", "doc_id", docID, "error", err)
+		return nil
+	}
+	return follow
+}
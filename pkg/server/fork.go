@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+var forks = metrics.NewCounter("gopad_document_forks_total", "Number of documents forked by source: api or websocket")
+
+// forkRequest is the optional body of POST /api/v1/documents/:id/fork
+type forkRequest struct {
+	Lineage bool `json:"lineage"` // record the source as the fork's parent
+}
+
+// forkDocument copies the tabs, notes and language of state into a new
+// document in the same workspace and returns its ID. Run outputs, locks and
+// the title stay behind, and nothing about the source document changes.
+func (s *Server) forkDocument(ctx context.Context, docID string, state *storage.DocumentState, lineage bool) (string, error) {
+	seed := contentOf(state)
+	if lineage {
+		seed.Parent = docID
+	}
+	return s.createDocument(ctx, state.Workspace, seed)
+}
+
+// contentOf returns a copy of the tabs, active tab and language of state, to
+// seed a new document with
+func contentOf(state *storage.DocumentState) *storage.DocumentState {
+	seed := &storage.DocumentState{
+		Language:    state.Language,
+		Tabs:        make([]storage.Tab, len(state.Tabs)),
+		ActiveTabId: state.ActiveTabId,
+	}
+	for i, t := range state.Tabs {
+		seed.Tabs[i] = storage.Tab{
+			ID:      t.ID,
+			Name:    t.Name,
+			Content: t.Content,
+			Notes:   t.Notes,
+			Kind:    t.Kind,
+			Runtime: t.Runtime,
+		}
+	}
+	return seed
+}
+
+// handleFork creates a copy of the document under a new ID and returns the ID
+func (s *Server) handleFork(c *gin.Context) {
+	var req forkRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+			return
+		}
+	}
+	docID := c.Param("id")
+	state, _, err := s.publishedState(c, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	forkID, err := s.forkDocument(c.Request.Context(), docID, state, req.Lineage)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	forks.Inc(metrics.Labels{"source": "api"})
+	requestLog(c).Info("Document forked", "doc_id", docID, "fork_id", forkID)
+	c.JSON(http.StatusCreated, gin.H{"id": forkID})
+}
+
+// handleFork copies the document the client is connected to and replies with
+// the new document's ID. Viewers may fork too, as the source is left as it was.
+func (c *Client) handleFork(ctx context.Context, msg map[string]interface{}) {
+	lineage, _ := msg["lineage"].(bool)
+	forkID, err := c.doc.server.forkDocument(ctx, c.docID, c.doc.snapshot(), lineage)
+	if err != nil {
+		c.sendError(err)
+		return
+	}
+	forks.Inc(metrics.Labels{"source": "websocket"})
+	c.log.Info("Document forked", "fork_id", forkID)
+	c.reply(map[string]interface{}{"type": "forked", "id": forkID})
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// frame is an outgoing message, shared by every client it is sent to. A
+// broadcast used to be transcoded, compressed and framed again by each
+// recipient's writePump; a frame does that once per encoding, the first time a
+// client needs it, and every other connection with the same compression
+// settings writes the same bytes. The JSON is never modified once the frame is
+// built.
+type frame struct {
+	json []byte
+
+	textOnce sync.Once
+	text     *websocket.PreparedMessage
+	textErr  error
+
+	binaryOnce sync.Once
+	binary     *websocket.PreparedMessage
+	binaryErr  error
+}
+
+// frameHeader holds the fields of a broadcast the hub routes it by. Decoding
+// only these skips over the content rather than building a map of it.
+type frameHeader struct {
+	Type  string `json:"type"`
+	TabID string `json:"tabId"`
+}
+
+// newFrame wraps a JSON message for sending
+func newFrame(message []byte) *frame {
+	return &frame{json: message}
+}
+
+// prepared returns the frame in the given wire encoding, ready to be written to
+// any connection
+func (f *frame) prepared(encoding string) (*websocket.PreparedMessage, error) {
+	if encoding != encodingMsgpack {
+		f.textOnce.Do(func() {
+			f.text, f.textErr = websocket.NewPreparedMessage(websocket.TextMessage, f.json)
+		})
+		return f.text, f.textErr
+	}
+	f.binaryOnce.Do(func() {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if f.binaryErr = encodeMsgpack(buf, f.json); f.binaryErr != nil {
+			return
+		}
+		// The prepared message copies the data, so the buffer can be reused
+		f.binary, f.binaryErr = websocket.NewPreparedMessage(websocket.BinaryMessage, buf.Bytes())
+	})
+	return f.binary, f.binaryErr
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// benchRecipients is how many clients each benchmarked broadcast is sent to
+const benchRecipients = 100
+
+// benchConn returns the server side of a websocket connection whose client
+// side discards everything it reads
+func benchConn(b *testing.B, compression bool) *websocket.Conn {
+	b.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	b.Cleanup(srv.Close)
+
+	// The websocket package logs closing each compressed message it read
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	dialer := websocket.Dialer{EnableCompression: compression}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	done := make(chan struct{})
+	b.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		for {
+			_, r, err := client.NextReader()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, r)
+		}
+	}()
+	conn := <-conns
+	b.Cleanup(func() { conn.Close() })
+	conn.EnableWriteCompression(compression)
+	return conn
+}
+
+// broadcastPerRecipient sends a broadcast the way the hub did before frames:
+// routing it by a map of the whole message, then transcoding and writing it
+// for each recipient on its own
+func broadcastPerRecipient(c *Client, message []byte, recipients int) error {
+	var msgObj map[string]interface{}
+	if err := json.Unmarshal(message, &msgObj); err != nil {
+		return err
+	}
+	_, _ = msgObj["type"].(string)
+	for i := 0; i < recipients; i++ {
+		messageType, data := websocket.TextMessage, message
+		if c.encoding == encodingMsgpack {
+			var v interface{}
+			if err := json.Unmarshal(message, &v); err != nil {
+				return err
+			}
+			var err error
+			if data, err = msgpack.Marshal(v); err != nil {
+				return err
+			}
+			messageType = websocket.BinaryMessage
+		}
+		if err := c.conn.WriteMessage(messageType, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcastFrame sends a broadcast as one frame shared by every recipient
+func broadcastFrame(c *Client, message []byte, recipients int) error {
+	var header frameHeader
+	if err := json.Unmarshal(message, &header); err != nil {
+		return err
+	}
+	f := newFrame(message)
+	for i := 0; i < recipients; i++ {
+		if err := c.writePrepared(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	// A 2 KiB edit, as gopad loadtest sends
+	message, err := json.Marshal(map[string]interface{}{
+		"type":    "update",
+		"tabId":   "1",
+		"content": strings.Repeat("lorem ipsum dolor sit amet\n", 2048/27+1)[:2048],
+		"userId":  "bench",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	paths := []struct {
+		name      string
+		broadcast func(*Client, []byte, int) error
+	}{
+		{"before", broadcastPerRecipient},
+		{"after", broadcastFrame},
+	}
+	for _, caps := range []struct {
+		name        string
+		compression bool
+		encoding    string
+	}{
+		{"json", false, encodingJSON},
+		{"json+compression", true, encodingJSON},
+		{"msgpack", false, encodingMsgpack},
+		{"msgpack+compression", true, encodingMsgpack},
+	} {
+		for _, path := range paths {
+			b.Run(fmt.Sprintf("%s/%s", caps.name, path.name), func(b *testing.B) {
+				c := &Client{conn: benchConn(b, caps.compression), encoding: caps.encoding}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := path.broadcast(c, message, benchRecipients); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/github"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+	"github.com/shiftregister-vg/gopad/pkg/telemetry"
+)
+
+// gitHubTimeout bounds how long an export to GitHub may take
+const gitHubTimeout = time.Minute
+
+var gitHubExports = metrics.NewCounter("gopad_github_exports_total", "Number of document exports to GitHub by target and result")
+
+// gitHubExportRequest says where to export a document on GitHub. Without a
+// repo a new gist is created.
+type gitHubExportRequest struct {
+	Repo        string `json:"repo"`   // "owner/name" to commit the tabs to
+	Branch      string `json:"branch"` // empty for the repository's default branch
+	Path        string `json:"path"`   // directory in the repository
+	Public      bool   `json:"public"` // gists only; they're secret by default
+	Description string `json:"description"`
+	Token       string `json:"token"` // the caller's own token; required unless they're an admin
+}
+
+// exportToGitHub publishes the editor tabs of a document state as files of a
+// gist or a commit to a repository and returns its URL. Only admins may
+// export with GITHUB_TOKEN, and only to the repositories it's allowed for.
+func (s *Server) exportToGitHub(ctx context.Context, docID string, state *storage.DocumentState, req gitHubExportRequest, admin bool) (string, error) {
+	token := req.Token
+	if token == "" {
+		if !admin || s.config.GitHubToken == "" {
+			return "", apperr.New(apperr.CodeValidation, "a GitHub token is required")
+		}
+		if req.Repo != "" && !gitHubRepoAllowed(s.config.GitHubRepos, req.Repo, cleanRepoPath(req.Path)) {
+			return "", apperr.Newf(apperr.CodeForbidden, "exports to %s need a GitHub token of your own", req.Repo)
+		}
+		token = s.config.GitHubToken
+	}
+	export := NewExport(docID, state, s.sanitizer)
+	files := exportFiles(export)
+	if len(files) == 0 {
+		return "", apperr.New(apperr.CodeValidation, "the document has no content to export")
+	}
+	description := req.Description
+	if description == "" {
+		description = export.Title
+	}
+	if description == "" {
+		description = "gopad document " + docID
+	}
+
+	target := "gist"
+	if req.Repo != "" {
+		target = "repo"
+	}
+	ctx, cancel := context.WithTimeout(ctx, gitHubTimeout)
+	defer cancel()
+	client := github.New(s.config.GitHubAPIURL, token)
+	var url string
+	var err error
+	if target == "repo" {
+		url, err = client.Commit(ctx, req.Repo, req.Branch, cleanRepoPath(req.Path), description, files)
+	} else {
+		url, err = client.CreateGist(ctx, description, req.Public, files)
+	}
+	if err != nil {
+		gitHubExports.Inc(metrics.Labels{"target": target, "result": "error"})
+		if errors.Is(err, github.ErrUnauthorized) {
+			return "", apperr.Wrap(apperr.CodeUnauthorized, err, "GitHub rejected the token")
+		}
+		return "", apperr.Wrap(apperr.CodeUnavailable, err, "failed to export to GitHub")
+	}
+	gitHubExports.Inc(metrics.Labels{"target": target, "result": "ok"})
+	s.usage.Record(docID, telemetry.FeatureExport)
+	return url, nil
+}
+
+// exportFiles names the editor tabs of an export as files, adding the
+// document language's extension where a name has none. Empty tabs are left
+// out since gists can't hold empty files.
+func exportFiles(export *Export) []github.File {
+	ext := suggest.Extension(export.Language)
+	used := make(map[string]bool)
+	var files []github.File
+	for _, tab := range export.Tabs {
+		if tab.Kind != "" || strings.TrimSpace(tab.Content) == "" {
+			continue
+		}
+		// Names become single path segments
+		name := strings.Trim(strings.NewReplacer("/", "-", "\\", "-").Replace(tab.Name), " .")
+		if name == "" {
+			name = "tab-" + tab.ID
+		}
+		if ext != "" && !suggest.HasExtension(name) {
+			name += "." + ext
+		}
+		unique := name
+		for n := 2; used[strings.ToLower(unique)]; n++ {
+			stem := strings.TrimSuffix(name, path.Ext(name))
+			unique = stem + "-" + strconv.Itoa(n) + path.Ext(name)
+		}
+		used[strings.ToLower(unique)] = true
+		files = append(files, github.File{Name: unique, Content: tab.Content})
+	}
+	return files
+}
+
+// cleanRepoPath turns a requested directory into a relative path that stays
+// inside the repository
+func cleanRepoPath(dir string) string {
+	dir = path.Clean("/" + dir)
+	return strings.TrimPrefix(dir, "/")
+}
+
+// gitHubRepoAllowed reports whether allowed, entries of "owner/name" or
+// "owner/name/directory", lets the server's token commit below dir of repo
+func gitHubRepoAllowed(allowed []string, repo, dir string) bool {
+	for _, entry := range allowed {
+		parts := strings.SplitN(entry, "/", 3)
+		if len(parts) < 2 || !strings.EqualFold(parts[0]+"/"+parts[1], repo) {
+			continue
+		}
+		if len(parts) == 2 {
+			return true
+		}
+		prefix := cleanRepoPath(parts[2])
+		if prefix == "" || dir == prefix || strings.HasPrefix(dir, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleExportGitHub exports a document to a gist or repository
+func (s *Server) handleExportGitHub(c *gin.Context) {
+	var req gitHubExportRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+			return
+		}
+	}
+	docID := c.Param("id")
+	state, settings, err := s.publishedState(c, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !settings.Enabled(policy.FeatureExport) {
+		abortWithError(c, featureDisabled(policy.FeatureExport))
+		return
+	}
+	url, err := s.exportToGitHub(c.Request.Context(), docID, state, req, s.isAdmin(c))
+	if err != nil {
+		requestLog(c).Warn("Error exporting document to GitHub", "doc_id", docID, "repo", req.Repo, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Document exported to GitHub", "doc_id", docID, "repo", req.Repo, "url", url)
+	c.JSON(http.StatusOK, gin.H{"url": url})
+}
+
+// handleExportGist exports the document to a gist or repository for an
+// exportGist message and replies with the URL
+func (c *Client) handleExportGist(msg map[string]interface{}) {
+	if err := c.doc.checkFeature(policy.FeatureExport); err != nil {
+		c.sendError(err)
+		return
+	}
+	var req gitHubExportRequest
+	req.Repo, _ = msg["repo"].(string)
+	req.Branch, _ = msg["branch"].(string)
+	req.Path, _ = msg["path"].(string)
+	req.Public, _ = msg["public"].(bool)
+	req.Description, _ = msg["description"].(string)
+	req.Token, _ = msg["token"].(string)
+	requestId := msg["requestId"]
+	state := c.doc.snapshot()
+
+	// GitHub can take a while; don't hold up this client's other messages.
+	// WebSocket clients aren't admins, so they always bring their own token.
+	go func() {
+		url, err := c.doc.server.exportToGitHub(c.doc.ctx, c.doc.ID, state, req, false)
+		if err != nil {
+			c.log.Warn("Error exporting document to GitHub", "repo", req.Repo, "error", err)
+			c.deliver(c.errorMessage(err))
+			return
+		}
+		c.log.Info("Document exported to GitHub", "repo", req.Repo, "url", url)
+		c.deliver(map[string]interface{}{
+			"type":      "exportGist",
+			"requestId": requestId,
+			"url":       url,
+		})
+	}()
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+func TestGitHubRepoAllowed(t *testing.T) {
+	allowed := []string{"acme/site", "acme/docs/notes/"}
+	tests := []struct {
+		repo, dir string
+		want      bool
+	}{
+		{"acme/site", "", true},
+		{"ACME/Site", "any/where", true},
+		{"acme/docs", "notes", true},
+		{"acme/docs", "notes/2024", true},
+		{"acme/docs", "", false},
+		{"acme/docs", "notes-old", false},
+		{"acme/other", "", false},
+		{"evil/site", "", false},
+	}
+	for _, tt := range tests {
+		if got := gitHubRepoAllowed(allowed, tt.repo, tt.dir); got != tt.want {
+			t.Errorf("gitHubRepoAllowed(%q, %q) = %v, want %v", tt.repo, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestExportToGitHubRequiresOwnToken(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GitHubToken = "server-token"
+	cfg.GitHubRepos = []string{"acme/site"}
+	s := &Server{config: cfg}
+	state := &storage.DocumentState{Tabs: []storage.Tab{{ID: "1", Name: "main", Content: "package main"}}}
+
+	tests := []struct {
+		name  string
+		req   gitHubExportRequest
+		admin bool
+		code  apperr.Code
+	}{
+		{"anonymous gist", gitHubExportRequest{}, false, apperr.CodeValidation},
+		{"anonymous commit", gitHubExportRequest{Repo: "acme/site"}, false, apperr.CodeValidation},
+		{"admin commit outside the allowlist", gitHubExportRequest{Repo: "acme/private"}, true, apperr.CodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.exportToGitHub(context.Background(), "doc", state, tt.req, tt.admin)
+			if code := apperr.CodeOf(err); err == nil || code != tt.code {
+				t.Fatalf("expected a %s error, got %v", tt.code, err)
+			}
+		})
+	}
+}
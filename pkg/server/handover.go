@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/presence"
+)
+
+const (
+	// handoverTTL bounds how long other instances wait for a draining instance
+	// to save a document before loading it anyway
+	handoverTTL = 10 * time.Second
+	// handoverPoll is how often a loading instance checks whether a handover finished
+	handoverPoll = 100 * time.Millisecond
+)
+
+// errDraining is returned to new connections while the instance is shutting down
+var errDraining = apperr.New(apperr.CodeUnavailable, "server is shutting down, reconnect shortly")
+
+// Drain hands every loaded document over to the other instances before
+// shutdown. New connections are refused and clients are closed with a
+// reconnect hint, while a handover marker in Redis makes instances they
+// reconnect to wait until pending changes are saved. Presence entries are
+// left in place so users stay listed while they reconnect.
+func (s *Server) Drain(ctx context.Context) {
+	s.draining.Store(true)
+	s.mu.RLock()
+	docs := make([]*Document, 0, len(s.documents))
+	for _, doc := range s.documents {
+		docs = append(docs, doc)
+	}
+	s.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, doc := range docs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doc.handover(ctx)
+		}()
+	}
+	wg.Wait()
+	logger.Info("Documents handed over", "documents", len(docs))
+}
+
+// handover persists the document and disconnects its clients so another instance can take over
+func (doc *Document) handover(ctx context.Context) {
+	store := doc.server.store
+	if err := store.BeginHandover(ctx, doc.ID, doc.server.instanceID, handoverTTL); err != nil {
+		logger.Error("Error starting handover", "doc_id", doc.ID, "error", err)
+	}
+	// The marker holds off the next owner until the save below is done
+	doc.releaseOwnership(ctx)
+
+	// Renew presence so users are listed for the full TTL while they reconnect
+	doc.mu.RLock()
+	var entries []presence.Entry
+	for _, client := range doc.users.connected() {
+		entries = append(entries, client.presenceEntry())
+	}
+	doc.mu.RUnlock()
+	for _, entry := range entries {
+		doc.recordPresence(entry)
+	}
+
+	doc.send(BroadcastMessage{handover: true})
+
+	// Save what's pending, then wait for any save already in flight
+	doc.saver.flush(ctx)
+	doc.compactor.flush(ctx)
+	doc.saveMu.Lock()
+	doc.saveMu.Unlock()
+
+	if err := store.EndHandover(ctx, doc.ID); err != nil {
+		logger.Error("Error finishing handover", "doc_id", doc.ID, "error", err)
+	}
+}
+
+// closeForHandover closes the connection with 1012 (service restart), telling the client to reconnect
+// Note: Must only be called from the hub goroutine
+func (c *Client) closeForHandover() {
+	msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "handover")
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		c.log.Debug("Error sending close frame", "error", err)
+	}
+	c.conn.Close()
+}
+
+// awaitHandover waits while another instance is still handing the document
+// over, so it isn't loaded before that instance's last changes are saved
+func (s *Server) awaitHandover(ctx context.Context, docID string) {
+	ctx, cancel := context.WithTimeout(ctx, handoverTTL)
+	defer cancel()
+	for {
+		pending, err := s.store.HandoverPending(ctx, docID)
+		if err != nil || !pending {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			logger.Warn("Gave up waiting for document handover", "doc_id", docID)
+			return
+		case <-time.After(handoverPoll):
+		}
+	}
+}
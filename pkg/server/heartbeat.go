@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/presence"
+)
+
+// UsePresence replaces the in-memory presence store, e.g. with a Redis backed one
+// shared between instances. It must be called before the server starts serving.
+func (s *Server) UsePresence(store presence.Store) {
+	s.presence = store
+}
+
+// presenceEntry describes the client for the presence store
+// Note: Caller must hold doc.mu
+func (c *Client) presenceEntry() presence.Entry {
+	return presence.Entry{
+		UUID:     c.uuid,
+		Name:     c.name,
+		Color:    c.color,
+		Cursor:   c.cursor,
+		Instance: c.doc.server.instanceID,
+		Peer:     c.peer,
+
+		AvatarURL:    c.avatarURL,
+		GravatarHash: c.gravatarHash,
+	}
+}
+
+// recordPresence writes one user's presence entry
+func (doc *Document) recordPresence(entry presence.Entry) {
+	ttl := doc.server.config.PresenceTTL
+	if ttl <= 0 {
+		return
+	}
+	if err := doc.server.presence.Heartbeat(doc.ctx, doc.ID, entry, ttl); err != nil && doc.ctx.Err() == nil {
+		logger.Error("Error recording presence", "doc_id", doc.ID, "client_uuid", entry.UUID, "error", err)
+	}
+}
+
+// removePresence drops a user's presence entry when they disconnect, unless
+// the same user has already reconnected with a new client
+func (c *Client) removePresence() {
+	// Users of a draining instance stay listed while they reconnect elsewhere
+	if c.doc.server.config.PresenceTTL <= 0 || c.doc.server.draining.Load() {
+		return
+	}
+	c.doc.mu.RLock()
+	current := c.doc.users.clients[c.uuid] == c
+	c.doc.mu.RUnlock()
+	if !current {
+		return
+	}
+	if err := c.doc.server.presence.Remove(c.doc.ctx, c.doc.ID, c.uuid); err != nil && c.doc.ctx.Err() == nil {
+		c.log.Error("Error removing presence", "client_uuid", c.uuid, "error", err)
+	}
+}
+
+// removeAnonymousPresence drops the entry a client was listed under before
+// it named itself with its own ID
+func (doc *Document) removeAnonymousPresence(uuid string) {
+	if doc.server.config.PresenceTTL <= 0 {
+		return
+	}
+	if err := doc.server.presence.Remove(doc.ctx, doc.ID, uuid); err != nil && doc.ctx.Err() == nil {
+		logger.Error("Error removing presence", "client_uuid", uuid, "error", err)
+	}
+}
+
+// heartbeatLoop renews the presence of connected users and picks up users
+// connected through other instances, until the document is shut down
+func (doc *Document) heartbeatLoop(ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		doc.syncPresence(doc.ctx)
+		select {
+		case <-doc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncPresence renews this instance's entries and refreshes the users seen
+// through other instances, broadcasting the user list if they changed
+func (doc *Document) syncPresence(ctx context.Context) {
+	doc.mu.RLock()
+	var local []presence.Entry
+	for _, client := range doc.users.connected() {
+		local = append(local, client.presenceEntry())
+	}
+	doc.mu.RUnlock()
+	for _, entry := range local {
+		doc.recordPresence(entry)
+	}
+
+	entries, err := doc.server.presence.List(ctx, doc.ID)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("Error listing presence", "doc_id", doc.ID, "error", err)
+		}
+		return
+	}
+	remote := make(map[string]presence.Entry)
+	for _, entry := range entries {
+		if entry.Instance != doc.server.instanceID {
+			remote[entry.UUID] = entry
+		}
+	}
+	doc.mu.Lock()
+	changed := !reflect.DeepEqual(doc.remoteUsers, remote)
+	doc.remoteUsers = remote
+	doc.mu.Unlock()
+	if changed {
+		doc.broadcastUserList()
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// maxAvatarURLLength bounds avatar URLs, which every client receives with the user list
+const maxAvatarURLLength = 2048
+
+// Errors for invalid avatars sent with setName
+var (
+	errInvalidAvatarURL    = apperr.New(apperr.CodeValidation, "avatar URL must be an absolute https URL")
+	errInvalidGravatarHash = apperr.New(apperr.CodeValidation, "gravatar hash must be a hex MD5 or SHA-256 hash")
+)
+
+// checkAvatar validates the avatar fields of a setName message; empty ones are fine
+func checkAvatar(avatarURL, gravatarHash string) error {
+	if avatarURL != "" {
+		u, err := url.Parse(avatarURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" || len(avatarURL) > maxAvatarURLLength {
+			return errInvalidAvatarURL
+		}
+	}
+	if gravatarHash != "" {
+		if _, err := hex.DecodeString(gravatarHash); err != nil || (len(gravatarHash) != 32 && len(gravatarHash) != 64) {
+			return errInvalidGravatarHash
+		}
+	}
+	return nil
+}
+
+// loadIdentity returns the identity stored for a user, or nil if there is
+// none or identities aren't remembered. Failing lookups are only logged, so
+// users can still join during a storage outage.
+func (s *Server) loadIdentity(ctx context.Context, uuid string) *storage.Identity {
+	if s.config.IdentityTTL <= 0 {
+		return nil
+	}
+	identity, err := s.store.LoadIdentity(ctx, uuid)
+	if err != nil {
+		logger.Error("Error loading identity", "client_uuid", uuid, "error", err)
+		return nil
+	}
+	return identity
+}
+
+// saveIdentity remembers how the client's user appears, for the next
+// document they join
+func (c *Client) saveIdentity(ctx context.Context, identity storage.Identity) {
+	ttl := c.doc.server.config.IdentityTTL
+	if ttl <= 0 {
+		return
+	}
+	identity.Updated = time.Now().UnixMilli()
+	if err := c.doc.server.store.SaveIdentity(ctx, &identity, ttl); err != nil {
+		c.log.Error("Error saving identity", "client_uuid", identity.UUID, "error", err)
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/webhook"
+)
+
+// Strategies for the IDs of documents created through the API
+const (
+	idStrategyUUID       = "uuid"       // random version 4 UUIDs
+	idStrategyWords      = "words"      // adjective-color-animal triplets such as "brave-olive-hawk"
+	idStrategyNanoID     = "nanoid"     // 21 URL-safe random characters
+	idStrategySequential = "sequential" // numbers counting up per workspace, prefixed with its name
+)
+
+// maxIDAttempts bounds how many IDs are tried before creating a document gives up
+const maxIDAttempts = 10
+
+// nanoIDAlphabet has 64 characters, so each random byte maps to one without bias
+const nanoIDAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_-"
+
+var (
+	idAdjectives = []string{
+		"able", "bold", "brave", "brisk", "calm", "clever", "cosy", "crisp",
+		"daring", "eager", "early", "fair", "fancy", "fierce", "gentle", "glad",
+		"grand", "happy", "hardy", "honest", "humble", "jolly", "keen", "kind",
+		"lively", "loyal", "lucky", "merry", "mighty", "modest", "neat", "nimble",
+		"noble", "plucky", "polite", "proud", "quick", "quiet", "rapid", "ready",
+		"rustic", "sharp", "shiny", "silent", "sleek", "smart", "snug", "solid",
+		"spry", "steady", "stout", "sunny", "swift", "tidy", "tough", "trusty",
+		"vivid", "warm", "wise", "witty", "young", "zany", "zealous", "zesty",
+	}
+	idColors = []string{
+		"amber", "aqua", "azure", "beige", "black", "blue", "bronze", "brown",
+		"coral", "cream", "crimson", "cyan", "ebony", "emerald", "fawn", "gold",
+		"gray", "green", "hazel", "indigo", "ivory", "jade", "khaki", "lemon",
+		"lilac", "lime", "magenta", "maroon", "mauve", "mint", "navy", "ochre",
+		"olive", "orange", "peach", "pearl", "pink", "plum", "purple", "red",
+		"rose", "ruby", "rust", "saffron", "sage", "salmon", "sand", "scarlet",
+		"sepia", "sienna", "silver", "slate", "tan", "teal", "topaz", "umber",
+		"violet", "wheat", "white", "wine", "yellow", "cobalt", "cherry", "copper",
+	}
+	idAnimals = []string{
+		"badger", "bat", "bear", "beaver", "bison", "boar", "camel", "cat",
+		"cobra", "crane", "crow", "deer", "dingo", "dove", "duck", "eagle",
+		"eel", "elk", "falcon", "ferret", "finch", "fox", "frog", "gecko",
+		"goat", "goose", "hare", "hawk", "heron", "horse", "ibis", "jackal",
+		"jaguar", "koala", "lemur", "lion", "llama", "lynx", "marten", "mole",
+		"moose", "moth", "newt", "otter", "owl", "panda", "parrot", "puma",
+		"quail", "raven", "robin", "seal", "shark", "sloth", "swan", "tiger",
+		"toad", "trout", "viper", "walrus", "whale", "wolf", "wren", "yak",
+	}
+)
+
+// newID returns a random version 4 UUID
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// newNanoID returns 21 random characters from nanoIDAlphabet
+func newNanoID() string {
+	var b [21]byte
+	rand.Read(b[:])
+	for i := range b {
+		b[i] = nanoIDAlphabet[b[i]&63]
+	}
+	return string(b[:])
+}
+
+// newWordsID returns a random adjective-color-animal triplet
+func newWordsID() string {
+	return pickWord(idAdjectives) + "-" + pickWord(idColors) + "-" + pickWord(idAnimals)
+}
+
+func pickWord(words []string) string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	return words[n.Int64()]
+}
+
+// newDocumentID generates a candidate ID for a new document in workspace
+// using the configured strategy. The ID may already be taken.
+func (s *Server) newDocumentID(ctx context.Context, workspace string) (string, error) {
+	switch s.config.IDStrategy {
+	case idStrategyWords:
+		return newWordsID(), nil
+	case idStrategyNanoID:
+		return newNanoID(), nil
+	case idStrategySequential:
+		n, err := s.store.NextDocumentNumber(ctx, workspace)
+		if err != nil {
+			return "", err
+		}
+		if workspace == "" {
+			return strconv.FormatInt(n, 10), nil
+		}
+		return fmt.Sprintf("%s-%d", workspace, n), nil
+	default:
+		return newID(), nil
+	}
+}
+
+// createDocument stores a new document in workspace under a new ID and returns
+// the ID. It starts with the tabs, language, parent and any settings and
+// expiry of seed, or empty when seed is nil. Saving as version 0 only succeeds when the ID isn't taken in
+// storage, so IDs that collide are skipped for the next candidate.
+func (s *Server) createDocument(ctx context.Context, workspace string, seed *storage.DocumentState) (string, error) {
+	p, err := s.workspacePolicy(ctx, s.workspaceOf(workspace))
+	if err != nil {
+		return "", err
+	}
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		docID, err := s.newDocumentID(ctx, s.workspaceOf(workspace))
+		if err != nil {
+			return "", err
+		}
+		// Documents being edited here may not have been saved yet
+		if _, loaded := s.loadedDocument(docID); loaded {
+			continue
+		}
+		state := &storage.DocumentState{
+			Language:    "plaintext",
+			Users:       make(map[string]string),
+			Tabs:        []storage.Tab{{ID: "1", Name: "Untitled"}},
+			ActiveTabId: "1",
+			Workspace:   workspace,
+			Expiry:      time.Duration(p.Resolve(policy.Settings{}).TTL),
+		}
+		if seed != nil {
+			state.Language = seed.Language
+			state.Tabs = seed.Tabs
+			state.ActiveTabId = seed.ActiveTabId
+			state.Parent = seed.Parent
+			state.Settings = seed.Settings
+			if seed.Expiry != 0 {
+				state.Expiry = seed.Expiry
+			}
+		}
+		err = s.store.SaveDocument(ctx, docID, state)
+		if errors.Is(err, storage.ErrVersionConflict) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		s.notify(webhook.DocumentCreated, docID, "")
+		return docID, nil
+	}
+	return "", apperr.New(apperr.CodeConflict, "no free document ID found")
+}
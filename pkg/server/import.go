@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+)
+
+var urlImports = metrics.NewCounter("gopad_url_imports_total", "Number of imports of tabs from URLs by result")
+
+// importURLRequest is the body of POST /api/v1/documents/:id/import/url
+type importURLRequest struct {
+	URL string `json:"url"` // a gist, a GitHub or GitLab file, a paste or any text file
+}
+
+// handleImportURL fetches the files behind a URL and adds each as a new tab,
+// focusing the first. The tabs are created in one change, so an import that
+// breaks a limit or a lock leaves the document as it was.
+func (s *Server) handleImportURL(c *gin.Context) {
+	if s.importer == nil {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "imports are not enabled"))
+		return
+	}
+	var req importURLRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.URL == "" {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "a URL to import is required"))
+		return
+	}
+	docID := c.Param("id")
+	_, settings, err := s.publishedState(c, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !settings.Enabled(policy.FeatureImport) {
+		abortWithError(c, featureDisabled(policy.FeatureImport))
+		return
+	}
+	files, err := s.importer.Files(c.Request.Context(), req.URL)
+	if err != nil {
+		urlImports.Inc(metrics.Labels{"result": "error"})
+		requestLog(c).Warn("Error fetching URL to import", "doc_id", docID, "url", req.URL, "error", err)
+		abortWithError(c, err)
+		return
+	}
+
+	ops := make([]bulkOp, 0, len(files)+1)
+	tabs := make([]gin.H, 0, len(files))
+	for _, file := range files {
+		tab := &Tab{ID: newID(), Name: file.Name, Content: file.Content}
+		if err := s.moderateTab(c.Request.Context(), requestLog(c), docID, "", tab); err != nil {
+			urlImports.Inc(metrics.Labels{"result": "rejected"})
+			abortWithError(c, err)
+			return
+		}
+		ops = append(ops, bulkOp{Op: "create", Tab: tab})
+		tabs = append(tabs, gin.H{"id": tab.ID, "name": s.sanitizer.Label(tab.Name)})
+	}
+	ops = append(ops, bulkOp{Op: "focus", TabID: ops[0].Tab.ID})
+	doc, err := s.getOrCreateDocument(c.Request.Context(), docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := doc.applyTabBulk(ops, c.GetHeader(lockTokenHeader), ""); err != nil {
+		urlImports.Inc(metrics.Labels{"result": "rejected"})
+		abortWithError(c, err)
+		return
+	}
+	urlImports.Inc(metrics.Labels{"result": "ok"})
+	requestLog(c).Info("Tabs imported from URL", "doc_id", docID, "url", req.URL, "tabs", len(files))
+	c.JSON(http.StatusCreated, gin.H{"tabs": tabs})
+}
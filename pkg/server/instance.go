@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+// Version is the server version reported in the instance metadata. Release
+// builds set it with -ldflags "-X github.com/shiftregister-vg/gopad/pkg/server.Version=v1.2.3";
+// otherwise the module version from the build info is used.
+var Version = ""
+
+// directoryInterval is how often an instance listed in the community
+// directory registers again, so the directory can drop instances that are gone
+const directoryInterval = 24 * time.Hour
+
+// serverVersion returns Version or, when it isn't set, the module version
+func serverVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+// instanceInfo describes an instance to clients and federation tooling, at
+// /.well-known/gopad.json
+type instanceInfo struct {
+	Software string          `json:"software"`
+	Version  string          `json:"version"`
+	Name     string          `json:"name,omitempty"`
+	URL      string          `json:"url,omitempty"`
+	Protocol protocolInfo    `json:"protocol"`
+	Features map[string]bool `json:"features"`
+	Limits   limitsInfo      `json:"limits"`
+	Auth     authInfo        `json:"auth"`
+	// Directory reports whether the instance is listed in the community directory
+	Directory bool `json:"directory"`
+}
+
+// protocolInfo lists what clients can ask for when connecting to /ws
+type protocolInfo struct {
+	Capabilities []string `json:"capabilities"`
+	Channels     []string `json:"channels"`
+	Encodings    []string `json:"encodings"`
+}
+
+// limitsInfo holds the size limits in bytes (and tabs) edits must stay within; zero means unlimited
+type limitsInfo struct {
+	MaxTabSize    int   `json:"maxTabSize"`
+	MaxTabs       int   `json:"maxTabs"`
+	MaxDocSize    int   `json:"maxDocSize"`
+	MaxNameLength int   `json:"maxNameLength"`
+	ImportMaxSize int64 `json:"importMaxSize,omitempty"`
+}
+
+// authInfo tells clients which credentials the instance asks for
+type authInfo struct {
+	SignedURLs   bool `json:"signedUrls"`   // raw, export and activity endpoints need a signed URL
+	EditorTokens bool `json:"editorTokens"` // editors can be elevated with a token
+	AdminAPI     bool `json:"adminApi"`     // the /admin endpoints are enabled
+}
+
+// instanceInfo describes this instance
+func (s *Server) instanceInfo() instanceInfo {
+	capabilities := make([]string, 0, len(capabilityNames))
+	for name := range capabilityNames {
+		capabilities = append(capabilities, name)
+	}
+	sort.Strings(capabilities)
+	channels := make([]string, 0, len(channelNames))
+	for name := range channelNames {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+	info := instanceInfo{
+		Software: "gopad",
+		Version:  serverVersion(),
+		Name:     s.config.InstanceName,
+		URL:      s.config.PublicURL,
+		Protocol: protocolInfo{
+			Capabilities: capabilities,
+			Channels:     channels,
+			Encodings:    []string{encodingJSON, encodingMsgpack},
+		},
+		Features: map[string]bool{
+			"run":               s.runner != nil,
+			"repl":              len(s.config.ReplCommands) > 0,
+			"lsp":               len(s.config.LSPCommands) > 0,
+			"import":            s.importer != nil,
+			"unfurl":            s.unfurler != nil,
+			"suggestions":       s.config.SuggestionsEnabled,
+			"languageDetection": s.config.LanguageDetection,
+			"resume":            s.config.ResumeWindow > 0,
+			"moderation":        s.moderator != nil,
+			"identities":        s.config.IdentityTTL > 0,
+			"federation":        len(s.config.FederationPeers) > 0,
+		},
+		Limits: limitsInfo{
+			MaxTabSize:    s.config.MaxTabSize,
+			MaxTabs:       s.config.MaxTabs,
+			MaxDocSize:    s.config.MaxDocSize,
+			MaxNameLength: s.config.MaxNameLength,
+		},
+		Auth: authInfo{
+			SignedURLs:   s.signer != nil,
+			EditorTokens: s.signer != nil,
+			AdminAPI:     s.config.AdminToken != "",
+		},
+		Directory: s.config.DirectoryURL != "" && s.config.PublicURL != "",
+	}
+	if s.importer != nil {
+		info.Limits.ImportMaxSize = s.config.ImportMaxSize
+	}
+	return info
+}
+
+// handleInstanceInfo serves the instance metadata
+func (s *Server) handleInstanceInfo(c *gin.Context) {
+	// Meant to be read by clients of other origins deciding whether to connect
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.JSON(http.StatusOK, s.instanceInfo())
+}
+
+// registerLoop lists the instance in the community directory at DirectoryURL
+// now and every directoryInterval, until the server shuts down
+func (s *Server) registerLoop() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(directoryInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.register(s.ctx, client); err != nil && s.ctx.Err() == nil {
+			logger.Error("Error registering with the instance directory", "url", s.config.DirectoryURL, "error", err)
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// register posts the instance metadata to the directory
+func (s *Server) register(ctx context.Context, client *http.Client) error {
+	body, err := json.Marshal(s.instanceInfo())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.DirectoryURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gopad/"+serverVersion())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	logger.Info("Registered with the instance directory", "url", s.config.DirectoryURL)
+	return nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// Clients with the lazyTabs capability get large tabs other than the active
+// one without their content in init, and fetch it with a tabContentRequest
+// when they open them, so documents with many large tabs open quickly.
+//
+// Clients with the manifest capability get no tab content in init at all, but
+// the revision of each tab instead. They keep the contents they've seen, and
+// request only the tabs whose revision differs from their cached copy, so
+// reconnecting to a large document transfers little more than the manifest.
+
+// manifestTab describes a tab in the init of manifest clients
+type manifestTab struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Notes    string `json:"notes"`
+	Kind     string `json:"kind,omitempty"`
+	Runtime  string `json:"runtime,omitempty"`
+	Revision string `json:"revision"` // storage.ContentRevision of the content
+	Size     int    `json:"size"`     // of the content in bytes
+}
+
+// tabManifest lists the tabs with the revisions of their contents in place of the contents
+// Note: Caller must hold doc.mu
+func (doc *Document) tabManifest() []manifestTab {
+	manifest := make([]manifestTab, len(doc.Tabs))
+	for i, tab := range doc.Tabs {
+		manifest[i] = manifestTab{
+			ID:       tab.ID,
+			Name:     tab.Name,
+			Notes:    tab.Notes,
+			Kind:     tab.Kind,
+			Runtime:  tab.Runtime,
+			Revision: storage.ContentRevision(tab.Content),
+			Size:     len(tab.Content),
+		}
+	}
+	return manifest
+}
+
+// tabListUpdate builds the tabUpdate broadcast for tabs renamed or deleted.
+// No content changed, so clients with the lazyTabs or manifest capability
+// get the manifest rather than every tab's content.
+// Note: Caller must hold doc.mu
+func (doc *Document) tabListUpdate() (BroadcastMessage, error) {
+	full, err := json.Marshal(map[string]interface{}{
+		"type":        "tabUpdate",
+		"tabs":        doc.Tabs,
+		"activeTabId": doc.ActiveTabId,
+	})
+	if err != nil {
+		return BroadcastMessage{}, err
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"type":        "tabUpdate",
+		"tabs":        doc.tabManifest(),
+		"activeTabId": doc.ActiveTabId,
+	})
+	if err != nil {
+		return BroadcastMessage{}, err
+	}
+	return BroadcastMessage{Message: full, Manifest: manifest}, nil
+}
+
+// lazyTabs returns the content sizes of the tabs whose content the client's
+// init leaves out, by tab ID. Manifest clients may hold any tab in their
+// cache and edit it right away, so none are deferred for them.
+// Note: Caller must hold doc.mu
+func (c *Client) lazyTabs() map[string]int {
+	threshold := c.doc.server.config.LazyTabSize
+	if threshold <= 0 || !c.has(capLazyTabs) || c.has(capManifest) {
+		return nil
+	}
+	var lazy map[string]int
+	for _, tab := range c.doc.Tabs {
+		if tab.ID == c.doc.ActiveTabId || len(tab.Content) < threshold {
+			continue
+		}
+		if lazy == nil {
+			lazy = make(map[string]int)
+		}
+		lazy[tab.ID] = len(tab.Content)
+	}
+	return lazy
+}
+
+// withoutContent returns a copy of tabs leaving out the content of those in lazy
+func withoutContent(tabs []Tab, lazy map[string]int) []Tab {
+	out := make([]Tab, len(tabs))
+	for i, tab := range tabs {
+		if _, ok := lazy[tab.ID]; ok {
+			tab.Content = ""
+		}
+		out[i] = tab
+	}
+	return out
+}
+
+// handleTabContentRequest sends the client the content of a tab, or of each
+// of the tabs in tabIds, typically ones its init left out
+func (c *Client) handleTabContentRequest(msg map[string]interface{}) {
+	var tabIds []string
+	if ids, ok := msg["tabIds"].([]interface{}); ok {
+		for _, id := range ids {
+			if tabId, ok := id.(string); ok {
+				tabIds = append(tabIds, tabId)
+			}
+		}
+	} else if tabId, ok := c.stringField(msg, "tabId"); ok {
+		tabIds = []string{tabId}
+	} else {
+		return
+	}
+	// Edits are broadcast in order while holding contentMu, so queuing the
+	// replies behind them through the hub lets the deltas that follow apply to them
+	c.doc.contentMu.Lock()
+	defer c.doc.contentMu.Unlock()
+	c.doc.mu.Lock()
+	replies := make([]map[string]interface{}, 0, len(tabIds))
+	missing := false
+	for _, tabId := range tabIds {
+		i := c.doc.findTab(tabId)
+		if i < 0 {
+			missing = true
+			continue
+		}
+		content := c.doc.Tabs[i].Content
+		c.rememberContent(tabId, content)
+		replies = append(replies, map[string]interface{}{
+			"type":      "tabContent",
+			"requestId": msg["requestId"],
+			"tabId":     tabId,
+			"content":   content,
+			"revision":  storage.ContentRevision(content),
+		})
+	}
+	c.doc.mu.Unlock()
+	if missing {
+		c.sendError(errTabNotFound)
+	}
+	for _, reply := range replies {
+		c.deliver(reply)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+func TestTabListUpdate(t *testing.T) {
+	doc := &Document{}
+	doc.Tabs = []Tab{{ID: "1", Name: "main.go", Content: "package main"}, {ID: "2", Name: "notes"}}
+	doc.ActiveTabId = "2"
+	update, err := doc.tabListUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var full struct {
+		Type        string `json:"type"`
+		Tabs        []Tab  `json:"tabs"`
+		ActiveTabID string `json:"activeTabId"`
+	}
+	if err := json.Unmarshal(update.Message, &full); err != nil {
+		t.Fatal(err)
+	}
+	if full.Type != "tabUpdate" || full.ActiveTabID != "2" || len(full.Tabs) != 2 || full.Tabs[0].Content != "package main" {
+		t.Errorf("unexpected full update %+v", full)
+	}
+
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(update.Manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	tabs, _ := manifest["tabs"].([]interface{})
+	if manifest["type"] != "tabUpdate" || manifest["activeTabId"] != "2" || len(tabs) != 2 {
+		t.Fatalf("unexpected manifest update %v", manifest)
+	}
+	first, _ := tabs[0].(map[string]interface{})
+	if _, ok := first["content"]; ok {
+		t.Error("manifest update carries tab content")
+	}
+	if first["revision"] != storage.ContentRevision("package main") || first["size"] != float64(len("package main")) {
+		t.Errorf("unexpected manifest entry %v", first)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// softLimitWarnings counts documents crossing the soft threshold of a limit
+var softLimitWarnings = metrics.NewCounter("gopad_soft_limit_warnings_total", "Number of times a document approached a size limit, by limit")
+
+// size returns the number of bytes a tab contributes to the document size
+func (t Tab) size() int {
+	return len(t.Name) + len(t.Content) + len(t.Notes)
+}
+
+// totalSize returns the size of all tabs in bytes
+// Note: Caller must hold doc.mu
+func (doc *Document) totalSize() int {
+	total := 0
+	for _, tab := range doc.Tabs {
+		total += tab.size()
+	}
+	return total
+}
+
+// usage reports the document's size against the configured limits
+// Note: Caller must hold doc.mu
+func (doc *Document) usage() map[string]interface{} {
+	maxTabs, maxTabSize, maxDocSize := doc.limits()
+	return map[string]interface{}{
+		"tabs":       len(doc.Tabs),
+		"bytes":      doc.totalSize(),
+		"maxTabs":    maxTabs,
+		"maxTabSize": maxTabSize,
+		"maxDocSize": maxDocSize,
+	}
+}
+
+// checkTabChange verifies that replacing the tab at index i (or adding a tab when i is -1)
+// with tab keeps the document within its limits, including those of its
+// workspace policy. Zero limits are unlimited.
+// Note: Caller must hold doc.mu
+func (doc *Document) checkTabChange(i int, tab Tab) error {
+	maxTabs, maxTabSize, maxDocSize := doc.limits()
+	if maxTabSize > 0 && len(tab.Content) > maxTabSize {
+		return apperr.Newf(apperr.CodeLimitExceeded, "tab content exceeds the %d byte limit", maxTabSize)
+	}
+	size := doc.totalSize() + tab.size()
+	if i >= 0 {
+		size -= doc.Tabs[i].size()
+	} else if maxTabs > 0 && len(doc.Tabs) >= maxTabs {
+		return apperr.Newf(apperr.CodeLimitExceeded, "documents are limited to %d tabs", maxTabs)
+	}
+	if maxDocSize > 0 && size > maxDocSize {
+		return apperr.Newf(apperr.CodeLimitExceeded, "document exceeds the %d byte limit", maxDocSize)
+	}
+	if err := doc.validateTab(tab); err != nil {
+		return err
+	}
+	return doc.blockSecrets(tab)
+}
+
+// softLimit is a limit a document is being warned about
+type softLimit struct {
+	limit string // maxTabs, maxTabSize or maxDocSize, as in usage
+	tabId string // for maxTabSize
+}
+
+// checkSoftLimits warns every client when the document crosses
+// SoftLimitRatio of one of its limits, and tells them once it drops back
+// below, so rooms can clean up before changes are rejected
+func (doc *Document) checkSoftLimits() {
+	ratio := doc.server.config.SoftLimitRatio
+	if ratio <= 0 {
+		return
+	}
+	doc.mu.Lock()
+	maxTabs, maxTabSize, maxDocSize := doc.limits()
+	over := make(map[softLimit]int)
+	if maxTabs > 0 && float64(len(doc.Tabs)) >= ratio*float64(maxTabs) {
+		over[softLimit{limit: "maxTabs"}] = len(doc.Tabs)
+	}
+	if size := doc.totalSize(); maxDocSize > 0 && float64(size) >= ratio*float64(maxDocSize) {
+		over[softLimit{limit: "maxDocSize"}] = size
+	}
+	if maxTabSize > 0 {
+		for _, tab := range doc.Tabs {
+			if float64(len(tab.Content)) >= ratio*float64(maxTabSize) {
+				over[softLimit{limit: "maxTabSize", tabId: tab.ID}] = len(tab.Content)
+			}
+		}
+	}
+	limits := map[string]int{"maxTabs": maxTabs, "maxTabSize": maxTabSize, "maxDocSize": maxDocSize}
+	var msgs []map[string]interface{}
+	for sl, used := range over {
+		if doc.softLimits[sl] {
+			continue
+		}
+		doc.softLimits[sl] = true
+		softLimitWarnings.Inc(metrics.Labels{"limit": sl.limit})
+		msg := map[string]interface{}{
+			"type":  "limitWarning",
+			"limit": sl.limit,
+			"used":  used,
+			"max":   limits[sl.limit],
+		}
+		if sl.tabId != "" {
+			msg["tabId"] = sl.tabId
+		}
+		msgs = append(msgs, msg)
+	}
+	for sl := range doc.softLimits {
+		if _, ok := over[sl]; ok {
+			continue
+		}
+		delete(doc.softLimits, sl)
+		// Deleted tabs don't need clearing
+		if sl.tabId != "" && doc.findTab(sl.tabId) < 0 {
+			continue
+		}
+		msg := map[string]interface{}{
+			"type":    "limitWarning",
+			"limit":   sl.limit,
+			"cleared": true,
+		}
+		if sl.tabId != "" {
+			msg["tabId"] = sl.tabId
+		}
+		msgs = append(msgs, msg)
+	}
+	doc.mu.Unlock()
+	if len(msgs) > 0 {
+		doc.broadcastChanges(msgs)
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/moderation"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// lockTokenHeader carries the lease token on writes made by a lock holder
+const lockTokenHeader = "X-Lock-Token"
+
+// lockView is a lock as shown to clients, without its token
+type lockView struct {
+	TabID   string `json:"tabId,omitempty"`
+	Owner   string `json:"owner"`
+	Expires int64  `json:"expires"`
+}
+
+// lockViews returns the live locks without their tokens
+func lockViews(locks []storage.Lock) []lockView {
+	now := time.Now()
+	views := []lockView{}
+	for _, l := range locks {
+		if l.Live(now) {
+			views = append(views, lockView{TabID: l.TabID, Owner: l.Owner, Expires: l.Expires})
+		}
+	}
+	return views
+}
+
+// checkLock returns a DOC_LOCKED error when a lease held by someone other than
+// token covers the tab. An empty tabId checks only document-wide locks.
+// Note: Caller must hold doc.mu
+func (doc *Document) checkLock(tabId, token string) error {
+	now := time.Now()
+	for _, l := range doc.locks {
+		if !l.Live(now) || !l.Covers(tabId) || (token != "" && l.Token == token) {
+			continue
+		}
+		if l.TabID == "" {
+			return apperr.Newf(apperr.CodeDocLocked, "document is locked by %s", l.Owner)
+		}
+		return apperr.Newf(apperr.CodeDocLocked, "tab is locked by %s", l.Owner)
+	}
+	return nil
+}
+
+// applyLocks replaces the document's leases and tells clients which tabs are locked
+func (doc *Document) applyLocks(locks []storage.Lock) {
+	doc.mu.Lock()
+	doc.locks = locks
+	views := lockViews(locks)
+	doc.mu.Unlock()
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":  "lockUpdate",
+		"locks": views,
+	})
+	if err != nil {
+		logger.Debug("Error marshaling lockUpdate message", "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
+
+// refreshLocks reloads the leases of a document loaded on this instance, so a
+// holder's next write doesn't race the pub/sub notification
+func (s *Server) refreshLocks(c *gin.Context, docID string) {
+	s.mu.RLock()
+	doc, ok := s.documents[docID]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+	locks, err := s.store.Locks(c.Request.Context(), docID)
+	if err != nil {
+		requestLog(c).Error("Error loading locks", "doc_id", docID, "error", err)
+		return
+	}
+	doc.applyLocks(locks)
+}
+
+// lockRequest acquires or renews a lease on a document or one of its tabs
+type lockRequest struct {
+	TabID string `json:"tabId"` // empty locks the whole document
+	Owner string `json:"owner"`
+	TTL   string `json:"ttl"`   // lease duration, e.g. "5m"
+	Token string `json:"token"` // set to renew a lease already held
+}
+
+// handleAcquireLock grants an edit lease; human edits covered by it are rejected until
+// it is released or expires
+func (s *Server) handleAcquireLock(c *gin.Context) {
+	docID := c.Param("id")
+	var req lockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	if req.Owner == "" {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "owner is required"))
+		return
+	}
+	ttl := 5 * time.Minute
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			abortWithError(c, apperr.New(apperr.CodeValidation, "invalid ttl"))
+			return
+		}
+		ttl = d
+	}
+	lock := &storage.Lock{TabID: req.TabID, Owner: req.Owner, Token: req.Token}
+	if lock.Token == "" {
+		lock.Token = newID()
+	}
+	if err := s.store.AcquireLock(c.Request.Context(), docID, lock, ttl); err != nil {
+		var conflict *storage.LockConflictError
+		if errors.As(err, &conflict) {
+			c.AbortWithStatusJSON(http.StatusLocked, gin.H{
+				"error":     s.messages.Translate(c.GetString(localeKey), "already locked by %s", conflict.Held.Owner),
+				"code":      apperr.CodeDocLocked,
+				"requestId": c.GetString(requestIDKey),
+				"lock":      lockView{TabID: conflict.Held.TabID, Owner: conflict.Held.Owner, Expires: conflict.Held.Expires},
+			})
+			return
+		}
+		requestLog(c).Error("Error acquiring lock", "doc_id", docID, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	s.refreshLocks(c, docID)
+	requestLog(c).Info("Lock acquired", "doc_id", docID, "tab_id", lock.TabID, "owner", lock.Owner, "ttl", ttl)
+	c.JSON(http.StatusOK, lock)
+}
+
+// handleReleaseLock drops a lease before it expires
+func (s *Server) handleReleaseLock(c *gin.Context) {
+	docID := c.Param("id")
+	if err := s.store.ReleaseLock(c.Request.Context(), docID, c.Query("tab"), c.Param("token")); err != nil {
+		if apperr.CodeOf(err) == apperr.CodeInternal {
+			requestLog(c).Error("Error releasing lock", "doc_id", docID, "error", err)
+		}
+		abortWithError(c, err)
+		return
+	}
+	s.refreshLocks(c, docID)
+	requestLog(c).Info("Lock released", "doc_id", docID, "tab_id", c.Query("tab"))
+	c.Status(http.StatusNoContent)
+}
+
+// handleListLocks reports a document's live leases
+func (s *Server) handleListLocks(c *gin.Context) {
+	locks, err := s.store.Locks(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"locks": lockViews(locks)})
+}
+
+// handleWriteTab replaces a tab's content on behalf of a lock holder, who proves
+// ownership of the lease with the X-Lock-Token header
+func (s *Server) handleWriteTab(c *gin.Context) {
+	docID, tabId := c.Param("id"), c.Param("tabId")
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(s.config.MaxDocSize)+1))
+	if err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	content, err := s.moderate(c.Request.Context(), requestLog(c), moderation.Request{
+		Kind:       moderation.KindContent,
+		DocumentID: docID,
+		TabID:      tabId,
+		Text:       string(body),
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	doc, err := s.getOrCreateDocument(c.Request.Context(), docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := doc.setTabContent(c.Request.Context(), tabId, content, c.GetHeader(lockTokenHeader), nil); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/lsp"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+)
+
+const (
+	// lspRequestTimeout bounds how long completion and hover requests may take
+	lspRequestTimeout = 5 * time.Second
+	// lspSyncDelay batches edits before they're sent to the language server
+	lspSyncDelay = 300 * time.Millisecond
+)
+
+var errLSPUnavailable = apperr.New(apperr.CodeValidation, "language features are not available for this language")
+
+// lspFile is a tab as the language server last saw it
+type lspFile struct {
+	uri     string
+	version int
+	content string
+}
+
+// lspSession is the language server of a document and the tabs it was sent
+type lspSession struct {
+	client   *lsp.Client
+	language string
+	changed  chan struct{} // signals edits to send, buffered so signalling never blocks
+
+	mu    sync.Mutex // serializes syncs
+	files map[string]*lspFile
+}
+
+// languageServer returns the language server for the document's language,
+// starting it on first use and replacing one started for another language
+func (doc *Document) languageServer() (*lspSession, error) {
+	doc.mu.RLock()
+	language := doc.Language
+	doc.mu.RUnlock()
+	command, ok := doc.server.config.LSPCommands[language]
+	if !ok {
+		return nil, errLSPUnavailable
+	}
+	if err := doc.checkFeature(policy.FeatureExecution); err != nil {
+		return nil, err
+	}
+
+	doc.lspMu.Lock()
+	defer doc.lspMu.Unlock()
+	if ls := doc.lsp.Load(); ls != nil {
+		if ls.language == language {
+			return ls, nil
+		}
+		doc.lsp.Store(nil)
+		go ls.client.Close()
+	}
+	ls := &lspSession{
+		language: language,
+		changed:  make(chan struct{}, 1),
+		files:    make(map[string]*lspFile),
+	}
+	client, err := lsp.Start(doc.ctx, command, func(uri string, diagnostics json.RawMessage) {
+		doc.publishDiagnostics(ls, uri, diagnostics)
+	})
+	if err != nil {
+		logger.Error("Error starting language server", "doc_id", doc.ID, "language", language, "error", err)
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to start the language server")
+	}
+	ls.client = client
+	doc.lsp.Store(ls)
+	logger.Info("Language server started", "doc_id", doc.ID, "language", language)
+
+	go func() {
+		for {
+			select {
+			case <-client.Done():
+				doc.lsp.CompareAndSwap(ls, nil)
+				logger.Info("Language server exited", "doc_id", doc.ID, "language", language)
+				return
+			case <-ls.changed:
+				// Send a burst of edits at once
+				select {
+				case <-time.After(lspSyncDelay):
+				case <-client.Done():
+					continue
+				}
+				doc.syncLanguageServer(ls)
+			}
+		}
+	}()
+	doc.syncLanguageServer(ls)
+	return ls, nil
+}
+
+// syncLanguageServer sends the language server the editor tabs that changed
+// since it last saw them, and closes the ones that were deleted
+func (doc *Document) syncLanguageServer(ls *lspSession) {
+	doc.mu.RLock()
+	tabs := make(map[string]string, len(doc.Tabs))
+	for _, tab := range doc.Tabs {
+		if tab.Kind == "" {
+			tabs[tab.ID] = tab.Content
+		}
+	}
+	doc.mu.RUnlock()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var err error
+	for tabId, content := range tabs {
+		file, ok := ls.files[tabId]
+		switch {
+		case !ok:
+			name := tabId
+			if ext := suggest.Extension(ls.language); ext != "" {
+				name += "." + ext
+			}
+			file = &lspFile{uri: ls.client.URI(name), version: 1, content: content}
+			ls.files[tabId] = file
+			err = ls.client.Open(file.uri, lsp.LanguageID(ls.language), file.version, content)
+		case file.content != content:
+			file.version++
+			file.content = content
+			err = ls.client.Change(file.uri, file.version, content)
+		}
+		if err != nil {
+			break
+		}
+	}
+	for tabId, file := range ls.files {
+		if _, ok := tabs[tabId]; !ok && err == nil {
+			delete(ls.files, tabId)
+			err = ls.client.CloseFile(file.uri)
+		}
+	}
+	if err != nil {
+		logger.Debug("Error syncing language server", "doc_id", doc.ID, "error", err)
+	}
+}
+
+// lspChanged lets a running language server know the document was edited
+func (doc *Document) lspChanged() {
+	ls := doc.lsp.Load()
+	if ls == nil {
+		return
+	}
+	select {
+	case ls.changed <- struct{}{}:
+	default:
+	}
+}
+
+// publishDiagnostics shares the diagnostics of a tab with every client
+func (doc *Document) publishDiagnostics(ls *lspSession, uri string, diagnostics json.RawMessage) {
+	ls.mu.Lock()
+	tabId := ""
+	for id, file := range ls.files {
+		if file.uri == uri {
+			tabId = id
+			break
+		}
+	}
+	ls.mu.Unlock()
+	if tabId == "" {
+		return
+	}
+	doc.broadcastChanges([]map[string]interface{}{{
+		"type":        "lspDiagnostics",
+		"tabId":       tabId,
+		"diagnostics": diagnostics,
+	}})
+}
+
+// stopLanguageServer shuts down the document's language server, if it is running
+func (doc *Document) stopLanguageServer() {
+	// Wait for a server being started, so it isn't left behind
+	doc.lspMu.Lock()
+	ls := doc.lsp.Swap(nil)
+	doc.lspMu.Unlock()
+	if ls != nil {
+		ls.client.Close()
+	}
+}
+
+// handleLSPRequest answers a completion or hover request for a position in a
+// tab. The result is passed on as the language server sent it.
+func (c *Client) handleLSPRequest(msgType string, msg map[string]interface{}) {
+	tabId, ok := c.stringField(msg, "tabId")
+	if !ok {
+		return
+	}
+	line, _ := msg["line"].(float64)
+	character, _ := msg["character"].(float64)
+	requestId := msg["requestId"]
+	pos := lsp.Position{Line: int(line), Character: int(character)}
+
+	c.doc.mu.RLock()
+	i := c.doc.findTab(tabId)
+	var tab Tab
+	if i >= 0 {
+		tab = c.doc.Tabs[i]
+	}
+	c.doc.mu.RUnlock()
+	if i < 0 {
+		c.sendError(errTabNotFound)
+		return
+	}
+	if tab.Kind != "" {
+		c.sendError(apperr.New(apperr.CodeInvalidTab, "only editor tabs have language features"))
+		return
+	}
+
+	// Language servers can take seconds to start and answer; don't hold up this
+	// client's other messages
+	go func() {
+		ls, err := c.doc.languageServer()
+		if err != nil {
+			c.deliver(c.errorMessage(err))
+			return
+		}
+		// Answer from the content as it is now
+		c.doc.syncLanguageServer(ls)
+		ls.mu.Lock()
+		file, ok := ls.files[tabId]
+		ls.mu.Unlock()
+		if !ok {
+			// Deleted in the meantime
+			c.deliver(c.errorMessage(errTabNotFound))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.doc.ctx, lspRequestTimeout)
+		defer cancel()
+		var result json.RawMessage
+		if msgType == "lspHover" {
+			result, err = ls.client.Hover(ctx, file.uri, pos)
+		} else {
+			result, err = ls.client.Completion(ctx, file.uri, pos)
+		}
+		if err != nil {
+			c.log.Debug("Language server request failed", "msg_type", msgType, "error", err)
+			c.deliver(c.errorMessage(apperr.Wrap(apperr.CodeInternal, err, "the language server didn't answer")))
+			return
+		}
+		if result == nil {
+			result = json.RawMessage("null")
+		}
+		c.deliver(map[string]interface{}{
+			"type":      msgType,
+			"requestId": requestId,
+			"tabId":     tabId,
+			"result":    result,
+		})
+	}()
+}
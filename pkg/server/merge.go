@@ -0,0 +1,363 @@
+package server
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/shiftregister-vg/gopad/pkg/ot"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// mergeStates performs a three-way merge of local changes onto remote, using
+// base as the common ancestor. Where both sides changed the same tab, edits to
+// separate parts of its content or notes are combined; where they overlap the
+// local version wins, since it holds the edits of clients connected here, and
+// the tab is returned among the conflicts.
+// The result carries remote's version so it can be saved on top of it.
+func mergeStates(base, local, remote *storage.DocumentState) (*storage.DocumentState, []string) {
+	if base == nil {
+		base = &storage.DocumentState{}
+	}
+	baseTabs := tabsByID(base.Tabs)
+	localTabs := tabsByID(local.Tabs)
+
+	merged := *remote
+	merged.Tabs = nil
+	var conflicts []string
+	seen := make(map[string]bool)
+	for _, remoteTab := range remote.Tabs {
+		seen[remoteTab.ID] = true
+		baseTab, inBase := baseTabs[remoteTab.ID]
+		localTab, inLocal := localTabs[remoteTab.ID]
+		switch {
+		case inBase && !inLocal:
+			// Deleted locally; keep it only if the remote side edited it since
+			if remoteTab != baseTab {
+				merged.Tabs = append(merged.Tabs, remoteTab)
+			}
+		case inLocal && (!inBase || localTab != baseTab):
+			if remoteTab == baseTab && inBase {
+				merged.Tabs = append(merged.Tabs, localTab)
+				break
+			}
+			// Changed on both sides
+			tab, ok := mergeTab(baseTab, localTab, remoteTab)
+			if !ok {
+				conflicts = append(conflicts, tab.ID)
+			}
+			merged.Tabs = append(merged.Tabs, tab)
+		default:
+			merged.Tabs = append(merged.Tabs, remoteTab)
+		}
+	}
+	for _, localTab := range local.Tabs {
+		if seen[localTab.ID] {
+			continue
+		}
+		// Tabs created locally are kept; tabs deleted remotely are dropped unless edited locally
+		if baseTab, inBase := baseTabs[localTab.ID]; !inBase || localTab != baseTab {
+			merged.Tabs = append(merged.Tabs, localTab)
+		}
+	}
+
+	if local.Language != base.Language {
+		merged.Language = local.Language
+	}
+	if local.Content != base.Content {
+		merged.Content = local.Content
+	}
+	if local.ActiveTabId != base.ActiveTabId {
+		merged.ActiveTabId = local.ActiveTabId
+	}
+	if local.Workspace != base.Workspace {
+		merged.Workspace = local.Workspace
+	}
+	if local.Title != base.Title {
+		merged.Title = local.Title
+	}
+	if local.Pinned != base.Pinned {
+		merged.Pinned = local.Pinned
+	}
+	if !reflect.DeepEqual(local.Settings, base.Settings) {
+		merged.Settings = local.Settings
+	}
+	merged.Outputs = mergeOutputs(local.Outputs, remote.Outputs)
+	merged.Expiry = local.Expiry
+	merged.Users = make(map[string]string)
+	for uuid, name := range remote.Users {
+		merged.Users[uuid] = name
+	}
+	for uuid, name := range local.Users {
+		merged.Users[uuid] = name
+	}
+	return &merged, conflicts
+}
+
+// mergeTab combines the changes both sides made to a tab, preferring local
+// ones for its name and kind. It reports false if the content or notes were
+// edited in overlapping places, in which case the local text is kept.
+func mergeTab(base, local, remote storage.Tab) (storage.Tab, bool) {
+	merged := remote
+	if local.Name != base.Name {
+		merged.Name = local.Name
+	}
+	if local.Kind != base.Kind || local.Runtime != base.Runtime {
+		merged.Kind, merged.Runtime = local.Kind, local.Runtime
+	}
+	content, contentOK := mergeText(base.Content, local.Content, remote.Content)
+	notes, notesOK := mergeText(base.Notes, local.Notes, remote.Notes)
+	merged.Content, merged.Notes = content, notes
+	return merged, contentOK && notesOK
+}
+
+// mergeText applies the edits local and remote each made to base. Each side's
+// edits are taken as the single region between the common prefix and suffix
+// it shares with base; regions that don't overlap are both applied. Otherwise
+// local is returned along with false.
+func mergeText(base, local, remote string) (string, bool) {
+	if local == base || local == remote {
+		return remote, true
+	}
+	if remote == base {
+		return local, true
+	}
+	first, second := editRegion(base, local), editRegion(base, remote)
+	if second.start < first.start || (second.start == first.start && second.end < first.end) {
+		first, second = second, first
+	}
+	// Inserts at the same place would have to be ordered arbitrarily
+	sameInsert := first.start == first.end && second.start == second.end && first.start == second.start
+	if first.end > second.start || sameInsert {
+		return local, false
+	}
+	return base[:first.start] + first.text + base[first.end:second.start] + second.text + base[second.end:], true
+}
+
+// textRegion is the part of a base text replaced by an edit
+type textRegion struct {
+	start, end int // byte range in the base text
+	text       string
+}
+
+// editRegion returns the region of base that edited replaces
+func editRegion(base, edited string) textRegion {
+	var region textRegion
+	ops := ot.Diff(base, edited)
+	if len(ops) > 0 {
+		region.start, region.end = ops[0].Position, ops[0].Position
+	}
+	for _, op := range ops {
+		if op.Type == "delete" {
+			region.end = op.Position + op.Length
+		} else {
+			region.text = op.Text
+		}
+	}
+	return region
+}
+
+// maxMergeBytes bounds the size of the texts mergeLines diffs, and
+// mergeTimeout how long it diffs each side; merges beyond either are treated
+// as conflicts, keeping merges of huge or very stale edits from taking long
+const (
+	maxMergeBytes = 1 << 20
+	mergeTimeout  = 100 * time.Millisecond
+)
+
+// mergeLines applies the edits local and remote each made to base line by
+// line, so edits to different lines interleave. Lines both sides changed the
+// same way are taken once, and lines both inserted at the same place are kept
+// remote's first. If the sides changed the same lines differently, or the
+// texts are too large to diff, local is returned along with false.
+func mergeLines(base, local, remote string) (string, bool) {
+	if local == base || local == remote {
+		return remote, true
+	}
+	if remote == base {
+		return local, true
+	}
+	if len(base)+len(local)+len(remote) > maxMergeBytes {
+		return local, false
+	}
+	baseLines := splitLines(base)
+	localHunks, remoteHunks := diffLines(base, local), diffLines(base, remote)
+	var merged strings.Builder
+	pos := 0
+	emit := func(h lineHunk) {
+		merged.WriteString(strings.Join(baseLines[pos:h.start], ""))
+		merged.WriteString(strings.Join(h.lines, ""))
+		pos = h.end
+	}
+	for len(localHunks) > 0 || len(remoteHunks) > 0 {
+		switch {
+		case len(localHunks) == 0:
+			emit(remoteHunks[0])
+			remoteHunks = remoteHunks[1:]
+		case len(remoteHunks) == 0:
+			emit(localHunks[0])
+			localHunks = localHunks[1:]
+		default:
+			l, r := localHunks[0], remoteHunks[0]
+			switch {
+			case l.start == r.start && l.end == r.end && slices.Equal(l.lines, r.lines):
+				emit(r)
+				localHunks, remoteHunks = localHunks[1:], remoteHunks[1:]
+			case l.start < r.end && r.start < l.end:
+				return local, false
+			case r.start < l.start || (r.start == l.start && r.start == r.end):
+				// At the same line, insertions go before replacements
+				emit(r)
+				remoteHunks = remoteHunks[1:]
+			default:
+				emit(l)
+				localHunks = localHunks[1:]
+			}
+		}
+	}
+	merged.WriteString(strings.Join(baseLines[pos:], ""))
+	return merged.String(), true
+}
+
+// lineHunk is a run of base lines an edit replaced
+type lineHunk struct {
+	start, end int // line range in base
+	lines      []string
+}
+
+// diffLines returns the hunks that turn base into edited, diffed line by line
+// with diff-match-patch. Diffs that run out of mergeTimeout are coarser but
+// still turn base into edited.
+func diffLines(base, edited string) []lineHunk {
+	dmp := diffmatchpatch.New()
+	dmp.DiffTimeout = mergeTimeout
+	a, b, lines := dmp.DiffLinesToChars(base, edited)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lines)
+
+	var hunks []lineHunk
+	var hunk *lineHunk
+	pos := 0
+	for _, diff := range diffs {
+		changed := splitLines(diff.Text)
+		if diff.Type == diffmatchpatch.DiffEqual {
+			if hunk != nil {
+				hunks = append(hunks, *hunk)
+				hunk = nil
+			}
+			pos += len(changed)
+			continue
+		}
+		if hunk == nil {
+			hunk = &lineHunk{start: pos, end: pos}
+		}
+		if diff.Type == diffmatchpatch.DiffDelete {
+			pos += len(changed)
+			hunk.end = pos
+		} else {
+			hunk.lines = append(hunk.lines, changed...)
+		}
+	}
+	if hunk != nil {
+		hunks = append(hunks, *hunk)
+	}
+	return hunks
+}
+
+// splitLines splits text after each newline, leaving no empty last line
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// mergeOutputs keeps the output of the latest run of each tab from either side
+func mergeOutputs(local, remote map[string]*storage.RunOutput) map[string]*storage.RunOutput {
+	if len(local) == 0 {
+		return remote
+	}
+	merged := maps.Clone(remote)
+	if merged == nil {
+		merged = make(map[string]*storage.RunOutput, len(local))
+	}
+	for tabID, output := range local {
+		if theirs, ok := merged[tabID]; !ok || output.Finished > theirs.Finished {
+			merged[tabID] = output
+		}
+	}
+	return merged
+}
+
+func tabsByID(tabs []storage.Tab) map[string]storage.Tab {
+	byID := make(map[string]storage.Tab, len(tabs))
+	for _, t := range tabs {
+		byID[t.ID] = t
+	}
+	return byID
+}
+
+// stateChanges builds the messages that bring clients from one in-memory state to
+// another: tab list changes (added, removed, reordered or renamed tabs) go out as a
+// single tabUpdate, while content, notes, focus, language and title changes are
+// sent as targeted messages so untouched tabs aren't re-rendered.
+// Note: Caller must hold after.mu
+func stateChanges(beforeTabs []Tab, beforeActive, beforeLanguage, beforeTitle string, after *Document) []map[string]interface{} {
+	var msgs []map[string]interface{}
+	if !sameTabList(beforeTabs, after.Tabs) {
+		msgs = append(msgs, map[string]interface{}{
+			"type":        "tabUpdate",
+			"tabs":        after.Tabs,
+			"activeTabId": after.ActiveTabId,
+		})
+	} else {
+		for i, tab := range after.Tabs {
+			if tab.Content != beforeTabs[i].Content {
+				msgs = append(msgs, map[string]interface{}{
+					"type":    "update",
+					"tabId":   tab.ID,
+					"content": tab.Content,
+				})
+			}
+			if tab.Notes != beforeTabs[i].Notes {
+				msgs = append(msgs, map[string]interface{}{
+					"type":  "tabNotesUpdate",
+					"tabId": tab.ID,
+					"notes": tab.Notes,
+				})
+			}
+		}
+		if after.ActiveTabId != beforeActive {
+			msgs = append(msgs, map[string]interface{}{
+				"type":  "tabFocus",
+				"tabId": after.ActiveTabId,
+			})
+		}
+	}
+	if after.Language != beforeLanguage {
+		msgs = append(msgs, map[string]interface{}{
+			"type":     "language",
+			"language": after.Language,
+		})
+	}
+	if after.displayTitle() != beforeTitle {
+		msgs = append(msgs, after.titleMessage())
+	}
+	return msgs
+}
+
+// sameTabList reports whether two tab lists have the same tabs, in the same order, with the same names
+func sameTabList(a, b []Tab) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Name != b[i].Name {
+			return false
+		}
+	}
+	return true
+}
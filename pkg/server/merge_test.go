@@ -0,0 +1,123 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+func TestMergeLines(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\n"
+	tests := []struct {
+		name, local, remote, want string
+		ok                        bool
+	}{
+		{"only local changed", "one\n2\nthree\nfour\n", base, "one\n2\nthree\nfour\n", true},
+		{"only remote changed", base, "one\ntwo\n3\nfour\n", "one\ntwo\n3\nfour\n", true},
+		{"separate lines", "ONE\ntwo\nthree\nfour\n", "one\ntwo\nthree\nFOUR\n", "ONE\ntwo\nthree\nFOUR\n", true},
+		{"adjacent lines", "one\nTWO\nthree\nfour\n", "one\ntwo\nTHREE\nfour\n", "one\nTWO\nTHREE\nfour\n", true},
+		{"same change on both sides", "one\n2\nthree\nfour\n", "one\n2\nthree\nfour\n", "one\n2\nthree\nfour\n", true},
+		{"insert and delete elsewhere", "zero\none\ntwo\nthree\nfour\n", "one\ntwo\nthree\n", "zero\none\ntwo\nthree\n", true},
+		{"inserts at the same place", "one\nlocal\ntwo\nthree\nfour\n", "one\nremote\ntwo\nthree\nfour\n", "one\nremote\nlocal\ntwo\nthree\nfour\n", true},
+		{"overlapping changes", "one\nlocal\nthree\nfour\n", "one\nremote\nthree\nfour\n", "one\nlocal\nthree\nfour\n", false},
+		{"overlapping deletion", "one\nfour\n", "one\ntwo\nTHREE\nfour\n", "one\nfour\n", false},
+		{"no trailing newline", "one\ntwo\nthree\nfour", "ONE\ntwo\nthree\nfour\n", "ONE\ntwo\nthree\nfour", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := mergeLines(base, tt.local, tt.remote)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("mergeLines = %q, %v; want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMergeLinesRefusesLargeTexts(t *testing.T) {
+	base := strings.Repeat("line\n", maxMergeBytes/10)
+	local, remote := "first\n"+base, base+"last\n"
+	got, ok := mergeLines(base, local, remote)
+	if ok || got != local {
+		t.Fatalf("expected a conflict keeping local, got %v", ok)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name, base, edited string
+		want               []lineHunk
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", nil},
+		{"replaced line", "a\nb\nc\n", "a\nB\nc\n", []lineHunk{{1, 2, []string{"B\n"}}}},
+		{"inserted line", "a\nc\n", "a\nb\nc\n", []lineHunk{{1, 1, []string{"b\n"}}}},
+		{"deleted lines", "a\nb\nc\nd\n", "a\nd\n", []lineHunk{{1, 3, nil}}},
+		{"two hunks", "a\nb\nc\nd\n", "A\nb\nc\nD\n", []lineHunk{{0, 1, []string{"A\n"}}, {3, 4, []string{"D\n"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffLines(tt.base, tt.edited)
+			if !slices.EqualFunc(got, tt.want, func(a, b lineHunk) bool {
+				return a.start == b.start && a.end == b.end && slices.Equal(a.lines, b.lines)
+			}) {
+				t.Errorf("diffLines = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeText(t *testing.T) {
+	tests := []struct {
+		name, base, local, remote, want string
+		ok                              bool
+	}{
+		{"separate edits", "hello world", "hello, world", "hello world!", "hello, world!", true},
+		{"overlapping edits", "hello world", "hello there", "hello you", "hello there", false},
+		{"inserts at the same place", "ab", "aXb", "aYb", "aXb", false},
+		{"remote unchanged", "ab", "abc", "ab", "abc", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := mergeText(tt.base, tt.local, tt.remote)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("mergeText = %q, %v; want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMergeStates(t *testing.T) {
+	base := &storage.DocumentState{Tabs: []storage.Tab{
+		{ID: "1", Name: "a", Content: "one\ntwo\n"},
+		{ID: "2", Name: "b", Content: "x"},
+		{ID: "3", Name: "c", Content: "y"},
+	}}
+	local := &storage.DocumentState{Tabs: []storage.Tab{
+		{ID: "1", Name: "a", Content: "ONE\ntwo\n"},
+		{ID: "3", Name: "c", Content: "y"},
+		{ID: "4", Name: "new", Content: "z"},
+	}}
+	remote := &storage.DocumentState{Version: 7, Tabs: []storage.Tab{
+		{ID: "1", Name: "a", Content: "one\ntwo!\n"},
+		{ID: "2", Name: "b", Content: "x"},
+	}}
+	merged, conflicts := mergeStates(base, local, remote)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+	if merged.Version != 7 {
+		t.Errorf("expected remote's version, got %d", merged.Version)
+	}
+	var ids []string
+	for _, tab := range merged.Tabs {
+		ids = append(ids, tab.ID)
+	}
+	// 2 was deleted locally, 3 remotely, and 4 was created locally
+	if !slices.Equal(ids, []string{"1", "4"}) {
+		t.Fatalf("expected tabs 1 and 4, got %v", ids)
+	}
+	if merged.Tabs[0].Content != "ONE\ntwo!\n" {
+		t.Errorf("expected both edits of tab 1, got %q", merged.Tabs[0].Content)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/mirror"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// errMirrorDisabled is returned by the mirror endpoints when no target is configured
+var errMirrorDisabled = apperr.New(apperr.CodeValidation, "mirroring is not configured")
+
+// mirrorTargets returns the targets configured for the static mirror
+func mirrorTargets(config Config) []mirror.Target {
+	var targets []mirror.Target
+	if config.MirrorDir != "" {
+		targets = append(targets, mirror.NewDir(config.MirrorDir))
+	}
+	if config.MirrorS3.Bucket != "" {
+		targets = append(targets, mirror.NewS3(config.MirrorS3))
+	}
+	return targets
+}
+
+// publishMirror queues a mirrored document's page for publishing, or for
+// removal once the document has become private
+func (s *Server) publishMirror(ctx context.Context, docID string, state *storage.DocumentState) {
+	settings, err := s.stateSettings(ctx, state)
+	if err != nil {
+		logger.Error("Error resolving settings of mirrored document", "doc_id", docID, "error", err)
+		return
+	}
+	if settings.Visibility == policy.VisibilityPrivate {
+		s.mirror.Remove(docID)
+		return
+	}
+	export := NewExport(docID, state, s.sanitizer)
+	s.mirror.Publish(&mirror.Page{
+		ID:           docID,
+		Title:        export.Title,
+		Language:     export.Language,
+		Tabs:         export.Tabs,
+		LastModified: time.UnixMilli(export.LastModified),
+	})
+}
+
+// mirrorSaved publishes a document's page after it's saved, if the document is
+// mirrored and pages aren't published on a schedule instead
+func (s *Server) mirrorSaved(ctx context.Context, docID string, state *storage.DocumentState) {
+	if s.mirror == nil || s.config.MirrorInterval > 0 {
+		return
+	}
+	mirrored, err := s.store.IsMirrored(ctx, docID)
+	if err != nil {
+		logger.Error("Error checking whether document is mirrored", "doc_id", docID, "error", err)
+		return
+	}
+	if mirrored {
+		s.publishMirror(ctx, docID, state)
+	}
+}
+
+// unmirror takes a document out of the static mirror and removes its page
+func (s *Server) unmirror(ctx context.Context, docID string) error {
+	if s.mirror == nil {
+		return nil
+	}
+	if err := s.store.SetMirrored(ctx, docID, false); err != nil {
+		return err
+	}
+	s.mirror.Remove(docID)
+	return nil
+}
+
+// mirrorLoop publishes the pages of mirrored documents that changed since the
+// last round every interval, until the server shuts down
+func (s *Server) mirrorLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	published := make(map[string]int64) // doc ID -> last modified time of the published page
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.publishMirrored(published)
+		}
+	}
+}
+
+func (s *Server) publishMirrored(published map[string]int64) {
+	ids, err := s.store.MirroredDocuments(s.ctx)
+	if err != nil {
+		logger.Error("Error listing mirrored documents", "error", err)
+		return
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, docID := range ids {
+		seen[docID] = true
+		state, err := s.documentState(s.ctx, docID)
+		if errors.Is(err, storage.ErrNotFound) {
+			// The document expired or was deleted
+			if err := s.unmirror(s.ctx, docID); err != nil {
+				logger.Error("Error unmirroring deleted document", "doc_id", docID, "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			logger.Error("Error loading mirrored document", "doc_id", docID, "error", err)
+			continue
+		}
+		if published[docID] == state.LastModified && state.LastModified != 0 {
+			continue
+		}
+		published[docID] = state.LastModified
+		s.publishMirror(s.ctx, docID, state)
+	}
+	for docID := range published {
+		if !seen[docID] {
+			delete(published, docID)
+		}
+	}
+}
+
+// handleMirrorDocument adds a document to the static mirror and publishes it
+func (s *Server) handleMirrorDocument(c *gin.Context) {
+	if s.mirror == nil {
+		abortWithError(c, errMirrorDisabled)
+		return
+	}
+	ctx := c.Request.Context()
+	docID := c.Param("id")
+	state, err := s.documentState(ctx, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	settings, err := s.stateSettings(ctx, state)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if settings.Visibility == policy.VisibilityPrivate {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "private documents can't be mirrored"))
+		return
+	}
+	if err := s.store.SetMirrored(ctx, docID, true); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	s.publishMirror(ctx, docID, state)
+	requestLog(c).Info("Document mirrored", "doc_id", docID)
+	c.Status(http.StatusNoContent)
+}
+
+// handleUnmirrorDocument takes a document out of the static mirror, removing its page
+func (s *Server) handleUnmirrorDocument(c *gin.Context) {
+	if s.mirror == nil {
+		abortWithError(c, errMirrorDisabled)
+		return
+	}
+	docID := c.Param("id")
+	if err := s.unmirror(c.Request.Context(), docID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Document unmirrored", "doc_id", docID)
+	c.Status(http.StatusNoContent)
+}
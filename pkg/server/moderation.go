@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/moderation"
+)
+
+// Errors for text moderators rejected
+var (
+	errContentRejected = apperr.New(apperr.CodeForbidden, "content was rejected by moderation")
+	errNameRejected    = apperr.New(apperr.CodeForbidden, "name was rejected by moderation")
+)
+
+// moderate asks the moderators about text this client wrote, returning the
+// text to use, possibly redacted, or an error rejecting it
+func (c *Client) moderate(ctx context.Context, kind, tabId, text string) (string, error) {
+	if c.doc.server.moderator == nil {
+		return text, nil
+	}
+	return c.doc.server.moderate(ctx, c.log.With("client_uuid", c.uuid), moderation.Request{
+		Kind:       kind,
+		DocumentID: c.docID,
+		TabID:      tabId,
+		User:       c.name,
+		Text:       text,
+	})
+}
+
+// moderateTab moderates the content and notes of a tab this client adds,
+// replacing them with the text to use
+func (c *Client) moderateTab(ctx context.Context, tab *Tab) error {
+	if c.doc.server.moderator == nil {
+		return nil
+	}
+	return c.doc.server.moderateTab(ctx, c.log.With("client_uuid", c.uuid), c.docID, c.name, tab)
+}
+
+// moderate asks the moderators about req, returning the text to use,
+// possibly redacted, or an error rejecting it. When a moderator fails the
+// text is let through, so an outage of a moderation service doesn't stop
+// everyone from editing.
+func (s *Server) moderate(ctx context.Context, log *slog.Logger, req moderation.Request) (string, error) {
+	if s.moderator == nil {
+		return req.Text, nil
+	}
+	verdict, err := s.moderator.Moderate(ctx, req)
+	if err != nil {
+		log.Warn("Moderation failed, letting text through", "kind", req.Kind, "tab_id", req.TabID, "error", err)
+		return req.Text, nil
+	}
+	switch verdict.Action {
+	case moderation.Reject:
+		log.Info("Moderation rejected text", "kind", req.Kind, "tab_id", req.TabID, "reason", verdict.Reason)
+		if req.Kind == moderation.KindName {
+			return "", errNameRejected
+		}
+		return "", errContentRejected
+	case moderation.Redact:
+		log.Info("Moderation redacted text", "kind", req.Kind, "tab_id", req.TabID, "reason", verdict.Reason)
+		return verdict.Text, nil
+	}
+	return req.Text, nil
+}
+
+// moderateTab moderates the content and notes of a tab added to document
+// docID by user, who is empty when unknown, replacing them with the text to use
+func (s *Server) moderateTab(ctx context.Context, log *slog.Logger, docID, user string, tab *Tab) error {
+	for _, text := range []*string{&tab.Content, &tab.Notes} {
+		if *text == "" {
+			continue
+		}
+		moderated, err := s.moderate(ctx, log, moderation.Request{
+			Kind:       moderation.KindContent,
+			DocumentID: docID,
+			TabID:      tab.ID,
+			User:       user,
+			Text:       *text,
+		})
+		if err != nil {
+			return err
+		}
+		*text = moderated
+	}
+	return nil
+}
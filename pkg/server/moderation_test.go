@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/shiftregister-vg/gopad/pkg/moderation"
+)
+
+// wordModerator rejects text containing "spam" and redacts "secret"
+type wordModerator struct {
+	requests []moderation.Request
+}
+
+func (m *wordModerator) Moderate(_ context.Context, req moderation.Request) (moderation.Verdict, error) {
+	m.requests = append(m.requests, req)
+	switch {
+	case strings.Contains(req.Text, "spam"):
+		return moderation.Verdict{Action: moderation.Reject}, nil
+	case strings.Contains(req.Text, "secret"):
+		return moderation.Verdict{Action: moderation.Redact, Text: strings.ReplaceAll(req.Text, "secret", "******")}, nil
+	}
+	return moderation.Verdict{Action: moderation.Allow}, nil
+}
+
+func TestModerateTab(t *testing.T) {
+	tests := []struct {
+		name        string
+		tab         Tab
+		wantErr     error
+		wantContent string
+		wantNotes   string
+		wantChecked int
+	}{
+		{"allowed", Tab{ID: "1", Content: "hello", Notes: "world"}, nil, "hello", "world", 2},
+		{"empty parts skipped", Tab{ID: "1", Content: "hello"}, nil, "hello", "", 1},
+		{"content redacted", Tab{ID: "1", Content: "my secret", Notes: "fine"}, nil, "my ******", "fine", 2},
+		{"notes redacted", Tab{ID: "1", Content: "fine", Notes: "a secret"}, nil, "fine", "a ******", 2},
+		{"content rejected", Tab{ID: "1", Content: "spam", Notes: "fine"}, errContentRejected, "", "", 1},
+		{"notes rejected", Tab{ID: "1", Content: "fine", Notes: "spam"}, errContentRejected, "", "", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &wordModerator{}
+			s := &Server{moderator: m}
+			tab := tt.tab
+			err := s.moderateTab(context.Background(), slog.Default(), "doc", "alice", &tab)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if len(m.requests) != tt.wantChecked {
+				t.Errorf("expected %d moderation requests, got %d", tt.wantChecked, len(m.requests))
+			}
+			for _, req := range m.requests {
+				if req.Kind != moderation.KindContent || req.DocumentID != "doc" || req.TabID != "1" || req.User != "alice" {
+					t.Errorf("unexpected request %+v", req)
+				}
+			}
+			if err != nil {
+				return
+			}
+			if tab.Content != tt.wantContent || tab.Notes != tt.wantNotes {
+				t.Errorf("expected content %q and notes %q, got %q and %q", tt.wantContent, tt.wantNotes, tab.Content, tab.Notes)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/ot"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// setTabContent replaces a tab's content, persists the change and sends it to
+// every client but sender, refusing content that would exceed the document
+// limits or edits to a tab locked by anyone but the holder of lockToken.
+func (doc *Document) setTabContent(ctx context.Context, tabId, content, lockToken string, sender *Client) error {
+	_, err := doc.editTabContent(ctx, tabId, lockToken, sender, func(string) (string, error) {
+		return content, nil
+	})
+	return err
+}
+
+// updateMerges counts whole-tab updates that had to be merged with changes
+// the client hadn't seen, by whether the changes overlapped
+var updateMerges = metrics.NewCounter("gopad_update_merges_total", "Number of whole-tab updates merged with changes their client hadn't seen, by result")
+
+// mergeAttempts is how often a whole-tab update is merged unlocked before
+// it's merged with the document locked, when the tab keeps changing meanwhile
+const mergeAttempts = 3
+
+// errTabChanged is returned by edits that find the tab changed since they
+// read it, to be tried again
+var errTabChanged = errors.New("tab changed while merging")
+
+// applyUpdate replaces a tab's content with a whole-tab update from c, as
+// sent by clients that don't send operations. Changes others made since c
+// last saw the tab are merged with the update line by line rather than
+// overwritten; where both changed the same lines the update wins. It returns
+// the tab's new content.
+func (c *Client) applyUpdate(ctx context.Context, tabId, content string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		c.doc.mu.RLock()
+		base, known := c.bases[tabId]
+		current := ""
+		if i := c.doc.findTab(tabId); i >= 0 {
+			current = c.doc.Tabs[i].Content
+		}
+		c.doc.mu.RUnlock()
+
+		// Merging large tabs takes a while, so it's done without holding the
+		// document and only applied if the tab didn't change meanwhile
+		merge := func(current string) (string, string) {
+			if !known || base == current {
+				return content, ""
+			}
+			if merged, ok := mergeLines(base, content, current); ok {
+				return merged, "merged"
+			}
+			return content, "conflict"
+		}
+		next, result := merge(current)
+		merged, err := c.doc.editTabContent(ctx, tabId, "", c, func(now string) (string, error) {
+			if now == current {
+				return next, nil
+			}
+			if attempt < mergeAttempts {
+				return "", errTabChanged
+			}
+			next, result = merge(now)
+			return next, nil
+		})
+		if errors.Is(err, errTabChanged) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if result != "" {
+			updateMerges.Inc(metrics.Labels{"result": result})
+		}
+		c.doc.mu.Lock()
+		c.rememberContent(tabId, merged)
+		c.doc.mu.Unlock()
+		return merged, nil
+	}
+}
+
+// rememberContent records that c has seen the given content of a tab
+// Note: Caller must hold doc.mu.Lock()
+func (c *Client) rememberContent(tabId, content string) {
+	if c.bases == nil {
+		c.bases = make(map[string]string)
+	}
+	c.bases[tabId] = content
+}
+
+// editTabContent replaces a tab's content with the result of edit, which is
+// called with the current content while the document is locked so no other
+// change can interleave, persists the change and sends it to every client but
+// sender. It returns the new content.
+// With delta persistence only the diff is appended to the operation log and
+// full snapshots are written by the compactor; otherwise the saver writes the
+// whole document.
+func (doc *Document) editTabContent(ctx context.Context, tabId, lockToken string, sender *Client, edit func(string) (string, error)) (string, error) {
+	// Broadcast changes in the order they're made, so delta frames apply
+	doc.contentMu.Lock()
+	defer doc.contentMu.Unlock()
+
+	if !doc.server.config.DeltaPersistence {
+		updated, before, err := doc.changeTab(tabId, lockToken, edit)
+		if err != nil {
+			return "", err
+		}
+		content := updated.Content
+		doc.broadcastContent(ctx, sender, tabId, before, content)
+		if content != before {
+			doc.noteEdit(sender)
+			doc.lspChanged()
+		}
+		doc.scheduleSave()
+		doc.checkSoftLimits()
+		doc.reportViolations(tabId, updated.Name, content)
+		doc.reportSecrets(tabId, content)
+		return content, nil
+	}
+
+	// Hold opsMu until the operations are logged so the log order matches
+	// the order they were applied in memory
+	doc.opsMu.Lock()
+	defer doc.opsMu.Unlock()
+
+	updated, before, err := doc.changeTab(tabId, lockToken, edit)
+	if err != nil {
+		return "", err
+	}
+	content := updated.Content
+	// Log the change from the content the log last left, which includes
+	// changes made here that couldn't be logged
+	doc.mu.RLock()
+	logged, ok := doc.logged[tabId]
+	if !ok {
+		logged = before
+	}
+	base := doc.opsCursor
+	doc.mu.RUnlock()
+	var ops []storage.TabOp
+	for _, op := range ot.Diff(logged, content) {
+		ops = append(ops, storage.TabOp{TabID: tabId, Op: op})
+	}
+	doc.broadcastContent(ctx, sender, tabId, before, content)
+	if content == before {
+		return content, nil
+	}
+	doc.noteEdit(sender)
+	doc.lspChanged()
+	doc.checkSoftLimits()
+	doc.reportViolations(tabId, updated.Name, content)
+	doc.reportSecrets(tabId, content)
+	if len(ops) == 0 {
+		return content, nil
+	}
+
+	id, err := doc.server.store.AppendOps(ctx, doc.ID, doc.server.instanceID, base, ops)
+	switch {
+	case errors.Is(err, storage.ErrOpsConflict):
+		// Another instance logged operations since ours were computed
+		opsResyncs.Inc(metrics.Labels{"reason": "conflict"})
+		if err := doc.catchUpOps(ctx); err != nil {
+			logger.Error("Error merging logged operations, falling back to a full save", "doc_id", doc.ID, "error", err)
+			doc.scheduleSave()
+			return content, nil
+		}
+	case err != nil:
+		logger.Error("Error appending operations, falling back to a full save", "doc_id", doc.ID, "error", err)
+		doc.scheduleSave()
+		return content, nil
+	default:
+		doc.mu.Lock()
+		doc.logged[tabId] = content
+		doc.advanceOpsCursor(id)
+		doc.mu.Unlock()
+	}
+	doc.compactor.schedule()
+	return content, nil
+}
+
+// changeTab replaces a tab's content with the result of edit, called with
+// the current content, unless the tab is locked against lockToken or the
+// result exceeds the document limits. It returns the changed tab and its
+// previous content. The document is unlocked even if edit panics.
+// Note: Caller must hold doc.contentMu
+func (doc *Document) changeTab(tabId, lockToken string, edit func(string) (string, error)) (Tab, string, error) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	i := doc.findTab(tabId)
+	if i < 0 {
+		return Tab{}, "", errTabNotFound
+	}
+	if err := doc.checkLock(tabId, lockToken); err != nil {
+		return Tab{}, "", err
+	}
+	content, err := edit(doc.Tabs[i].Content)
+	if err != nil {
+		return Tab{}, "", err
+	}
+	updated := doc.Tabs[i]
+	updated.Content = content
+	if err := doc.checkTabChange(i, updated); err != nil {
+		return Tab{}, "", err
+	}
+	before := doc.Tabs[i].Content
+	doc.Tabs[i].Content = content
+	return updated, before, nil
+}
+
+// advanceOpsCursor records that operations up to id are reflected in memory
+// Note: Caller must hold doc.mu.Lock()
+func (doc *Document) advanceOpsCursor(id string) {
+	if storage.CompareStreamIDs(id, doc.opsCursor) > 0 {
+		doc.opsCursor = id
+	}
+}
+
+// setLogged records the tab contents of state as those logged operations apply to
+// Note: Caller must hold doc.mu.Lock() unless the document isn't shared yet
+func (doc *Document) setLogged(state *storage.DocumentState) {
+	doc.logged = make(map[string]string, len(state.Tabs))
+	for _, tab := range state.Tabs {
+		doc.logged[tab.ID] = tab.Content
+	}
+}
+
+// opsResyncs counts documents reloaded because the operation log moved on
+// without them, by reason: conflict when another instance appended first,
+// gap when entries were missed and mismatch when an entry didn't apply
+var opsResyncs = metrics.NewCounter("gopad_ops_resyncs_total", "Number of times a document was reloaded to catch up with the operation log, by reason: conflict, gap or mismatch")
+
+// applyRemoteOps applies operations logged by another instance. Each entry
+// applies to the contents its predecessor left, so entries that don't follow
+// the last one applied here, or don't apply, mean the log moved on without
+// this instance and the document is reloaded instead.
+func (doc *Document) applyRemoteOps(batch *storage.OpBatch) {
+	if batch.Origin == doc.server.instanceID {
+		return
+	}
+	doc.contentMu.Lock()
+	defer doc.contentMu.Unlock()
+	doc.opsMu.Lock()
+	defer doc.opsMu.Unlock()
+
+	doc.mu.Lock()
+	if storage.CompareStreamIDs(batch.ID, doc.opsCursor) <= 0 {
+		doc.mu.Unlock()
+		return
+	}
+	reason := ""
+	logged := make(map[string]string)
+	if batch.Base != doc.opsCursor {
+		reason = "gap"
+	}
+	for _, op := range batch.Ops {
+		if reason != "" {
+			break
+		}
+		content, ok := logged[op.TabID]
+		if !ok {
+			if content, ok = doc.logged[op.TabID]; !ok {
+				reason = "mismatch"
+				break
+			}
+		}
+		tabDoc := &ot.Document{Content: content}
+		if err := tabDoc.Apply(op.Op); err != nil {
+			reason = "mismatch"
+			break
+		}
+		logged[op.TabID] = tabDoc.Content
+	}
+	if reason != "" {
+		doc.mu.Unlock()
+		opsResyncs.Inc(metrics.Labels{"reason": reason})
+		logger.Warn("Operations from another instance don't follow the log here, reloading", "doc_id", doc.ID, "entry", batch.ID, "base", batch.Base, "cursor", doc.opsCursor, "reason", reason)
+		if err := doc.catchUpOps(doc.ctx); err != nil && doc.ctx.Err() == nil {
+			logger.Error("Error reloading logged operations", "doc_id", doc.ID, "error", err)
+		}
+		return
+	}
+	msgs := doc.advanceLogged(logged)
+	doc.advanceOpsCursor(batch.ID)
+	doc.mu.Unlock()
+
+	doc.broadcastChanges(msgs)
+}
+
+// advanceLogged moves the logged contents of tabs to the ones given and
+// brings the tabs along, merging in changes made here that weren't logged.
+// It returns the updates to send clients.
+// Note: Caller must hold doc.mu.Lock()
+func (doc *Document) advanceLogged(logged map[string]string) []map[string]interface{} {
+	var msgs []map[string]interface{}
+	for tabId, content := range logged {
+		previous, known := doc.logged[tabId]
+		doc.logged[tabId] = content
+		i := doc.findTab(tabId)
+		if i < 0 {
+			continue
+		}
+		current := doc.Tabs[i].Content
+		switch {
+		case !known:
+			// Never logged here, so it differs by changes made here
+			content = current
+		case current != previous:
+			content, _ = mergeLines(previous, current, content)
+		}
+		if content == current {
+			continue
+		}
+		doc.Tabs[i].Content = content
+		msgs = append(msgs, map[string]interface{}{
+			"type":    "update",
+			"tabId":   tabId,
+			"content": content,
+		})
+	}
+	return msgs
+}
+
+// catchUpOps reloads the document with the operations logged so far and
+// merges the content changes made here that aren't logged onto it, then logs
+// them on top. Tabs that exist on only one side are left to snapshots.
+// Note: Caller must hold doc.contentMu and doc.opsMu
+func (doc *Document) catchUpOps(ctx context.Context) error {
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		latest, err := doc.server.store.LoadDocument(ctx, doc.ID)
+		if err != nil {
+			return err
+		}
+		doc.mu.Lock()
+		logged := make(map[string]string, len(latest.Tabs))
+		for _, tab := range latest.Tabs {
+			if doc.findTab(tab.ID) >= 0 {
+				logged[tab.ID] = tab.Content
+			}
+		}
+		msgs := doc.advanceLogged(logged)
+		doc.opsCursor = latest.OpsCursor
+		var ops []storage.TabOp
+		merged := make(map[string]string, len(logged))
+		for tabId, content := range logged {
+			merged[tabId] = doc.Tabs[doc.findTab(tabId)].Content
+			for _, op := range ot.Diff(content, merged[tabId]) {
+				ops = append(ops, storage.TabOp{TabID: tabId, Op: op})
+			}
+		}
+		doc.mu.Unlock()
+		doc.broadcastChanges(msgs)
+		if len(ops) == 0 {
+			return nil
+		}
+
+		id, err := doc.server.store.AppendOps(ctx, doc.ID, doc.server.instanceID, latest.OpsCursor, ops)
+		if errors.Is(err, storage.ErrOpsConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		doc.mu.Lock()
+		for tabId, content := range merged {
+			doc.logged[tabId] = content
+		}
+		doc.advanceOpsCursor(id)
+		doc.mu.Unlock()
+		return nil
+	}
+	return storage.ErrOpsConflict
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+var (
+	// messageDuration records how long client messages take to handle, by type
+	messageDuration = metrics.NewHistogram("gopad_message_duration_seconds", "Time spent handling a client message",
+		[]float64{0.001, 0.005, 0.025, 0.1, 0.5, 2, 10})
+	// messageBudgetExceeded counts client messages that overran their processing budget, by type
+	messageBudgetExceeded = metrics.NewCounter("gopad_message_budget_exceeded_total", "Number of client messages that took longer than MESSAGE_BUDGET")
+	// shedMessages counts low-priority work dropped or deferred while a hub was overloaded, by kind
+	shedMessages = metrics.NewCounter("gopad_shed_messages_total", "Number of low-priority messages shed while a document hub was overloaded")
+)
+
+// overloadCooldown is how long a hub stays in shedding mode after it last fell behind
+const overloadCooldown = 5 * time.Second
+
+// loadMonitor tracks how far a document hub lags behind the messages queued for it.
+// While the lag exceeds the threshold the document sheds low-priority work so
+// content updates keep flowing.
+type loadMonitor struct {
+	threshold  time.Duration // zero disables shedding
+	mu         sync.Mutex
+	overloaded bool
+	until      time.Time // when shedding ends unless the hub falls behind again
+}
+
+func newLoadMonitor(threshold time.Duration) *loadMonitor {
+	return &loadMonitor{threshold: threshold}
+}
+
+// observe records the time a message waited for the hub and reports whether
+// the overloaded state changed as a result
+func (m *loadMonitor) observe(lag time.Duration) (changed bool) {
+	if m.threshold <= 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if lag > m.threshold {
+		m.until = now.Add(overloadCooldown)
+		if !m.overloaded {
+			m.overloaded = true
+			return true
+		}
+		return false
+	}
+	if m.overloaded && now.After(m.until) {
+		m.overloaded = false
+		return true
+	}
+	return false
+}
+
+// shedding reports whether low-priority work should be dropped or deferred
+func (m *loadMonitor) shedding() bool {
+	if m.threshold <= 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.overloaded
+}
+
+// backpressureMessage tells clients whether the document is shedding low-priority
+// work, so they can throttle cursor updates and expect delayed presence
+func backpressureMessage(overloaded bool) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "backpressure",
+		"overloaded": overloaded,
+	}
+}
+
+// announceLoad tells every client whether the hub is shedding work
+// Note: Must only be called from the hub goroutine
+func (doc *Document) announceLoad() {
+	overloaded := doc.load.shedding()
+	if overloaded {
+		logger.Warn("Document hub is falling behind, shedding low-priority work", "doc_id", doc.ID)
+	} else {
+		logger.Info("Document hub caught up", "doc_id", doc.ID)
+	}
+	for client := range doc.clients {
+		if client.wants("backpressure") {
+			client.reply(backpressureMessage(overloaded))
+		}
+	}
+}
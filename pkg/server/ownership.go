@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/signedurl"
+)
+
+// relayedKey is the context key of the address of a client relayed by
+// another instance sharing this one's Redis
+const relayedKey = "relayedClient"
+
+var relayedConnections = metrics.NewCounter("gopad_relayed_connections_total", "Number of client connections relayed to the instance owning their document, by direction and result")
+
+// errNotOwner is returned to relayed clients of documents another instance took over
+var errNotOwner = apperr.New(apperr.CodeUnavailable, "another instance took over this document, reconnect shortly")
+
+// With document ownership, only the instance holding a document's lease
+// loads it, so a single instance saves it and bumps its version. Clients
+// connecting to other instances are relayed to the owner, which sees them as
+// its own.
+
+// ownershipEnabled reports whether documents are owned by one instance at a time
+func (s *Server) ownershipEnabled() bool {
+	return s.config.AdvertiseURL != "" && s.config.ClusterSecret != ""
+}
+
+// relayPath is where instances relay clients of documents owned here
+func relayPath(docID string) string {
+	return "/cluster/v1/documents/" + docID + "/ws"
+}
+
+// relayResource is what an instance signs when relaying a client: the
+// document, the client's address and, for clients of a federation peer, the
+// peer and the access it was granted
+func relayResource(docID, ip, peer, mode string) string {
+	return relayPath(docID) + "?ip=" + ip + "&peer=" + peer + "&mode=" + mode
+}
+
+// routeToOwner claims the document for this instance unless another owns it,
+// in which case the client is relayed there. It returns false when the
+// request was handled.
+func (s *Server) routeToOwner(c *gin.Context, docID string) bool {
+	if !s.ownershipEnabled() {
+		return true
+	}
+	owner, err := s.store.ClaimOwnership(c.Request.Context(), docID, s.config.AdvertiseURL, s.config.OwnerLease)
+	if err != nil {
+		// Storage is needed to load the document anyway
+		requestLog(c).Error("Error claiming document", "doc_id", docID, "error", err)
+		return true
+	}
+	if owner == s.config.AdvertiseURL {
+		return true
+	}
+	// Clients are only relayed once, so the owner changed since they were
+	if _, relayed := c.Get(relayedKey); relayed {
+		c.Header("Retry-After", "1")
+		abortWithError(c, errNotOwner)
+		return false
+	}
+	s.relayToOwner(c, docID, owner)
+	return false
+}
+
+// relayToOwner connects the client to the instance owning the document,
+// relaying frames both ways until either side closes
+func (s *Server) relayToOwner(c *gin.Context, docID, owner string) {
+	target, err := url.Parse(owner)
+	if err != nil {
+		requestLog(c).Error("Invalid URL of document owner", "doc_id", docID, "owner", owner, "error", err)
+		abortWithError(c, errHostUnreachable)
+		return
+	}
+	if target.Scheme == "https" {
+		target.Scheme = "wss"
+	} else {
+		target.Scheme = "ws"
+	}
+	target = target.JoinPath(relayPath(docID))
+	ip := clientIP(c)
+	var peerURL, mode string
+	if peer := peerOf(c); peer != nil {
+		peerURL, mode = peer.instance, "readonly"
+		if !peer.readOnly {
+			mode = "readwrite"
+		}
+	}
+	query := c.Request.URL.Query()
+	query.Del("doc")
+	query.Set("ip", ip)
+	query.Set("peer", peerURL)
+	query.Set("mode", mode)
+	target.RawQuery = query.Encode()
+
+	signer := signedurl.New([]byte(s.config.ClusterSecret), 0)
+	header := http.Header{}
+	header.Set("X-GoPad-Relay", signer.Token(relayResource(docID, ip, peerURL, mode), time.Now().Add(federationTokenTTL)))
+	upstream, err := dialRelay(c, target.String(), header)
+	if err != nil {
+		relayedConnections.Inc(metrics.Labels{"direction": "outbound", "result": "failed"})
+		if !errors.Is(err, errRelayRefused) {
+			requestLog(c).Warn("Error connecting to document owner", "doc_id", docID, "owner", owner, "error", err)
+			abortWithError(c, errHostUnreachable)
+		}
+		return
+	}
+	if !s.relayClient(c, upstream) {
+		return
+	}
+	relayedConnections.Inc(metrics.Labels{"direction": "outbound", "result": "connected"})
+	requestLog(c).Debug("Client relayed to document owner", "doc_id", docID, "owner", owner)
+}
+
+// handleRelayedWebSocket connects a client relayed by another instance to a
+// document owned here. The relaying instance signs the request with the
+// cluster secret, vouching for the client's address and, for clients of
+// federation peers, the access the peer was granted.
+func (s *Server) handleRelayedWebSocket(c *gin.Context) {
+	docID, ip, peerURL, mode := c.Param("id"), c.Query("ip"), c.Query("peer"), c.Query("mode")
+	signer := signedurl.New([]byte(s.config.ClusterSecret), federationSkew)
+	if err := signer.VerifyToken(relayResource(docID, ip, peerURL, mode), c.GetHeader("X-GoPad-Relay"), time.Now()); err != nil {
+		relayedConnections.Inc(metrics.Labels{"direction": "inbound", "result": "refused"})
+		requestLog(c).Warn("Refused relayed client with invalid signature", "doc_id", docID, "error", err)
+		abortWithError(c, apperr.Wrap(apperr.CodeUnauthorized, err, "invalid relay signature"))
+		return
+	}
+	c.Set(relayedKey, ip)
+	if peerURL != "" {
+		c.Set(peerKey, &federatedPeer{instance: peerURL, clientIP: ip, readOnly: mode != "readwrite"})
+	}
+	relayedConnections.Inc(metrics.Labels{"direction": "inbound", "result": "accepted"})
+	s.handleWebSocket(c)
+}
+
+// holdOwnership renews the document's lease every third of it until the
+// document is shut down. The lease then runs out on its own, unless the
+// document was handed over. Should another instance have taken the document
+// over, e.g. after Redis was unreachable here for longer than the lease, its
+// clients are handed over to that instance.
+func (doc *Document) holdOwnership(lease time.Duration) {
+	s := doc.server
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		owner, err := s.store.ClaimOwnership(doc.ctx, doc.ID, s.config.AdvertiseURL, lease)
+		if err != nil {
+			if doc.ctx.Err() == nil {
+				logger.Error("Error renewing document ownership", "doc_id", doc.ID, "error", err)
+			}
+			continue
+		}
+		if owner != s.config.AdvertiseURL {
+			logger.Warn("Document taken over by another instance", "doc_id", doc.ID, "owner", owner)
+			doc.handover(doc.ctx)
+			s.evictDocument(doc.ID, true)
+			return
+		}
+	}
+}
+
+// releaseOwnership gives up the document's lease so the instance its clients
+// reconnect to can take over right away
+func (doc *Document) releaseOwnership(ctx context.Context) {
+	s := doc.server
+	if !s.ownershipEnabled() {
+		return
+	}
+	if err := s.store.ReleaseOwnership(ctx, doc.ID, s.config.AdvertiseURL); err != nil {
+		logger.Error("Error releasing document ownership", "doc_id", doc.ID, "error", err)
+	}
+}
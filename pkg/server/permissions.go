@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+)
+
+// errNotElevated is sent for structural changes to a document that only lets
+// elevated editors make them
+var errNotElevated = apperr.New(apperr.CodeForbidden, "only editors with an editor token can change the tabs and language of this document")
+
+// editorTokenPath is what a document's editor tokens are signed for
+func editorTokenPath(docID string) string {
+	return "/api/v1/documents/" + docID + "/editor"
+}
+
+// verifyEditorToken checks an editor token passed when connecting to a document
+func (s *Server) verifyEditorToken(docID, token string) error {
+	if s.signer == nil {
+		return apperr.New(apperr.CodeUnauthorized, "editor tokens are not configured")
+	}
+	if err := s.signer.VerifyToken(editorTokenPath(docID), token, time.Now()); err != nil {
+		return apperr.Wrap(apperr.CodeUnauthorized, err, "invalid editor token")
+	}
+	return nil
+}
+
+// checkStructure returns an error if the document only lets elevated editors
+// change its tabs and language and c isn't one
+// Note: Caller must hold doc.mu
+func (doc *Document) checkStructure(c *Client) error {
+	if c.elevated || doc.effective().TabChanges != policy.TabChangesElevated {
+		return nil
+	}
+	return errNotElevated
+}
+
+// editorTokenRequest asks for an editor token for a document
+type editorTokenRequest struct {
+	TTL string `json:"ttl"` // e.g. "24h"
+}
+
+// handleCreateEditorToken mints a time-limited token that elevates the
+// editors connecting with it, letting them change the structure of documents
+// that restrict it
+func (s *Server) handleCreateEditorToken(c *gin.Context) {
+	if s.signer == nil {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "signed URLs are not configured"))
+		return
+	}
+	var req editorTokenRequest
+	// The body is optional
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+			return
+		}
+	}
+	ttl := 24 * time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			abortWithError(c, apperr.New(apperr.CodeValidation, "invalid ttl"))
+			return
+		}
+		ttl = d
+	}
+	docID := c.Param("id")
+	expires := time.Now().Add(ttl)
+	requestLog(c).Info("Editor token created", "doc_id", docID, "expires", expires)
+	c.JSON(http.StatusOK, gin.H{
+		"token":     s.signer.Token(editorTokenPath(docID), expires),
+		"expires":   expires.Unix(),
+		"expiresAt": s.messages.FormatTime(c.GetString(localeKey), expires),
+	})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+var (
+	// errPinNotAllowed is sent for pin messages from clients without an editor token
+	errPinNotAllowed = apperr.New(apperr.CodeForbidden, "only editors with an editor token can pin this document")
+	// errPinLimited is sent for pin messages in workspaces limiting how long documents are kept
+	errPinLimited = apperr.New(apperr.CodeLimitExceeded, "this workspace limits how long documents are kept, so they can't be pinned")
+)
+
+// Pinned documents are saved without a TTL, so they're kept until unpinned.
+// The document's owners, the editors holding an editor token, pin it over the
+// WebSocket, and admins through the admin API.
+
+// setPinned pins or unpins a document, saving it so the change of TTL applies
+// right away
+func (s *Server) setPinned(ctx context.Context, docID string, pinned bool) error {
+	if doc, loaded := s.loadedDocument(docID); loaded {
+		if err := doc.setPinned(ctx, pinned); err != nil {
+			return err
+		}
+	} else {
+		state, err := s.documentState(ctx, docID)
+		if err != nil {
+			return err
+		}
+		settings, err := s.stateSettings(ctx, state)
+		if err != nil {
+			return err
+		}
+		state.Pinned = pinned
+		state.Expiry = time.Duration(settings.TTL)
+		if err := s.store.SaveDocument(ctx, docID, state); err != nil {
+			return err
+		}
+	}
+	return s.store.SetPinned(ctx, docID, pinned)
+}
+
+// setPinned pins or unpins a loaded document and tells its clients
+func (doc *Document) setPinned(ctx context.Context, pinned bool) error {
+	doc.mu.Lock()
+	before := doc.pinned
+	doc.pinned = pinned
+	doc.mu.Unlock()
+	if err := doc.saveState(ctx); err != nil {
+		return err
+	}
+	doc.mu.RLock()
+	msgs := doc.pinChanges(before)
+	doc.mu.RUnlock()
+	doc.broadcastChanges(msgs)
+	return nil
+}
+
+// pinChanges returns the pinned message to send if the document was pinned
+// or unpinned since it was before
+// Note: Caller must hold doc.mu
+func (doc *Document) pinChanges(before bool) []map[string]interface{} {
+	if doc.pinned == before {
+		return nil
+	}
+	return []map[string]interface{}{{"type": "pinned", "pinned": doc.pinned}}
+}
+
+// handlePin pins the document, or unpins it with pinned false
+func (c *Client) handlePin(ctx context.Context, msg map[string]interface{}) {
+	pinned := true
+	if v, ok := msg["pinned"].(bool); ok {
+		pinned = v
+	}
+	if !c.elevated {
+		c.sendError(errPinNotAllowed)
+		return
+	}
+	c.doc.mu.RLock()
+	limited := c.doc.policy != nil && c.doc.policy.Limits.MaxTTL > 0
+	c.doc.mu.RUnlock()
+	if pinned && limited {
+		c.sendError(errPinLimited)
+		return
+	}
+	if err := c.doc.server.setPinned(ctx, c.docID, pinned); err != nil {
+		c.sendError(err)
+		return
+	}
+	c.log.Info("Document pinned", "pinned", pinned)
+}
+
+// handleListPinned lists the pinned documents
+func (s *Server) handleListPinned(c *gin.Context) {
+	ids, err := s.store.PinnedDocuments(c.Request.Context())
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	sort.Strings(ids)
+	c.JSON(http.StatusOK, gin.H{"documents": ids})
+}
+
+// handlePinDocument pins a document
+func (s *Server) handlePinDocument(c *gin.Context) {
+	s.respondPinned(c, true)
+}
+
+// handleUnpinDocument unpins a document, so it expires with its TTL again
+func (s *Server) handleUnpinDocument(c *gin.Context) {
+	s.respondPinned(c, false)
+}
+
+// respondPinned pins or unpins the document of the request
+func (s *Server) respondPinned(c *gin.Context, pinned bool) {
+	docID := c.Param("id")
+	if err := s.setPinned(c.Request.Context(), docID, pinned); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Document pinned", "doc_id", docID, "pinned", pinned)
+	c.JSON(http.StatusOK, gin.H{"id": docID, "pinned": pinned})
+}
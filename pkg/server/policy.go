@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// featureDisabled is the error for using a feature the document's settings turn off
+func featureDisabled(feature string) error {
+	return apperr.Newf(apperr.CodeForbidden, "%s is disabled for this document", feature)
+}
+
+// workspaceOf returns the workspace whose policy applies to a document assigned to workspace
+func (s *Server) workspaceOf(workspace string) string {
+	if workspace == "" {
+		return s.config.DefaultWorkspace
+	}
+	return workspace
+}
+
+// workspacePolicy returns a workspace's policy, loading it from storage the
+// first time; it is kept up to date by watchPolicies afterwards. A nil policy
+// means the workspace sets no defaults or limits.
+func (s *Server) workspacePolicy(ctx context.Context, workspace string) (*policy.Policy, error) {
+	if workspace == "" {
+		return nil, nil
+	}
+	s.policiesMu.RLock()
+	p, ok := s.policies[workspace]
+	s.policiesMu.RUnlock()
+	if ok {
+		return p, nil
+	}
+	p, err := s.store.WorkspacePolicy(ctx, workspace)
+	if err != nil {
+		return nil, err
+	}
+	s.policiesMu.Lock()
+	s.policies[workspace] = p
+	s.policiesMu.Unlock()
+	return p, nil
+}
+
+// cachedPolicy returns a workspace's policy without waiting for storage. If it
+// hasn't been loaded yet it is fetched in the background and applied to the
+// workspace's documents once it arrives.
+func (s *Server) cachedPolicy(workspace string) *policy.Policy {
+	if workspace == "" {
+		return nil
+	}
+	s.policiesMu.RLock()
+	p, ok := s.policies[workspace]
+	s.policiesMu.RUnlock()
+	if !ok {
+		go func() {
+			p, err := s.workspacePolicy(s.ctx, workspace)
+			if err != nil {
+				logger.Error("Error loading workspace policy", "workspace", workspace, "error", err)
+				return
+			}
+			s.applyPolicy(workspace, p)
+		}()
+	}
+	return p
+}
+
+// watchPolicies applies policy changes saved by any instance until the server shuts down
+func (s *Server) watchPolicies() {
+	<-s.store.SubscribeToPolicies(s.ctx, s.applyPolicy).Done()
+}
+
+// applyPolicy switches the loaded documents of a workspace to a new policy
+func (s *Server) applyPolicy(workspace string, p *policy.Policy) {
+	s.policiesMu.Lock()
+	s.policies[workspace] = p
+	s.policiesMu.Unlock()
+
+	s.mu.RLock()
+	docs := make([]*Document, 0, len(s.documents))
+	for _, doc := range s.documents {
+		docs = append(docs, doc)
+	}
+	s.mu.RUnlock()
+	for _, doc := range docs {
+		doc.mu.Lock()
+		if s.workspaceOf(doc.workspace) != workspace {
+			doc.mu.Unlock()
+			continue
+		}
+		doc.policy = p
+		doc.mu.Unlock()
+		doc.broadcastSettings()
+	}
+}
+
+// stateSettings returns the settings in effect for a stored document
+func (s *Server) stateSettings(ctx context.Context, state *storage.DocumentState) (policy.Settings, error) {
+	p, err := s.workspacePolicy(ctx, s.workspaceOf(state.Workspace))
+	if err != nil {
+		return policy.Settings{}, err
+	}
+	var own policy.Settings
+	if state.Settings != nil {
+		own = *state.Settings
+	}
+	return p.Resolve(own), nil
+}
+
+// effective returns the settings in effect for the document
+// Note: Caller must hold doc.mu
+func (doc *Document) effective() policy.Settings {
+	return doc.policy.Resolve(doc.settings)
+}
+
+// limits returns the document's size limits: the server's, tightened by its workspace policy
+// Note: Caller must hold doc.mu
+func (doc *Document) limits() (maxTabs, maxTabSize, maxDocSize int) {
+	cfg := doc.server.config
+	maxTabs, maxTabSize, maxDocSize = cfg.MaxTabs, cfg.MaxTabSize, cfg.MaxDocSize
+	if p := doc.policy; p != nil {
+		maxTabs = policy.Cap(maxTabs, p.Limits.MaxTabs)
+		maxTabSize = policy.Cap(maxTabSize, p.Limits.MaxTabSize)
+		maxDocSize = policy.Cap(maxDocSize, p.Limits.MaxDocSize)
+	}
+	return maxTabs, maxTabSize, maxDocSize
+}
+
+// checkFeature returns an error if the document's settings turn feature off
+func (doc *Document) checkFeature(feature string) error {
+	doc.mu.RLock()
+	enabled := doc.effective().Enabled(feature)
+	doc.mu.RUnlock()
+	if !enabled {
+		return featureDisabled(feature)
+	}
+	return nil
+}
+
+// settingsMessage describes the document's settings: its own, and those in
+// effect once the workspace policy is applied
+// Note: Caller must hold doc.mu
+func (doc *Document) settingsMessage() map[string]interface{} {
+	return map[string]interface{}{
+		"type":              "settings",
+		"workspace":         doc.workspace,
+		"settings":          doc.settings,
+		"effectiveSettings": doc.effective(),
+		"usage":             doc.usage(),
+	}
+}
+
+// broadcastSettings tells all clients about changed settings or limits
+func (doc *Document) broadcastSettings() {
+	doc.mu.RLock()
+	jsonMsg, err := json.Marshal(doc.settingsMessage())
+	doc.mu.RUnlock()
+	if err != nil {
+		logger.Error("Error marshaling settings", "doc_id", doc.ID, "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
+
+// handleSetSettings replaces the document's own settings, as long as they stay
+// within the workspace policy
+func (c *Client) handleSetSettings(msg map[string]interface{}) {
+	var settings policy.Settings
+	raw, err := json.Marshal(msg["settings"])
+	if err == nil {
+		err = json.Unmarshal(raw, &settings)
+	}
+	if err != nil {
+		c.sendError(apperr.Wrap(apperr.CodeInvalidMessage, err, "invalid settings"))
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		c.sendError(err)
+		return
+	}
+	c.doc.mu.Lock()
+	// Otherwise anyone could lift the restriction
+	if settings.TabChanges != c.doc.settings.TabChanges && !c.elevated {
+		c.doc.mu.Unlock()
+		c.sendError(errNotElevated)
+		return
+	}
+	if err := c.doc.policy.Check(settings); err != nil {
+		c.doc.mu.Unlock()
+		c.sendError(err)
+		return
+	}
+	c.doc.settings = settings
+	c.doc.mu.Unlock()
+	c.log.Info("Document settings changed", "settings", string(raw))
+	c.doc.broadcastSettings()
+
+	// Save so a changed TTL is applied to the stored document
+	c.doc.scheduleSave()
+}
+
+// handleGetWorkspacePolicy returns a workspace's policy; workspaces without one have an empty policy
+func (s *Server) handleGetWorkspacePolicy(c *gin.Context) {
+	p, err := s.store.WorkspacePolicy(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if p == nil {
+		p = &policy.Policy{}
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// handleSetWorkspacePolicy replaces a workspace's policy. Every instance
+// applies it to the workspace's loaded documents as soon as it's saved.
+func (s *Server) handleSetWorkspacePolicy(c *gin.Context) {
+	var p policy.Policy
+	if err := c.ShouldBindJSON(&p); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	if err := p.Validate(); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	workspace := c.Param("id")
+	if err := s.store.SaveWorkspacePolicy(c.Request.Context(), workspace, &p); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Workspace policy changed", "workspace", workspace)
+	c.JSON(http.StatusOK, &p)
+}
+
+// workspaceRequest is the body of PUT /admin/documents/:id/workspace
+type workspaceRequest struct {
+	Workspace string `json:"workspace"` // empty moves the document to the default workspace
+}
+
+// handleSetDocumentWorkspace moves a document into a workspace
+func (s *Server) handleSetDocumentWorkspace(c *gin.Context) {
+	var req workspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	ctx := c.Request.Context()
+	docID := c.Param("id")
+	p, err := s.workspacePolicy(ctx, s.workspaceOf(req.Workspace))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if doc, loaded := s.loadedDocument(docID); loaded {
+		doc.mu.Lock()
+		doc.workspace = req.Workspace
+		doc.policy = p
+		doc.mu.Unlock()
+		doc.broadcastSettings()
+		if err := doc.saveState(ctx); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	} else {
+		state, err := s.store.LoadDocument(ctx, docID)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		if state.Version == 0 && len(state.Tabs) == 0 {
+			abortWithError(c, storage.ErrNotFound)
+			return
+		}
+		state.Workspace = req.Workspace
+		var own policy.Settings
+		if state.Settings != nil {
+			own = *state.Settings
+		}
+		state.Expiry = time.Duration(p.Resolve(own).TTL)
+		if err := s.store.SaveDocument(ctx, docID, state); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	requestLog(c).Info("Document moved to workspace", "doc_id", docID, "workspace", req.Workspace)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// presenceDigest batches join, leave and edit activity into periodic summaries for
+// clients that connected with ?presence=digest, so screen readers can announce one
+// message instead of a stream of individual events
+type presenceDigest struct {
+	doc      *Document
+	interval time.Duration
+	mu       sync.Mutex
+	summary  *presenceSummary
+	timer    *time.Timer
+}
+
+// presenceSummary is the activity collected during one digest interval
+type presenceSummary struct {
+	Joined []string       `json:"joined"`
+	Left   []string       `json:"left"`
+	Edits  map[string]int `json:"edits"` // name -> number of edits
+}
+
+func newPresenceDigest(doc *Document, interval time.Duration) *presenceDigest {
+	return &presenceDigest{doc: doc, interval: interval}
+}
+
+// joined records that a user joined the document
+func (p *presenceDigest) joined(name string) {
+	p.record(func(s *presenceSummary) { s.Joined = append(s.Joined, name) })
+}
+
+// left records that a user left the document
+func (p *presenceDigest) left(name string) {
+	p.record(func(s *presenceSummary) { s.Left = append(s.Left, name) })
+}
+
+// edited records an edit made by a user
+func (p *presenceDigest) edited(name string) {
+	p.record(func(s *presenceSummary) { s.Edits[name]++ })
+}
+
+func (p *presenceDigest) record(update func(*presenceSummary)) {
+	if p == nil || p.interval <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.summary == nil {
+		p.summary = &presenceSummary{Edits: make(map[string]int)}
+	}
+	update(p.summary)
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.interval, p.flush)
+	}
+}
+
+// flush hands the collected activity to the hub for delivery
+func (p *presenceDigest) flush() {
+	p.mu.Lock()
+	if p.doc.load.shedding() {
+		// Keep collecting until the hub catches up
+		shedMessages.Inc(metrics.Labels{"kind": "presenceDigest"})
+		p.timer = time.AfterFunc(p.interval, p.flush)
+		p.mu.Unlock()
+		return
+	}
+	summary := p.summary
+	p.summary = nil
+	p.timer = nil
+	p.mu.Unlock()
+	if summary != nil {
+		p.doc.send(BroadcastMessage{Digest: summary})
+	}
+}
+
+// text renders the summary as a sentence in the given locale
+func (s *presenceSummary) text(server *Server, locale string) string {
+	var parts []string
+	for _, name := range s.Joined {
+		parts = append(parts, server.messages.Translate(locale, "%s joined", name))
+	}
+	for _, name := range s.Left {
+		parts = append(parts, server.messages.Translate(locale, "%s left", name))
+	}
+	names := make([]string, 0, len(s.Edits))
+	for name := range s.Edits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if s.Edits[name] == 1 {
+			parts = append(parts, server.messages.Translate(locale, "%s made 1 edit", name))
+		} else {
+			parts = append(parts, server.messages.Translate(locale, "%s made %d edits", name, s.Edits[name]))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// message builds the digest frame for one client
+func (s *presenceSummary) message(server *Server, locale string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "presenceDigest",
+		"summary": s.text(server, locale),
+		"joined":  s.Joined,
+		"left":    s.Left,
+		"edits":   s.Edits,
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// maxViewSize bounds view messages, which are kept for every user and sent
+// to everyone following them
+const maxViewSize = 4 * 1024
+
+// Errors for follow messages
+var (
+	errFollowSelf    = apperr.New(apperr.CodeValidation, "you can't follow yourself")
+	errViewTooLarge  = apperr.Newf(apperr.CodeLimitExceeded, "view messages are limited to %d bytes", maxViewSize)
+	errNotPresenting = apperr.New(apperr.CodeConflict, "someone else is presenting")
+)
+
+// Users can follow another user's view: the tab they're on and where they
+// scrolled to, sent with view messages, which are relayed to their followers
+// only. Cursors reach everyone anyway. A presenter is followed by everyone
+// else, including users joining later, until they stop presenting or leave;
+// spectators can unfollow to look around on their own. Who follows whom and
+// who presents is listed in the user list.
+
+// handleFollow makes c follow the view of another user, sending it the
+// user's last view so it catches up at once
+func (c *Client) handleFollow(msg map[string]interface{}) {
+	uuid, ok := c.stringField(msg, "uuid")
+	if !ok {
+		return
+	}
+	c.doc.mu.Lock()
+	if uuid == c.uuid {
+		c.doc.mu.Unlock()
+		c.sendError(errFollowSelf)
+		return
+	}
+	leader, listed := c.doc.users.clients[uuid]
+	if !listed || leader.disconnected {
+		c.doc.mu.Unlock()
+		c.sendError(errUserNotConnected)
+		return
+	}
+	c.following = uuid
+	view := leader.view
+	c.doc.mu.Unlock()
+	if view != nil {
+		c.reply(view)
+	}
+	c.doc.broadcastUserList()
+}
+
+// handleUnfollow stops c following anyone, including a presenter
+func (c *Client) handleUnfollow() {
+	c.doc.mu.Lock()
+	c.following = ""
+	c.doc.mu.Unlock()
+	c.doc.broadcastUserList()
+}
+
+// handleView records where c is looking and relays it to its followers
+func (c *Client) handleView(msg map[string]interface{}, message []byte) {
+	if len(message) > maxViewSize {
+		c.sendError(errViewTooLarge)
+		return
+	}
+	msg["uuid"] = c.uuid
+	view, err := json.Marshal(msg)
+	if err != nil {
+		c.log.Debug("Error marshaling view message", "error", err)
+		return
+	}
+	c.doc.mu.Lock()
+	c.view = view
+	followers := c.doc.followers(c.uuid)
+	c.doc.mu.Unlock()
+	if c.doc.load.shedding() {
+		shedMessages.Inc(metrics.Labels{"kind": "view"})
+		return
+	}
+	for _, follower := range followers {
+		c.doc.send(BroadcastMessage{Recipient: follower, Message: view})
+	}
+}
+
+// handlePresent starts or stops c presenting. Starting makes everyone else
+// follow c; stopping releases them.
+func (c *Client) handlePresent(msg map[string]interface{}) {
+	enabled, _ := msg["enabled"].(bool)
+	c.doc.mu.Lock()
+	if c.doc.presenter != "" && c.doc.presenter != c.uuid {
+		c.doc.mu.Unlock()
+		if enabled {
+			c.sendError(errNotPresenting)
+		}
+		return
+	}
+	var followers []*Client
+	if enabled {
+		c.doc.presenter = c.uuid
+		for _, client := range c.doc.users.connected() {
+			if client != c {
+				client.following = c.uuid
+			}
+		}
+		followers = c.doc.followers(c.uuid)
+	} else {
+		c.doc.presenter = ""
+		for _, client := range c.doc.followers(c.uuid) {
+			client.following = ""
+		}
+	}
+	view := c.view
+	c.doc.mu.Unlock()
+	if view != nil {
+		for _, follower := range followers {
+			c.doc.send(BroadcastMessage{Recipient: follower, Message: view})
+		}
+	}
+	c.doc.broadcastUserList()
+	c.log.Info("Presenting", "client_uuid", c.uuid, "enabled", enabled)
+}
+
+// followers returns the connected clients following user uuid
+// Note: Caller must hold doc.mu
+func (doc *Document) followers(uuid string) []*Client {
+	var followers []*Client
+	for _, client := range doc.users.connected() {
+		if client.following == uuid {
+			followers = append(followers, client)
+		}
+	}
+	return followers
+}
+
+// moveFollowers keeps clients following a user, or the user presenting,
+// when they change their ID
+// Note: Caller must hold doc.mu.Lock()
+func (doc *Document) moveFollowers(from, to string) {
+	if doc.presenter == from {
+		doc.presenter = to
+	}
+	for _, client := range doc.users.clients {
+		if client.following == from {
+			client.following = to
+		}
+	}
+}
+
+// releaseFollowers stops clients following users who are no longer listed,
+// and ends the presentation of a presenter who left
+// Note: Caller must hold doc.mu.Lock()
+func (doc *Document) releaseFollowers() {
+	if _, listed := doc.users.clients[doc.presenter]; !listed {
+		doc.presenter = ""
+	}
+	for _, client := range doc.users.clients {
+		if _, listed := doc.users.clients[client.following]; !listed {
+			client.following = ""
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+const (
+	// reactionBurst is how many reactions and highlights a client may send
+	// per reactionWindow
+	reactionBurst  = 10
+	reactionWindow = 10 * time.Second
+
+	// highlightTTL is how long a highlight stays up, and is sent to users
+	// joining meanwhile
+	highlightTTL = 30 * time.Second
+
+	maxEmojiRunes = 8
+	maxNoteRunes  = 280
+)
+
+// Errors for reaction and highlight messages
+var (
+	errInvalidEmoji    = apperr.Newf(apperr.CodeValidation, "reactions must be an emoji of at most %d characters", maxEmojiRunes)
+	errInvalidLines    = apperr.New(apperr.CodeValidation, "highlighted lines must be a range starting at line 1 or later")
+	errNoteTooLong     = apperr.Newf(apperr.CodeLimitExceeded, "highlight notes are limited to %d characters", maxNoteRunes)
+	errReactionLimited = apperr.Newf(apperr.CodeRateLimited, "too many reactions and highlights, at most %d every %d seconds", reactionBurst, int(reactionWindow/time.Second))
+)
+
+// reactionsLimited counts reactions and highlights dropped because the client
+// sent too many
+var reactionsLimited = metrics.NewCounter("gopad_reactions_limited_total", "Number of reaction and highlight messages rejected by the rate limit by type")
+
+// Reactions and highlights let reviewers celebrate or point at lines without
+// editing the content. Neither is saved: reactions are relayed to everyone and
+// forgotten, highlights are kept in memory for highlightTTL, one per user, so
+// users joining meanwhile see them in the init message.
+
+// highlight is a range of lines a user points at
+type highlight struct {
+	UUID    string `json:"uuid"`
+	Name    string `json:"name"`
+	TabID   string `json:"tabId"`
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+	Note    string `json:"note,omitempty"`
+	Expires int64  `json:"expires"` // unix milliseconds
+}
+
+// allowReaction counts a reaction or highlight against the client's rate
+// limit, reporting whether it may be relayed
+// Note: readPump only
+func (c *Client) allowReaction(kind string) bool {
+	now := time.Now()
+	if now.Sub(c.reactionsSince) >= reactionWindow {
+		c.reactionsSince, c.reactions = now, 0
+	}
+	if c.reactions >= reactionBurst {
+		reactionsLimited.Inc(metrics.Labels{"type": kind})
+		c.sendError(errReactionLimited)
+		return false
+	}
+	c.reactions++
+	return true
+}
+
+// validEmoji reports whether s looks like a single emoji: short, and made of
+// symbols and joiners rather than letters, digits or spaces
+func validEmoji(s string) bool {
+	n := utf8.RuneCountInString(s)
+	if n == 0 || n > maxEmojiRunes || !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleReaction relays an emoji reaction, optionally pinned to a line of a
+// tab, to everyone in the document
+func (c *Client) handleReaction(msg map[string]interface{}) {
+	emoji, ok := c.stringField(msg, "emoji")
+	if !ok {
+		return
+	}
+	if !validEmoji(emoji) {
+		c.sendError(errInvalidEmoji)
+		return
+	}
+	reaction := map[string]interface{}{
+		"type":  "reaction",
+		"uuid":  c.uuid,
+		"emoji": emoji,
+	}
+	c.doc.mu.Lock()
+	reaction["name"] = c.name
+	if tabId, _ := msg["tabId"].(string); tabId != "" {
+		if c.doc.findTab(tabId) < 0 {
+			c.doc.mu.Unlock()
+			c.sendError(errTabNotFound)
+			return
+		}
+		reaction["tabId"] = tabId
+		if line, ok := msg["line"].(float64); ok && line >= 1 {
+			reaction["line"] = int(line)
+		}
+	}
+	c.doc.mu.Unlock()
+	if !c.allowReaction("reaction") {
+		return
+	}
+	c.relayEphemeral("reaction", reaction)
+}
+
+// handleHighlight points c at a range of lines in a tab, replacing its previous
+// highlight, or takes its highlight down when clear is set
+func (c *Client) handleHighlight(msg map[string]interface{}) {
+	if clear, _ := msg["clear"].(bool); clear {
+		c.doc.mu.Lock()
+		_, had := c.doc.highlights[c.uuid]
+		delete(c.doc.highlights, c.uuid)
+		c.doc.mu.Unlock()
+		if had {
+			c.relayEphemeral("highlight", map[string]interface{}{"type": "highlight", "uuid": c.uuid, "clear": true})
+		}
+		return
+	}
+	tabId, ok := c.stringField(msg, "tabId")
+	if !ok {
+		return
+	}
+	from, _ := msg["from"].(float64)
+	to, _ := msg["to"].(float64)
+	if from < 1 || to < from {
+		c.sendError(errInvalidLines)
+		return
+	}
+	note, _ := msg["note"].(string)
+	if utf8.RuneCountInString(note) > maxNoteRunes {
+		c.sendError(errNoteTooLong)
+		return
+	}
+	if !c.allowReaction("highlight") {
+		return
+	}
+	now := time.Now()
+	c.doc.mu.Lock()
+	if c.doc.findTab(tabId) < 0 {
+		c.doc.mu.Unlock()
+		c.sendError(errTabNotFound)
+		return
+	}
+	h := &highlight{
+		UUID:    c.uuid,
+		Name:    c.name,
+		TabID:   tabId,
+		From:    int(from),
+		To:      int(to),
+		Note:    note,
+		Expires: now.Add(highlightTTL).UnixMilli(),
+	}
+	c.doc.pruneHighlights(now)
+	c.doc.highlights[c.uuid] = h
+	c.doc.mu.Unlock()
+	c.relayEphemeral("highlight", map[string]interface{}{"type": "highlight", "highlight": h})
+}
+
+// relayEphemeral sends a reaction or highlight to everyone, including c so its
+// client can show it the way the others do. Like cursors, these are the first
+// to go when the document is overloaded.
+func (c *Client) relayEphemeral(kind string, v interface{}) {
+	if c.doc.load.shedding() {
+		shedMessages.Inc(metrics.Labels{"kind": kind})
+		return
+	}
+	message, err := json.Marshal(v)
+	if err != nil {
+		c.log.Debug("Error marshaling "+kind+" message", "error", err)
+		return
+	}
+	c.doc.send(BroadcastMessage{Message: message})
+}
+
+// pruneHighlights drops highlights that have expired
+// Note: Caller must hold doc.mu.Lock()
+func (doc *Document) pruneHighlights(now time.Time) {
+	for uuid, h := range doc.highlights {
+		if now.UnixMilli() >= h.Expires {
+			delete(doc.highlights, uuid)
+		}
+	}
+}
+
+// highlightList returns the highlights still up, for the init message
+// Note: Caller must hold doc.mu
+func (doc *Document) highlightList() []*highlight {
+	now := time.Now().UnixMilli()
+	list := []*highlight{}
+	for _, h := range doc.highlights {
+		if now < h.Expires {
+			list = append(list, h)
+		}
+	}
+	return list
+}
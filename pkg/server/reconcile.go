@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// reconcileRepairs counts documents found out of step with storage, by the repair applied
+var reconcileRepairs = metrics.NewCounter("gopad_reconcile_repairs_total", "Number of loaded documents found out of sync with storage")
+
+// reconcileLoop periodically checks every loaded document against storage until the server shuts down
+func (s *Server) reconcileLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.reconcile(s.ctx)
+		}
+	}
+}
+
+// reconcile repairs loaded documents whose version disagrees with storage.
+// Updates are delivered over pub/sub, so a message missed during a reconnect
+// would otherwise leave this instance serving a stale copy indefinitely.
+func (s *Server) reconcile(ctx context.Context) {
+	s.mu.RLock()
+	docs := make([]*Document, 0, len(s.documents))
+	for _, doc := range s.documents {
+		docs = append(docs, doc)
+	}
+	s.mu.RUnlock()
+
+	for _, doc := range docs {
+		if ctx.Err() != nil {
+			return
+		}
+		doc.reconcile()
+	}
+}
+
+// reconcile compares the document's version with the stored one and repairs any drift
+func (doc *Document) reconcile() {
+	stored, err := doc.server.store.DocumentVersion(doc.ctx, doc.ID)
+	if err != nil {
+		if doc.ctx.Err() == nil {
+			logger.Error("Error reading stored document version", "doc_id", doc.ID, "error", err)
+		}
+		return
+	}
+	doc.mu.RLock()
+	local := doc.version
+	doc.mu.RUnlock()
+
+	switch {
+	case stored > local:
+		// Missed an update from another instance
+		logger.Warn("Document is behind storage, reloading", "doc_id", doc.ID, "version", local, "stored_version", stored)
+		reconcileRepairs.Inc(metrics.Labels{"repair": "reload"})
+		if doc.saver.hasPending() {
+			// Saving conflicts and merges our unsaved changes onto the stored state
+			doc.saver.flush(doc.ctx)
+			return
+		}
+		latest, err := doc.server.store.LoadDocument(doc.ctx, doc.ID)
+		if err != nil {
+			logger.Error("Error reloading document", "doc_id", doc.ID, "error", err)
+			return
+		}
+		doc.applyRemoteUpdate(latest)
+	case stored < local:
+		// The stored copy was lost or rolled back; write ours again
+		logger.Warn("Storage is behind document, re-saving", "doc_id", doc.ID, "version", local, "stored_version", stored)
+		reconcileRepairs.Inc(metrics.Labels{"repair": "resave"})
+		if !doc.rebase(local, stored) {
+			return
+		}
+		if err := doc.saveState(doc.ctx); err != nil {
+			logger.Error("Error re-saving document", "doc_id", doc.ID, "error", err)
+		}
+	}
+}
+
+// rebase makes the next save compare against version stored, provided the
+// document is still at version local. It reports whether it did.
+func (doc *Document) rebase(local, stored int64) bool {
+	doc.saveMu.Lock()
+	defer doc.saveMu.Unlock()
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.version != local || doc.discarded {
+		return false
+	}
+	doc.version = stored
+	return true
+}
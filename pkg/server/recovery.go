@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/presence"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// recoverySnapshot is the content of a recovery file: every document loaded
+// on an instance as it was in memory, for restarting without losing changes
+// that haven't reached storage
+type recoverySnapshot struct {
+	Instance  string              `json:"instance"`
+	CreatedAt time.Time           `json:"createdAt"`
+	Documents []recoveredDocument `json:"documents"`
+}
+
+// recoveredDocument is one document of a recovery file
+type recoveredDocument struct {
+	ID       string                 `json:"id"`
+	State    *storage.DocumentState `json:"state"`
+	Base     *storage.DocumentState `json:"base,omitempty"` // last state read from or written to storage, for merging
+	Unsaved  bool                   `json:"unsaved"`        // State has changes storage may not have
+	Presence []presence.Entry       `json:"presence,omitempty"`
+}
+
+// WriteRecoveryFile writes every loaded document, including unsaved changes
+// and who is connected, to path. Storage isn't touched, so it works while
+// Redis is down, and the file is replaced atomically so a crash while writing
+// leaves the previous one intact.
+func (s *Server) WriteRecoveryFile(path string) (*recoverySnapshot, error) {
+	s.mu.RLock()
+	docs := make([]*Document, 0, len(s.documents))
+	for _, doc := range s.documents {
+		docs = append(docs, doc)
+	}
+	s.mu.RUnlock()
+	snapshot := &recoverySnapshot{Instance: s.instanceID, CreatedAt: time.Now().UTC()}
+	for _, doc := range docs {
+		snapshot.Documents = append(snapshot.Documents, doc.recoveryState())
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to write recovery file")
+	}
+	if err := replaceFile(path, data); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to write recovery file")
+	}
+	return snapshot, nil
+}
+
+// replaceFile writes data to path through a temporary file, written and
+// synced in full before it replaces the previous one
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gopad-recovery-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
+
+// recoveryState captures the document consistently for a recovery file
+func (doc *Document) recoveryState() recoveredDocument {
+	// A save in flight may yet fail, so its changes count as unsaved
+	saving := !doc.saveMu.TryLock()
+	if !saving {
+		defer doc.saveMu.Unlock()
+	}
+	unsaved := saving || doc.saver.hasPending() || doc.compactor.hasPending()
+	doc.mu.RLock()
+	defer doc.mu.RUnlock()
+	rec := recoveredDocument{
+		ID:      doc.ID,
+		State:   doc.currentState(),
+		Base:    doc.base,
+		Unsaved: unsaved,
+	}
+	for _, client := range doc.users.connected() {
+		// Synthetic collaborators don't survive a restart
+		if client.conn != nil {
+			rec.Presence = append(rec.Presence, client.presenceEntry())
+		}
+	}
+	return rec
+}
+
+// Restore loads the documents of a recovery file written by WriteRecoveryFile
+// and returns how many there were. Documents with unsaved changes are saved
+// again, merging with anything stored since; the others are only used where
+// storage has nothing as recent. Their users stay listed for the presence TTL
+// while they reconnect. Call it before the server starts handling requests.
+func (s *Server) Restore(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, apperr.Wrap(apperr.CodeInternal, err, "failed to read recovery file")
+	}
+	var snapshot recoverySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, apperr.Wrap(apperr.CodeInternal, err, "failed to read recovery file")
+	}
+	s.mu.Lock()
+	for i := range snapshot.Documents {
+		if rec := &snapshot.Documents[i]; rec.State != nil {
+			s.recovered[rec.ID] = rec
+		}
+	}
+	s.mu.Unlock()
+	for _, rec := range snapshot.Documents {
+		if rec.State != nil {
+			if _, err := s.getOrCreateDocument(s.ctx, rec.ID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	logger.Info("Documents restored from recovery file", "path", path, "documents", len(snapshot.Documents), "created_at", snapshot.CreatedAt)
+	return len(snapshot.Documents), nil
+}
+
+// recoveredState returns rec, the document's entry in a recovery file if it
+// has one, to load the document with instead of the stored state if it's
+// more recent
+func recoveredState(rec *recoveredDocument, stored *storage.DocumentState, loadErr error) *recoveredDocument {
+	if rec == nil {
+		return nil
+	}
+	if rec.Unsaved || loadErr != nil || rec.State.Version > stored.Version {
+		return rec
+	}
+	return nil
+}
+
+// handleRecoverySnapshot writes the instance's loaded documents to its recovery file
+func (s *Server) handleRecoverySnapshot(c *gin.Context) {
+	snapshot, err := s.WriteRecoveryFile(s.config.RecoveryFile)
+	if err != nil {
+		requestLog(c).Error("Error writing recovery file", "path", s.config.RecoveryFile, "error", err)
+		abortWithError(c, err)
+		return
+	}
+	unsaved := 0
+	for _, rec := range snapshot.Documents {
+		if rec.Unsaved {
+			unsaved++
+		}
+	}
+	requestLog(c).Info("Recovery file written", "path", s.config.RecoveryFile, "documents", len(snapshot.Documents), "unsaved", unsaved)
+	c.JSON(http.StatusOK, gin.H{
+		"path":      s.config.RecoveryFile,
+		"createdAt": snapshot.CreatedAt,
+		"documents": len(snapshot.Documents),
+		"unsaved":   unsaved,
+	})
+}
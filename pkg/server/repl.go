@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/repl"
+	"github.com/shiftregister-vg/gopad/pkg/telemetry"
+)
+
+// tabKindREPL marks a tab attached to an interpreter session instead of holding editable content
+const tabKindREPL = "repl"
+
+// replTranscriptSize is how much of a REPL's recent input and output is kept
+// for clients that join while it is running
+const replTranscriptSize = 64 << 10
+
+// errNotREPL is sent for REPL messages about tabs of another kind
+var errNotREPL = apperr.New(apperr.CodeInvalidTab, "tab is not a REPL")
+
+// replSession is the interpreter attached to a REPL tab
+type replSession struct {
+	session    *repl.Session
+	transcript []byte // guarded by doc.replMu
+}
+
+// checkTabKind verifies a new tab's kind, and for REPL tabs that its runtime
+// is configured and the document may run code
+func (doc *Document) checkTabKind(tab Tab) error {
+	switch tab.Kind {
+	case "":
+		return nil
+	case tabKindREPL:
+		if _, ok := doc.server.config.ReplCommands[tab.Runtime]; !ok {
+			return apperr.Newf(apperr.CodeValidation, "REPL runtime %q is not available", tab.Runtime)
+		}
+		return doc.checkFeature(policy.FeatureExecution)
+	default:
+		return apperr.Newf(apperr.CodeValidation, "unknown tab kind %q", tab.Kind)
+	}
+}
+
+// replSession returns the interpreter of a REPL tab, starting it on first use
+func (doc *Document) replSession(tabId string) (*replSession, error) {
+	doc.mu.RLock()
+	i := doc.findTab(tabId)
+	var tab Tab
+	if i >= 0 {
+		tab = doc.Tabs[i]
+	}
+	doc.mu.RUnlock()
+	if i < 0 {
+		return nil, errTabNotFound
+	}
+	if tab.Kind != tabKindREPL {
+		return nil, errNotREPL
+	}
+	command, ok := doc.server.config.ReplCommands[tab.Runtime]
+	if !ok {
+		return nil, apperr.Newf(apperr.CodeValidation, "REPL runtime %q is not available", tab.Runtime)
+	}
+
+	doc.replMu.Lock()
+	defer doc.replMu.Unlock()
+	if rs, ok := doc.repls[tabId]; ok {
+		return rs, nil
+	}
+	rs := &replSession{}
+	session, err := repl.Start(doc.ctx, command, func(data []byte) {
+		doc.replOutput(tabId, rs, "output", "", data)
+	})
+	if err != nil {
+		logger.Error("Error starting REPL", "doc_id", doc.ID, "tab_id", tabId, "runtime", tab.Runtime, "error", err)
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to start the REPL")
+	}
+	rs.session = session
+	doc.repls[tabId] = rs
+	doc.server.usage.Record(doc.ID, telemetry.FeatureRun)
+	logger.Info("REPL started", "doc_id", doc.ID, "tab_id", tabId, "runtime", tab.Runtime)
+
+	go func() {
+		<-session.Done()
+		doc.replMu.Lock()
+		if doc.repls[tabId] == rs {
+			delete(doc.repls, tabId)
+		}
+		doc.replMu.Unlock()
+		logger.Info("REPL exited", "doc_id", doc.ID, "tab_id", tabId, "exit_code", session.ExitCode())
+		doc.broadcastREPL(map[string]interface{}{
+			"type":     "replExit",
+			"tabId":    tabId,
+			"exitCode": session.ExitCode(),
+		})
+	}()
+	return rs, nil
+}
+
+// replOutput records input or output of a REPL in its transcript and shares it with every client
+func (doc *Document) replOutput(tabId string, rs *replSession, stream, user string, data []byte) {
+	doc.replMu.Lock()
+	rs.transcript = append(rs.transcript, data...)
+	if excess := len(rs.transcript) - replTranscriptSize; excess > 0 {
+		rs.transcript = append([]byte(nil), rs.transcript[excess:]...)
+	}
+	doc.replMu.Unlock()
+	msg := map[string]interface{}{
+		"type":   "replOutput",
+		"tabId":  tabId,
+		"stream": stream,
+		"data":   string(data),
+	}
+	if user != "" {
+		msg["user"] = user
+	}
+	doc.broadcastREPL(msg)
+}
+
+// broadcastREPL sends a REPL message to all clients
+func (doc *Document) broadcastREPL(msg map[string]interface{}) {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		logger.Debug("Error marshaling REPL message", "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
+
+// replTranscripts returns the recent input and output of each running REPL, by tab ID
+func (doc *Document) replTranscripts() map[string]string {
+	doc.replMu.Lock()
+	defer doc.replMu.Unlock()
+	transcripts := make(map[string]string, len(doc.repls))
+	for tabId, rs := range doc.repls {
+		transcripts[tabId] = string(rs.transcript)
+	}
+	return transcripts
+}
+
+// stopREPL kills the interpreter of a tab, if it is running
+func (doc *Document) stopREPL(tabId string) {
+	doc.replMu.Lock()
+	rs, ok := doc.repls[tabId]
+	delete(doc.repls, tabId)
+	doc.replMu.Unlock()
+	if ok {
+		// Closing waits for the last output, which needs replMu
+		rs.session.Close()
+	}
+}
+
+// stopREPLs kills every interpreter of the document, once nobody is left to use them
+func (doc *Document) stopREPLs() {
+	doc.replMu.Lock()
+	sessions := make([]*replSession, 0, len(doc.repls))
+	for tabId, rs := range doc.repls {
+		sessions = append(sessions, rs)
+		delete(doc.repls, tabId)
+	}
+	doc.replMu.Unlock()
+	for _, rs := range sessions {
+		rs.session.Close()
+	}
+	if len(sessions) > 0 {
+		logger.Info("Stopped REPLs of empty document", "doc_id", doc.ID, "sessions", len(sessions))
+	}
+}
+
+// handleReplInput sends a line typed by this client to a REPL tab's
+// interpreter, starting it if needed, and shows it to everyone
+func (c *Client) handleReplInput(msg map[string]interface{}) {
+	tabId, ok := c.stringField(msg, "tabId")
+	if !ok {
+		return
+	}
+	input, ok := c.stringField(msg, "input")
+	if !ok {
+		return
+	}
+	if err := c.doc.checkFeature(policy.FeatureExecution); err != nil {
+		c.sendError(err)
+		return
+	}
+	rs, err := c.doc.replSession(tabId)
+	if err != nil {
+		c.sendError(err)
+		return
+	}
+	c.doc.replOutput(tabId, rs, "input", c.name, []byte(input))
+	if err := rs.session.Write(input); err != nil {
+		c.sendError(apperr.Wrap(apperr.CodeInternal, err, "failed to send input to the REPL"))
+	}
+}
+
+// handleReplReset kills a REPL tab's interpreter; the next input starts a fresh one
+func (c *Client) handleReplReset(msg map[string]interface{}) {
+	tabId, ok := c.stringField(msg, "tabId")
+	if !ok {
+		return
+	}
+	c.doc.stopREPL(tabId)
+}
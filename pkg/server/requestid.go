@@ -0,0 +1,44 @@
+package server
+
+import (
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+)
+
+// validRequestID limits which caller supplied IDs are trusted, so logs can't be polluted
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID tags every request with an ID, reusing one set by a proxy in X-Request-ID,
+// echoes it in the response and writes an access log line carrying it
+func requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newID()
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+
+	start := time.Now()
+	c.Next()
+	requestLog(c).Info("Request handled",
+		"method", c.Request.Method,
+		"client_ip", c.ClientIP(),
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+	)
+}
+
+// requestLog returns a logger that tags messages with the request's ID
+func requestLog(c *gin.Context) *slog.Logger {
+	return logger.With("request_id", c.GetString(requestIDKey))
+}
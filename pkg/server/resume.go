@@ -0,0 +1,147 @@
+package server
+
+import (
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// replayBufferSize is the most broadcasts kept for a disconnected client. It
+// stays below the send buffer so a whole replay can be queued at once; clients
+// that miss more get a full init instead.
+const replayBufferSize = 128
+
+// resumes counts reconnections by whether their session could be resumed
+var resumes = metrics.NewCounter("gopad_session_resumes_total", "Number of reconnections asking to resume a session")
+
+// session keeps the broadcasts a disconnected client misses, so it can catch
+// up with them when it reconnects with a resume.<token> subprotocol or ?resume=<token>
+type session struct {
+	client     *Client  // the disconnected client, whose identity and subscriptions carry over
+	frames     []*frame // missed broadcasts, oldest first
+	detachedAt time.Time
+}
+
+// resumeRequest asks the hub to hand a session over to a new connection
+type resumeRequest struct {
+	token  string
+	client *Client
+	done   chan bool // receives whether the session was resumed
+}
+
+// detach keeps a session for a client that disconnected, holding the frames
+// still queued for it and the broadcasts it misses from now on
+// Note: Must only be called from the hub goroutine
+func (doc *Document) detach(client *Client) {
+	sess := &session{client: client, detachedAt: time.Now()}
+	delete(doc.clients, client)
+	close(client.send)
+	for frame := range client.send {
+		sess.frames = append(sess.frames, frame)
+	}
+	for _, frame := range client.backlog {
+		sess.frames = append(sess.frames, frame.message)
+	}
+	client.backlog = nil
+	if len(sess.frames) > replayBufferSize {
+		return
+	}
+	doc.sessions[client.session] = sess
+}
+
+// recordMissed adds a broadcast to the sessions of disconnected clients that subscribe to it
+// Note: Must only be called from the hub goroutine
+func (doc *Document) recordMissed(msgType string, message *frame) {
+	for token, sess := range doc.sessions {
+		if !sess.client.wants(msgType) {
+			continue
+		}
+		if len(sess.frames) >= replayBufferSize {
+			// Too far behind to catch up; it gets a full init on reconnect
+			logger.Debug("Replay buffer full, dropping session", "doc_id", doc.ID, "conn_id", sess.client.connID)
+			delete(doc.sessions, token)
+			continue
+		}
+		sess.frames = append(sess.frames, message)
+	}
+}
+
+// expireSessions drops sessions of clients that didn't reconnect within the resume window
+// Note: Must only be called from the hub goroutine
+func (doc *Document) expireSessions() {
+	window := doc.server.config.ResumeWindow
+	for token, sess := range doc.sessions {
+		if time.Since(sess.detachedAt) > window {
+			delete(doc.sessions, token)
+		}
+	}
+}
+
+// resume registers client in place of a disconnected session's client and
+// queues the broadcasts it missed, preceded by a resumed message. It returns
+// false if the session is unknown, expired or overflowed.
+// Note: Must only be called from the hub goroutine
+func (doc *Document) resume(req resumeRequest) bool {
+	sess, ok := doc.sessions[req.token]
+	if !ok {
+		return false
+	}
+	delete(doc.sessions, req.token)
+	old, client := sess.client, req.client
+	client.session = req.token
+	client.uuid = old.uuid
+	client.name = old.name
+	client.anonymous = old.anonymous
+	client.color = old.color
+	client.avatarURL, client.gravatarHash = old.avatarURL, old.gravatarHash
+	client.cursor = old.cursor
+	client.following, client.view = old.following, old.view
+	client.bases = old.bases
+	client.presenceDigest = old.presenceDigest
+	client.channels.Store(old.channels.Load())
+	doc.clients[client] = true
+	client.reply(map[string]interface{}{
+		"type":     "resumed",
+		"session":  req.token,
+		"replayed": len(sess.frames),
+	})
+	for _, frame := range sess.frames {
+		client.send <- frame
+	}
+	return true
+}
+
+// resumeSession asks the hub to resume the session identified by token on
+// client's connection and restores the user it belonged to
+func (doc *Document) resumeSession(token string, client *Client) bool {
+	req := resumeRequest{token: token, client: client, done: make(chan bool, 1)}
+	select {
+	case doc.resumes <- req:
+	case <-doc.ctx.Done():
+		return false
+	}
+	var resumed bool
+	select {
+	case resumed = <-req.done:
+	case <-doc.ctx.Done():
+		return false
+	}
+	if !resumed {
+		resumes.Inc(metrics.Labels{"result": "expired"})
+		return false
+	}
+	resumes.Inc(metrics.Labels{"result": "resumed"})
+
+	if client.uuid != "" {
+		doc.mu.Lock()
+		// Take the user back unless they reconnected without resuming in the meantime
+		doc.users.rejoin(client, doc.remoteColors(client.uuid))
+		entry := client.presenceEntry()
+		doc.mu.Unlock()
+		doc.broadcastUserList()
+		doc.recordPresence(entry)
+	}
+	client.log.Info("Client resumed session", "client_uuid", client.uuid)
+	return true
+}
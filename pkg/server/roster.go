@@ -0,0 +1,156 @@
+package server
+
+import "time"
+
+// disconnectGrace is how long a disconnected user stays listed, keeping their
+// color, so a reconnect or reload doesn't shuffle colors around
+const disconnectGrace = 2 * time.Minute
+
+// roster tracks the users of a document: the client each user is connected
+// through, the color they were given and when they disconnected. Colors are
+// never stored apart from the users holding them, so they can't leak: a color
+// is free exactly when no listed user has a similar one.
+// Note: Caller must hold doc.mu for every method
+type roster struct {
+	clients map[string]*Client // uuid -> latest client of the user, including disconnected ones
+}
+
+func newRoster() *roster {
+	return &roster{clients: make(map[string]*Client)}
+}
+
+// join lists c as user uuid and gives it the user's color, or for new users
+// the preferred one if it's free and the one derived from uuid otherwise. It returns
+// the client c replaced, if any, which the caller must unregister. remote are the
+// colors of users connected through other instances.
+func (r *roster) join(c *Client, uuid, preferred string, remote []string) (replaced *Client) {
+	// A client renaming itself to another uuid stops holding the old user's color
+	if c.uuid != uuid && r.clients[c.uuid] == c {
+		delete(r.clients, c.uuid)
+		c.color = ""
+	}
+	if old, ok := r.clients[uuid]; ok && old != c {
+		// The same user keeps their color across connections
+		c.color = old.color
+		replaced = old
+	} else if preferred != "" && preferred != c.color && r.free(preferred, c, remote) {
+		c.color = preferred
+	}
+	c.uuid = uuid
+	if c.color == "" {
+		c.color = r.pickColor(uuid, c, remote)
+	}
+	c.disconnected = false
+	c.disconnectedAt = time.Time{}
+	r.clients[uuid] = c
+	return replaced
+}
+
+// rejoin lists a resumed client as its user again unless they reconnected
+// without resuming in the meantime, and reports whether it did. The client
+// keeps its color unless someone else was given it since.
+func (r *roster) rejoin(c *Client, remote []string) bool {
+	if existing, ok := r.clients[c.uuid]; ok && !existing.disconnected {
+		return false
+	}
+	delete(r.clients, c.uuid)
+	if c.color == "" || !r.free(c.color, c, remote) {
+		c.color = r.pickColor(c.uuid, c, remote)
+	}
+	c.disconnected = false
+	c.disconnectedAt = time.Time{}
+	r.clients[c.uuid] = c
+	return true
+}
+
+// leave marks c as disconnected at now. Its user stays listed with their color
+// for disconnectGrace.
+func (r *roster) leave(c *Client, now time.Time) {
+	c.disconnected = true
+	c.disconnectedAt = now
+}
+
+// remove drops c's user at once, freeing their color
+func (r *roster) remove(c *Client) {
+	if r.clients[c.uuid] == c {
+		delete(r.clients, c.uuid)
+	}
+}
+
+// expire removes users who have been disconnected for disconnectGrace at now,
+// freeing their colors, and reports whether there were any
+func (r *roster) expire(now time.Time) bool {
+	removed := false
+	for uuid, c := range r.clients {
+		if c.disconnected && now.Sub(c.disconnectedAt) >= disconnectGrace {
+			delete(r.clients, uuid)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// connected returns the clients of users who haven't disconnected
+func (r *roster) connected() []*Client {
+	clients := make([]*Client, 0, len(r.clients))
+	for _, c := range r.clients {
+		if !c.disconnected {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// heldHues returns the hues of the colors held by users other than except,
+// here and on other instances
+func (r *roster) heldHues(except *Client, remote []string) []float64 {
+	var hues []float64
+	for _, c := range r.clients {
+		if hue, ok := colorHue(c.color); ok && c != except {
+			hues = append(hues, hue)
+		}
+	}
+	for _, color := range remote {
+		if hue, ok := colorHue(color); ok {
+			hues = append(hues, hue)
+		}
+	}
+	return hues
+}
+
+// free reports whether color is far enough from the colors of users other
+// than except to tell them apart
+func (r *roster) free(color string, except *Client, remote []string) bool {
+	hue, ok := colorHue(color)
+	return ok && nearestHue(hue, r.heldHues(except, remote)) >= minHueDistance
+}
+
+// pickColor returns the color of user uuid, clear of the colors of users other than except
+func (r *roster) pickColor(uuid string, except *Client, remote []string) string {
+	return colorFor(uuid, r.heldHues(except, remote))
+}
+
+// remoteColors returns the colors of users connected only through other
+// instances, other than user uuid
+// Note: Caller must hold doc.mu
+func (doc *Document) remoteColors(uuid string) []string {
+	var colors []string
+	for id, entry := range doc.remoteUsers {
+		if _, local := doc.users.clients[id]; !local && id != uuid {
+			colors = append(colors, entry.Color)
+		}
+	}
+	return colors
+}
+
+// expireUsers removes users whose disconnect grace has run out and reports
+// whether there were any
+func (doc *Document) expireUsers() bool {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if !doc.users.expire(time.Now()) {
+		return false
+	}
+	doc.releaseFollowers()
+	return true
+}
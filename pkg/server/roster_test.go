@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// hueOf returns the hue of a color the roster gave out, failing the test for anything else
+func hueOf(t *testing.T, color string) float64 {
+	t.Helper()
+	hue, ok := colorHue(color)
+	if !ok {
+		t.Fatalf("%q is not a user color", color)
+	}
+	return hue
+}
+
+func TestRosterJoin(t *testing.T) {
+	r := newRoster()
+	alice := &Client{}
+	if replaced := r.join(alice, "alice", "", nil); replaced != nil {
+		t.Fatalf("first join replaced %v", replaced)
+	}
+	if alice.uuid != "alice" || alice.disconnected {
+		t.Fatalf("unexpected client after join: uuid %q, disconnected %v", alice.uuid, alice.disconnected)
+	}
+	aliceHue := hueOf(t, alice.color)
+
+	bob := &Client{}
+	r.join(bob, "bob", "", nil)
+	if d := nearestHue(hueOf(t, bob.color), []float64{aliceHue}); d < minHueDistance {
+		t.Errorf("bob's color is %.0f degrees from alice's", d)
+	}
+
+	// A free preferred color is used
+	preferred := hslColor(aliceHue + 90)
+	carol := &Client{}
+	r.join(carol, "carol", preferred, nil)
+	if carol.color != preferred {
+		t.Errorf("expected carol's preferred color %s, got %s", preferred, carol.color)
+	}
+	if n := len(r.connected()); n != 3 {
+		t.Errorf("expected 3 connected users, got %d", n)
+	}
+}
+
+func TestRosterRejoinWithinGraceKeepsColor(t *testing.T) {
+	r := newRoster()
+	first := &Client{}
+	r.join(first, "alice", "", nil)
+	r.leave(first, time.Now())
+
+	// The reconnecting user asks for another color but keeps the one they had
+	second := &Client{}
+	replaced := r.join(second, "alice", hslColor(hueOf(t, first.color)+180), nil)
+	if replaced != first {
+		t.Fatalf("expected the previous connection to be replaced, got %v", replaced)
+	}
+	if second.color != first.color {
+		t.Errorf("color changed on rejoin from %s to %s", first.color, second.color)
+	}
+	connected := r.connected()
+	if len(connected) != 1 || connected[0] != second {
+		t.Errorf("expected only the new connection to be connected, got %v", connected)
+	}
+}
+
+func TestRosterLeave(t *testing.T) {
+	r := newRoster()
+	alice := &Client{}
+	r.join(alice, "alice", "", nil)
+	now := time.Now()
+	r.leave(alice, now)
+
+	if !alice.disconnected || !alice.disconnectedAt.Equal(now) {
+		t.Fatalf("expected alice to be disconnected at %v", now)
+	}
+	if n := len(r.connected()); n != 0 {
+		t.Errorf("expected no connected users, got %d", n)
+	}
+	// The user stays listed and holds their color during the grace period
+	if r.clients["alice"] != alice {
+		t.Error("alice is no longer listed")
+	}
+	if r.free(alice.color, nil, nil) {
+		t.Error("alice's color is free while alice is listed")
+	}
+}
+
+func TestRosterExpire(t *testing.T) {
+	r := newRoster()
+	alice, bob := &Client{}, &Client{}
+	r.join(alice, "alice", "", nil)
+	r.join(bob, "bob", "", nil)
+	now := time.Now()
+	r.leave(alice, now)
+
+	if r.expire(now.Add(disconnectGrace - time.Second)) {
+		t.Fatal("expired a user within the grace period")
+	}
+	if r.clients["alice"] != alice {
+		t.Fatal("alice was removed within the grace period")
+	}
+	if !r.expire(now.Add(disconnectGrace)) {
+		t.Fatal("expected alice to expire after the grace period")
+	}
+	if _, ok := r.clients["alice"]; ok {
+		t.Error("alice is still listed after expiring")
+	}
+	if r.clients["bob"] != bob {
+		t.Error("connected users must not expire")
+	}
+	if !r.free(alice.color, bob, nil) {
+		t.Error("alice's color wasn't freed when alice expired")
+	}
+}
+
+func TestRosterReclaimsColorsWhenPaletteIsExhausted(t *testing.T) {
+	r := newRoster()
+	// Fill the palette with users whose colors can all be told apart
+	var users []*Client
+	for i := 0; ; i++ {
+		uuid := fmt.Sprintf("user-%d", i)
+		if !r.free(r.pickColor(uuid, nil, nil), nil, nil) {
+			break
+		}
+		c := &Client{}
+		r.join(c, uuid, "", nil)
+		users = append(users, c)
+	}
+	if len(users) < 2 {
+		t.Fatalf("palette held only %d users", len(users))
+	}
+	first := users[0]
+	now := time.Now()
+	r.leave(first, now)
+
+	// The disconnected user's color stays taken during the grace period
+	late := &Client{}
+	r.join(late, "late", first.color, nil)
+	if late.color == first.color {
+		t.Fatal("a color held by a disconnected user was given out within the grace period")
+	}
+	r.remove(late)
+
+	r.expire(now.Add(disconnectGrace))
+	var held []float64
+	for _, c := range users[1:] {
+		held = append(held, hueOf(t, c.color))
+	}
+	reclaimed := &Client{}
+	r.join(reclaimed, "reclaimed", "", nil)
+	if d := nearestHue(hueOf(t, reclaimed.color), held); d < minHueDistance {
+		t.Errorf("new user's color is %.0f degrees from a held one after the palette was freed", d)
+	}
+	r.remove(reclaimed)
+	preferring := &Client{}
+	r.join(preferring, "preferring", first.color, nil)
+	if preferring.color != first.color {
+		t.Errorf("expected the expired user's color %s to be reused, got %s", first.color, preferring.color)
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/runner"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/telemetry"
+)
+
+var (
+	errRunUnavailable = apperr.New(apperr.CodeValidation, "code execution is not configured")
+	errRunBusy        = apperr.New(apperr.CodeConflict, "code is already running")
+)
+
+// codeRun is a tab's code running in the sandbox
+type codeRun struct {
+	id     string
+	tabId  string
+	cancel context.CancelFunc
+}
+
+// startRun runs the code of an editor tab in the sandbox and shares its output
+// with every client. A document runs one program at a time.
+func (doc *Document) startRun(tabId, user string) error {
+	r := doc.server.runner
+	if r == nil {
+		return errRunUnavailable
+	}
+	if err := doc.checkFeature(policy.FeatureExecution); err != nil {
+		return err
+	}
+	doc.mu.RLock()
+	if tabId == "" {
+		tabId = doc.ActiveTabId
+	}
+	i := doc.findTab(tabId)
+	var tab Tab
+	if i >= 0 {
+		tab = doc.Tabs[i]
+	}
+	language := doc.Language
+	doc.mu.RUnlock()
+	if i < 0 {
+		return errTabNotFound
+	}
+	if tab.Kind != "" {
+		return apperr.New(apperr.CodeInvalidTab, "only editor tabs can be run")
+	}
+	if !r.Supports(language) {
+		return apperr.Newf(apperr.CodeValidation, "running %s code is not available", language)
+	}
+
+	doc.replMu.Lock()
+	if doc.run != nil {
+		doc.replMu.Unlock()
+		return errRunBusy
+	}
+	ctx, cancel := context.WithCancel(doc.ctx)
+	run := &codeRun{id: newID(), tabId: tabId, cancel: cancel}
+	doc.run = run
+	doc.replMu.Unlock()
+
+	doc.server.usage.Record(doc.ID, telemetry.FeatureRun)
+	logger.Info("Run started", "doc_id", doc.ID, "tab_id", tabId, "language", language, "user", user)
+	doc.broadcastREPL(map[string]interface{}{
+		"type":     "runStart",
+		"runId":    run.id,
+		"tabId":    tabId,
+		"language": language,
+		"user":     user,
+	})
+
+	go func() {
+		defer cancel()
+		start := time.Now()
+		var stdout, stderr strings.Builder
+		result, err := r.Run(ctx, language, tab.Content, func(stream string, data []byte) {
+			// The runner caps the output, so it's safe to collect all of it
+			if stream == "stderr" {
+				stderr.Write(data)
+			} else {
+				stdout.Write(data)
+			}
+			doc.broadcastREPL(map[string]interface{}{
+				"type":   "runOutput",
+				"runId":  run.id,
+				"tabId":  tabId,
+				"stream": stream,
+				"data":   string(data),
+			})
+		})
+		doc.replMu.Lock()
+		if doc.run == run {
+			doc.run = nil
+		}
+		doc.replMu.Unlock()
+		msg := map[string]interface{}{
+			"type":      "runExit",
+			"runId":     run.id,
+			"tabId":     tabId,
+			"exitCode":  result.ExitCode,
+			"timedOut":  result.TimedOut,
+			"truncated": result.Truncated,
+		}
+		if err != nil {
+			logger.Error("Error running code", "doc_id", doc.ID, "tab_id", tabId, "language", language, "error", err)
+			// The program never ran, which clients show like a crash
+			result.ExitCode = -1
+			msg["exitCode"] = -1
+			msg["failed"] = true
+		}
+		logger.Info("Run finished", "doc_id", doc.ID, "tab_id", tabId, "exit_code", result.ExitCode,
+			"timed_out", result.TimedOut, "truncated", result.Truncated)
+		doc.broadcastREPL(msg)
+
+		output := &storage.RunOutput{
+			RunID:     run.id,
+			Revision:  storage.ContentRevision(tab.Content),
+			User:      user,
+			ExitCode:  result.ExitCode,
+			TimedOut:  result.TimedOut,
+			Truncated: result.Truncated,
+			Failed:    err != nil,
+			Duration:  time.Since(start).Milliseconds(),
+			Finished:  time.Now().UnixMilli(),
+		}
+		doc.fillOutput(output, stdout.String(), stderr.String())
+		doc.recordOutput(tabId, output)
+	}()
+	return nil
+}
+
+// Limits on the output kept with a document, which is far less than a run may
+// print: what's cut off was still streamed to the clients watching the run
+const (
+	maxOutputText = 64 << 10  // bytes of each of stdout and stderr
+	maxRichOutput = 512 << 10 // bytes of all rich output together
+)
+
+// richOutputTypes lists the MIME types programs may display, and whether
+// their data is base64 encoded
+var richOutputTypes = map[string]bool{
+	"text/html":     false,
+	"text/markdown": false,
+	"image/png":     true,
+	"image/jpeg":    true,
+	"image/gif":     true,
+}
+
+// fillOutput stores the text and rich output of a run in output, within the
+// limits of what a document keeps. HTML is sanitized like rendered notes, and
+// unsupported or malformed displays are dropped.
+func (doc *Document) fillOutput(output *storage.RunOutput, stdout, stderr string) {
+	text, displays := runner.SplitDisplays(stdout)
+	output.Stdout, output.Stderr = keepOutput(output, text), keepOutput(output, stderr)
+	size := 0
+	for _, d := range displays {
+		binary, ok := richOutputTypes[d.MIMEType]
+		if !ok {
+			continue
+		}
+		if binary {
+			if _, err := base64.StdEncoding.DecodeString(d.Data); err != nil {
+				continue
+			}
+		} else if d.MIMEType == "text/html" {
+			d.Data = doc.server.sanitizer.HTML(d.Data)
+		}
+		if size+len(d.Data) > maxRichOutput {
+			output.Truncated = true
+			break
+		}
+		size += len(d.Data)
+		output.Rich = append(output.Rich, storage.RichOutput{MIMEType: d.MIMEType, Data: d.Data})
+	}
+}
+
+// keepOutput returns the part of a stream kept in output, marking it truncated
+// when that isn't all of it
+func keepOutput(output *storage.RunOutput, text string) string {
+	if len(text) <= maxOutputText {
+		return text
+	}
+	output.Truncated = true
+	return strings.ToValidUTF8(text[:maxOutputText], "")
+}
+
+// recordOutput attaches the output of a run to its tab, replacing the one of
+// the previous run, and shares it with every client
+func (doc *Document) recordOutput(tabId string, output *storage.RunOutput) {
+	doc.mu.Lock()
+	// The tab may have been deleted while it ran
+	if doc.findTab(tabId) < 0 {
+		doc.mu.Unlock()
+		return
+	}
+	if doc.outputs == nil {
+		doc.outputs = make(map[string]*storage.RunOutput)
+	}
+	doc.outputs[tabId] = output
+	doc.mu.Unlock()
+	doc.broadcastREPL(outputMessage(tabId, output))
+	doc.scheduleSave()
+}
+
+// outputMessage tells clients about the output of a tab's last run
+func outputMessage(tabId string, output *storage.RunOutput) map[string]interface{} {
+	return map[string]interface{}{
+		"type":   "tabOutput",
+		"tabId":  tabId,
+		"output": output,
+	}
+}
+
+// tabOutputs returns the outputs of the document's tabs, leaving out those of
+// deleted tabs
+// Note: Caller must hold doc.mu
+func (doc *Document) tabOutputs() map[string]*storage.RunOutput {
+	outputs := make(map[string]*storage.RunOutput, len(doc.outputs))
+	for tabId, output := range doc.outputs {
+		if doc.findTab(tabId) >= 0 {
+			outputs[tabId] = output
+		}
+	}
+	return outputs
+}
+
+// outputChanges builds tabOutput messages for the runs whose output arrived
+// from another instance since before
+// Note: Caller must hold doc.mu
+func (doc *Document) outputChanges(before map[string]*storage.RunOutput) []map[string]interface{} {
+	var msgs []map[string]interface{}
+	for tabId, output := range doc.tabOutputs() {
+		if previous, ok := before[tabId]; !ok || previous.RunID != output.RunID {
+			msgs = append(msgs, outputMessage(tabId, output))
+		}
+	}
+	return msgs
+}
+
+// stopRun kills the program running for the document, if any
+func (doc *Document) stopRun() {
+	doc.replMu.Lock()
+	run := doc.run
+	doc.replMu.Unlock()
+	if run != nil {
+		run.cancel()
+	}
+}
+
+// handleRun runs the code of the given tab, or of the active tab when none is given
+func (c *Client) handleRun(msg map[string]interface{}) {
+	tabId, _ := msg["tabId"].(string)
+	if err := c.doc.startRun(tabId, c.name); err != nil {
+		c.sendError(err)
+	}
+}
+
+// handleRunStop kills the running program; its runExit reports it as killed
+func (c *Client) handleRunStop() {
+	c.doc.stopRun()
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+const (
+	// saveRetryBackoff and saveRetryBackoffMax bound the wait before flushing
+	// again after a save failed
+	saveRetryBackoff    = time.Second
+	saveRetryBackoffMax = time.Minute
+)
+
+// saver coalesces document writes so storage is hit at most once per interval,
+// or sooner once maxOps changes have accumulated
+type saver struct {
+	doc      *Document
+	interval time.Duration
+	maxOps   int
+	mu       sync.Mutex
+	pending  int
+	failures int // consecutive failed saves
+	timer    *time.Timer
+	flushMu  sync.Mutex // serializes flushes, so the final one waits for a save in flight
+}
+
+func newSaver(doc *Document, interval time.Duration, maxOps int) *saver {
+	return &saver{
+		doc:      doc,
+		interval: interval,
+		maxOps:   maxOps,
+	}
+}
+
+// schedule records a change and arranges for it to be persisted
+func (s *saver) schedule() {
+	s.mu.Lock()
+	s.pending++
+	if s.interval <= 0 || (s.maxOps > 0 && s.pending >= s.maxOps) {
+		s.mu.Unlock()
+		// Flush asynchronously so callers such as the hub never block on storage
+		go s.flush(s.doc.ctx)
+		return
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.interval, func() {
+			s.flush(s.doc.ctx)
+		})
+	}
+	s.mu.Unlock()
+}
+
+// hasPending reports whether there are changes waiting to be persisted
+func (s *saver) hasPending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending > 0
+}
+
+// flush persists the document if there are unsaved changes
+func (s *saver) flush(ctx context.Context) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.doc.mu.RLock()
+	discarded := s.doc.discarded
+	s.doc.mu.RUnlock()
+	if s.pending == 0 || discarded {
+		s.pending = 0
+		s.mu.Unlock()
+		return
+	}
+	pending := s.pending
+	s.pending = 0
+	s.mu.Unlock()
+
+	if err := s.doc.saveState(ctx); err != nil {
+		logger.Error("Error saving document state", "doc_id", s.doc.ID, "error", err)
+		// Keep the changes pending so the next flush retries them, and the
+		// state in case the document is unloaded before storage is back
+		s.mu.Lock()
+		s.pending += pending
+		s.failures++
+		s.retry()
+		s.mu.Unlock()
+		s.doc.server.holdSave(s.doc)
+		return
+	}
+	s.mu.Lock()
+	s.failures = 0
+	s.mu.Unlock()
+	s.doc.server.saved(s.doc.ID)
+	logger.Debug("Document saved", "doc_id", s.doc.ID, "ops", pending)
+}
+
+// retry arms the timer to flush again after a failed save, backing off while
+// storage stays unavailable. Once the document is closing, its hub's final
+// flush retries instead.
+// Note: Caller must hold s.mu
+func (s *saver) retry() {
+	if s.timer != nil || s.doc.ctx.Err() != nil {
+		return
+	}
+	s.timer = time.AfterFunc(storage.Backoff(s.failures, saveRetryBackoff, saveRetryBackoffMax), func() {
+		s.flush(s.doc.ctx)
+	})
+}
+
+// scheduleSave marks the document as changed; the saver decides when to write it
+func (doc *Document) scheduleSave() {
+	doc.saver.schedule()
+}
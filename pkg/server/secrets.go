@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/validate"
+)
+
+// Secret scanning modes
+const (
+	secretScanOff   = "off"
+	secretScanWarn  = "warn"
+	secretScanBlock = "block"
+)
+
+// secretsDetected counts content changes found to contain credentials, by pattern and action
+var secretsDetected = metrics.NewCounter("gopad_secrets_detected_total", "Number of content changes containing credential-like strings")
+
+// secretPatterns lists the pattern names of findings
+func secretPatterns(findings []validate.Finding) string {
+	names := make([]string, len(findings))
+	for i, f := range findings {
+		names[i] = f.Pattern
+	}
+	return strings.Join(names, ", ")
+}
+
+// auditSecrets records detected credentials in the log and admin feed
+func (doc *Document) auditSecrets(tabId string, findings []validate.Finding, action string) {
+	for _, f := range findings {
+		secretsDetected.Inc(metrics.Labels{"pattern": f.Pattern, "action": action})
+	}
+	logger.Warn("Credential-like content detected", "audit", true, "doc_id", doc.ID, "tab_id", tabId,
+		"patterns", secretPatterns(findings), "action", action)
+	doc.server.events.publish(adminEvent{Type: "secretDetected", DocID: doc.ID})
+}
+
+// blockSecrets rejects tab content containing credentials when SECRET_SCAN is "block"
+// Note: Caller must hold doc.mu
+func (doc *Document) blockSecrets(tab Tab) error {
+	if doc.server.config.SecretScan != secretScanBlock {
+		return nil
+	}
+	findings := validate.ScanSecrets(tab.Content)
+	if len(findings) == 0 {
+		return nil
+	}
+	doc.auditSecrets(tab.ID, findings, "blocked")
+	return apperr.Newf(apperr.CodeValidation, "content appears to contain a secret (%s)", secretPatterns(findings))
+}
+
+// reportSecrets warns everyone editing the document when a tab starts to
+// contain a credential, and clears the warning once it's removed
+func (doc *Document) reportSecrets(tabId, content string) {
+	if doc.server.config.SecretScan != secretScanWarn {
+		return
+	}
+	findings := validate.ScanSecrets(content)
+	patterns := secretPatterns(findings)
+	doc.mu.Lock()
+	previous := doc.secrets[tabId]
+	if patterns == "" {
+		delete(doc.secrets, tabId)
+	} else {
+		doc.secrets[tabId] = patterns
+	}
+	doc.mu.Unlock()
+	if patterns == previous {
+		return
+	}
+	if len(findings) > 0 {
+		doc.auditSecrets(tabId, findings, "warned")
+	}
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":     "secretWarning",
+		"tabId":    tabId,
+		"findings": findings,
+	})
+	if err != nil {
+		logger.Error("Error marshaling secret warning", "doc_id", doc.ID, "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
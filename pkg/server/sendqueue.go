@@ -0,0 +1,100 @@
+package server
+
+import (
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+var (
+	// coalescedFrames counts update frames replaced in a slow client's backlog by a newer update of the same tab
+	coalescedFrames = metrics.NewCounter("gopad_send_coalesced_total", "Number of queued update frames replaced by a newer update of the same tab")
+	// droppedClients counts clients disconnected because they couldn't keep up, by reason
+	droppedClients = metrics.NewCounter("gopad_slow_clients_dropped_total", "Number of clients disconnected for not reading their messages")
+)
+
+// queuedFrame is a frame waiting in a client's backlog for room in its send buffer
+type queuedFrame struct {
+	message *frame
+	tabId   string // set for update frames, which a later update of the same tab replaces
+}
+
+// enqueue hands a frame to a client. When its send buffer is full the frame
+// waits in the client's backlog instead, where consecutive updates of the same
+// tab are coalesced since each carries the tab's whole content. Clients whose
+// backlog outgrows SendBacklog are disconnected.
+// Note: Must only be called from the hub goroutine
+func (doc *Document) enqueue(client *Client, message *frame, updateTab string) {
+	doc.flushBacklog(client)
+	if len(client.backlog) == 0 {
+		select {
+		case client.send <- message:
+			return
+		default:
+		}
+		if doc.server.config.SendBacklog <= 0 {
+			doc.dropClient(client, "buffer")
+			return
+		}
+		client.stalledSince = time.Now()
+	}
+	if last := len(client.backlog) - 1; updateTab != "" && last >= 0 && client.backlog[last].tabId == updateTab {
+		client.backlog[last].message = message
+		coalescedFrames.Inc(metrics.Labels{})
+		return
+	}
+	client.backlog = append(client.backlog, queuedFrame{message: message, tabId: updateTab})
+	if len(client.backlog) > doc.server.config.SendBacklog {
+		doc.dropClient(client, "backlog")
+	}
+}
+
+// flushBacklog moves as much of a client's backlog into its send buffer as fits
+// Note: Must only be called from the hub goroutine
+func (doc *Document) flushBacklog(client *Client) {
+	sent := 0
+	for _, frame := range client.backlog {
+		select {
+		case client.send <- frame.message:
+			sent++
+			continue
+		default:
+		}
+		break
+	}
+	if sent == 0 {
+		return
+	}
+	client.backlog = client.backlog[sent:]
+	if len(client.backlog) == 0 {
+		client.backlog = nil
+	}
+	// The client is reading again, so its stall starts over
+	client.stalledSince = time.Now()
+}
+
+// checkStalls flushes every backlog and disconnects clients that haven't read
+// anything for SendStallTimeout
+// Note: Must only be called from the hub goroutine
+func (doc *Document) checkStalls() {
+	timeout := doc.server.config.SendStallTimeout
+	for client := range doc.clients {
+		if len(client.backlog) == 0 {
+			continue
+		}
+		doc.flushBacklog(client)
+		if len(client.backlog) > 0 && timeout > 0 && time.Since(client.stalledSince) > timeout {
+			doc.dropClient(client, "stall")
+		}
+	}
+}
+
+// dropClient disconnects a client that isn't reading its messages
+// Note: Must only be called from the hub goroutine
+func (doc *Document) dropClient(client *Client, reason string) {
+	client.log.Warn("Client not keeping up with messages, removing client", "reason", reason, "backlog", len(client.backlog))
+	droppedClients.Inc(metrics.Labels{"reason": reason})
+	client.backlog = nil
+	delete(doc.clients, client)
+	close(client.send)
+}
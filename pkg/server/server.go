@@ -0,0 +1,519 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/fetch"
+	"github.com/shiftregister-vg/gopad/pkg/i18n"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/mirror"
+	"github.com/shiftregister-vg/gopad/pkg/moderation"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/presence"
+	"github.com/shiftregister-vg/gopad/pkg/runner"
+	"github.com/shiftregister-vg/gopad/pkg/sanitize"
+	"github.com/shiftregister-vg/gopad/pkg/signedurl"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/telemetry"
+	"github.com/shiftregister-vg/gopad/pkg/unfurl"
+	"github.com/shiftregister-vg/gopad/pkg/validate"
+	"github.com/shiftregister-vg/gopad/pkg/webhook"
+)
+
+// Store is the persistence backend used by the server
+type Store interface {
+	SaveDocument(ctx context.Context, docID string, state *storage.DocumentState) error
+	LoadDocument(ctx context.Context, docID string) (*storage.DocumentState, error)
+	DocumentVersion(ctx context.Context, docID string) (int64, error)
+	SubscribeToUpdates(ctx context.Context, docID string, handler func(*storage.DocumentState)) *storage.Subscription
+	SubscribeToDeletion(ctx context.Context, docID string, handler func()) *storage.Subscription
+	DeleteDocument(ctx context.Context, docID string) error
+	RestoreDocument(ctx context.Context, docID string) error
+	CollectTrash(ctx context.Context) error
+	ListDocumentIDs(ctx context.Context) ([]string, error)
+	DocumentUsage(ctx context.Context, docID string) (*storage.DocumentUsage, error)
+	ShredDocument(ctx context.Context, docID string) error
+	AppendOps(ctx context.Context, docID, origin, base string, ops []storage.TabOp) (string, error)
+	SubscribeToOps(ctx context.Context, docID string, handler func(*storage.OpBatch)) *storage.Subscription
+	BeginHandover(ctx context.Context, docID, instance string, ttl time.Duration) error
+	EndHandover(ctx context.Context, docID string) error
+	HandoverPending(ctx context.Context, docID string) (bool, error)
+	SaveWorkspacePolicy(ctx context.Context, workspace string, p *policy.Policy) error
+	WorkspacePolicy(ctx context.Context, workspace string) (*policy.Policy, error)
+	NextDocumentNumber(ctx context.Context, workspace string) (int64, error)
+	SubscribeToPolicies(ctx context.Context, handler func(workspace string, p *policy.Policy)) *storage.Subscription
+	AcquireLock(ctx context.Context, docID string, lock *storage.Lock, ttl time.Duration) error
+	ReleaseLock(ctx context.Context, docID, tabID, token string) error
+	Locks(ctx context.Context, docID string) ([]storage.Lock, error)
+	SubscribeToLocks(ctx context.Context, docID string, handler func([]storage.Lock)) *storage.Subscription
+	AppendActivity(ctx context.Context, docID string, event *storage.ActivityEvent, ttl time.Duration) error
+	Activity(ctx context.Context, docID string, limit int) ([]storage.ActivityEvent, error)
+	SubscribeToActivity(ctx context.Context, docID string, handler func(*storage.ActivityEvent)) *storage.Subscription
+	SubscribeToExpiry(ctx context.Context, handler func(docID string)) *storage.Subscription
+	PublishBeat(ctx context.Context, docID string, beat *storage.Beat) error
+	SubscribeToBeats(ctx context.Context, docID string, handler func(*storage.Beat)) *storage.Subscription
+	ClaimExpiringDocuments(ctx context.Context, window time.Duration) ([]storage.ExpiringDocument, error)
+	ClaimArchivableDocuments(ctx context.Context, window time.Duration) ([]storage.ExpiringDocument, error)
+	DocumentTTL(ctx context.Context, docID string) (time.Duration, error)
+	SetPinned(ctx context.Context, docID string, pinned bool) error
+	PinnedDocuments(ctx context.Context) ([]string, error)
+	SetMirrored(ctx context.Context, docID string, mirrored bool) error
+	IsMirrored(ctx context.Context, docID string) (bool, error)
+	MirroredDocuments(ctx context.Context) ([]string, error)
+	SaveSession(ctx context.Context, docID string, session *storage.Session) error
+	Session(ctx context.Context, docID string) (*storage.Session, error)
+	DeleteSession(ctx context.Context, docID string) error
+	Sessions(ctx context.Context) (map[string]*storage.Session, error)
+	AddBan(ctx context.Context, ban *storage.Ban) error
+	RemoveBan(ctx context.Context, docID, kind, value string) error
+	Bans(ctx context.Context, docID string) ([]storage.Ban, error)
+	FindBan(ctx context.Context, docID, ip, uuid string) (*storage.Ban, error)
+	SaveIdentity(ctx context.Context, identity *storage.Identity, ttl time.Duration) error
+	LoadIdentity(ctx context.Context, uuid string) (*storage.Identity, error)
+	SaveFollow(ctx context.Context, docID string, follow *storage.Follow) error
+	Follow(ctx context.Context, docID string) (*storage.Follow, error)
+	DeleteFollow(ctx context.Context, docID string) error
+	SaveTemplate(ctx context.Context, docID string, template *storage.Template) error
+	DeleteTemplate(ctx context.Context, docID string) error
+	Templates(ctx context.Context) (map[string]*storage.Template, error)
+	ClaimOwnership(ctx context.Context, docID, instance string, lease time.Duration) (string, error)
+	ReleaseOwnership(ctx context.Context, docID, instance string) error
+	Ping(ctx context.Context) error
+}
+
+// Server hosts collaborative documents over WebSockets
+type Server struct {
+	config     Config
+	store      Store
+	instanceID string // identifies this process in shared storage
+	usage      *telemetry.Recorder
+	signer     *signedurl.Signer // nil when signed URLs are disabled
+	sanitizer  *sanitize.Sanitizer
+	moderator  moderation.Moderator // nil when moderation is off
+	messages   *i18n.Catalog
+	unfurler   *unfurl.Fetcher     // nil when link previews are disabled
+	importer   *fetch.Fetcher      // nil when imports are disabled
+	validator  *validate.Validator // nil when no content validators are configured
+	presence   presence.Store      // who is connected to each document
+	events     *eventFeed          // activity streamed to /ws/admin
+	webhooks   *webhook.Sender     // nil when no webhooks are configured
+	mirror     *mirror.Publisher   // nil when no mirror target is configured
+	archive    []archiveTarget     // empty when archiving is off
+	runner     *runner.Runner      // nil when no language can be run
+	draining   atomic.Bool         // set once documents are being handed over for shutdown
+	engine     *gin.Engine
+	ctx        context.Context // cancelled when the server shuts down
+	cancel     context.CancelFunc
+	hubs       sync.WaitGroup // running document hubs
+	mu         sync.RWMutex
+	documents  map[string]*Document
+	loading    map[string]*documentLoad // documents being loaded, by ID
+	policiesMu sync.RWMutex
+	policies   map[string]*policy.Policy     // workspace -> policy, nil when it has none
+	recovered  map[string]*recoveredDocument // documents restored from a recovery file but not loaded yet
+	buffer     *writeBuffer                  // nil when failed saves aren't held
+	editsMu    sync.Mutex
+	lastEdits  map[string]time.Time // docID -> last edit here, until reported inactive
+
+	sessionsMu    sync.Mutex
+	sessionWarned map[string]time.Time // docID -> end of the session its clients here were warned about
+}
+
+// New creates a server using the given configuration and storage backend. It
+// fails when the configuration is invalid, before starting anything.
+func New(config Config, store Store) (*Server, error) {
+	messages, err := i18n.New(config.DefaultLocale)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load message catalog: %w", err)
+	}
+	engine := gin.New()
+	// Only believe forwarded client addresses from the configured proxies
+	engine.RemoteIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	if err := engine.SetTrustedProxies(config.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	validator, err := validate.New(config.Validation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content validation settings: %w", err)
+	}
+	moderationConfig := config.Moderation
+	moderationConfig.WebhookSecret = []byte(config.WebhookSecret)
+	moderator, err := moderation.New(moderationConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid moderation settings: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		config:     config,
+		store:      store,
+		instanceID: newID(),
+		usage:      telemetry.New(config.TelemetryEnabled, metrics.Default),
+		sanitizer:  sanitize.New(config.SanitizePolicy, config.MaxNameLength),
+		presence:   presence.NewMemory(),
+		events:     newEventFeed(),
+		engine:     engine,
+		messages:   messages,
+		validator:  validator,
+		moderator:  moderator,
+		ctx:        ctx,
+		cancel:     cancel,
+		documents:  make(map[string]*Document),
+		loading:    make(map[string]*documentLoad),
+		policies:   make(map[string]*policy.Policy),
+		recovered:  make(map[string]*recoveredDocument),
+		lastEdits:  make(map[string]time.Time),
+	}
+	s.sessionWarned = make(map[string]time.Time)
+	if config.UnfurlEnabled {
+		s.unfurler = unfurl.New(config.UnfurlCacheTTL)
+	}
+	if config.ImportEnabled {
+		s.importer = fetch.New(config.ImportMaxSize)
+	}
+	if config.SignedURLSecret != "" {
+		s.signer = signedurl.New([]byte(config.SignedURLSecret), config.SignedURLSkew)
+	}
+	if len(config.WebhookURLs) > 0 {
+		s.webhooks = webhook.New(config.WebhookURLs, []byte(config.WebhookSecret))
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			s.watchExpiry()
+		}()
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			s.watchLifecycle()
+		}()
+	}
+	if len(config.Run.Commands) > 0 {
+		s.runner = runner.New(config.Run)
+	}
+	if targets := mirrorTargets(config); len(targets) > 0 {
+		s.mirror = mirror.New(targets...)
+		if config.MirrorInterval > 0 {
+			s.hubs.Add(1)
+			go func() {
+				defer s.hubs.Done()
+				s.mirrorLoop(config.MirrorInterval)
+			}()
+		}
+	}
+	if config.WriteBufferSize > 0 {
+		s.buffer = newWriteBuffer(config.WriteBufferSize, config.WriteBufferDir)
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			s.replayLoop()
+		}()
+	}
+	s.archive = archiveTargets(config)
+	if config.ExpiryWarning > 0 || len(s.archive) > 0 {
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			s.watchExpiring()
+		}()
+	}
+	s.routes()
+	if config.AdminToken != "" {
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			s.reportStats()
+		}()
+	}
+	s.hubs.Add(1)
+	go func() {
+		defer s.hubs.Done()
+		s.watchPolicies()
+	}()
+	s.hubs.Add(1)
+	go func() {
+		defer s.hubs.Done()
+		s.watchSessions()
+	}()
+	s.hubs.Add(1)
+	go func() {
+		defer s.hubs.Done()
+		s.collectTrashLoop()
+	}()
+	if config.ReconcileInterval > 0 {
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			s.reconcileLoop(config.ReconcileInterval)
+		}()
+	}
+	if config.DirectoryURL != "" && config.PublicURL != "" {
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			s.registerLoop()
+		}()
+	}
+	return s, nil
+}
+
+// ServeHTTP implements http.Handler so the server can be mounted in other programs
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.engine.ServeHTTP(w, r)
+}
+
+// Run serves on addr until ctx is cancelled, then shuts down gracefully
+func (s *Server) Run(ctx context.Context, addr string) error {
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: s.engine,
+	}
+	return s.serve(ctx, httpServer, httpServer.ListenAndServe)
+}
+
+// RunTLS serves HTTPS on addr with the given TLS configuration until ctx is
+// cancelled, then shuts down gracefully. The configuration must provide
+// certificates, e.g. through Certificates or GetCertificate.
+func (s *Server) RunTLS(ctx context.Context, addr string, tlsConfig *tls.Config) error {
+	httpServer := &http.Server{
+		Addr:      addr,
+		Handler:   s.engine,
+		TLSConfig: tlsConfig,
+	}
+	return s.serve(ctx, httpServer, func() error {
+		return httpServer.ListenAndServeTLS("", "")
+	})
+}
+
+// serve runs listen until it fails or ctx is cancelled, handing documents
+// over and shutting httpServer down in the latter case
+func (s *Server) serve(ctx context.Context, httpServer *http.Server, listen func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- listen()
+	}()
+
+	select {
+	case err := <-errCh:
+		s.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.Drain(shutdownCtx)
+	err := httpServer.Shutdown(shutdownCtx)
+	s.Close()
+	return err
+}
+
+// Close stops all document goroutines and storage subscriptions,
+// waiting for pending saves to be flushed
+func (s *Server) Close() {
+	s.cancel()
+	s.hubs.Wait()
+	if s.webhooks != nil {
+		s.webhooks.Close()
+	}
+	if s.mirror != nil {
+		s.mirror.Close()
+	}
+}
+
+func (s *Server) routes() {
+	r := s.engine
+	r.Use(gin.Recovery(), requestID, s.localize, s.countErrors)
+
+	if s.config.Development {
+		// In development, proxy all non-WebSocket requests to the React dev server
+		r.Use(s.devProxy)
+	} else {
+		// In production, serve static files
+		r.Static("/static", filepath.Join(s.config.StaticDir, "static"))
+		r.StaticFile("/", filepath.Join(s.config.StaticDir, "index.html"))
+		r.StaticFile("/index.html", filepath.Join(s.config.StaticDir, "index.html"))
+	}
+
+	// Debug endpoint to check document state
+	r.GET("/debug/doc/:id", s.handleDebugDocument)
+	if s.config.Development {
+		r.POST("/debug/doc/:id/collaborators", s.handleSpawnCollaborators)
+		r.DELETE("/debug/doc/:id/collaborators", s.handleStopCollaborators)
+	}
+
+	// WebSocket endpoint
+	r.GET("/ws", s.handleWebSocket)
+
+	// Document API
+	api := r.Group("/api/v1")
+	api.POST("/documents", s.handleCreateDocument)
+	api.GET("/templates", s.handleListTemplates)
+	docs := api.Group("/documents/:id")
+	docs.GET("/raw", s.requireSignedURL, s.handleRaw)
+	docs.GET("/export", s.requireSignedURL, s.handleExport)
+	docs.POST("/export/gist", s.requireSignedURL, s.handleExportGitHub)
+	docs.POST("/import/url", s.requireSignedURL, s.handleImportURL)
+	docs.POST("/fork", s.requireSignedURL, s.handleFork)
+	docs.GET("/activity", s.requireSignedURL, s.handleActivity)
+	docs.GET("/tabs/:tabId/notes.html", s.requireSignedURL, s.handleNotesHTML)
+	docs.GET("/session.ics", s.requireSignedURL, s.handleSessionICS)
+
+	// Instance metadata for clients and federation tooling
+	r.GET("/.well-known/gopad.json", s.handleInstanceInfo)
+
+	// Clients of peer instances following documents hosted here
+	if len(s.config.FederationPeers) > 0 {
+		r.GET("/federation/v1/documents/:id/ws", s.handleFederatedWebSocket)
+	}
+
+	// Clients relayed by the other instances to documents owned here
+	if s.ownershipEnabled() {
+		r.GET("/cluster/v1/documents/:id/ws", s.handleRelayedWebSocket)
+	}
+
+	// Metrics endpoint
+	r.GET("/metrics", gin.WrapH(metrics.Default.Handler()))
+	r.GET("/readyz", s.handleReady)
+
+	// Admin endpoints are only available when an admin token is configured
+	if s.config.AdminToken != "" {
+		r.GET("/ws/admin", adminTokenFromWebSocket, requireAdminToken(s.config.AdminToken), s.handleAdminFeed)
+		admin := r.Group("/admin", requireAdminToken(s.config.AdminToken))
+		admin.GET("/storage", s.handleStorageUsageList)
+		admin.GET("/storage/:id", s.handleStorageUsage)
+		admin.GET("/documents", s.handleListDocuments)
+		admin.POST("/recovery-snapshot", s.handleRecoverySnapshot)
+		admin.DELETE("/documents/:id", s.handlePurgeDocument)
+		admin.POST("/documents/:id/save", s.handleSaveDocument)
+		admin.POST("/documents/:id/restore", s.handleRestoreDocument)
+		admin.PUT("/documents/:id/pin", s.handlePinDocument)
+		admin.DELETE("/documents/:id/pin", s.handleUnpinDocument)
+		admin.GET("/documents/:id/users", s.handleListUsers)
+		admin.DELETE("/documents/:id/users/:uuid", s.handleDisconnectUser)
+		admin.POST("/documents/:id/shred", s.handleShredDocument)
+		admin.POST("/documents/:id/signed-url", s.handleCreateSignedURL)
+		admin.POST("/documents/:id/editor-token", s.handleCreateEditorToken)
+		admin.PUT("/documents/:id/session", s.handleSetSession)
+		admin.GET("/documents/:id/session", s.handleGetSession)
+		admin.DELETE("/documents/:id/session", s.handleDeleteSession)
+		admin.GET("/documents/:id/bans", s.handleListBans)
+		admin.POST("/documents/:id/bans", s.handleAddBan)
+		admin.DELETE("/documents/:id/bans/:kind/:value", s.handleRemoveBan)
+		admin.GET("/documents/:id/locks", s.handleListLocks)
+		admin.POST("/documents/:id/locks", s.handleAcquireLock)
+		admin.DELETE("/documents/:id/locks/:token", s.handleReleaseLock)
+		admin.PUT("/documents/:id/tabs/:tabId/content", s.handleWriteTab)
+		admin.POST("/documents/:id/tabs/:tabId/batch", s.handleBatchTab)
+		admin.PUT("/documents/:id/workspace", s.handleSetDocumentWorkspace)
+		admin.PUT("/documents/:id/mirror", s.handleMirrorDocument)
+		admin.DELETE("/documents/:id/mirror", s.handleUnmirrorDocument)
+		admin.GET("/documents/:id/follow", s.handleGetFollow)
+		admin.PUT("/documents/:id/follow", s.handleFollowDocument)
+		admin.DELETE("/documents/:id/follow", s.handleUnfollowDocument)
+		admin.PUT("/documents/:id/template", s.handleSetTemplate)
+		admin.DELETE("/documents/:id/template", s.handleDeleteTemplate)
+		admin.GET("/pinned", s.handleListPinned)
+		admin.GET("/bans", s.handleListBans)
+		admin.POST("/bans", s.handleAddBan)
+		admin.DELETE("/bans/:kind/:value", s.handleRemoveBan)
+		admin.GET("/workspaces/:id/policy", s.handleGetWorkspacePolicy)
+		admin.PUT("/workspaces/:id/policy", s.handleSetWorkspacePolicy)
+	}
+
+	// SPA fallback: serve index.html for all other routes (only in production)
+	if !s.config.Development {
+		r.NoRoute(func(c *gin.Context) {
+			c.File(filepath.Join(s.config.StaticDir, "index.html"))
+		})
+	}
+}
+
+// evictDocument stops a document's hub and drops it from memory, disconnecting its clients.
+// Pending changes are written first unless persist is false.
+func (s *Server) evictDocument(docID string, persist bool) {
+	s.mu.Lock()
+	doc, exists := s.documents[docID]
+	delete(s.documents, docID)
+	s.mu.Unlock()
+	if !exists {
+		return
+	}
+	s.events.publish(adminEvent{Type: "documentEvicted", DocID: docID})
+	if !persist && s.buffer != nil {
+		// A held save would bring the document back
+		s.buffer.remove(docID)
+	}
+	doc.mu.Lock()
+	doc.discarded = !persist
+	doc.mu.Unlock()
+	doc.cancel()
+}
+
+// devProxy forwards requests to the React dev server
+func (s *Server) devProxy(c *gin.Context) {
+	if strings.ToLower(c.Request.Header.Get("Upgrade")) == "websocket" || c.Request.URL.Path == "/ws" || strings.HasPrefix(c.Request.URL.Path, "/debug/") {
+		if c.Request.URL.Path == "/ws" {
+			logger.Debug("WebSocket request handled", "path", c.Request.URL.Path)
+		}
+		c.Next()
+		return
+	}
+	logger.Debug("Proxying request to React dev server", "path", c.Request.URL.Path)
+	// Proxy to React dev server
+	proxy := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	req, err := http.NewRequest(c.Request.Method, s.config.DevServerURL+c.Request.URL.Path, c.Request.Body)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	req.Header = c.Request.Header
+	resp, err := proxy.Do(req)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Copy response headers
+	for k, v := range resp.Header {
+		c.Writer.Header()[k] = v
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
+	c.Writer.Write([]byte{}) // Flush headers
+	c.Writer.Flush()
+}
+
+// handleDebugDocument reports the in-memory state of a document
+func (s *Server) handleDebugDocument(c *gin.Context) {
+	docID := c.Param("id")
+	s.mu.RLock()
+	doc, exists := s.documents[docID]
+	s.mu.RUnlock()
+	if exists {
+		doc.mu.RLock()
+		content := doc.Content
+		users := make(map[string]string)
+		for name, client := range doc.users.clients {
+			users[name] = client.name
+		}
+		doc.mu.RUnlock()
+		c.JSON(200, gin.H{
+			"id":      docID,
+			"content": content,
+			"users":   users,
+		})
+	} else {
+		abortWithError(c, storage.ErrNotFound)
+	}
+}
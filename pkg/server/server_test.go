@@ -0,0 +1,28 @@
+package server
+
+import "testing"
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"trusted proxies", func(c *Config) { c.TrustedProxies = []string{"not-an-address"} }},
+		{"forbidden pattern name", func(c *Config) { c.Validation.Forbidden = []string{"no-such-pattern"} }},
+		{"forbidden pattern", func(c *Config) { c.Validation.Pattern = "(" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.modify(&cfg)
+			// Invalid configurations fail before the store is used
+			s, err := New(cfg, nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if s != nil {
+				t.Errorf("expected no server, got %v", s)
+			}
+		})
+	}
+}
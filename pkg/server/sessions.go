@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// sessionLockOwner owns the document-wide locks freezing documents outside their session
+const sessionLockOwner = "scheduled session"
+
+// sessionCheckInterval is how often sessions are checked for starting and ending
+const sessionCheckInterval = 30 * time.Second
+
+// sessionFreezeTTL is how long the lock freezing an ended session lasts
+// unless the next check renews it
+const sessionFreezeTTL = 3 * sessionCheckInterval
+
+// errNoSession is returned for documents without a scheduled session
+var errNoSession = apperr.New(apperr.CodeNotFound, "no session is scheduled for this document")
+
+// sessionRequest schedules a session
+type sessionRequest struct {
+	Title      string    `json:"title"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	WarnBefore string    `json:"warnBefore"` // e.g. "5m"; "0s" for no warning
+}
+
+// sessionView is a session as shown to clients, without its lock token
+type sessionView struct {
+	Title      string    `json:"title,omitempty"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	WarnBefore string    `json:"warnBefore"`
+}
+
+func viewSession(session *storage.Session) sessionView {
+	return sessionView{
+		Title:      session.Title,
+		Start:      session.Start,
+		End:        session.End,
+		WarnBefore: session.WarnBefore.String(),
+	}
+}
+
+// handleSetSession schedules a session for a document, freezing it until the
+// session starts
+func (s *Server) handleSetSession(c *gin.Context) {
+	docID := c.Param("id")
+	var req sessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	if req.Start.IsZero() || req.End.IsZero() {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "start and end are required"))
+		return
+	}
+	if !req.End.After(req.Start) {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "end must be after start"))
+		return
+	}
+	warnBefore := 5 * time.Minute
+	if req.WarnBefore != "" {
+		d, err := time.ParseDuration(req.WarnBefore)
+		if err != nil || d < 0 {
+			abortWithError(c, apperr.New(apperr.CodeValidation, "invalid warnBefore"))
+			return
+		}
+		warnBefore = d
+	}
+	ctx := c.Request.Context()
+	previous, err := s.store.Session(ctx, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	session := &storage.Session{
+		Title:      s.sanitizer.Label(req.Title),
+		Start:      req.Start.UTC(),
+		End:        req.End.UTC(),
+		WarnBefore: warnBefore,
+		Token:      newID(),
+	}
+	// Rescheduling keeps the lock, so it doesn't conflict with itself
+	if previous != nil {
+		session.Token = previous.Token
+	}
+	if err := s.store.SaveSession(ctx, docID, session); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	s.applySession(ctx, docID, session, time.Now())
+	s.refreshLocks(c, docID)
+	requestLog(c).Info("Session scheduled", "doc_id", docID, "start", session.Start, "end", session.End)
+	c.JSON(http.StatusOK, viewSession(session))
+}
+
+// handleGetSession returns a document's scheduled session
+func (s *Server) handleGetSession(c *gin.Context) {
+	session, err := s.store.Session(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if session == nil {
+		abortWithError(c, errNoSession)
+		return
+	}
+	c.JSON(http.StatusOK, viewSession(session))
+}
+
+// handleDeleteSession cancels a document's session and unfreezes it
+func (s *Server) handleDeleteSession(c *gin.Context) {
+	docID := c.Param("id")
+	ctx := c.Request.Context()
+	session, err := s.store.Session(ctx, docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if session == nil {
+		abortWithError(c, errNoSession)
+		return
+	}
+	if err := s.store.DeleteSession(ctx, docID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	s.unfreeze(ctx, docID, session)
+	s.refreshLocks(c, docID)
+	s.sessionsMu.Lock()
+	delete(s.sessionWarned, docID)
+	s.sessionsMu.Unlock()
+	requestLog(c).Info("Session cancelled", "doc_id", docID)
+	c.Status(http.StatusNoContent)
+}
+
+// handleSessionICS serves a document's session as an iCalendar event for
+// adding it to calendars
+func (s *Server) handleSessionICS(c *gin.Context) {
+	docID := c.Param("id")
+	if _, _, err := s.publishedState(c, docID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	session, err := s.store.Session(c.Request.Context(), docID)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if session == nil {
+		abortWithError(c, errNoSession)
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="session.ics"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(sessionICS(docID, session, time.Now())))
+}
+
+// sessionICS renders a session as an iCalendar file with a single event
+func sessionICS(docID string, session *storage.Session, now time.Time) string {
+	const stamp = "20060102T150405Z"
+	title := session.Title
+	if title == "" {
+		title = "GoPad session"
+	}
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//GoPad//Sessions//EN",
+		"BEGIN:VEVENT",
+		"UID:" + icsEscape(docID) + "@gopad",
+		"DTSTAMP:" + now.UTC().Format(stamp),
+		"DTSTART:" + session.Start.UTC().Format(stamp),
+		"DTEND:" + session.End.UTC().Format(stamp),
+		"SUMMARY:" + icsEscape(title),
+		"DESCRIPTION:" + icsEscape("GoPad document "+docID),
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// icsEscape escapes text for an iCalendar property value
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "").Replace(text)
+}
+
+// watchSessions starts, warns about and ends scheduled sessions until the
+// server shuts down. Every instance checks every session: freezing and
+// unfreezing are idempotent, and warnings go to the clients connected here.
+func (s *Server) watchSessions() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			sessions, err := s.store.Sessions(s.ctx)
+			if err != nil {
+				if s.ctx.Err() == nil {
+					logger.Error("Error loading sessions", "error", err)
+				}
+				continue
+			}
+			for docID, session := range sessions {
+				s.applySession(s.ctx, docID, session, now)
+			}
+		}
+	}
+}
+
+// applySession brings a document in line with its session at now: frozen
+// before the start, editable during the session with a warning near its end,
+// and frozen again once it's over
+func (s *Server) applySession(ctx context.Context, docID string, session *storage.Session, now time.Time) {
+	switch {
+	case now.Before(session.Start):
+		// The lock runs out when the session starts, even if no check happens then
+		s.freeze(ctx, docID, session, session.Start.Sub(now))
+	case now.Before(session.End):
+		s.unfreeze(ctx, docID, session)
+		if remaining := session.End.Sub(now); session.WarnBefore > 0 && remaining <= session.WarnBefore {
+			s.warnSessionEnding(docID, session, remaining)
+		}
+	default:
+		s.freeze(ctx, docID, session, sessionFreezeTTL)
+	}
+}
+
+// freeze locks the whole document on behalf of its session
+func (s *Server) freeze(ctx context.Context, docID string, session *storage.Session, ttl time.Duration) {
+	lock := &storage.Lock{Owner: sessionLockOwner, Token: session.Token}
+	if err := s.store.AcquireLock(ctx, docID, lock, ttl); err != nil {
+		// Someone holding a lock of their own delays the freeze until they release it
+		var conflict *storage.LockConflictError
+		if errors.As(err, &conflict) {
+			logger.Warn("Document locked, freezing it for its session later", "doc_id", docID, "owner", conflict.Held.Owner)
+			return
+		}
+		logger.Error("Error freezing document for its session", "doc_id", docID, "error", err)
+	}
+}
+
+// unfreeze releases the lock of a document's session
+func (s *Server) unfreeze(ctx context.Context, docID string, session *storage.Session) {
+	err := s.store.ReleaseLock(ctx, docID, "", session.Token)
+	if err != nil && !errors.Is(err, storage.ErrLockNotHeld) {
+		logger.Error("Error unfreezing document for its session", "doc_id", docID, "error", err)
+	}
+}
+
+// warnSessionEnding tells the clients of a document loaded here that its
+// session ends soon, once per session
+func (s *Server) warnSessionEnding(docID string, session *storage.Session, remaining time.Duration) {
+	s.mu.RLock()
+	doc, loaded := s.documents[docID]
+	s.mu.RUnlock()
+	if !loaded {
+		return
+	}
+	s.sessionsMu.Lock()
+	warned := s.sessionWarned[docID].Equal(session.End)
+	if !warned {
+		s.sessionWarned[docID] = session.End
+	}
+	s.sessionsMu.Unlock()
+	if warned {
+		return
+	}
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":      "sessionEnding",
+		"end":       session.End,
+		"remaining": int(remaining.Seconds()),
+	})
+	if err != nil {
+		logger.Debug("Error marshaling sessionEnding message", "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// maxSignalSize bounds signal messages, which carry session descriptions and
+// ICE candidates for peer-to-peer connections between users
+const maxSignalSize = 64 * 1024
+
+// errSignalTooLarge is returned for signal messages over maxSignalSize
+var errSignalTooLarge = apperr.Newf(apperr.CodeLimitExceeded, "signal messages are limited to %d bytes", maxSignalSize)
+
+// Messages meant for one user are addressed with BroadcastMessage.To and still
+// pass through the hub, which delivers them to the user's connection here only.
+// Clients address signal messages, for WebRTC signaling, and cursor pings this
+// way with a to field holding the user's uuid.
+
+// addressee reports whether user uuid is connected to this instance, replying
+// with an error if not
+func (c *Client) addressee(uuid string) bool {
+	c.doc.mu.RLock()
+	client, ok := c.doc.users.clients[uuid]
+	connected := ok && !client.disconnected && client.conn != nil
+	c.doc.mu.RUnlock()
+	if !connected {
+		c.sendError(errUserNotConnected)
+	}
+	return connected
+}
+
+// handleSignal relays a signal message to the user it's addressed to, adding
+// the sender's uuid as from
+func (c *Client) handleSignal(msg map[string]interface{}, message []byte) {
+	if len(message) > maxSignalSize {
+		c.sendError(errSignalTooLarge)
+		return
+	}
+	to, ok := c.stringField(msg, "to")
+	if !ok || !c.addressee(to) {
+		return
+	}
+	msg["from"] = c.uuid
+	delete(msg, "to")
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		c.log.Debug("Error marshaling signal message", "error", err)
+		return
+	}
+	c.doc.send(BroadcastMessage{To: to, Message: jsonMsg})
+}
+
+// handleCursorPing sends a cursor to one user only, to point them somewhere
+// without moving the cursor everyone else sees
+func (c *Client) handleCursorPing(msg map[string]interface{}, to string) {
+	if !c.addressee(to) {
+		return
+	}
+	msg["from"] = c.uuid
+	delete(msg, "to")
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		c.log.Debug("Error marshaling cursor ping", "error", err)
+		return
+	}
+	if c.doc.load.shedding() {
+		shedMessages.Inc(metrics.Labels{"kind": "cursor"})
+		return
+	}
+	c.doc.send(BroadcastMessage{To: to, Message: jsonMsg})
+}
+
+// deliverTo hands an addressed message to the connection of its user
+// Note: Must only be called from the hub goroutine
+func (doc *Document) deliverTo(uuid string, message []byte) {
+	doc.mu.RLock()
+	client := doc.users.clients[uuid]
+	doc.mu.RUnlock()
+	if client != nil && doc.clients[client] {
+		doc.enqueue(client, newFrame(message), "")
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+)
+
+// errNoSuggestion is sent when accepting a suggestion that was never made or no longer applies
+var errNoSuggestion = apperr.New(apperr.CodeInvalidMessage, "no suggestion for this tab")
+
+// pendingSuggestion drops the parts of a suggestion for a tab that match the
+// tab's name or the document's language already
+// Note: Caller must hold doc.mu
+func (doc *Document) pendingSuggestion(tab Tab, s suggest.Suggestion) suggest.Suggestion {
+	if s.Name == tab.Name {
+		s.Name = ""
+	}
+	if s.Language == doc.Language {
+		s.Language = ""
+	}
+	return s
+}
+
+// suggestFor proposes a name and language for a tab after its content changed.
+// Each suggestion is only made once, so ignoring it dismisses it.
+func (c *Client) suggestFor(tabId, content string) {
+	if !c.doc.server.config.SuggestionsEnabled {
+		return
+	}
+	detected := suggest.For(content)
+	c.doc.mu.Lock()
+	i := c.doc.findTab(tabId)
+	if i < 0 || c.doc.Tabs[i].Kind != "" {
+		c.doc.mu.Unlock()
+		return
+	}
+	tab := c.doc.Tabs[i]
+	// Tabs still named like a document rather than a file get the name with the language's extension
+	if detected.Name == "" && tab.Name != "" && !suggest.HasExtension(tab.Name) {
+		if ext := suggest.Extension(detected.Language); ext != "" {
+			detected.Name = tab.Name + "." + ext
+		}
+	}
+	s := c.doc.pendingSuggestion(tab, detected)
+	if s == (suggest.Suggestion{}) || c.doc.suggested[tabId] == s {
+		c.doc.mu.Unlock()
+		return
+	}
+	c.doc.suggested[tabId] = s
+	c.doc.mu.Unlock()
+	c.reply(map[string]interface{}{
+		"type":     "suggestion",
+		"tabId":    tabId,
+		"name":     s.Name,
+		"language": s.Language,
+	})
+}
+
+// handleSuggestionAccept applies the suggestion last made for a tab. Clients
+// may accept only part of it by listing the fields to apply.
+func (c *Client) handleSuggestionAccept(msg map[string]interface{}) {
+	tabId, ok := c.stringField(msg, "tabId")
+	if !ok {
+		return
+	}
+	c.doc.mu.Lock()
+	s, ok := c.doc.suggested[tabId]
+	i := c.doc.findTab(tabId)
+	if !ok || i < 0 {
+		c.doc.mu.Unlock()
+		c.sendError(errNoSuggestion)
+		return
+	}
+	if fields, ok := msg["fields"].([]interface{}); ok {
+		accepted := suggest.Suggestion{}
+		for _, field := range fields {
+			switch field {
+			case "name":
+				accepted.Name = s.Name
+			case "language":
+				accepted.Language = s.Language
+			}
+		}
+		s = accepted
+	}
+	// Drop the parts that were applied some other way in the meantime
+	s = c.doc.pendingSuggestion(c.doc.Tabs[i], s)
+	if s == (suggest.Suggestion{}) {
+		c.doc.mu.Unlock()
+		c.sendError(errNoSuggestion)
+		return
+	}
+	if err := c.doc.checkLock(tabId, ""); err != nil {
+		c.doc.mu.Unlock()
+		c.sendError(err)
+		return
+	}
+	var activity []storage.ActivityEvent
+	if s.Name != "" {
+		previous := c.doc.Tabs[i].Name
+		c.doc.Tabs[i].Name = c.doc.server.sanitizer.Label(s.Name)
+		activity = append(activity, storage.ActivityEvent{Type: storage.ActivityTabRenamed, User: c.name, TabID: tabId, TabName: c.doc.Tabs[i].Name, PreviousName: previous})
+	}
+	if s.Language != "" {
+		c.doc.Language = s.Language
+		activity = append(activity, storage.ActivityEvent{Type: storage.ActivityLanguageChanged, User: c.name, Language: s.Language})
+	}
+	var msgs []map[string]interface{}
+	if s.Name != "" {
+		msgs = append(msgs, map[string]interface{}{
+			"type":        "tabUpdate",
+			"tabs":        c.doc.Tabs,
+			"activeTabId": c.doc.ActiveTabId,
+		})
+	}
+	if s.Language != "" {
+		msgs = append(msgs, map[string]interface{}{
+			"type":     "language",
+			"language": s.Language,
+		})
+	}
+	jsonMsgs := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		jsonMsg, err := json.Marshal(m)
+		if err != nil {
+			c.log.Debug("Error marshaling suggestion change", "error", err)
+			continue
+		}
+		jsonMsgs = append(jsonMsgs, jsonMsg)
+	}
+	c.doc.mu.Unlock()
+	c.log.Info("Suggestion accepted", "tab_id", tabId, "name", s.Name, "language", s.Language)
+	for _, jsonMsg := range jsonMsgs {
+		c.doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+	}
+	c.doc.scheduleSave()
+	for _, event := range activity {
+		c.doc.recordActivity(event)
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+const (
+	// maxCollaborators bounds the synthetic collaborators in a document
+	maxCollaborators = 20
+	// maxCollaboratorRate bounds keystrokes and cursor moves per second of each collaborator
+	maxCollaboratorRate = 50
+)
+
+var loremWords = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do
+	eiusmod tempor incididunt ut labore et dolore magna aliqua ut enim ad minim veniam quis
+	nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat duis aute irure
+	dolor in reprehenderit in voluptate velit esse cillum dolore eu fugiat nulla pariatur`)
+
+// collaboratorsRequest is the body of POST /debug/doc/:id/collaborators
+type collaboratorsRequest struct {
+	Count      int     `json:"count"`      // default 1
+	TabID      string  `json:"tabId"`      // tab to type into; empty follows the active tab
+	TypingRate float64 `json:"typingRate"` // characters per second, default 4; 0 only moves the cursor
+	CursorRate float64 `json:"cursorRate"` // cursor jumps per second, default 0.5
+}
+
+// collaborator is a synthetic user typing lorem ipsum into a document, so
+// presence and merging can be tried without opening many browsers. It is
+// listed like any user but has no connection and receives nothing.
+type collaborator struct {
+	client *Client
+	tabId  string
+	pos    int    // byte offset of the cursor in the tab
+	typing string // rest of the word being typed
+}
+
+// handleSpawnCollaborators adds synthetic collaborators to a loaded document
+func (s *Server) handleSpawnCollaborators(c *gin.Context) {
+	req := collaboratorsRequest{Count: 1, TypingRate: 4, CursorRate: 0.5}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+			return
+		}
+	}
+	if req.Count < 1 || req.TypingRate < 0 || req.TypingRate > maxCollaboratorRate || req.CursorRate < 0 || req.CursorRate > maxCollaboratorRate {
+		abortWithError(c, apperr.Newf(apperr.CodeValidation, "count must be positive and rates between 0 and %d per second", maxCollaboratorRate))
+		return
+	}
+	doc, exists := s.loadedDocument(c.Param("id"))
+	if !exists {
+		abortWithError(c, errDocumentNotLoaded)
+		return
+	}
+
+	doc.mu.Lock()
+	if len(doc.collaborators)+req.Count > maxCollaborators {
+		doc.mu.Unlock()
+		abortWithError(c, apperr.Newf(apperr.CodeLimitExceeded, "documents are limited to %d synthetic collaborators", maxCollaborators))
+		return
+	}
+	users := make([]gin.H, 0, req.Count)
+	for i := 0; i < req.Count; i++ {
+		connID := newID()
+		client := &Client{
+			connID: connID,
+			log:    requestLog(c).With("doc_id", doc.ID, "conn_id", connID, "synthetic", true),
+			docID:  doc.ID,
+			doc:    doc,
+		}
+		uuid := "synthetic-" + connID
+		doc.users.join(client, uuid, "", doc.remoteColors(uuid))
+		word := loremWords[rand.Intn(len(loremWords))]
+		client.name = "Synthetic " + strings.ToUpper(word[:1]) + word[1:]
+		ctx, cancel := context.WithCancel(doc.ctx)
+		doc.collaborators[client] = cancel
+		users = append(users, gin.H{"uuid": client.uuid, "name": client.name, "color": client.color})
+
+		s.hubs.Add(1)
+		go func() {
+			defer s.hubs.Done()
+			(&collaborator{client: client, tabId: req.TabID}).run(ctx, req.TypingRate, req.CursorRate)
+		}()
+	}
+	doc.mu.Unlock()
+	doc.broadcastUserList()
+	requestLog(c).Info("Synthetic collaborators started", "doc_id", doc.ID, "count", req.Count, "typing_rate", req.TypingRate, "cursor_rate", req.CursorRate)
+	c.JSON(http.StatusOK, gin.H{"collaborators": users})
+}
+
+// handleStopCollaborators removes every synthetic collaborator from a document
+func (s *Server) handleStopCollaborators(c *gin.Context) {
+	doc, exists := s.loadedDocument(c.Param("id"))
+	if !exists {
+		abortWithError(c, errDocumentNotLoaded)
+		return
+	}
+	doc.mu.RLock()
+	cancels := make([]context.CancelFunc, 0, len(doc.collaborators))
+	for _, cancel := range doc.collaborators {
+		cancels = append(cancels, cancel)
+	}
+	doc.mu.RUnlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	requestLog(c).Info("Synthetic collaborators stopped", "doc_id", doc.ID, "count", len(cancels))
+	c.Status(http.StatusNoContent)
+}
+
+// run types and moves the cursor at the given rates per second until ctx is
+// done, then takes the collaborator out of the document
+func (co *collaborator) run(ctx context.Context, typingRate, cursorRate float64) {
+	c := co.client
+	defer func() {
+		c.removePresence()
+		c.doc.mu.Lock()
+		delete(c.doc.collaborators, c)
+		c.doc.users.remove(c)
+		c.doc.mu.Unlock()
+		if c.doc.ctx.Err() == nil {
+			c.doc.broadcastUserList()
+		}
+	}()
+	typing, cursor := ticker(typingRate), ticker(cursorRate)
+	defer typing.Stop()
+	defer cursor.Stop()
+	co.moveCursor()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-typing.C:
+			co.typeChar(ctx)
+		case <-cursor.C:
+			co.moveCursor()
+		}
+	}
+}
+
+// ticker ticks rate times per second, or never for a zero rate
+func ticker(rate float64) *time.Ticker {
+	if rate <= 0 {
+		t := time.NewTicker(time.Hour)
+		t.Stop()
+		return t
+	}
+	return time.NewTicker(time.Duration(float64(time.Second) / rate))
+}
+
+// tab returns the tab to work in, following the active tab unless one was picked
+// Note: Caller must hold doc.mu
+func (co *collaborator) tab() int {
+	tabId := co.tabId
+	if tabId == "" {
+		tabId = co.client.doc.ActiveTabId
+	}
+	return co.client.doc.findTab(tabId)
+}
+
+// typeChar inserts the next character of lorem ipsum at the cursor
+func (co *collaborator) typeChar(ctx context.Context) {
+	c := co.client
+	c.doc.mu.RLock()
+	i := co.tab()
+	var tabId, kind string
+	if i >= 0 {
+		tabId, kind = c.doc.Tabs[i].ID, c.doc.Tabs[i].Kind
+	}
+	c.doc.mu.RUnlock()
+	if i < 0 || kind != "" {
+		return
+	}
+	if co.typing == "" {
+		co.typing = loremWords[rand.Intn(len(loremWords))] + " "
+		if rand.Intn(8) == 0 {
+			co.typing += "\n"
+		}
+	}
+	next := co.typing[:1]
+	_, err := c.doc.editTabContent(ctx, tabId, "", c, func(content string) (string, error) {
+		// Others may have edited around the cursor in the meantime
+		pos := min(co.pos, len(content))
+		for pos > 0 && pos < len(content) && !utf8.RuneStart(content[pos]) {
+			pos--
+		}
+		co.pos = pos + len(next)
+		return content[:pos] + next + content[pos:], nil
+	})
+	if err != nil {
+		c.log.Debug("Synthetic collaborator couldn't type", "tab_id", tabId, "error", err)
+		return
+	}
+	co.typing = co.typing[1:]
+	co.sendCursor()
+}
+
+// moveCursor puts the cursor at a random position of the tab
+func (co *collaborator) moveCursor() {
+	c := co.client
+	c.doc.mu.RLock()
+	if i := co.tab(); i >= 0 {
+		co.pos = rand.Intn(len(c.doc.Tabs[i].Content) + 1)
+	}
+	c.doc.mu.RUnlock()
+	co.typing = ""
+	co.sendCursor()
+}
+
+// sendCursor shares the cursor position with every client, as an editor would
+func (co *collaborator) sendCursor() {
+	c := co.client
+	c.doc.mu.Lock()
+	position := 0
+	if i := co.tab(); i >= 0 {
+		content := c.doc.Tabs[i].Content
+		co.pos = min(co.pos, len(content))
+		// Editors count UTF-16 code units
+		position = len(utf16.Encode([]rune(content[:co.pos])))
+	}
+	message, err := json.Marshal(map[string]interface{}{
+		"type":     "cursor",
+		"uuid":     c.uuid,
+		"name":     c.name,
+		"color":    c.color,
+		"position": position,
+	})
+	if err == nil {
+		c.cursor = message
+	}
+	c.doc.mu.Unlock()
+	if err != nil {
+		logger.Debug("Error marshaling synthetic cursor", "error", err)
+		return
+	}
+	if c.doc.load.shedding() {
+		shedMessages.Inc(metrics.Labels{"kind": "cursor"})
+		return
+	}
+	c.doc.send(BroadcastMessage{Sender: c, Message: message})
+}
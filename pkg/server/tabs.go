@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// errTabNotFound is sent when a message references a tab that doesn't exist
+var errTabNotFound = apperr.New(apperr.CodeInvalidTab, "tab not found")
+
+// stringField returns a string field of msg, telling the client its message was
+// rejected when the field is missing or has the wrong type
+func (c *Client) stringField(msg map[string]interface{}, field string) (string, bool) {
+	value, ok := msg[field].(string)
+	if !ok {
+		c.sendError(apperr.Newf(apperr.CodeInvalidMessage, "%s message is missing field %q", msg["type"], field))
+	}
+	return value, ok
+}
+
+// reply sends a message to this client only
+func (c *Client) reply(v interface{}) {
+	jsonMsg, err := json.Marshal(v)
+	if err != nil {
+		c.log.Debug("Error marshaling reply", "error", err)
+		return
+	}
+	select {
+	case c.send <- newFrame(jsonMsg):
+	default:
+		c.log.Debug("Client buffer full, dropping reply")
+	}
+}
+
+// deliver sends a message to this client through the hub. Unlike reply it is safe
+// to call from goroutines other than readPump, as only the hub closes c.send.
+func (c *Client) deliver(v interface{}) {
+	jsonMsg, err := json.Marshal(v)
+	if err != nil {
+		c.log.Debug("Error marshaling reply", "error", err)
+		return
+	}
+	c.doc.send(BroadcastMessage{Recipient: c, Message: jsonMsg})
+}
+
+// findTab returns the index of the tab with the given ID, or -1
+// Note: Caller must hold doc.mu
+func (doc *Document) findTab(tabId string) int {
+	for i, tab := range doc.Tabs {
+		if tab.ID == tabId {
+			return i
+		}
+	}
+	return -1
+}
+
+// resyncTab sends the server's copy of a tab back to this client after one of
+// its edits was rejected, so its editor doesn't drift from everyone else's
+func (c *Client) resyncTab(tabId string) {
+	c.doc.mu.Lock()
+	i := c.doc.findTab(tabId)
+	if i < 0 {
+		c.doc.mu.Unlock()
+		return
+	}
+	content := c.doc.Tabs[i].Content
+	c.rememberContent(tabId, content)
+	c.doc.mu.Unlock()
+	c.reply(map[string]interface{}{
+		"type":    "update",
+		"tabId":   tabId,
+		"content": content,
+	})
+}
+
+// handleTabDuplicate copies a tab and inserts the copy right after the original
+func (c *Client) handleTabDuplicate(ctx context.Context, msg map[string]interface{}) {
+	tabId, ok := c.stringField(msg, "tabId")
+	if !ok {
+		return
+	}
+	// Moderators may call a service, so the copy is moderated before doc.mu is taken
+	c.doc.mu.RLock()
+	i := c.doc.findTab(tabId)
+	if i < 0 {
+		c.doc.mu.RUnlock()
+		c.sendError(errTabNotFound)
+		return
+	}
+	moderated := Tab{ID: newID(), Content: c.doc.Tabs[i].Content, Notes: c.doc.Tabs[i].Notes}
+	c.doc.mu.RUnlock()
+	if err := c.moderateTab(ctx, &moderated); err != nil {
+		c.sendError(err)
+		return
+	}
+
+	c.doc.mu.Lock()
+	// Deleted meanwhile
+	if i = c.doc.findTab(tabId); i < 0 {
+		c.doc.mu.Unlock()
+		c.sendError(errTabNotFound)
+		return
+	}
+	if err := c.doc.checkStructure(c); err != nil {
+		c.doc.mu.Unlock()
+		c.sendError(err)
+		return
+	}
+	copied := c.doc.Tabs[i]
+	// As moderated, even if the original was edited meanwhile
+	copied.ID, copied.Content, copied.Notes = moderated.ID, moderated.Content, moderated.Notes
+	if err := c.doc.checkLock(copied.ID, ""); err != nil {
+		c.doc.mu.Unlock()
+		c.sendError(err)
+		return
+	}
+	copied.Name = copied.Name + " (copy)"
+	if err := c.doc.checkTabChange(-1, copied); err != nil {
+		c.doc.mu.Unlock()
+		c.sendError(err)
+		return
+	}
+	tabs := make([]Tab, 0, len(c.doc.Tabs)+1)
+	tabs = append(tabs, c.doc.Tabs[:i+1]...)
+	tabs = append(tabs, copied)
+	tabs = append(tabs, c.doc.Tabs[i+1:]...)
+	c.doc.Tabs = tabs
+	c.doc.ActiveTabId = copied.ID
+	updateMsg := map[string]interface{}{
+		"type":        "tabUpdate",
+		"tabs":        c.doc.Tabs,
+		"activeTabId": c.doc.ActiveTabId,
+	}
+	jsonMsg, err := json.Marshal(updateMsg)
+	c.doc.mu.Unlock()
+	if err != nil {
+		c.log.Debug("Error marshaling tabUpdate message", "error", err)
+		return
+	}
+	c.doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+
+	// Save state after duplicating tab
+	c.doc.scheduleSave()
+	c.doc.checkSoftLimits()
+	c.doc.recordActivity(storage.ActivityEvent{Type: storage.ActivityTabCreated, User: c.name, TabID: copied.ID, TabName: copied.Name})
+}
+
+// handleTabPromote creates a new document seeded with a tab's content and notes
+// and tells the requesting client the new document ID
+func (c *Client) handleTabPromote(ctx context.Context, msg map[string]interface{}) {
+	tabId, ok := c.stringField(msg, "tabId")
+	if !ok {
+		return
+	}
+	if err := c.doc.checkFeature(policy.FeaturePromote); err != nil {
+		c.sendError(err)
+		return
+	}
+	c.doc.mu.RLock()
+	i := c.doc.findTab(tabId)
+	if i < 0 {
+		c.doc.mu.RUnlock()
+		c.sendError(errTabNotFound)
+		return
+	}
+	tab := c.doc.Tabs[i]
+	language := c.doc.Language
+	// The new document stays in the same workspace with the same settings
+	workspace, settings := c.doc.workspace, c.doc.settings
+	expiry := time.Duration(c.doc.effective().TTL)
+	c.doc.mu.RUnlock()
+
+	seed := &storage.DocumentState{
+		Language: language,
+		Tabs: []storage.Tab{
+			{
+				ID:      "1",
+				Name:    tab.Name,
+				Content: tab.Content,
+				Notes:   tab.Notes,
+				Kind:    tab.Kind,
+				Runtime: tab.Runtime,
+			},
+		},
+		ActiveTabId: "1",
+		Settings:    &settings,
+		Expiry:      expiry,
+	}
+	newDocID, err := c.doc.server.createDocument(ctx, workspace, seed)
+	if err != nil {
+		c.log.Error("Error creating promoted document", "error", err)
+		c.sendError(err)
+		return
+	}
+	c.reply(map[string]interface{}{
+		"type":  "tabPromoted",
+		"tabId": tabId,
+		"docId": newDocID,
+	})
+}
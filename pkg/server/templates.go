@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// builtinTemplate is a template shipped with the server
+type builtinTemplate struct {
+	ID          string
+	Name        string
+	Description string
+	Language    string
+	Tabs        []storage.Tab
+}
+
+// builtinTemplates are offered next to the documents flagged as templates, in
+// this order. Their IDs can't be flagged, so they always mean the same thing.
+var builtinTemplates = []builtinTemplate{
+	{
+		ID:          "go-interview",
+		Name:        "Go interview",
+		Description: "A Go program and its tests, with notes for the interviewer",
+		Language:    "go",
+		Tabs: []storage.Tab{
+			{
+				ID:   "1",
+				Name: "main.go",
+				Content: "package main\n\nimport \"fmt\"\n\n" +
+					"// solve is where the candidate's solution goes\n" +
+					"func solve(input []int) int {\n\treturn 0\n}\n\n" +
+					"func main() {\n\tfmt.Println(solve([]int{1, 2, 3}))\n}\n",
+				Notes: "## Problem\n\n\n## Candidate\n\n- Name:\n- Role:\n\n" +
+					"## Notes\n\n- Approach:\n- Complexity:\n- Testing:\n- Communication:\n",
+			},
+			{
+				ID:   "2",
+				Name: "main_test.go",
+				Content: "package main\n\nimport \"testing\"\n\n" +
+					"func TestSolve(t *testing.T) {\n\ttests := []struct {\n\t\tinput []int\n\t\twant  int\n\t}{\n\t\t{[]int{1, 2, 3}, 0},\n\t}\n" +
+					"\tfor _, tt := range tests {\n\t\tif got := solve(tt.input); got != tt.want {\n" +
+					"\t\t\tt.Errorf(\"solve(%v) = %d, want %d\", tt.input, got, tt.want)\n\t\t}\n\t}\n}\n",
+			},
+		},
+	},
+	{
+		ID:          "sql-scratchpad",
+		Name:        "SQL scratchpad",
+		Description: "A schema with sample rows and a tab for queries against it",
+		Language:    "sql",
+		Tabs: []storage.Tab{
+			{
+				ID:   "1",
+				Name: "schema.sql",
+				Content: "CREATE TABLE users (\n  id INTEGER PRIMARY KEY,\n  name TEXT NOT NULL,\n  created_at TIMESTAMP NOT NULL\n);\n\n" +
+					"CREATE TABLE orders (\n  id INTEGER PRIMARY KEY,\n  user_id INTEGER NOT NULL REFERENCES users (id),\n  total NUMERIC(10, 2) NOT NULL\n);\n\n" +
+					"INSERT INTO users (id, name, created_at) VALUES\n  (1, 'Ada', '2024-01-01'),\n  (2, 'Grace', '2024-02-01');\n\n" +
+					"INSERT INTO orders (id, user_id, total) VALUES\n  (1, 1, 19.99),\n  (2, 1, 5.00),\n  (3, 2, 42.50);\n",
+			},
+			{
+				ID:   "2",
+				Name: "queries.sql",
+				Content: "SELECT u.name, COUNT(o.id) AS orders, SUM(o.total) AS spent\nFROM users u\n" +
+					"LEFT JOIN orders o ON o.user_id = u.id\nGROUP BY u.name\nORDER BY spent DESC;\n",
+			},
+		},
+	},
+	{
+		ID:          "incident-notes",
+		Name:        "Incident notes",
+		Description: "Summary, timeline and follow-ups for running and reviewing an incident",
+		Language:    "markdown",
+		Tabs: []storage.Tab{
+			{
+				ID:   "1",
+				Name: "Incident",
+				Content: "# Incident: \n\n- Status: investigating\n- Severity:\n- Incident commander:\n- Started:\n- Resolved:\n\n" +
+					"## Summary\n\n\n## Impact\n\n\n## Timeline\n\n| Time (UTC) | Event |\n| --- | --- |\n| | |\n\n" +
+					"## Root Cause\n\n\n## Follow-ups\n\n- [ ] \n",
+			},
+		},
+	},
+}
+
+// findBuiltinTemplate returns the built-in template with the given ID, or nil
+func findBuiltinTemplate(id string) *builtinTemplate {
+	for i := range builtinTemplates {
+		if builtinTemplates[i].ID == id {
+			return &builtinTemplates[i]
+		}
+	}
+	return nil
+}
+
+// templateRequest flags a document as a template
+type templateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// templateView is a template as listed to clients
+type templateView struct {
+	ID          string `json:"id"` // of the built-in template or the template document
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Builtin     bool   `json:"builtin,omitempty"`
+}
+
+// templateState returns the content new documents created from template id
+// start with
+func (s *Server) templateState(ctx context.Context, id string) (*storage.DocumentState, error) {
+	if builtin := findBuiltinTemplate(id); builtin != nil {
+		tabs := make([]storage.Tab, len(builtin.Tabs))
+		copy(tabs, builtin.Tabs)
+		return &storage.DocumentState{Language: builtin.Language, Tabs: tabs, ActiveTabId: tabs[0].ID}, nil
+	}
+	// Only flagged documents serve as templates; others are copied by forking
+	templates, err := s.store.Templates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if templates[id] == nil {
+		return nil, storage.ErrTemplateNotFound
+	}
+	state, err := s.documentState(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, storage.ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return contentOf(state), nil
+}
+
+// handleListTemplates lists the built-in templates followed by the documents
+// flagged as templates, by name
+func (s *Server) handleListTemplates(c *gin.Context) {
+	templates, err := s.store.Templates(c.Request.Context())
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	views := make([]templateView, 0, len(builtinTemplates)+len(templates))
+	for _, builtin := range builtinTemplates {
+		views = append(views, templateView{ID: builtin.ID, Name: builtin.Name, Description: builtin.Description, Builtin: true})
+	}
+	stored := make([]templateView, 0, len(templates))
+	for docID, template := range templates {
+		stored = append(stored, templateView{ID: docID, Name: template.Name, Description: template.Description})
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		if stored[i].Name != stored[j].Name {
+			return stored[i].Name < stored[j].Name
+		}
+		return stored[i].ID < stored[j].ID
+	})
+	c.JSON(http.StatusOK, gin.H{"templates": append(views, stored...)})
+}
+
+// handleSetTemplate flags a document as a template, or renames its template
+func (s *Server) handleSetTemplate(c *gin.Context) {
+	docID := c.Param("id")
+	var req templateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, apperr.Wrap(apperr.CodeValidation, err, "invalid request body"))
+		return
+	}
+	name := s.sanitizer.Label(req.Name)
+	if name == "" {
+		abortWithError(c, apperr.New(apperr.CodeValidation, "a template name is required"))
+		return
+	}
+	if findBuiltinTemplate(docID) != nil {
+		abortWithError(c, apperr.New(apperr.CodeConflict, "a built-in template has this ID"))
+		return
+	}
+	ctx := c.Request.Context()
+	// Templates whose document isn't in storage are dropped when listed, so
+	// save a document being edited here first
+	if doc, loaded := s.loadedDocument(docID); loaded {
+		if err := doc.saveState(ctx); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	} else if _, err := s.documentState(ctx, docID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	template := &storage.Template{
+		Name:        name,
+		Description: s.sanitizer.Label(req.Description),
+		Created:     time.Now().UnixMilli(),
+	}
+	if err := s.store.SaveTemplate(ctx, docID, template); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Document flagged as template", "doc_id", docID, "name", name)
+	c.JSON(http.StatusOK, templateView{ID: docID, Name: template.Name, Description: template.Description})
+}
+
+// handleDeleteTemplate unflags a template, keeping its document
+func (s *Server) handleDeleteTemplate(c *gin.Context) {
+	docID := c.Param("id")
+	if err := s.store.DeleteTemplate(c.Request.Context(), docID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	requestLog(c).Info("Template removed", "doc_id", docID)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/suggest"
+)
+
+// displayTitle returns the title set by users, or else the inferred one
+// Note: Caller must hold doc.mu
+func (doc *Document) displayTitle() string {
+	if doc.title != "" {
+		return doc.title
+	}
+	return doc.inferredTitle
+}
+
+// titleMessage builds the title frame sent when the displayed title changes
+// Note: Caller must hold doc.mu
+func (doc *Document) titleMessage() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "title",
+		"title":    doc.displayTitle(),
+		"inferred": doc.title == "",
+	}
+}
+
+// inferTitle derives a title from the first Markdown heading in the tabs'
+// notes or, failing that, the comment the first commented editor tab starts with
+func inferTitle(tabs []Tab) string {
+	for _, tab := range tabs {
+		if heading := suggest.Heading(tab.Notes); heading != "" {
+			return heading
+		}
+	}
+	for _, tab := range tabs {
+		if tab.Kind != "" {
+			continue
+		}
+		if comment := suggest.Comment(tab.Content); comment != "" {
+			return comment
+		}
+	}
+	return ""
+}
+
+// refreshTitle infers the document's title again before it's saved, so it
+// follows changes to the notes and code without being recomputed on every
+// keystroke. Clients are told when the displayed title changes.
+func (doc *Document) refreshTitle() {
+	doc.mu.Lock()
+	inferred := doc.server.sanitizer.Label(inferTitle(doc.Tabs))
+	if inferred == doc.inferredTitle {
+		doc.mu.Unlock()
+		return
+	}
+	doc.inferredTitle = inferred
+	var msgs []map[string]interface{}
+	if doc.title == "" {
+		msgs = append(msgs, doc.titleMessage())
+	}
+	doc.mu.Unlock()
+	doc.broadcastChanges(msgs)
+}
+
+// handleSetTitle sets the document's title; an empty title goes back to the inferred one
+func (c *Client) handleSetTitle(msg map[string]interface{}) {
+	title, ok := c.stringField(msg, "title")
+	if !ok {
+		return
+	}
+	c.doc.mu.Lock()
+	if err := c.doc.checkLock("", ""); err != nil {
+		c.doc.mu.Unlock()
+		c.sendError(err)
+		return
+	}
+	c.doc.title = c.doc.server.sanitizer.Label(title)
+	jsonMsg, err := json.Marshal(c.doc.titleMessage())
+	c.doc.mu.Unlock()
+	if err != nil {
+		logger.Debug("Error marshaling title message", "error", err)
+		return
+	}
+	c.doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+	c.doc.scheduleSave()
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// collectTrashLoop deletes the offloaded contents of documents whose copy in
+// the trash expired until the server shuts down
+func (s *Server) collectTrashLoop() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.store.CollectTrash(s.ctx); err != nil && s.ctx.Err() == nil {
+			logger.Error("Error collecting expired trash", "error", err)
+		}
+	}
+}
+
+// restoreTrashed moves a deleted document back out of the trash and saves it,
+// so it expires as its settings say and is listed as pinned again if it was
+func (s *Server) restoreTrashed(ctx context.Context, docID string) (*storage.DocumentState, error) {
+	if err := s.store.RestoreDocument(ctx, docID); err != nil {
+		return nil, err
+	}
+	state, err := s.documentState(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := s.stateSettings(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	state.Expiry = time.Duration(settings.TTL)
+	if err := s.store.SaveDocument(ctx, docID, state); err != nil {
+		return nil, err
+	}
+	if state.Pinned {
+		if err := s.store.SetPinned(ctx, docID, true); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
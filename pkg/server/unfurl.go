@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+)
+
+// handleUnfurl fetches a preview for a URL added to a tab's notes and shares it
+// with every client, so all participants render the same link preview
+func (c *Client) handleUnfurl(msg map[string]interface{}) {
+	url, ok := c.stringField(msg, "url")
+	if !ok {
+		return
+	}
+	tabId, _ := msg["tabId"].(string)
+	unfurler := c.doc.server.unfurler
+	if unfurler == nil {
+		c.sendError(errUnfurlDisabled)
+		return
+	}
+	if err := c.doc.checkFeature(policy.FeatureUnfurl); err != nil {
+		c.sendError(err)
+		return
+	}
+	// Fetching can take seconds; don't hold up this client's other messages
+	go func() {
+		ctx, cancel := context.WithTimeout(c.doc.ctx, 10*time.Second)
+		defer cancel()
+		meta, err := unfurler.Fetch(ctx, url)
+		if err != nil {
+			c.log.Debug("Error unfurling URL", "url", url, "error", err)
+			c.deliver(c.errorMessage(err))
+			return
+		}
+		previewMsg := map[string]interface{}{
+			"type":    "unfurl",
+			"tabId":   tabId,
+			"url":     url,
+			"preview": meta,
+		}
+		jsonMsg, err := json.Marshal(previewMsg)
+		if err != nil {
+			c.log.Debug("Error marshaling unfurl message", "error", err)
+			return
+		}
+		c.doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+	}()
+}
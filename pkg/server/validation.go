@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/validate"
+)
+
+// errValidationFailed is the error rejected content is reported with
+var errValidationFailed = apperr.New(apperr.CodeValidation, "content failed validation")
+
+// violationError rejects content that failed validation, carrying the details
+// sent with error frames and responses
+type violationError struct {
+	violations []validate.Violation
+}
+
+func (e *violationError) Error() string {
+	return errValidationFailed.Error()
+}
+
+func (e *violationError) Unwrap() error {
+	return errValidationFailed
+}
+
+// violationsOf returns the violations carried by err, if any
+func violationsOf(err error) []validate.Violation {
+	var ve *violationError
+	if errors.As(err, &ve) {
+		return ve.violations
+	}
+	return nil
+}
+
+// validateTab rejects tab content that fails the configured validators.
+// In flag mode nothing is rejected; see reportViolations.
+func (doc *Document) validateTab(tab Tab) error {
+	if doc.server.config.ValidationMode != validate.ModeReject {
+		return nil
+	}
+	if violations := doc.server.validator.Check(tab.Name, tab.Content); len(violations) > 0 {
+		return &violationError{violations: violations}
+	}
+	return nil
+}
+
+// reportViolations tells clients about validation problems in a tab's new
+// content when validators run in flag mode, and when a flagged tab is clean again
+func (doc *Document) reportViolations(tabId, name, content string) {
+	if doc.server.validator == nil || doc.server.config.ValidationMode != validate.ModeFlag {
+		return
+	}
+	violations := doc.server.validator.Check(name, content)
+	doc.mu.Lock()
+	wasFlagged := doc.flagged[tabId]
+	if len(violations) > 0 {
+		doc.flagged[tabId] = true
+	} else {
+		delete(doc.flagged, tabId)
+	}
+	doc.mu.Unlock()
+	if len(violations) == 0 && !wasFlagged {
+		return
+	}
+	jsonMsg, err := json.Marshal(map[string]interface{}{
+		"type":       "validation",
+		"tabId":      tabId,
+		"violations": violations,
+	})
+	if err != nil {
+		logger.Error("Error marshaling validation message", "doc_id", doc.ID, "error", err)
+		return
+	}
+	doc.send(BroadcastMessage{Sender: nil, Message: jsonMsg})
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// beatMisses is how many beat intervals may pass without one of this
+// instance's own beats coming back before its subscriptions count as dead
+const beatMisses = 3
+
+var (
+	// subscriptionRepairs counts documents whose subscriptions were found
+	// unhealthy, by reason: interrupted, silent or gap
+	subscriptionRepairs = metrics.NewCounter("gopad_subscription_repairs_total", "Number of document subscriptions repaired by the watchdog by reason")
+	// beatLag records how long this instance's beats take to come back
+	beatLag = metrics.NewHistogram("gopad_subscription_lag_seconds", "Time from publishing a beat until the instance receives it",
+		[]float64{0.001, 0.005, 0.025, 0.1, 0.5, 2, 10})
+)
+
+// Documents learn about changes made through other instances over Redis
+// pub/sub, which drops messages silently when a connection breaks. Every
+// instance with a document loaded publishes a numbered beat every
+// SubscriptionBeat and listens to everyone's. Subscriptions reconnect on their
+// own; the watchdog resubscribes when the instance's own beats stop coming
+// back anyway, and reloads the document from storage whenever messages may
+// have been lost.
+
+// watchdog tracks the health of a document's subscriptions
+type watchdog struct {
+	mu      sync.Mutex
+	subs    []*storage.Subscription // the running subscriptions
+	seq     uint64                  // of the last beat published
+	seen    map[string]uint64       // instance ID -> sequence number of its last beat received
+	lastOwn time.Time               // when an own beat last came back, or the subscriptions started
+}
+
+// subscribe starts the document's subscriptions, replacing any running ones.
+// They stop when the document is shut down.
+func (doc *Document) subscribe() {
+	s, docID := doc.server, doc.ID
+	w := &doc.watchdog
+	w.mu.Lock()
+	running := w.subs
+	w.subs = nil
+	w.mu.Unlock()
+	for _, sub := range running {
+		sub.Close()
+	}
+
+	subs := []*storage.Subscription{
+		s.store.SubscribeToUpdates(doc.ctx, docID, doc.applyRemoteUpdate),
+		// Another instance purged or shredded the document; don't write it back
+		s.store.SubscribeToDeletion(doc.ctx, docID, func() {
+			logger.Info("Document deleted by another instance, evicting", "doc_id", docID)
+			s.evictDocument(docID, false)
+		}),
+		s.store.SubscribeToLocks(doc.ctx, docID, doc.applyLocks),
+		s.store.SubscribeToActivity(doc.ctx, docID, doc.applyActivity),
+	}
+	if s.config.DeltaPersistence {
+		subs = append(subs, s.store.SubscribeToOps(doc.ctx, docID, doc.applyRemoteOps))
+	}
+	if s.config.SubscriptionBeat > 0 {
+		subs = append(subs, s.store.SubscribeToBeats(doc.ctx, docID, doc.receiveBeat))
+	}
+	w.mu.Lock()
+	w.subs = subs
+	w.lastOwn = time.Now()
+	w.mu.Unlock()
+}
+
+// watchSubscriptions publishes the document's beats and repairs its
+// subscriptions until the document is shut down
+func (doc *Document) watchSubscriptions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		doc.publishBeat()
+		if reason := doc.watchdog.check(time.Now(), interval); reason != "" {
+			logger.Warn("Document subscriptions unhealthy, reloading", "doc_id", doc.ID, "reason", reason)
+			subscriptionRepairs.Inc(metrics.Labels{"reason": reason})
+			// Interrupted subscriptions are back already, silent ones may be stuck
+			if reason == "silent" {
+				doc.subscribe()
+			}
+			doc.resync()
+		}
+	}
+}
+
+// publishBeat sends the document's next beat
+func (doc *Document) publishBeat() {
+	w := &doc.watchdog
+	w.mu.Lock()
+	w.seq++
+	beat := &storage.Beat{Instance: doc.server.instanceID, Seq: w.seq, Sent: time.Now().UnixMilli()}
+	w.mu.Unlock()
+	if err := doc.server.store.PublishBeat(doc.ctx, doc.ID, beat); err != nil && doc.ctx.Err() == nil {
+		logger.Error("Error publishing beat", "doc_id", doc.ID, "error", err)
+	}
+}
+
+// check reports why the subscriptions need repairing, or "" if they're healthy
+func (w *watchdog) check(now time.Time, interval time.Duration) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	interrupted := false
+	for _, sub := range w.subs {
+		// Every flag is cleared, so each interruption is repaired once
+		if sub.Interrupted() {
+			interrupted = true
+		}
+	}
+	switch {
+	case interrupted:
+		return "interrupted"
+	case now.Sub(w.lastOwn) > beatMisses*interval:
+		return "silent"
+	}
+	return ""
+}
+
+// receiveBeat records a beat, reloading the document when the sequence
+// shows beats, and so possibly updates, went missing
+func (doc *Document) receiveBeat(beat *storage.Beat) {
+	own := beat.Instance == doc.server.instanceID
+	w := &doc.watchdog
+	w.mu.Lock()
+	last, known := w.seen[beat.Instance]
+	w.seen[beat.Instance] = beat.Seq
+	if own {
+		w.lastOwn = time.Now()
+	}
+	w.mu.Unlock()
+	if own {
+		beatLag.Observe(time.Since(time.UnixMilli(beat.Sent)).Seconds(), metrics.Labels{})
+	}
+	// A lower number means the other instance loaded the document again
+	if known && beat.Seq > last+1 {
+		logger.Warn("Missed beats from an instance, reloading document", "doc_id", doc.ID, "instance", beat.Instance, "missed", beat.Seq-last-1)
+		subscriptionRepairs.Inc(metrics.Labels{"reason": "gap"})
+		go doc.resync()
+	}
+}
+
+// resync catches up with changes whose messages may have been lost: the
+// content, by reconciling with storage and the operation log, and the locks
+func (doc *Document) resync() {
+	doc.reconcile()
+	if doc.server.config.DeltaPersistence {
+		// Operations don't change the version, so missed ones only show in the log
+		doc.contentMu.Lock()
+		doc.opsMu.Lock()
+		err := doc.catchUpOps(doc.ctx)
+		doc.opsMu.Unlock()
+		doc.contentMu.Unlock()
+		if err != nil && doc.ctx.Err() == nil {
+			logger.Error("Error reloading logged operations", "doc_id", doc.ID, "error", err)
+		}
+	}
+	locks, err := doc.server.store.Locks(doc.ctx, doc.ID)
+	if err != nil {
+		if doc.ctx.Err() == nil {
+			logger.Error("Error reloading locks", "doc_id", doc.ID, "error", err)
+		}
+		return
+	}
+	doc.applyLocks(locks)
+}
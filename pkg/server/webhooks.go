@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/webhook"
+)
+
+// notify sends a document event to the configured webhooks, if any
+func (s *Server) notify(eventType, docID, user string) {
+	if s.webhooks == nil {
+		return
+	}
+	s.webhooks.Send(webhook.Event{Type: eventType, DocumentID: docID, User: user})
+}
+
+// watchExpiry reports documents expiring from storage to the webhooks until the server shuts down
+func (s *Server) watchExpiry() {
+	sub := s.store.SubscribeToExpiry(s.ctx, func(docID string) {
+		s.notify(webhook.DocumentExpired, docID, "")
+	})
+	<-sub.Done()
+}
+
+const (
+	// idleCheckInterval is how often edited documents are checked for having gone idle
+	idleCheckInterval = time.Minute
+	// expiryCheckInterval is how often storage is checked for documents about to expire
+	expiryCheckInterval = 10 * time.Minute
+)
+
+// watchLifecycle reports documents going idle after edits and documents
+// about to expire to the webhooks until the server shuts down
+func (s *Server) watchLifecycle() {
+	idle := time.NewTicker(idleCheckInterval)
+	defer idle.Stop()
+	var expiring <-chan time.Time
+	if s.config.WebhookExpiryWarning > 0 {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		expiring = ticker.C
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-idle.C:
+			s.notifyInactive(now)
+		case <-expiring:
+			s.notifyExpiring(s.ctx)
+		}
+	}
+}
+
+// notifyInactive reports documents whose last edit here is WebhookIdle before now
+func (s *Server) notifyInactive(now time.Time) {
+	var inactive []string
+	s.editsMu.Lock()
+	for docID, last := range s.lastEdits {
+		if now.Sub(last) >= s.config.WebhookIdle {
+			inactive = append(inactive, docID)
+			delete(s.lastEdits, docID)
+		}
+	}
+	s.editsMu.Unlock()
+	for _, docID := range inactive {
+		s.notify(webhook.DocumentInactive, docID, "")
+	}
+}
+
+// notifyExpiring reports documents whose TTL passes within WebhookExpiryWarning
+func (s *Server) notifyExpiring(ctx context.Context) {
+	expiring, err := s.store.ClaimExpiringDocuments(ctx, s.config.WebhookExpiryWarning)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("Error checking for expiring documents", "error", err)
+		}
+		return
+	}
+	now := time.Now()
+	for _, doc := range expiring {
+		s.webhooks.Send(webhook.Event{
+			Type:       webhook.DocumentExpiring,
+			DocumentID: doc.ID,
+			ExpiresAt:  now.Add(doc.ExpiresIn).UnixMilli(),
+		})
+	}
+}
+
+// noteEdit reports the first edit after the document has been idle for
+// WebhookIdle, and records the edit for reporting the document once it goes
+// idle again. Documents just loaded count as idle since their last save.
+// Note: Caller must hold doc.contentMu
+func (doc *Document) noteEdit(sender *Client) {
+	if doc.server.webhooks == nil {
+		return
+	}
+	now := time.Now()
+	last := doc.lastEdit
+	if last.IsZero() {
+		doc.mu.RLock()
+		last = time.UnixMilli(doc.lastModified)
+		doc.mu.RUnlock()
+	}
+	doc.lastEdit = now
+	doc.server.editsMu.Lock()
+	doc.server.lastEdits[doc.ID] = now
+	doc.server.editsMu.Unlock()
+	if now.Sub(last) < doc.server.config.WebhookIdle {
+		return
+	}
+	var user string
+	if sender != nil {
+		user = sender.name
+	}
+	doc.server.notify(webhook.DocumentActive, doc.ID, user)
+}
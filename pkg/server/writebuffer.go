@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/storage"
+)
+
+// While Redis is unreachable, saves that fail are held in a write buffer
+// instead of only being retried with the next change, and replayed once it's
+// back. Held saves are kept like the documents of a recovery file: replaying
+// one for a document no longer loaded loads it from the held state, merging
+// with anything stored since.
+
+var (
+	bufferedSaves     = metrics.NewCounter("gopad_buffered_saves_total", "Number of document saves held while storage was unreachable, by result: buffered, replayed or dropped")
+	bufferedDocuments = metrics.NewGauge("gopad_buffered_documents", "Number of documents with saves held until storage is reachable again")
+)
+
+const (
+	// replayBackoff and replayBackoffMax bound the wait between attempts to replay held saves
+	replayBackoff    = time.Second
+	replayBackoffMax = 30 * time.Second
+	// pingTimeout bounds checking whether storage is reachable
+	pingTimeout = 2 * time.Second
+)
+
+// writeBuffer holds the latest state of documents whose saves failed while
+// storage was unreachable
+type writeBuffer struct {
+	limit int
+	dir   string        // empty when held saves are only kept in memory
+	wake  chan struct{} // signalled when a save is held
+	mu    sync.Mutex
+	docs  map[string]*recoveredDocument
+	since time.Time // when the first save still held failed
+}
+
+// newWriteBuffer creates a buffer holding saves of up to limit documents,
+// picking up the ones a previous run left in dir
+func newWriteBuffer(limit int, dir string) *writeBuffer {
+	b := &writeBuffer{
+		limit: limit,
+		dir:   dir,
+		wake:  make(chan struct{}, 1),
+		docs:  make(map[string]*recoveredDocument),
+	}
+	if dir == "" {
+		return b
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		logger.Error("Error creating write buffer directory", "dir", dir, "error", err)
+		return b
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Error("Error reading write buffer directory", "dir", dir, "error", err)
+		return b
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			logger.Error("Error reading held save", "file", entry.Name(), "error", err)
+			continue
+		}
+		var rec recoveredDocument
+		if err := json.Unmarshal(data, &rec); err != nil || rec.State == nil {
+			logger.Error("Invalid held save", "file", entry.Name(), "error", err)
+			continue
+		}
+		b.docs[rec.ID] = &rec
+	}
+	if len(b.docs) > 0 {
+		logger.Info("Replaying saves held by a previous run", "dir", dir, "documents", len(b.docs))
+		b.since = time.Now()
+		b.wake <- struct{}{}
+	}
+	bufferedDocuments.Set(float64(len(b.docs)), nil)
+	return b
+}
+
+// put holds rec in place of any earlier save of the document. It returns
+// false when the buffer is full.
+func (b *writeBuffer) put(rec *recoveredDocument) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, held := b.docs[rec.ID]; !held && len(b.docs) >= b.limit {
+		return false
+	}
+	b.docs[rec.ID] = rec
+	if b.since.IsZero() {
+		b.since = time.Now()
+	}
+	bufferedDocuments.Set(float64(len(b.docs)), nil)
+	if b.dir != "" {
+		data, err := json.Marshal(rec)
+		if err == nil {
+			err = replaceFile(b.path(rec.ID), data)
+		}
+		if err != nil {
+			logger.Error("Error writing held save", "doc_id", rec.ID, "error", err)
+		}
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// remove drops the held save of a document, once it's saved or deleted
+func (b *writeBuffer) remove(docID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, held := b.docs[docID]; !held {
+		return false
+	}
+	delete(b.docs, docID)
+	if len(b.docs) == 0 {
+		b.since = time.Time{}
+	}
+	bufferedDocuments.Set(float64(len(b.docs)), nil)
+	if b.dir != "" {
+		if err := os.Remove(b.path(docID)); err != nil && !os.IsNotExist(err) {
+			logger.Error("Error removing held save", "doc_id", docID, "error", err)
+		}
+	}
+	return true
+}
+
+// held returns the saves being held
+func (b *writeBuffer) held() []*recoveredDocument {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recs := make([]*recoveredDocument, 0, len(b.docs))
+	for _, rec := range b.docs {
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// status returns how many documents have saves held and since when
+func (b *writeBuffer) status() (int, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.docs), b.since
+}
+
+// path returns the file a document's held save is kept in
+func (b *writeBuffer) path(docID string) string {
+	return filepath.Join(b.dir, url.PathEscape(docID)+".json")
+}
+
+// holdSave keeps the document's current state for replaying if its save
+// failed because storage is unreachable. It reports whether it did.
+func (s *Server) holdSave(doc *Document) bool {
+	if s.buffer == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	// Other failures, such as conflicts that didn't merge, aren't helped by waiting
+	if s.store.Ping(ctx) == nil {
+		return false
+	}
+	rec := doc.recoveryState()
+	rec.Unsaved = true
+	if !s.buffer.put(&rec) {
+		bufferedSaves.Inc(metrics.Labels{"result": "dropped"})
+		logger.Error("Write buffer full, dropping save", "doc_id", doc.ID, "limit", s.config.WriteBufferSize)
+		return false
+	}
+	bufferedSaves.Inc(metrics.Labels{"result": "buffered"})
+	logger.Warn("Storage unreachable, holding save", "doc_id", doc.ID)
+	return true
+}
+
+// saved drops the held save of a document that was saved since
+func (s *Server) saved(docID string) {
+	if s.buffer != nil && s.buffer.remove(docID) {
+		bufferedSaves.Inc(metrics.Labels{"result": "replayed"})
+		logger.Info("Held save written", "doc_id", docID)
+	}
+}
+
+// replayLoop waits for saves to be held and replays them once storage is
+// reachable, backing off with jitter while it isn't
+func (s *Server) replayLoop() {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.buffer.wake:
+		}
+		for attempt := 1; ; attempt++ {
+			if n, _ := s.buffer.status(); n == 0 {
+				break
+			}
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(storage.Backoff(attempt, replayBackoff, replayBackoffMax)):
+			}
+			ctx, cancel := context.WithTimeout(s.ctx, pingTimeout)
+			err := s.store.Ping(ctx)
+			cancel()
+			if err != nil {
+				continue
+			}
+			s.replayHeld()
+		}
+	}
+}
+
+// replayHeld saves the documents whose saves are held, loading those that
+// aren't loaded anymore from the held state
+func (s *Server) replayHeld() {
+	for _, rec := range s.buffer.held() {
+		if s.ctx.Err() != nil {
+			return
+		}
+		doc, loaded := s.loadedDocument(rec.ID)
+		if !loaded {
+			s.mu.Lock()
+			if _, pending := s.recovered[rec.ID]; !pending {
+				s.recovered[rec.ID] = rec
+			}
+			s.mu.Unlock()
+			var err error
+			if doc, err = s.getOrCreateDocument(s.ctx, rec.ID); err != nil {
+				return
+			}
+		}
+		// Flushing forgets the held save once the document is saved, and
+		// holds it again if storage went away in between
+		doc.saver.flush(s.ctx)
+		doc.compactor.flush(s.ctx)
+		if !doc.saver.hasPending() && !doc.compactor.hasPending() {
+			// Nothing was left to save, e.g. the document was saved since
+			s.saved(rec.ID)
+		}
+	}
+}
+
+// handleReady reports whether the instance can take clients. It can while
+// storage is unreachable as long as saves are held for replaying, reporting
+// itself degraded, but not while draining or when saves would be lost.
+func (s *Server) handleReady(c *gin.Context) {
+	if s.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), pingTimeout)
+	defer cancel()
+	reachable := s.store.Ping(ctx) == nil
+	body := gin.H{"status": "ok", "storage": "ok"}
+	if !reachable {
+		body["status"], body["storage"] = "degraded", "unreachable"
+	}
+	if s.buffer == nil {
+		if !reachable {
+			c.JSON(http.StatusServiceUnavailable, body)
+			return
+		}
+	} else if n, since := s.buffer.status(); n > 0 {
+		body["status"] = "degraded"
+		body["bufferedDocuments"] = n
+		body["degradedSince"] = since.UTC()
+		if n >= s.buffer.limit && !reachable {
+			c.JSON(http.StatusServiceUnavailable, body)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, body)
+}
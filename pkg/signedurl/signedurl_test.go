@@ -0,0 +1,81 @@
+package signedurl
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	s := New([]byte("secret"), time.Minute)
+	now := time.Unix(1_700_000_000, 0)
+	expires := now.Add(time.Hour)
+	signed := func(path string, expires time.Time) url.Values {
+		u, err := url.Parse(s.Sign(path, expires))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Query()
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		query url.Values
+		now   time.Time
+		want  error
+	}{
+		{"valid", "/doc/a", signed("/doc/a", expires), now, nil},
+		{"expired within skew", "/doc/a", signed("/doc/a", expires), expires.Add(30 * time.Second), nil},
+		{"expired past skew", "/doc/a", signed("/doc/a", expires), expires.Add(2 * time.Minute), ErrExpired},
+		{"other path", "/doc/b", signed("/doc/a", expires), now, ErrInvalidSignature},
+		{"other secret", "/doc/a", func() url.Values {
+			u, _ := url.Parse(New([]byte("other"), 0).Sign("/doc/a", expires))
+			return u.Query()
+		}(), now, ErrInvalidSignature},
+		{"extended expiry", "/doc/a", func() url.Values {
+			q := signed("/doc/a", expires)
+			q.Set("expires", "9999999999")
+			return q
+		}(), now, ErrInvalidSignature},
+		{"malformed expiry", "/doc/a", url.Values{"expires": {"soon"}, "sig": {s.signature("/doc/a", "soon")}}, now, ErrInvalidSignature},
+		{"missing signature", "/doc/a", url.Values{"expires": {"1700003600"}}, now, ErrMissingSignature},
+		{"missing expiry", "/doc/a", url.Values{"sig": {"x"}}, now, ErrMissingSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Verify(tt.path, tt.query, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	s := New([]byte("secret"), 0)
+	now := time.Unix(1_700_000_000, 0)
+	token := s.Token("/doc/a", now.Add(time.Hour))
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		now   time.Time
+		want  error
+	}{
+		{"valid", "/doc/a", token, now, nil},
+		{"expired", "/doc/a", token, now.Add(2 * time.Hour), ErrExpired},
+		{"other path", "/doc/b", token, now, ErrInvalidSignature},
+		{"no separator", "/doc/a", "1700003600", now, ErrInvalidSignature},
+		{"empty", "/doc/a", "", now, ErrInvalidSignature},
+		{"empty parts", "/doc/a", ".", now, ErrMissingSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.VerifyToken(tt.path, tt.token, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
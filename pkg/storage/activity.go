@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// ActivityLimit is how many of a document's most recent activity events are kept
+const ActivityLimit = 1000
+
+// Activity event types
+const (
+	ActivityUserJoined      = "userJoined"
+	ActivityTabCreated      = "tabCreated"
+	ActivityTabRenamed      = "tabRenamed"
+	ActivityTabDeleted      = "tabDeleted"
+	ActivityLanguageChanged = "languageChanged"
+)
+
+// ActivityEvent is an entry in a document's activity feed
+type ActivityEvent struct {
+	Type         string `json:"type"`
+	Time         int64  `json:"time"`                   // unix milliseconds
+	User         string `json:"user,omitempty"`         // display name of who made the change; empty for automation
+	TabID        string `json:"tabId,omitempty"`        // for tab events
+	TabName      string `json:"tabName,omitempty"`      // the tab's name, after a rename
+	PreviousName string `json:"previousName,omitempty"` // the tab's name before a rename
+	Language     string `json:"language,omitempty"`     // for languageChanged
+}
+
+// appendActivityScript adds an event to the feed, keeps only the newest entries
+// and publishes it.
+// KEYS[1] = activity list, ARGV = serialized event, limit, TTL seconds, activity channel, message prefix
+var appendActivityScript = redis.NewScript(`
+redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('LTRIM', KEYS[1], -tonumber(ARGV[2]), -1)
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+redis.call('PUBLISH', ARGV[4], ARGV[5] .. ARGV[1])
+return 1
+`)
+
+// AppendActivity records an event in the document's activity feed and
+// notifies all instances. The feed is kept for ttl after its last event, or
+// for as long as documents are by default when ttl is zero.
+func (s *Storage) AppendActivity(ctx context.Context, docID string, event *ActivityEvent, ttl time.Duration) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal activity")
+	}
+	if data, err = s.encode(ctx, docID, data); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		ttl = defaultExpiry
+	}
+	channel, prefix := s.channel(docID, "activity:updates")
+	err = appendActivityScript.Run(ctx, s.client,
+		[]string{fmt.Sprintf("doc:%s:activity", docID)},
+		data, ActivityLimit, int64(ttl.Seconds()), channel, prefix,
+	).Err()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to record activity")
+	}
+	return nil
+}
+
+// Activity returns up to limit of the document's most recent activity events, oldest first
+func (s *Storage) Activity(ctx context.Context, docID string, limit int) ([]ActivityEvent, error) {
+	if limit <= 0 || limit > ActivityLimit {
+		limit = ActivityLimit
+	}
+	entries, err := s.client.LRange(ctx, fmt.Sprintf("doc:%s:activity", docID), int64(-limit), -1).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load activity")
+	}
+	events := make([]ActivityEvent, 0, len(entries))
+	for _, entry := range entries {
+		event, err := s.decodeActivity(ctx, docID, []byte(entry))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	return events, nil
+}
+
+// SubscribeToActivity delivers activity events recorded by any instance until ctx is cancelled
+func (s *Storage) SubscribeToActivity(ctx context.Context, docID string, handler func(*ActivityEvent)) *Subscription {
+	return s.subscribe(ctx, docID, "activity:updates", func(msg string) error {
+		event, err := s.decodeActivity(ctx, docID, []byte(msg))
+		if err != nil {
+			return err
+		}
+		handler(event)
+		return nil
+	})
+}
+
+func (s *Storage) decodeActivity(ctx context.Context, docID string, data []byte) (*ActivityEvent, error) {
+	data, err := s.decode(ctx, docID, data)
+	if err != nil {
+		return nil, err
+	}
+	var event ActivityEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal activity")
+	}
+	return &event, nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Kinds of ban
+const (
+	BanIP   = "ip"   // a client address
+	BanUUID = "uuid" // a user ID sent with setName
+)
+
+// bansKey holds the instance-wide bans
+const bansKey = "bans"
+
+// Ban keeps a client away from one document or, with an empty DocID, from all of them
+type Ban struct {
+	Kind    string `json:"kind"` // BanIP or BanUUID
+	Value   string `json:"value"`
+	DocID   string `json:"docId,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Created int64  `json:"created"`           // unix milliseconds
+	Expires int64  `json:"expires,omitempty"` // unix milliseconds, zero for permanent
+}
+
+// Live reports whether the ban still applies at now
+func (b *Ban) Live(now time.Time) bool {
+	return b.Expires == 0 || b.Expires > now.UnixMilli()
+}
+
+// ErrBanNotFound is returned when lifting a ban that doesn't exist
+var ErrBanNotFound = apperr.New(apperr.CodeNotFound, "ban not found")
+
+// Bans of a scope live in one hash keyed by "<kind>:<value>", so checking a
+// client takes a single HMGET per scope. Expired bans are dropped when listed.
+
+func bansKeyFor(docID string) string {
+	if docID == "" {
+		return bansKey
+	}
+	return fmt.Sprintf("doc:%s:bans", docID)
+}
+
+func banField(kind, value string) string {
+	return kind + ":" + value
+}
+
+// AddBan stores a ban, replacing one of the same kind and value in its scope
+func (s *Storage) AddBan(ctx context.Context, ban *Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal ban")
+	}
+	if err := s.client.HSet(ctx, bansKeyFor(ban.DocID), banField(ban.Kind, ban.Value), data).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to save ban")
+	}
+	return nil
+}
+
+// RemoveBan lifts a ban, returning ErrBanNotFound if there is none
+func (s *Storage) RemoveBan(ctx context.Context, docID, kind, value string) error {
+	removed, err := s.client.HDel(ctx, bansKeyFor(docID), banField(kind, value)).Result()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to remove ban")
+	}
+	if removed == 0 {
+		return ErrBanNotFound
+	}
+	return nil
+}
+
+// Bans lists the live bans of a document, or the instance-wide ones for an
+// empty docID, oldest first
+func (s *Storage) Bans(ctx context.Context, docID string) ([]Ban, error) {
+	key := bansKeyFor(docID)
+	entries, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list bans")
+	}
+	now := time.Now()
+	bans := make([]Ban, 0, len(entries))
+	var expired []string
+	for field, data := range entries {
+		var ban Ban
+		if err := json.Unmarshal([]byte(data), &ban); err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal ban")
+		}
+		if !ban.Live(now) {
+			expired = append(expired, field)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	if len(expired) > 0 {
+		if err := s.client.HDel(ctx, key, expired...).Err(); err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list bans")
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created < bans[j].Created })
+	return bans, nil
+}
+
+// FindBan returns the live ban keeping a client with the given address or
+// user ID away from a document, or nil if there is none. Instance-wide bans
+// are reported first. Either ip or uuid may be empty.
+func (s *Storage) FindBan(ctx context.Context, docID, ip, uuid string) (*Ban, error) {
+	var fields []string
+	if ip != "" {
+		fields = append(fields, banField(BanIP, ip))
+	}
+	if uuid != "" {
+		fields = append(fields, banField(BanUUID, uuid))
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	pipe := s.client.Pipeline()
+	scopes := []*redis.SliceCmd{
+		pipe.HMGet(ctx, bansKey, fields...),
+		pipe.HMGet(ctx, bansKeyFor(docID), fields...),
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to check bans")
+	}
+	now := time.Now()
+	for _, scope := range scopes {
+		for _, value := range scope.Val() {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var ban Ban
+			if err := json.Unmarshal([]byte(data), &ban); err != nil {
+				return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal ban")
+			}
+			if ban.Live(now) {
+				return &ban, nil
+			}
+		}
+	}
+	return nil, nil
+}
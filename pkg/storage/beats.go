@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Beat is published periodically by every instance that has a document
+// loaded. Instances receive their own beats along with everyone else's, so
+// beats that stop arriving reveal a dead subscription, and a gap in an
+// instance's sequence numbers reveals messages lost while it reconnected.
+type Beat struct {
+	Instance string `json:"instance"`
+	Seq      uint64 `json:"seq"`  // counts up from 1 for each document an instance loads
+	Sent     int64  `json:"sent"` // unix milliseconds
+}
+
+// PublishBeat sends a beat to every instance subscribed to the document
+func (s *Storage) PublishBeat(ctx context.Context, docID string, beat *Beat) error {
+	data, err := json.Marshal(beat)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal beat")
+	}
+	channel, prefix := s.channel(docID, "beats")
+	if err := s.client.Publish(ctx, channel, prefix+string(data)).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to publish beat")
+	}
+	return nil
+}
+
+// SubscribeToBeats delivers the beats of every instance with the document
+// loaded until ctx is cancelled
+func (s *Storage) SubscribeToBeats(ctx context.Context, docID string, handler func(*Beat)) *Subscription {
+	return s.subscribe(ctx, docID, "beats", func(msg string) error {
+		var beat Beat
+		if err := json.Unmarshal([]byte(msg), &beat); err != nil {
+			return apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal beat")
+		}
+		handler(&beat)
+		return nil
+	})
+}
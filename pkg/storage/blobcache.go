@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// blobCacheLookups counts lookups of offloaded tab contents in memory, by result: hit or miss
+var blobCacheLookups = metrics.NewCounter("gopad_tab_cache_lookups_total", "Number of offloaded tab contents looked up in memory before the blob store, by result: hit or miss")
+
+// blobCache keeps recently used offloaded tab contents in memory, so loading a
+// document again or receiving its updates from other instances doesn't fetch
+// every large tab from the blob store. Blob names are derived from their
+// content, so cached entries never go stale; they're only dropped when space
+// is needed or their blobs are removed.
+type blobCache struct {
+	limit int // total size of the cached contents in bytes
+	mu    sync.Mutex
+	size  int
+	order *list.List               // most recently used first
+	items map[string]*list.Element // by blob name
+}
+
+type blobCacheEntry struct {
+	name    string
+	content string
+}
+
+// newBlobCache creates a cache holding up to limit bytes, or nil to cache nothing
+func newBlobCache(limit int) *blobCache {
+	if limit <= 0 {
+		return nil
+	}
+	return &blobCache{
+		limit: limit,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the decoded content of a blob if it's cached
+func (c *blobCache) get(name string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[name]
+	if !ok {
+		blobCacheLookups.Inc(metrics.Labels{"result": "miss"})
+		return "", false
+	}
+	blobCacheLookups.Inc(metrics.Labels{"result": "hit"})
+	c.order.MoveToFront(elem)
+	return elem.Value.(*blobCacheEntry).content, true
+}
+
+// put caches the decoded content of a blob, evicting the least recently used
+// ones to make room. Contents larger than the whole cache aren't kept.
+func (c *blobCache) put(name, content string) {
+	if c == nil || len(content) > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[name]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[name] = c.order.PushFront(&blobCacheEntry{name: name, content: content})
+	c.size += len(content)
+	for c.size > c.limit {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// remove drops blobs from the cache
+func (c *blobCache) remove(names ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		if elem, ok := c.items[name]; ok {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// removePrefix drops the blobs whose names start with prefix, such as all of a document's
+func (c *blobCache) removePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, elem := range c.items {
+		if strings.HasPrefix(name, prefix) {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// Note: Caller must hold c.mu
+func (c *blobCache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*blobCacheEntry)
+	delete(c.items, entry.name)
+	c.size -= len(entry.content)
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+// Modes of connecting to Redis
+const (
+	ModeSingle   = "single"   // one server
+	ModeCluster  = "cluster"  // a Redis Cluster, discovered from the nodes in the URL
+	ModeSentinel = "sentinel" // the master monitored by the Sentinels in the URL
+)
+
+const (
+	// connectBackoff and connectBackoffMax bound the wait between attempts to connect
+	connectBackoff    = 250 * time.Millisecond
+	connectBackoffMax = 10 * time.Second
+)
+
+// Options tune the Redis connection on top of its URL. Zero values keep what
+// the URL says, which can also set pool sizes, timeouts and retries through
+// go-redis' query parameters such as ?pool_size=20&max_retries=5.
+type Options struct {
+	// Mode picks the kind of client. Empty uses the URL's scheme, where
+	// redis+sentinel:// and redis+cluster:// (or rediss+ for TLS) pick the
+	// Sentinel and cluster modes and anything else a single server.
+	Mode string
+	// MasterName is the master to ask the Sentinels for, unless the URL's
+	// master_name parameter names one
+	MasterName string
+	// TLSCAFile holds the PEM certificates Redis is verified with instead of
+	// the system's, and TLSCertFile and TLSKeyFile a client certificate for
+	// mutual TLS. Either turns TLS on, as does a rediss:// URL.
+	TLSCAFile   string
+	TLSCertFile string
+	TLSKeyFile  string
+	// PoolSize and MinIdleConns size the connection pool of each node
+	PoolSize     int
+	MinIdleConns int
+	// MaxRetries is how often failed commands are retried, -1 for never,
+	// waiting between MinRetryBackoff and MaxRetryBackoff with exponential
+	// backoff and jitter
+	MaxRetries      int
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+	// ConnectAttempts is how often connecting is tried, backing off in between,
+	// before giving up; zero tries once
+	ConnectAttempts int
+	// OperationTimeout bounds each command and pipeline called with a context
+	// without a deadline, such as a document's or the server's, so a slow
+	// Redis can't hold up callers forever; zero leaves them unbounded
+	OperationTimeout time.Duration
+	// SlowOperation is how long saving, loading or deleting a document or
+	// subscribing may take before it's logged as slow; zero never logs them
+	SlowOperation time.Duration
+}
+
+// Connect opens a Redis connection in the mode the options or URL ask for,
+// using ctx for the initial connection check
+func Connect(ctx context.Context, redisURL string, opts Options) (redis.UniversalClient, error) {
+	mode := opts.Mode
+	// The mode is picked here; go-redis only knows the plain schemes
+	if scheme, rest, ok := strings.Cut(redisURL, "://"); ok {
+		if base, suffix, ok := strings.Cut(scheme, "+"); ok {
+			if mode == "" {
+				mode = suffix
+			}
+			redisURL = base + "://" + rest
+		}
+	}
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeValidation, err, "failed to parse Redis URL")
+	}
+
+	var client redis.UniversalClient
+	switch mode {
+	case "", ModeSingle:
+		o, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeValidation, err, "failed to parse Redis URL")
+		}
+		if err := opts.tune(u.Hostname(), &o.TLSConfig, &o.PoolSize, &o.MinIdleConns, &o.MaxRetries, &o.MinRetryBackoff, &o.MaxRetryBackoff); err != nil {
+			return nil, err
+		}
+		o.ContextTimeoutEnabled = true
+		client = redis.NewClient(o)
+	case ModeCluster:
+		o, err := redis.ParseClusterURL(redisURL)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeValidation, err, "failed to parse Redis URL")
+		}
+		if err := opts.tune(u.Hostname(), &o.TLSConfig, &o.PoolSize, &o.MinIdleConns, &o.MaxRetries, &o.MinRetryBackoff, &o.MaxRetryBackoff); err != nil {
+			return nil, err
+		}
+		o.ContextTimeoutEnabled = true
+		client = redis.NewClusterClient(o)
+	case ModeSentinel:
+		o, err := redis.ParseFailoverURL(redisURL)
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeValidation, err, "failed to parse Redis URL")
+		}
+		if o.MasterName == "" {
+			o.MasterName = opts.MasterName
+		}
+		if o.MasterName == "" {
+			return nil, apperr.New(apperr.CodeValidation, "connecting through Sentinel needs the name of the master")
+		}
+		if err := opts.tune(u.Hostname(), &o.TLSConfig, &o.PoolSize, &o.MinIdleConns, &o.MaxRetries, &o.MinRetryBackoff, &o.MaxRetryBackoff); err != nil {
+			return nil, err
+		}
+		o.ContextTimeoutEnabled = true
+		client = redis.NewFailoverClient(o)
+	default:
+		return nil, apperr.Newf(apperr.CodeValidation, "unknown Redis mode %q", mode)
+	}
+	if opts.OperationTimeout > 0 {
+		client.AddHook(deadlineHook{timeout: opts.OperationTimeout})
+	}
+
+	if err := ping(ctx, client, opts.ConnectAttempts); err != nil {
+		client.Close()
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to connect to Redis")
+	}
+	return client, nil
+}
+
+// tune applies the options that are set over the settings parsed from the URL
+func (o Options) tune(host string, tlsConfig **tls.Config, poolSize, minIdleConns, maxRetries *int, minBackoff, maxBackoff *time.Duration) error {
+	if o.TLSCAFile != "" || o.TLSCertFile != "" {
+		config := *tlsConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		}
+		if o.TLSCAFile != "" {
+			data, err := os.ReadFile(o.TLSCAFile)
+			if err != nil {
+				return apperr.Wrap(apperr.CodeValidation, err, "failed to read Redis CA certificates")
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return apperr.Newf(apperr.CodeValidation, "no certificates in %s", o.TLSCAFile)
+			}
+			config.RootCAs = pool
+		}
+		if o.TLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+			if err != nil {
+				return apperr.Wrap(apperr.CodeValidation, err, "failed to load Redis client certificate")
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		*tlsConfig = config
+	}
+	if o.PoolSize > 0 {
+		*poolSize = o.PoolSize
+	}
+	if o.MinIdleConns > 0 {
+		*minIdleConns = o.MinIdleConns
+	}
+	if o.MaxRetries != 0 {
+		*maxRetries = o.MaxRetries
+	}
+	if o.MinRetryBackoff > 0 {
+		*minBackoff = o.MinRetryBackoff
+	}
+	if o.MaxRetryBackoff > 0 {
+		*maxBackoff = o.MaxRetryBackoff
+	}
+	return nil
+}
+
+// deadlineHook gives commands and pipelines called without a deadline one
+// timeout from now. Callers' own deadlines, such as a client message's
+// processing budget, are kept; go-redis applies them to reads and writes on
+// the connection since ContextTimeoutEnabled is set.
+type deadlineHook struct {
+	timeout time.Duration
+}
+
+func (h deadlineHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h deadlineHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if _, ok := ctx.Deadline(); ok {
+			return next(ctx, cmd)
+		}
+		ctx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+		return next(ctx, cmd)
+	}
+}
+
+func (h deadlineHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if _, ok := ctx.Deadline(); ok {
+			return next(ctx, cmds)
+		}
+		ctx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+		return next(ctx, cmds)
+	}
+}
+
+// ping checks the connection, trying up to attempts times with exponential
+// backoff and jitter in between, so instances starting together with Redis
+// wait for it rather than fail
+func ping(ctx context.Context, client redis.UniversalClient, attempts int) error {
+	for attempt := 1; ; attempt++ {
+		err := client.Ping(ctx).Err()
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		delay := Backoff(attempt, connectBackoff, connectBackoffMax)
+		logger.Warn("Redis is unreachable, retrying", "attempt", attempt, "retry_in", delay.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (gave up: %w)", err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Backoff returns how long to wait before the given retry: a random duration
+// up to base doubled for each earlier attempt, capped at limit. Spreading
+// retries out this way keeps instances that failed together from retrying
+// in lockstep.
+func Backoff(attempt int, base, limit time.Duration) time.Duration {
+	ceiling := limit
+	if attempt < 32 {
+		if d := base << (attempt - 1); d > 0 && d < limit {
+			ceiling = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
@@ -0,0 +1,41 @@
+package storage
+
+import "sync"
+
+// docLocks serializes work on each document without holding up other
+// documents, so blobs one save or delete removes can't be ones another is
+// about to reference. Locks are dropped once nobody holds or waits for them.
+type docLocks struct {
+	mu    sync.Mutex
+	locks map[string]*docLock
+}
+
+type docLock struct {
+	sync.Mutex
+	refs int // holders and waiters
+}
+
+// lock locks docID and returns the function that unlocks it
+func (l *docLocks) lock(docID string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*docLock)
+	}
+	dl, ok := l.locks[docID]
+	if !ok {
+		dl = &docLock{}
+		l.locks[docID] = dl
+	}
+	dl.refs++
+	l.mu.Unlock()
+
+	dl.Lock()
+	return func() {
+		dl.Unlock()
+		l.mu.Lock()
+		if dl.refs--; dl.refs == 0 {
+			delete(l.locks, docID)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/envelope"
+)
+
+// encryptedPrefix marks payloads sealed with a per-document data key
+const encryptedPrefix = "enc:v1:"
+
+// ErrKeyDestroyed is returned when a document's data key has been shredded
+var ErrKeyDestroyed = apperr.New(apperr.CodeNotFound, "document key has been destroyed")
+
+// dataKeyTTL is how long an unwrapped data key is used before it's read again,
+// bounding how long an instance that missed a deletion keeps using it
+const dataKeyTTL = 5 * time.Minute
+
+// maxCachedKeys bounds how many unwrapped data keys are kept in memory
+const maxCachedKeys = 10000
+
+// keyring caches unwrapped per-document data keys
+type keyring struct {
+	master envelope.KeyWrapper
+	mu     sync.Mutex
+	keys   map[string]cachedKey
+}
+
+// cachedKey is an unwrapped data key along with its wrapped form as stored
+type cachedKey struct {
+	key, wrapped []byte
+	expires      time.Time
+}
+
+// EnableEncryption encrypts document payloads at rest. Each document gets its own
+// data key, stored next to the document wrapped by master.
+func (s *Storage) EnableEncryption(master envelope.KeyWrapper) {
+	s.keys = &keyring{
+		master: master,
+		keys:   make(map[string]cachedKey),
+	}
+}
+
+// dataKey returns the document's data key and its wrapped form, generating one
+// when create is true
+func (s *Storage) dataKey(ctx context.Context, docID string, create bool) (key, wrapped []byte, err error) {
+	s.keys.mu.Lock()
+	cached, ok := s.keys.keys[docID]
+	s.keys.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key, cached.wrapped, nil
+	}
+
+	docKey := fmt.Sprintf("doc:%s", docID)
+	wrapped, err = s.client.HGet(ctx, docKey, "dek").Bytes()
+	if err == redis.Nil {
+		if !create {
+			return nil, nil, ErrKeyDestroyed
+		}
+		key, err = envelope.GenerateDataKey()
+		if err != nil {
+			return nil, nil, apperr.Wrap(apperr.CodeInternal, err, "failed to generate data key")
+		}
+		if wrapped, err = s.keys.master.Wrap(ctx, key); err != nil {
+			return nil, nil, apperr.Wrap(apperr.CodeInternal, err, "failed to wrap data key")
+		}
+		// Another instance may have created the key first; use whichever won
+		created, err := s.client.HSetNX(ctx, docKey, "dek", wrapped).Result()
+		if err != nil {
+			return nil, nil, apperr.Wrap(apperr.CodeInternal, err, "failed to store data key")
+		}
+		if !created {
+			return s.dataKey(ctx, docID, false)
+		}
+	} else if err != nil {
+		return nil, nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load data key")
+	} else if key, err = s.keys.master.Unwrap(ctx, wrapped); err != nil {
+		return nil, nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unwrap data key")
+	}
+
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+	if len(s.keys.keys) >= maxCachedKeys {
+		s.keys.evict()
+	}
+	s.keys.keys[docID] = cachedKey{key: key, wrapped: wrapped, expires: time.Now().Add(dataKeyTTL)}
+	return key, wrapped, nil
+}
+
+// evict makes room in a full keyring, dropping expired keys or, when none
+// have expired, an arbitrary one
+// Note: Caller must hold k.mu
+func (k *keyring) evict() {
+	now := time.Now()
+	for docID, cached := range k.keys {
+		if !now.Before(cached.expires) {
+			delete(k.keys, docID)
+		}
+	}
+	for docID := range k.keys {
+		if len(k.keys) < maxCachedKeys {
+			break
+		}
+		delete(k.keys, docID)
+	}
+}
+
+// forgetDataKey drops the cached data key of a document whose hash was
+// removed or replaced
+func (s *Storage) forgetDataKey(docID string) {
+	if s.keys == nil {
+		return
+	}
+	s.keys.mu.Lock()
+	delete(s.keys.keys, docID)
+	s.keys.mu.Unlock()
+}
+
+// sealer returns a function encrypting payloads of the document with its data
+// key, and the key's wrapped form for saves to check it's still the stored
+// one. Without encryption payloads are returned unchanged and wrapped is empty.
+func (s *Storage) sealer(ctx context.Context, docID string) (seal func([]byte) ([]byte, error), wrapped []byte, err error) {
+	if s.keys == nil {
+		return func(data []byte) ([]byte, error) { return data, nil }, nil, nil
+	}
+	key, wrapped, err := s.dataKey(ctx, docID, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(data []byte) ([]byte, error) {
+		sealed, err := envelope.Seal(key, data, []byte(docID))
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to encrypt document")
+		}
+		return []byte(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+	}, wrapped, nil
+}
+
+// encode encrypts a serialized state when encryption is enabled
+func (s *Storage) encode(ctx context.Context, docID string, data []byte) ([]byte, error) {
+	seal, _, err := s.sealer(ctx, docID)
+	if err != nil {
+		return nil, err
+	}
+	return seal(data)
+}
+
+// decode decrypts a stored payload; unencrypted payloads are returned unchanged
+func (s *Storage) decode(ctx context.Context, docID string, data []byte) ([]byte, error) {
+	if !strings.HasPrefix(string(data), encryptedPrefix) {
+		return data, nil
+	}
+	if s.keys == nil {
+		return nil, apperr.New(apperr.CodeInternal, "document is encrypted but encryption is not enabled")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(data[len(encryptedPrefix):]))
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to decode encrypted document")
+	}
+	key, _, err := s.dataKey(ctx, docID, false)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := envelope.Open(key, sealed, []byte(docID))
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to decrypt document")
+	}
+	return plaintext, nil
+}
+
+// ShredDocument destroys a document's data key together with its content, making
+// any remaining copies of the encrypted payload unrecoverable
+func (s *Storage) ShredDocument(ctx context.Context, docID string) error {
+	defer s.writes.lock(docID)()
+	s.forgetDataKey(docID)
+	blobs, err := s.storedBlobs(ctx, docID)
+	if err != nil {
+		return err
+	}
+	trashed, err := s.trashedBlobs(ctx, docID)
+	if err != nil {
+		return err
+	}
+	// The wrapped key lives in the document hash, so deleting it destroys both
+	pipe := s.client.Pipeline()
+	pipe.Del(ctx, fmt.Sprintf("doc:%s", docID))
+	pipe.Del(ctx, fmt.Sprintf("doc:%s:ops", docID))
+	pipe.Del(ctx, fmt.Sprintf("doc:%s:activity", docID))
+	pipe.Del(ctx, fmt.Sprintf("trash:%s", docID))
+	pipe.Del(ctx, fmt.Sprintf("trash:%s:ops", docID))
+	pipe.HDel(ctx, trashedKey, docID)
+	pipe.HDel(ctx, templatesKey, docID)
+	pipe.SRem(ctx, pinnedKey, docID)
+	channel, prefix := s.channel(docID, "deleted")
+	pipe.Publish(ctx, channel, prefix)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to shred document")
+	}
+	if s.offload != nil {
+		s.removeBlobs(ctx, docID, append(blobs, unreferenced(trashed, blobs)...))
+		// Nor may contents of earlier versions outlive it in memory
+		s.offload.cache.removePrefix(blobPrefix(docID))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// expiredEvents is the keyspace notification pattern for keys reaching their TTL,
+// published only when Redis has notify-keyspace-events including "Ex"
+const expiredEvents = "__keyevent@*__:expired"
+
+// expiryClaimTTL is how long the instance reporting an expired document holds its claim
+const expiryClaimTTL = time.Hour
+
+// SubscribeToExpiry calls handler for documents removed from Redis because
+// their TTL passed, until ctx is cancelled. Of all subscribed instances only
+// one is called per document. Redis must be configured with
+// notify-keyspace-events "Ex" for expirations to be reported at all.
+func (s *Storage) SubscribeToExpiry(ctx context.Context, handler func(docID string)) *Subscription {
+	return s.subscribePattern(ctx, expiredEvents, func(key string) error {
+		id, ok := strings.CutPrefix(key, "doc:")
+		// Auxiliary keys such as the operation log expire with the document
+		if !ok || strings.Contains(id, ":") {
+			return nil
+		}
+		claimed, err := s.client.SetNX(ctx, fmt.Sprintf("expired:%s", id), 1, expiryClaimTTL).Result()
+		// Without a claim another instance may report the document, so skip it
+		if err == nil && claimed {
+			handler(id)
+		}
+		return nil
+	})
+}
+
+// ExpiringDocument is a document whose TTL is about to pass
+type ExpiringDocument struct {
+	ID        string
+	ExpiresIn time.Duration
+}
+
+// ClaimExpiringDocuments returns the documents whose TTL passes within window.
+// Each is returned once per TTL: the claim lasts until the document would
+// expire, so one saved in the meantime can be reported again as its new TTL
+// runs out, and of several instances calling this only one gets each document.
+func (s *Storage) ClaimExpiringDocuments(ctx context.Context, window time.Duration) ([]ExpiringDocument, error) {
+	return s.claimExpiring(ctx, window, "expiring")
+}
+
+// ClaimArchivableDocuments is ClaimExpiringDocuments for archiving documents
+// before they expire, with claims of its own
+func (s *Storage) ClaimArchivableDocuments(ctx context.Context, window time.Duration) ([]ExpiringDocument, error) {
+	return s.claimExpiring(ctx, window, "archiving")
+}
+
+// claimExpiring returns the documents whose TTL passes within window and
+// that no instance has claimed for purpose during this TTL yet
+func (s *Storage) claimExpiring(ctx context.Context, window time.Duration, purpose string) ([]ExpiringDocument, error) {
+	ids, err := s.ListDocumentIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var expiring []ExpiringDocument
+	for _, id := range ids {
+		ttl, err := s.DocumentTTL(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if ttl <= 0 || ttl > window {
+			continue
+		}
+		claimed, err := s.client.SetNX(ctx, fmt.Sprintf("%s:%s", purpose, id), 1, ttl).Result()
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to check document expiry")
+		}
+		if claimed {
+			expiring = append(expiring, ExpiringDocument{ID: id, ExpiresIn: ttl})
+		}
+	}
+	return expiring, nil
+}
+
+// DocumentTTL returns how long until a document expires, or a negative
+// duration for documents without a TTL or that don't exist
+func (s *Storage) DocumentTTL(ctx context.Context, docID string) (time.Duration, error) {
+	ttl, err := s.client.TTL(ctx, fmt.Sprintf("doc:%s", docID)).Result()
+	if err != nil {
+		return 0, apperr.Wrap(apperr.CodeInternal, err, "failed to check document expiry")
+	}
+	return ttl, nil
+}
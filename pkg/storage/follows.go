@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Access a document can be followed with
+const (
+	FollowReadOnly  = "read-only"
+	FollowReadWrite = "read-write"
+)
+
+// Follow makes a document a window onto one hosted on another gopad
+// instance: clients connecting to it are proxied to the hosting instance
+type Follow struct {
+	Instance string `json:"instance"` // public URL of the hosting instance
+	DocID    string `json:"docId"`    // ID of the document there
+	Mode     string `json:"mode"`     // FollowReadOnly or FollowReadWrite
+	Created  int64  `json:"created"`  // unix milliseconds
+}
+
+// ErrNotFollowing is returned when unfollowing a document that doesn't follow one
+var ErrNotFollowing = apperr.New(apperr.CodeNotFound, "document doesn't follow another instance")
+
+func followKey(docID string) string {
+	return fmt.Sprintf("doc:%s:follow", docID)
+}
+
+// SaveFollow makes a document follow one on another instance, replacing any
+// document it followed before
+func (s *Storage) SaveFollow(ctx context.Context, docID string, follow *Follow) error {
+	data, err := json.Marshal(follow)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal follow")
+	}
+	if err := s.client.Set(ctx, followKey(docID), data, 0).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to save follow")
+	}
+	return nil
+}
+
+// Follow returns the document on another instance that a document follows,
+// or nil if it's hosted here
+func (s *Storage) Follow(ctx context.Context, docID string) (*Follow, error) {
+	data, err := s.client.Get(ctx, followKey(docID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load follow")
+	}
+	var follow Follow
+	if err := json.Unmarshal(data, &follow); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal follow")
+	}
+	return &follow, nil
+}
+
+// DeleteFollow stops a document following one on another instance
+func (s *Storage) DeleteFollow(ctx context.Context, docID string) error {
+	removed, err := s.client.Del(ctx, followKey(docID)).Result()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to delete follow")
+	}
+	if removed == 0 {
+		return ErrNotFollowing
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// BeginHandover marks a document as being handed over by a draining instance.
+// Instances loading the document wait for EndHandover, or for ttl to pass if
+// the draining instance dies, so they don't load state that is still being saved.
+func (s *Storage) BeginHandover(ctx context.Context, docID, instance string, ttl time.Duration) error {
+	if err := s.client.Set(ctx, fmt.Sprintf("doc:%s:handover", docID), instance, ttl).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to begin handover")
+	}
+	return nil
+}
+
+// EndHandover marks the document's state as fully persisted by the draining instance
+func (s *Storage) EndHandover(ctx context.Context, docID string) error {
+	if err := s.client.Del(ctx, fmt.Sprintf("doc:%s:handover", docID)).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to end handover")
+	}
+	return nil
+}
+
+// HandoverPending reports whether another instance is still handing the document over
+func (s *Storage) HandoverPending(ctx context.Context, docID string) (bool, error) {
+	n, err := s.client.Exists(ctx, fmt.Sprintf("doc:%s:handover", docID)).Result()
+	if err != nil {
+		return false, apperr.Wrap(apperr.CodeInternal, err, "failed to check handover")
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Identity is how a user appears in every document: the name and color they
+// were last seen with and an optional avatar
+type Identity struct {
+	UUID         string `json:"uuid"`
+	Name         string `json:"name"`
+	Color        string `json:"color"`
+	AvatarURL    string `json:"avatarUrl,omitempty"`
+	GravatarHash string `json:"gravatarHash,omitempty"` // hex MD5 or SHA-256 of the user's email address
+	Updated      int64  `json:"updated"`                // unix milliseconds
+}
+
+func identityKey(uuid string) string {
+	return fmt.Sprintf("user:%s", uuid)
+}
+
+// SaveIdentity stores a user's identity, keeping it for ttl after this save
+func (s *Storage) SaveIdentity(ctx context.Context, identity *Identity, ttl time.Duration) error {
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal identity")
+	}
+	if err := s.client.Set(ctx, identityKey(identity.UUID), data, ttl).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to save identity")
+	}
+	return nil
+}
+
+// LoadIdentity returns a user's stored identity, or nil if there is none
+func (s *Storage) LoadIdentity(ctx context.Context, uuid string) (*Identity, error) {
+	data, err := s.client.Get(ctx, identityKey(uuid)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load identity")
+	}
+	var identity Identity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal identity")
+	}
+	return &identity, nil
+}
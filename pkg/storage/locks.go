@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Lock is an edit lease on a whole document (empty TabID) or a single tab
+type Lock struct {
+	TabID   string `json:"tabId"`
+	Owner   string `json:"owner"`
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"` // unix milliseconds
+}
+
+// Live reports whether the lease is still valid at now
+func (l *Lock) Live(now time.Time) bool {
+	return l.Expires > now.UnixMilli()
+}
+
+// Covers reports whether the lock applies to edits of the given tab
+func (l *Lock) Covers(tabID string) bool {
+	return l.TabID == "" || l.TabID == tabID
+}
+
+// LockConflictError is returned when a lease is held by someone else
+type LockConflictError struct {
+	Held Lock
+}
+
+func (e *LockConflictError) Error() string {
+	return fmt.Sprintf("already locked by %s", e.Held.Owner)
+}
+
+// ErrLockNotHeld is returned when releasing a lock with an unknown token
+var ErrLockNotHeld = apperr.New(apperr.CodeNotFound, "lock not held")
+
+// All of a document's locks live in one key so the scripts stay within a single cluster slot.
+// Entries are pruned as they expire; the key itself expires with the last lease.
+
+// acquireScript grants or renews a lease unless it conflicts with another holder's lease.
+// KEYS[1] = locks key, ARGV = tab ID, owner, token, TTL ms, now ms, lock channel, message prefix
+var acquireScript = redis.NewScript(`
+local now = tonumber(ARGV[5])
+local raw = redis.call('GET', KEYS[1])
+local live = {}
+if raw then
+	for _, l in ipairs(cjson.decode(raw)) do
+		if l.expires > now then
+			if l.token ~= ARGV[3] and (l.tabId == ARGV[1] or l.tabId == '' or ARGV[1] == '') then
+				return {0, cjson.encode(l)}
+			end
+			if not (l.token == ARGV[3] and l.tabId == ARGV[1]) then
+				table.insert(live, l)
+			end
+		end
+	end
+end
+local expires = now + tonumber(ARGV[4])
+table.insert(live, {tabId = ARGV[1], owner = ARGV[2], token = ARGV[3], expires = expires})
+local last = 0
+for _, l in ipairs(live) do
+	if l.expires > last then last = l.expires end
+end
+local encoded = cjson.encode(live)
+redis.call('SET', KEYS[1], encoded, 'PX', last - now)
+redis.call('PUBLISH', ARGV[6], ARGV[7] .. encoded)
+return {1, tostring(expires)}
+`)
+
+// releaseScript drops the lease with the given token and tab.
+// KEYS[1] = locks key, ARGV = tab ID, token, now ms, lock channel, message prefix
+var releaseScript = redis.NewScript(`
+local now = tonumber(ARGV[3])
+local raw = redis.call('GET', KEYS[1])
+if not raw then
+	return 0
+end
+local live = {}
+local released = 0
+local last = 0
+for _, l in ipairs(cjson.decode(raw)) do
+	if l.token == ARGV[2] and l.tabId == ARGV[1] then
+		released = 1
+	elseif l.expires > now then
+		table.insert(live, l)
+		if l.expires > last then last = l.expires end
+	end
+end
+if released == 0 then
+	return 0
+end
+if #live == 0 then
+	redis.call('DEL', KEYS[1])
+	redis.call('PUBLISH', ARGV[4], ARGV[5] .. '[]')
+else
+	local encoded = cjson.encode(live)
+	redis.call('SET', KEYS[1], encoded, 'PX', last - now)
+	redis.call('PUBLISH', ARGV[4], ARGV[5] .. encoded)
+end
+return 1
+`)
+
+// AcquireLock grants lock for ttl, or renews it when lock.Token already holds the same
+// scope. On success lock.Expires is set; a *LockConflictError describes a competing lease.
+func (s *Storage) AcquireLock(ctx context.Context, docID string, lock *Lock, ttl time.Duration) error {
+	channel, prefix := s.channel(docID, "locks:updates")
+	result, err := acquireScript.Run(ctx, s.client,
+		[]string{fmt.Sprintf("doc:%s:locks", docID)},
+		lock.TabID, lock.Owner, lock.Token, ttl.Milliseconds(), time.Now().UnixMilli(), channel, prefix,
+	).Slice()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to acquire lock")
+	}
+	if len(result) != 2 {
+		return apperr.New(apperr.CodeInternal, "unexpected lock script result")
+	}
+	payload, _ := result[1].(string)
+	if granted, _ := result[0].(int64); granted == 0 {
+		conflict := &LockConflictError{}
+		if err := json.Unmarshal([]byte(payload), &conflict.Held); err != nil {
+			return apperr.Wrap(apperr.CodeInternal, err, "failed to decode lock")
+		}
+		return conflict
+	}
+	lock.Expires, _ = strconv.ParseInt(payload, 10, 64)
+	return nil
+}
+
+// ReleaseLock drops the lease identified by tab and token
+func (s *Storage) ReleaseLock(ctx context.Context, docID, tabID, token string) error {
+	channel, prefix := s.channel(docID, "locks:updates")
+	released, err := releaseScript.Run(ctx, s.client,
+		[]string{fmt.Sprintf("doc:%s:locks", docID)},
+		tabID, token, time.Now().UnixMilli(), channel, prefix,
+	).Int64()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to release lock")
+	}
+	if released == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Locks returns the document's current leases
+func (s *Storage) Locks(ctx context.Context, docID string) ([]Lock, error) {
+	raw, err := s.client.Get(ctx, fmt.Sprintf("doc:%s:locks", docID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load locks")
+	}
+	return decodeLocks(raw)
+}
+
+// SubscribeToLocks delivers the document's full lock list whenever it changes
+// until ctx is cancelled
+func (s *Storage) SubscribeToLocks(ctx context.Context, docID string, handler func([]Lock)) *Subscription {
+	return s.subscribe(ctx, docID, "locks:updates", func(msg string) error {
+		locks, err := decodeLocks(msg)
+		if err != nil {
+			return err
+		}
+		handler(locks)
+		return nil
+	})
+}
+
+// decodeLocks parses a lock list; Lua's cjson encodes an empty list as "{}"
+func decodeLocks(raw string) ([]Lock, error) {
+	if raw == "{}" {
+		return nil, nil
+	}
+	var locks []Lock
+	if err := json.Unmarshal([]byte(raw), &locks); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to decode locks")
+	}
+	return locks, nil
+}
@@ -0,0 +1,91 @@
+// Package migrate upgrades stored document payloads written in an older shape
+// to the current one. Every payload records the version of the schema it was
+// written with in its "schema" field, missing in ones that predate it. Storage
+// upgrades payloads as it loads them, and `gopad migrate` saves every document
+// again so they're stored in the current shape.
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Current is the schema version documents are stored with
+const Current = 1
+
+// step upgrades a payload of the version before it to its own
+type step struct {
+	version int
+	name    string
+	apply   func(doc map[string]json.RawMessage) error
+}
+
+// steps are applied in order to payloads older than their version. A change to
+// the shape of stored documents adds a step here and bumps Current.
+var steps = []step{
+	{version: 1, name: "tabs", apply: addTabs},
+}
+
+// version returns the schema version a payload was written with
+func version(data []byte) (int, error) {
+	var header struct {
+		Schema int `json:"schema"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, err
+	}
+	return header.Schema, nil
+}
+
+// Upgrade applies the steps a payload of an older schema needs. Current
+// payloads are returned as they are. The schema field is left alone, so the
+// upgraded payload still tells which version it was stored with; writers set it.
+func Upgrade(data []byte) ([]byte, error) {
+	from, err := version(data)
+	if err != nil {
+		return nil, err
+	}
+	if from >= Current {
+		return data, nil
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		if s.version <= from {
+			continue
+		}
+		if err := s.apply(doc); err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", s.version, s.name, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// addTabs moves the content of documents from before tabs into a tab of its
+// own. The content field is kept, as it still holds the legacy content.
+func addTabs(doc map[string]json.RawMessage) error {
+	var tabs []json.RawMessage
+	if raw, ok := doc["tabs"]; ok {
+		if err := json.Unmarshal(raw, &tabs); err != nil {
+			return err
+		}
+	}
+	if len(tabs) > 0 {
+		return nil
+	}
+	var content string
+	if raw, ok := doc["content"]; ok {
+		if err := json.Unmarshal(raw, &content); err != nil {
+			return err
+		}
+	}
+	tab, err := json.Marshal([]map[string]string{{"id": "1", "name": "Untitled", "content": content, "notes": ""}})
+	if err != nil {
+		return err
+	}
+	doc["tabs"] = tab
+	doc["activeTabId"] = json.RawMessage(`"1"`)
+	return nil
+}
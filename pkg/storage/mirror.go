@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// mirroredKey is the set of documents published to the static mirror
+const mirroredKey = "mirror:documents"
+
+// SetMirrored adds a document to the static mirror or takes it out again
+func (s *Storage) SetMirrored(ctx context.Context, docID string, mirrored bool) error {
+	var err error
+	if mirrored {
+		err = s.client.SAdd(ctx, mirroredKey, docID).Err()
+	} else {
+		err = s.client.SRem(ctx, mirroredKey, docID).Err()
+	}
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to update mirrored documents")
+	}
+	return nil
+}
+
+// IsMirrored reports whether a document is published to the static mirror
+func (s *Storage) IsMirrored(ctx context.Context, docID string) (bool, error) {
+	mirrored, err := s.client.SIsMember(ctx, mirroredKey, docID).Result()
+	if err != nil {
+		return false, apperr.Wrap(apperr.CodeInternal, err, "failed to check mirrored documents")
+	}
+	return mirrored, nil
+}
+
+// MirroredDocuments returns the IDs of the documents published to the static mirror
+func (s *Storage) MirroredDocuments(ctx context.Context) ([]string, error) {
+	ids, err := s.client.SMembers(ctx, mirroredKey).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list mirrored documents")
+	}
+	return ids, nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+var (
+	// storageOperations counts storage operations by operation and result
+	storageOperations = metrics.NewCounter("gopad_storage_operations_total", "Number of storage operations by operation and result: ok, conflict or error")
+	// storageDuration records how long storage operations take, by operation
+	storageDuration = metrics.NewHistogram("gopad_storage_operation_seconds", "Time taken by storage operations, including retries", metrics.DefaultBuckets)
+)
+
+// observe records an operation that started at start and failed with err, if
+// it did, logging it with kv when it took longer than the slow operation
+// threshold
+func (s *Storage) observe(op string, start time.Time, err error, kv ...any) {
+	elapsed := time.Since(start)
+	result := "ok"
+	switch {
+	case errors.Is(err, ErrVersionConflict):
+		result = "conflict"
+	case err != nil:
+		result = "error"
+	}
+	storageOperations.Inc(metrics.Labels{"operation": op, "result": result})
+	storageDuration.Observe(elapsed.Seconds(), metrics.Labels{"operation": op})
+	if s.slowOperation > 0 && elapsed > s.slowOperation {
+		logger.Warn("Slow storage operation", append([]any{"operation", op, "elapsed", elapsed, "result", result}, kv...)...)
+	}
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+// BlobStore holds tab contents too large to keep in Redis, such as an S3 bucket
+type BlobStore interface {
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+	// Get returns an error matching fs.ErrNotExist for blobs that don't exist
+	Get(ctx context.Context, name string) ([]byte, error)
+	// Size returns how many bytes a blob takes up, or an error matching
+	// fs.ErrNotExist for blobs that don't exist
+	Size(ctx context.Context, name string) (int64, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// offloader moves large tab contents out of Redis
+type offloader struct {
+	blobs     BlobStore
+	threshold int        // tab contents of at least this many bytes are offloaded
+	cache     *blobCache // nil unless recently used contents are kept in memory
+}
+
+// errBlobReplaced is returned while loading a document whose blob was removed
+// by a newer save, so the load is retried
+var errBlobReplaced = errors.New("tab content was replaced while loading")
+
+// blobLoadAttempts is how often loading a document is tried when its blobs
+// keep being replaced
+const blobLoadAttempts = 3
+
+// EnableOffload stores the contents of tabs of threshold bytes or more in
+// blobs, keeping only a reference in the document saved to Redis. Blobs are
+// encrypted like the document when encryption is enabled. Up to cacheSize
+// bytes of recently saved or loaded contents are kept in memory; zero fetches
+// them from blobs every time.
+func (s *Storage) EnableOffload(blobs BlobStore, threshold, cacheSize int) {
+	s.offload = &offloader{blobs: blobs, threshold: threshold, cache: newBlobCache(cacheSize)}
+}
+
+// blobName returns where a tab content is stored. Names are derived from the
+// content, so unchanged contents aren't uploaded again, and grouped by
+// document with the ID escaped so it stays one path segment.
+func blobName(docID, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return blobPrefix(docID) + hex.EncodeToString(sum[:])
+}
+
+// blobPrefix returns what the names of a document's blobs start with
+func blobPrefix(docID string) string {
+	return "tabs/" + url.PathEscape(docID) + "/"
+}
+
+// offloadTabs replaces the large tab contents of state with references to
+// blobs, uploading the ones not among previous sealed by seal, and returns
+// every blob the state references. The caller's tabs are left untouched.
+func (s *Storage) offloadTabs(ctx context.Context, docID string, state *DocumentState, previous []string, seal func([]byte) ([]byte, error)) ([]string, error) {
+	if s.offload == nil {
+		return nil, nil
+	}
+	var refs []string
+	tabs := make([]Tab, len(state.Tabs))
+	for i, tab := range state.Tabs {
+		if len(tab.Content) >= s.offload.threshold {
+			name := blobName(docID, tab.Content)
+			if !slices.Contains(previous, name) {
+				data, err := seal([]byte(tab.Content))
+				if err != nil {
+					return nil, err
+				}
+				if err := s.offload.blobs.Put(ctx, name, data, "application/octet-stream"); err != nil {
+					return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to store tab content")
+				}
+			}
+			// Contents just saved are the ones other instances load next
+			s.offload.cache.put(name, tab.Content)
+			tab.Content, tab.ContentRef = "", name
+			refs = append(refs, name)
+		}
+		tabs[i] = tab
+	}
+	state.Tabs = tabs
+	return refs, nil
+}
+
+// resolveTabs fetches the contents of tabs that reference a blob
+func (s *Storage) resolveTabs(ctx context.Context, docID string, state *DocumentState) error {
+	for i := range state.Tabs {
+		tab := &state.Tabs[i]
+		if tab.ContentRef == "" {
+			continue
+		}
+		// Offloaded contents can only be read from the blob store they went to
+		if s.offload == nil {
+			return apperr.New(apperr.CodeInternal, "document has offloaded tab contents but offloading is not enabled")
+		}
+		if content, ok := s.offload.cache.get(tab.ContentRef); ok {
+			tab.Content, tab.ContentRef = content, ""
+			continue
+		}
+		data, err := s.offload.blobs.Get(ctx, tab.ContentRef)
+		if errors.Is(err, fs.ErrNotExist) {
+			return errBlobReplaced
+		}
+		if err != nil {
+			return apperr.Wrap(apperr.CodeInternal, err, "failed to load tab content")
+		}
+		if data, err = s.decode(ctx, docID, data); err != nil {
+			return err
+		}
+		s.offload.cache.put(tab.ContentRef, string(data))
+		tab.Content, tab.ContentRef = string(data), ""
+	}
+	return nil
+}
+
+// removeBlobs deletes blobs no longer referenced by a document. Failures are
+// only logged, as a blob left behind just takes up space.
+func (s *Storage) removeBlobs(ctx context.Context, docID string, names []string) {
+	s.offload.cache.remove(names...)
+	for _, name := range names {
+		if err := s.offload.blobs.Delete(ctx, name); err != nil {
+			logger.Warn("Error removing offloaded tab content", "doc_id", docID, "blob", name, "error", err)
+		}
+	}
+}
+
+// discardBlobs deletes the blobs uploaded for a save that failed, except
+// those the stored version references: the save that won may have uploaded
+// the same contents
+func (s *Storage) discardBlobs(ctx context.Context, docID string, uploaded []string) {
+	if s.offload == nil || len(uploaded) == 0 {
+		return
+	}
+	stored, err := s.storedBlobs(ctx, docID)
+	if err != nil {
+		logger.Warn("Error reading offloaded tab contents to discard", "doc_id", docID, "error", err)
+		return
+	}
+	s.removeBlobs(ctx, docID, unreferenced(uploaded, stored))
+}
+
+// storedBlobs returns the blobs the stored version of a document references
+func (s *Storage) storedBlobs(ctx context.Context, docID string) ([]string, error) {
+	if s.offload == nil {
+		return nil, nil
+	}
+	refs, err := s.client.HGet(ctx, fmt.Sprintf("doc:%s", docID), "blobs").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to read offloaded tab contents")
+	}
+	return strings.Fields(refs), nil
+}
+
+// blobsSize adds up the sizes of a document's blobs. Blobs removed meanwhile
+// by a newer save are left out.
+func (s *Storage) blobsSize(ctx context.Context, names []string) (int64, error) {
+	var total int64
+	for _, name := range names {
+		size, err := s.offload.blobs.Size(ctx, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, apperr.Wrap(apperr.CodeInternal, err, "failed to inspect offloaded tab content")
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// unreferenced returns the names of old that aren't in current
+func unreferenced(old, current []string) []string {
+	var stale []string
+	for _, name := range old {
+		if !slices.Contains(current, name) {
+			stale = append(stale, name)
+		}
+	}
+	return stale
+}
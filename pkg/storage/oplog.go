@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+	"github.com/shiftregister-vg/gopad/pkg/ot"
+)
+
+// skippedOps counts logged operations that didn't apply when replaying the log
+var skippedOps = metrics.NewCounter("gopad_skipped_operations_total", "Number of logged operations skipped while replaying the operation log because they didn't apply")
+
+// TabOp is an edit operation applied to a single tab
+type TabOp struct {
+	TabID string       `json:"tabId"`
+	Op    ot.Operation `json:"op"`
+}
+
+// OpBatch is a group of operations appended to a document's operation log
+type OpBatch struct {
+	ID     string  `json:"id"`     // stream entry ID
+	Origin string  `json:"origin"` // instance that appended the batch
+	Base   string  `json:"base"`   // entry the operations apply after, empty for the first
+	Ops    []TabOp `json:"ops"`
+}
+
+// ErrOpsConflict is returned when operations are appended on top of an entry
+// that is no longer the last in the log, because another instance appended first
+var ErrOpsConflict = apperr.New(apperr.CodeVersionConflict, "operation log conflict")
+
+// appendScript adds a batch to the operation log if its base is still the
+// last entry, and publishes it with its entry ID, so every entry applies to
+// the state its predecessor left and subscribers see batches in log order.
+// A new log expires like a document without a snapshot; snapshots then keep
+// it alive as long as the document.
+// KEYS[1] = op stream, ARGV = origin, serialized ops, TTL seconds, ops channel, message prefix, base
+var appendScript = redis.NewScript(`
+local last = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+if last[1] and last[1][1] ~= ARGV[6] then
+	return false
+end
+local created = redis.call('EXISTS', KEYS[1]) == 0
+local id = redis.call('XADD', KEYS[1], '*', 'origin', ARGV[1], 'base', ARGV[6], 'ops', ARGV[2])
+if created then
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+end
+redis.call('PUBLISH', ARGV[4], ARGV[5] .. cjson.encode({id = id, origin = ARGV[1], base = ARGV[6], ops = ARGV[2]}))
+return id
+`)
+
+// opsMessage is the published form of an OpBatch; Ops may be encrypted
+type opsMessage struct {
+	ID     string `json:"id"`
+	Origin string `json:"origin"`
+	Base   string `json:"base"`
+	Ops    string `json:"ops"`
+}
+
+// AppendOps appends operations to the document's operation log and returns the entry ID.
+// Only the operations are written, so large documents don't need a full snapshot per edit.
+// base is the last entry the operations were computed after; if another entry
+// was appended since, ErrOpsConflict is returned and nothing is written.
+func (s *Storage) AppendOps(ctx context.Context, docID, origin, base string, ops []TabOp) (string, error) {
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return "", apperr.Wrap(apperr.CodeInternal, err, "failed to marshal operations")
+	}
+	if data, err = s.encode(ctx, docID, data); err != nil {
+		return "", err
+	}
+	channel, prefix := s.channel(docID, "ops:updates")
+	id, err := appendScript.Run(ctx, s.client,
+		[]string{fmt.Sprintf("doc:%s:ops", docID)},
+		origin, data, int64(defaultExpiry.Seconds()), channel, prefix, base,
+	).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrOpsConflict
+	}
+	if err != nil {
+		return "", apperr.Wrap(apperr.CodeInternal, err, "failed to append operations")
+	}
+	return id, nil
+}
+
+// SubscribeToOps delivers operation batches appended by any instance until ctx is cancelled
+func (s *Storage) SubscribeToOps(ctx context.Context, docID string, handler func(*OpBatch)) *Subscription {
+	return s.subscribe(ctx, docID, "ops:updates", func(msg string) error {
+		var wire opsMessage
+		if err := json.Unmarshal([]byte(msg), &wire); err != nil {
+			return apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal operations")
+		}
+		batch, err := s.decodeBatch(ctx, docID, wire)
+		if err != nil {
+			return err
+		}
+		handler(batch)
+		return nil
+	})
+}
+
+// applyOps applies the logged operations among entries that are newer than
+// state.OpsCursor to state
+func (s *Storage) applyOps(ctx context.Context, docID string, state *DocumentState, entries []redis.XMessage) error {
+	for _, entry := range entries {
+		if CompareStreamIDs(entry.ID, state.OpsCursor) <= 0 {
+			continue
+		}
+		origin, _ := entry.Values["origin"].(string)
+		base, _ := entry.Values["base"].(string)
+		ops, _ := entry.Values["ops"].(string)
+		batch, err := s.decodeBatch(ctx, docID, opsMessage{ID: entry.ID, Origin: origin, Base: base, Ops: ops})
+		if err != nil {
+			return err
+		}
+		if skipped := ApplyOps(state, batch.Ops); skipped > 0 {
+			skippedOps.Add(float64(skipped), nil)
+			logger.Warn("Skipping logged operations that don't apply", "doc_id", docID, "entry", entry.ID, "skipped", skipped)
+		}
+		// Stream IDs start with the time the entry was logged
+		ms, _ := splitStreamID(entry.ID)
+		for _, op := range batch.Ops {
+			for i := range state.Tabs {
+				if state.Tabs[i].ID == op.TabID {
+					state.Tabs[i].Modified = int64(ms)
+				}
+			}
+		}
+		state.OpsCursor = entry.ID
+	}
+	return nil
+}
+
+func (s *Storage) decodeBatch(ctx context.Context, docID string, wire opsMessage) (*OpBatch, error) {
+	data, err := s.decode(ctx, docID, []byte(wire.Ops))
+	if err != nil {
+		return nil, err
+	}
+	batch := &OpBatch{ID: wire.ID, Origin: wire.Origin, Base: wire.Base}
+	if err := json.Unmarshal(data, &batch.Ops); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal operations")
+	}
+	return batch, nil
+}
+
+// ApplyOps applies operations to the matching tabs of state.
+// Operations that no longer fit the content are skipped; it returns how many were.
+func ApplyOps(state *DocumentState, ops []TabOp) (skipped int) {
+	for _, op := range ops {
+		for i := range state.Tabs {
+			if state.Tabs[i].ID != op.TabID {
+				continue
+			}
+			doc := &ot.Document{Content: state.Tabs[i].Content}
+			if err := doc.Apply(op.Op); err == nil {
+				state.Tabs[i].Content = doc.Content
+			} else {
+				skipped++
+			}
+			break
+		}
+	}
+	return skipped
+}
+
+// CompareStreamIDs orders two Redis stream entry IDs, returning -1, 0 or 1.
+// An empty ID sorts before every other ID.
+func CompareStreamIDs(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+	aMs, aSeq := splitStreamID(a)
+	bMs, bSeq := splitStreamID(b)
+	switch {
+	case aMs < bMs, aMs == bMs && aSeq < bSeq:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func splitStreamID(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	msVal, _ := strconv.ParseUint(ms, 10, 64)
+	seqVal, _ := strconv.ParseUint(seq, 10, 64)
+	return msVal, seqVal
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shiftregister-vg/gopad/pkg/ot"
+)
+
+func TestAppendOps(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	s := newTestStorage(t, mr, nil)
+	state := &DocumentState{Language: "go", Tabs: []Tab{{ID: "1", Name: "main", Content: "hello"}}, ActiveTabId: "1"}
+	if err := s.SaveDocument(ctx, "doc", state); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(position int, text string) []TabOp {
+		return []TabOp{{TabID: "1", Op: ot.Operation{Type: "insert", Position: position, Text: text}}}
+	}
+
+	// Each append names the entry it was computed after, which the script
+	// compares with the last one
+	var ids []string
+	tests := []struct {
+		name    string
+		base    func() string
+		ops     []TabOp
+		wantErr error
+	}{
+		{"first on empty log", func() string { return "" }, insert(5, ","), nil},
+		{"empty base on non-empty log", func() string { return "" }, insert(0, "x"), ErrOpsConflict},
+		{"on the last entry", func() string { return ids[0] }, insert(6, " world"), nil},
+		{"on a stale entry", func() string { return ids[0] }, insert(0, "x"), ErrOpsConflict},
+		{"on an unknown entry", func() string { return "1-1" }, insert(0, "x"), ErrOpsConflict},
+		{"on the new last entry", func() string { return ids[1] }, insert(12, "!"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := s.AppendOps(ctx, "doc", "instance", tt.base(), tt.ops)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil {
+				if len(ids) > 0 && CompareStreamIDs(id, ids[len(ids)-1]) <= 0 {
+					t.Errorf("entry %s doesn't come after %s", id, ids[len(ids)-1])
+				}
+				ids = append(ids, id)
+			}
+		})
+	}
+
+	// Conflicting appends wrote nothing, so loading replays exactly the others
+	loaded, err := s.LoadDocument(ctx, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.Tabs[0].Content; got != "hello, world!" {
+		t.Errorf("expected the appended operations replayed, got %q", got)
+	}
+}
+
+func TestCompareStreamIDs(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1-0", "1-0", 0},
+		{"", "", 0},
+		{"", "1-0", -1},
+		{"1-0", "", 1},
+		{"1-0", "2-0", -1},
+		{"2-0", "1-0", 1},
+		{"1-2", "1-10", -1},
+		{"10-0", "9-99", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareStreamIDs(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareStreamIDs(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
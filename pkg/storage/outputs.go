@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// RunOutput is the result of the last run of a tab's code, kept with the
+// document like the output cell of a notebook
+type RunOutput struct {
+	RunID string `json:"runId"`
+	// Revision is ContentRevision of the code that ran, so clients can tell
+	// whether the tab changed since
+	Revision  string       `json:"revision"`
+	User      string       `json:"user,omitempty"`
+	Stdout    string       `json:"stdout,omitempty"`
+	Stderr    string       `json:"stderr,omitempty"`
+	Rich      []RichOutput `json:"rich,omitempty"`
+	ExitCode  int          `json:"exitCode"`
+	TimedOut  bool         `json:"timedOut,omitempty"`
+	Truncated bool         `json:"truncated,omitempty"` // output was cut short, by the sandbox or to keep the document small
+	Failed    bool         `json:"failed,omitempty"`    // the program couldn't be started
+	Duration  int64        `json:"duration"`            // milliseconds
+	Finished  int64        `json:"finished"`            // unix milliseconds
+}
+
+// RichOutput is formatted output a program displayed, such as an image.
+// Data is base64 for images and text otherwise.
+type RichOutput struct {
+	MIMEType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// ContentRevision identifies a version of a tab's content: the hex SHA-256 of it
+func ContentRevision(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// claimOwnerScript takes the lease on a document for an instance, or renews it if
+// the instance already holds it, and returns the instance holding it.
+// KEYS[1] = owner key, ARGV = instance, lease milliseconds
+var claimOwnerScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return owner
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return ARGV[1]
+`)
+
+// releaseOwnerScript gives up the lease on a document if the instance still holds it.
+// KEYS[1] = owner key, ARGV = instance
+var releaseOwnerScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ClaimOwnership makes instance the owner of a document for lease unless
+// another instance owns it, and returns the owner. Owners renew their lease by
+// claiming the document again before it runs out.
+func (s *Storage) ClaimOwnership(ctx context.Context, docID, instance string, lease time.Duration) (string, error) {
+	owner, err := claimOwnerScript.Run(ctx, s.client,
+		[]string{fmt.Sprintf("doc:%s:owner", docID)},
+		instance, lease.Milliseconds(),
+	).Text()
+	if err != nil {
+		return "", apperr.Wrap(apperr.CodeInternal, err, "failed to claim document")
+	}
+	return owner, nil
+}
+
+// ReleaseOwnership gives up instance's lease on a document, so another
+// instance can claim it without waiting for the lease to run out
+func (s *Storage) ReleaseOwnership(ctx context.Context, docID, instance string) error {
+	if err := releaseOwnerScript.Run(ctx, s.client, []string{fmt.Sprintf("doc:%s:owner", docID)}, instance).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to release document")
+	}
+	return nil
+}
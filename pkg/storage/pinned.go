@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// pinnedKey is the set of pinned documents. Whether a document is kept
+// without a TTL is decided by DocumentState.Pinned when it's saved; the set
+// only lists them.
+const pinnedKey = "pinned"
+
+// SetPinned adds a document to the pinned documents or takes it out again
+func (s *Storage) SetPinned(ctx context.Context, docID string, pinned bool) error {
+	var err error
+	if pinned {
+		err = s.client.SAdd(ctx, pinnedKey, docID).Err()
+	} else {
+		err = s.client.SRem(ctx, pinnedKey, docID).Err()
+	}
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to update pinned documents")
+	}
+	return nil
+}
+
+// PinnedDocuments returns the IDs of the pinned documents
+func (s *Storage) PinnedDocuments(ctx context.Context) ([]string, error) {
+	ids, err := s.client.SMembers(ctx, pinnedKey).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list pinned documents")
+	}
+	return ids, nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// sessionsKey is the set of documents with a scheduled session
+const sessionsKey = "sessions"
+
+// sessionRetention is how long a session is kept after it ends, keeping its
+// document frozen meanwhile
+const sessionRetention = 30 * 24 * time.Hour
+
+// Session is a scheduled session a document is used for, such as an interview
+// or workshop. The document is frozen outside of it.
+type Session struct {
+	Title      string        `json:"title,omitempty"`
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	WarnBefore time.Duration `json:"warnBefore"` // how long before the end participants are warned
+	Token      string        `json:"token"`      // of the lock freezing the document
+}
+
+// SaveSession schedules a session for a document, replacing any earlier one
+func (s *Storage) SaveSession(ctx context.Context, docID string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal session")
+	}
+	ttl := time.Until(session.End.Add(sessionRetention))
+	pipe := s.client.Pipeline()
+	pipe.Set(ctx, fmt.Sprintf("session:%s", docID), data, ttl)
+	pipe.SAdd(ctx, sessionsKey, docID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to save session")
+	}
+	return nil
+}
+
+// Session returns a document's scheduled session, or nil if it has none
+func (s *Storage) Session(ctx context.Context, docID string) (*Session, error) {
+	data, err := s.client.Get(ctx, fmt.Sprintf("session:%s", docID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load session")
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal session")
+	}
+	return &session, nil
+}
+
+// DeleteSession removes a document's scheduled session
+func (s *Storage) DeleteSession(ctx context.Context, docID string) error {
+	pipe := s.client.Pipeline()
+	pipe.Del(ctx, fmt.Sprintf("session:%s", docID))
+	pipe.SRem(ctx, sessionsKey, docID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to delete session")
+	}
+	return nil
+}
+
+// Sessions returns every scheduled session by document ID. Documents whose
+// session has expired are dropped from the set along the way.
+func (s *Storage) Sessions(ctx context.Context) (map[string]*Session, error) {
+	ids, err := s.client.SMembers(ctx, sessionsKey).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list sessions")
+	}
+	sessions := make(map[string]*Session, len(ids))
+	for _, id := range ids {
+		session, err := s.Session(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			if err := s.client.SRem(ctx, sessionsKey, id).Err(); err != nil {
+				return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list sessions")
+			}
+			continue
+		}
+		sessions[id] = session
+	}
+	return sessions, nil
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+// shardRouter carries the pub/sub messages of all documents over a fixed number
+// of channels. Each document publishes to the channel its ID hashes to, tagging
+// messages with the document and topic, and the router hands them to that
+// document's subscribers. An instance then needs one Redis connection for all
+// of its documents instead of one per document and topic.
+type shardRouter struct {
+	client  redisClient
+	shards  int
+	observe func(op string, start time.Time, err error, kv ...any)
+
+	mu         sync.Mutex
+	pubsub     *redis.PubSub // nil until the first subscription
+	subscribed []bool        // shard channels the pubsub connection listens to
+	subs       map[routeKey]map[*routeSub]struct{}
+}
+
+// routeKey identifies the messages of one topic of one document
+type routeKey struct {
+	docID string
+	topic string
+}
+
+// routeSub queues the payloads for one subscriber, so a document whose handler
+// is slow doesn't hold up the others on its shard
+type routeSub struct {
+	mu    sync.Mutex
+	queue []string
+	ready chan struct{}
+}
+
+// EnableSharding publishes document messages on shards channels, chosen by a
+// hash of the document ID, instead of on channels of their own. Every instance
+// must use the same number of shards.
+func (s *Storage) EnableSharding(shards int) {
+	s.shards = &shardRouter{
+		client:     s.client,
+		shards:     shards,
+		observe:    s.observe,
+		subscribed: make([]bool, shards),
+		subs:       make(map[routeKey]map[*routeSub]struct{}),
+	}
+}
+
+// channel returns the channel a document's messages on topic are published to,
+// along with the prefix that goes before each payload
+func (s *Storage) channel(docID, topic string) (string, string) {
+	if s.shards == nil {
+		return fmt.Sprintf("doc:%s:%s", docID, topic), ""
+	}
+	return s.shards.channel(docID), fmt.Sprintf("%s %d:%s", topic, len(docID), docID)
+}
+
+// subscribe starts a subscription delivering every payload published for a
+// document on topic
+func (s *Storage) subscribe(ctx context.Context, docID, topic string, handler func(payload string) error) *Subscription {
+	if s.shards != nil {
+		return s.shards.subscribe(ctx, routeKey{docID: docID, topic: topic}, handler)
+	}
+	return s.subscribeChannel(ctx, fmt.Sprintf("doc:%s:%s", docID, topic), handler)
+}
+
+// channel returns the shard channel for a document
+func (r *shardRouter) channel(docID string) string {
+	return fmt.Sprintf("docs:shard:%d", r.shard(docID))
+}
+
+func (r *shardRouter) shard(docID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(docID))
+	return int(h.Sum32() % uint32(r.shards))
+}
+
+func (r *shardRouter) subscribe(ctx context.Context, key routeKey, handler func(payload string) error) *Subscription {
+	return startSubscription(ctx, func(ctx context.Context, sub *Subscription) {
+		route := &routeSub{ready: make(chan struct{}, 1)}
+		start := time.Now()
+		err := r.add(ctx, key, route)
+		r.observe("subscribe", start, err, "doc_id", key.docID, "topic", key.topic)
+		if err != nil {
+			sub.interrupted.Store(true)
+			logger.Warn("Error subscribing to shard, subscribing again with the connection", "doc_id", key.docID, "error", err)
+		}
+		defer r.remove(key, route)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-route.ready:
+				for _, payload := range route.take() {
+					if err := handler(payload); err != nil {
+						logger.Warn("Skipping message that couldn't be decoded", "doc_id", key.docID, "topic", key.topic, "error", err)
+					}
+				}
+			}
+		}
+	})
+}
+
+// add registers sub, subscribing to the document's shard the first time it's needed.
+// Shard channels stay subscribed afterwards; there are only so many of them.
+// The connection subscribes to them again whenever it reconnects, so sub is
+// registered even when subscribing failed.
+func (r *shardRouter) add(ctx context.Context, key routeKey, sub *routeSub) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	shard := r.shard(key.docID)
+	if !r.subscribed[shard] {
+		channel := r.channel(key.docID)
+		if r.pubsub == nil {
+			// The connection outlives the subscriber that opened it
+			r.pubsub = r.client.Subscribe(context.Background(), channel)
+			go r.dispatch(r.pubsub.Channel())
+		} else if err = r.pubsub.Subscribe(ctx, channel); err != nil {
+			err = apperr.Wrap(apperr.CodeInternal, err, "failed to subscribe to shard")
+		}
+		r.subscribed[shard] = true
+	}
+	if r.subs[key] == nil {
+		r.subs[key] = make(map[*routeSub]struct{})
+	}
+	r.subs[key][sub] = struct{}{}
+	return err
+}
+
+func (r *shardRouter) remove(key routeKey, sub *routeSub) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subs[key], sub)
+	if len(r.subs[key]) == 0 {
+		delete(r.subs, key)
+	}
+}
+
+// dispatch hands messages to the subscribers of their document and topic,
+// dropping those for documents this instance doesn't follow
+func (r *shardRouter) dispatch(ch <-chan *redis.Message) {
+	for msg := range ch {
+		key, payload, ok := parseRouted(msg.Payload)
+		if !ok {
+			continue
+		}
+		r.mu.Lock()
+		for sub := range r.subs[key] {
+			sub.push(payload)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// close stops delivering messages
+func (r *shardRouter) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pubsub == nil {
+		return nil
+	}
+	return r.pubsub.Close()
+}
+
+// parseRouted splits a sharded message into its document, topic and payload
+func parseRouted(msg string) (routeKey, string, bool) {
+	topic, rest, ok := strings.Cut(msg, " ")
+	if !ok {
+		return routeKey{}, "", false
+	}
+	size, rest, ok := strings.Cut(rest, ":")
+	if !ok {
+		return routeKey{}, "", false
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 || n > len(rest) {
+		return routeKey{}, "", false
+	}
+	return routeKey{docID: rest[:n], topic: topic}, rest[n:], true
+}
+
+func (sub *routeSub) push(payload string) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, payload)
+	sub.mu.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *routeSub) take() []string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	queue := sub.queue
+	sub.queue = nil
+	return queue
+}
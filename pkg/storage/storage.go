@@ -3,14 +3,27 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+	"github.com/shiftregister-vg/gopad/pkg/storage/migrate"
+	"github.com/shiftregister-vg/gopad/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// ErrNotFound is returned when a document doesn't exist in storage
+var ErrNotFound = apperr.New(apperr.CodeNotFound, "document not found")
+
+// ErrVersionConflict is returned when a save is based on an outdated version
+var ErrVersionConflict = apperr.New(apperr.CodeVersionConflict, "document version conflict")
+
 // DocumentState represents the persistent state of a document
 type DocumentState struct {
 	Content      string            `json:"content"`
@@ -20,185 +33,595 @@ type DocumentState struct {
 	Version      int64             `json:"version"` // Added for conflict detection
 	Tabs         []Tab             `json:"tabs"`    // Added for tab support
 	ActiveTabId  string            `json:"activeTabId"`
+	OpsCursor    string            `json:"opsCursor,omitempty"` // last operation log entry included in this snapshot
+	Workspace    string            `json:"workspace,omitempty"` // workspace whose policy applies
+	Settings     *policy.Settings  `json:"settings,omitempty"`  // the document's own settings
+	Title        string            `json:"title,omitempty"`     // set by users; empty to use InferredTitle
+	Parent       string            `json:"parent,omitempty"`    // document this one was forked from, if recorded
+	Pinned       bool              `json:"pinned,omitempty"`    // kept without a TTL
+	// InferredTitle is derived from the document's notes and code when it's saved
+	InferredTitle string `json:"inferredTitle,omitempty"`
+	// Outputs holds the result of the last run of each tab that was run, by tab ID
+	Outputs map[string]*RunOutput `json:"outputs,omitempty"`
+	// Schema is the version of the schema the document was stored with; older
+	// ones are upgraded when loaded, see package migrate
+	Schema int `json:"schema,omitempty"`
+	// Expiry is how long the document is kept after this save; zero keeps it for
+	// defaultExpiry. Pinned documents ignore it.
+	Expiry time.Duration `json:"-"`
+}
+
+// DisplayTitle returns the title users gave the document, or else the one inferred from its content
+func (s *DocumentState) DisplayTitle() string {
+	if s.Title != "" {
+		return s.Title
+	}
+	return s.InferredTitle
 }
 
+// defaultExpiry is how long documents are kept after their last save unless their settings say otherwise
+const defaultExpiry = 7 * 24 * time.Hour
+
 type Tab struct {
 	ID      string `json:"id"`
 	Name    string `json:"name"`
 	Content string `json:"content"`
-	Notes   string `json:"notes"` // Added for storing markdown notes
+	Notes   string `json:"notes"`             // Added for storing markdown notes
+	Kind    string `json:"kind,omitempty"`    // empty for editor tabs, "repl" for interpreter sessions
+	Runtime string `json:"runtime,omitempty"` // interpreter of a REPL tab
+	// ContentRef names the blob holding Content when it was offloaded; only set in Redis
+	ContentRef string `json:"contentRef,omitempty"`
+	// Modified is when the tab's name, content or notes last changed, in unix milliseconds
+	Modified int64 `json:"modified,omitempty"`
 }
 
 // redisClient is an interface that abstracts Redis operations
 type redisClient interface {
 	Ping(ctx context.Context) *redis.StatusCmd
+	redis.Scripter
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	Exists(ctx context.Context, keys ...string) *redis.IntCmd
 	HGet(ctx context.Context, key, field string) *redis.StringCmd
+	HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd
 	HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	HSetNX(ctx context.Context, key, field string, value interface{}) *redis.BoolCmd
+	HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd
+	HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Incr(ctx context.Context, key string) *redis.IntCmd
+	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SIsMember(ctx context.Context, key string, member interface{}) *redis.BoolCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
 	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	TTL(ctx context.Context, key string) *redis.DurationCmd
+	MemoryUsage(ctx context.Context, key string, samples ...int) *redis.IntCmd
+	HStrLen(ctx context.Context, key, field string) *redis.IntCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
 	Publish(ctx context.Context, channel string, message interface{}) *redis.IntCmd
 	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	PSubscribe(ctx context.Context, channels ...string) *redis.PubSub
+	XRange(ctx context.Context, stream, start, stop string) *redis.XMessageSliceCmd
+	LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+	XTrimMinID(ctx context.Context, key string, minID string) *redis.IntCmd
 	Pipeline() redis.Pipeliner
 	Close() error
 }
 
 // Storage handles persistent document state using Redis
 type Storage struct {
-	client redisClient
-	mu     sync.RWMutex
-	ctx    context.Context
+	client  redisClient
+	mu      sync.RWMutex
+	writes  docLocks     // serializes the saves and deletes of each document
+	keys    *keyring     // nil unless encryption at rest is enabled
+	shards  *shardRouter // nil unless pub/sub sharding is enabled
+	offload *offloader   // nil unless large tab contents are offloaded
+	// trashTTL is how long deleted documents can be restored, zero to delete them right away
+	trashTTL time.Duration
+	// slowOperation is how long an operation may take before it's logged, zero to never log them
+	slowOperation time.Duration
 }
 
-// New creates a new storage instance
-func New(redisURL string) (*Storage, error) {
-	ctx := context.Background()
-	var client redisClient
+// New creates a new storage instance, using ctx for the initial connection check
+func New(ctx context.Context, redisURL string, opts Options) (*Storage, error) {
+	client, err := Connect(ctx, redisURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{
+		client:        client,
+		trashTTL:      defaultTrashTTL,
+		slowOperation: opts.SlowOperation,
+	}, nil
+}
 
-	// Check if cluster mode is enabled
-	if os.Getenv("REDIS_CLUSTER_MODE") == "true" {
-		// Parse URL for cluster mode
-		opts, err := redis.ParseURL(redisURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
-		}
+// saveScript writes the document only if the stored version still matches the
+// version the caller started from, then bumps the version and publishes the update.
+// KEYS[1] = document key, ARGV = expected version, data, TTL seconds (0 to keep the document
+// forever), update channel, message prefix, offloaded blobs the data references
+var saveScript = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+if current ~= tonumber(ARGV[1]) then
+	return -1
+end
+if ARGV[7] ~= '' and redis.call('HGET', KEYS[1], 'dek') ~= ARGV[7] then
+	return -2
+end
+redis.call('HSET', KEYS[1], 'data', ARGV[2], 'version', current + 1, 'blobs', ARGV[6])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+redis.call('PUBLISH', ARGV[4], ARGV[5] .. ARGV[2])
+return current + 1
+`)
+
+// SaveDocument saves the document state to Redis.
+// state.Version must be the version the changes are based on; it is incremented on success.
+// If another writer saved in the meantime ErrVersionConflict is returned and nothing is written.
+func (s *Storage) SaveDocument(ctx context.Context, docID string, state *DocumentState) (err error) {
+	ctx, span := tracing.Start(ctx, "storage.SaveDocument",
+		attribute.String("doc_id", docID),
+		attribute.Int64("version", state.Version),
+	)
+	defer func() { tracing.End(span, err) }()
+	defer func(start time.Time) { s.observe("save", start, err, "doc_id", docID) }(time.Now())
+
+	defer s.writes.lock(docID)()
+
+	expected := state.Version
+	next := *state
+	next.Version = expected + 1
+	next.LastModified = time.Now().UnixMilli()
+	next.Schema = migrate.Current
+
+	// Everything is sealed with one key, which the script checks is still the
+	// document's: a key cached while another instance shredded the document
+	// would make the saved state unreadable
+	seal, dek, err := s.sealer(ctx, docID)
+	if err != nil {
+		return err
+	}
 
-		// Create cluster client
-		clusterClient := redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:    []string{opts.Addr},
-			Username: opts.Username,
-			Password: opts.Password,
-			// Enable cluster mode
-			ClusterSlots: func(ctx context.Context) ([]redis.ClusterSlot, error) {
-				return nil, nil // Let the client discover slots automatically
-			},
-		})
+	// Large tab contents go to the blob store, leaving references in Redis.
+	// Uploads can be slow, so other documents' saves and loads aren't held up.
+	previous, err := s.storedBlobs(ctx, docID)
+	if err != nil {
+		return err
+	}
+	blobs, err := s.offloadTabs(ctx, docID, &next, previous, seal)
+	if err != nil {
+		return err
+	}
+
+	// Marshal state
+	data, err := json.Marshal(&next)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal document state")
+	}
+	if data, err = seal(data); err != nil {
+		return err
+	}
+
+	expiry := state.Expiry
+	if expiry <= 0 {
+		expiry = defaultExpiry
+	}
+	// Pinned documents are kept until they're unpinned
+	if state.Pinned {
+		expiry = 0
+	}
 
-		// Test connection
-		if err := clusterClient.Ping(ctx).Err(); err != nil {
-			return nil, fmt.Errorf("failed to connect to Redis cluster: %w", err)
+	// Compare-and-set in a single script so concurrent writers can't interleave
+	channel, prefix := s.channel(docID, "updates")
+	s.mu.Lock()
+	result, err := saveScript.Run(ctx, s.client,
+		[]string{fmt.Sprintf("doc:%s", docID)},
+		expected, data, int64(expiry.Seconds()), channel, prefix, strings.Join(blobs, " "), string(dek),
+	).Int64()
+	s.mu.Unlock()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to save document state")
+	}
+	if result == -2 {
+		s.forgetDataKey(docID)
+		s.discardBlobs(ctx, docID, unreferenced(blobs, previous))
+		return ErrKeyDestroyed
+	}
+	if result < 0 {
+		s.discardBlobs(ctx, docID, unreferenced(blobs, previous))
+		return ErrVersionConflict
+	}
+	if s.offload != nil {
+		s.removeBlobs(ctx, docID, unreferenced(previous, blobs))
+	}
+
+	// Operations covered by the snapshot are no longer needed, and the rest
+	// must last as long as the document. The stream lives in a different
+	// cluster slot, so this happens outside the script.
+	if next.OpsCursor != "" {
+		stream := fmt.Sprintf("doc:%s:ops", docID)
+		pipe := s.client.Pipeline()
+		pipe.XTrimMinID(ctx, stream, next.OpsCursor)
+		if expiry > 0 {
+			pipe.Expire(ctx, stream, expiry)
+		} else {
+			pipe.Persist(ctx, stream)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return apperr.Wrap(apperr.CodeInternal, err, "failed to compact operation log")
 		}
+	}
 
-		client = clusterClient
-	} else {
-		// Parse URL for single instance mode
-		opts, err := redis.ParseURL(redisURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	state.Version = next.Version
+	state.LastModified = next.LastModified
+	return nil
+}
+
+// LoadDocument loads the document state from Redis
+func (s *Storage) LoadDocument(ctx context.Context, docID string) (_ *DocumentState, err error) {
+	ctx, span := tracing.Start(ctx, "storage.LoadDocument", attribute.String("doc_id", docID))
+	defer func() { tracing.End(span, err) }()
+	defer func(start time.Time) { s.observe("load", start, err, "doc_id", docID) }(time.Now())
+
+	return s.reloadDocument(ctx, docID)
+}
+
+// reloadDocument loads a document, retrying while saves completing meanwhile
+// remove blobs of the version being loaded
+func (s *Storage) reloadDocument(ctx context.Context, docID string) (*DocumentState, error) {
+	for attempt := 1; ; attempt++ {
+		state, err := s.loadDocument(ctx, docID)
+		if !errors.Is(err, errBlobReplaced) {
+			return state, err
 		}
+		if attempt == blobLoadAttempts {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load tab content")
+		}
+	}
+}
 
-		// Create single instance client
-		singleClient := redis.NewClient(opts)
+// loadDocument reads and decodes the stored state of a document
+func (s *Storage) loadDocument(ctx context.Context, docID string) (*DocumentState, error) {
+	// Only the reads hold s.mu, so a delete or restore isn't seen half done;
+	// blobs are fetched afterwards
+	s.mu.RLock()
+	pipe := s.client.Pipeline()
+	hash := pipe.HMGet(ctx, fmt.Sprintf("doc:%s", docID), "data", "version")
+	// The whole log, as the snapshot saying where to start isn't read yet.
+	// Saves trim it, so it's short.
+	log := pipe.XRange(ctx, fmt.Sprintf("doc:%s:ops", docID), "-", "+")
+	_, err := pipe.Exec(ctx)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load document state")
+	}
+	return s.decodeDocument(ctx, docID, hash.Val(), log.Val())
+}
 
-		// Test connection
-		if err := singleClient.Ping(ctx).Err(); err != nil {
-			return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+// decodeDocument decodes the data and version fields of a document's hash,
+// returning an empty state when it isn't stored, and brings it up to date
+// with the operations among entries logged since it was taken, which may
+// have been logged before the first snapshot
+func (s *Storage) decodeDocument(ctx context.Context, docID string, values []interface{}, entries []redis.XMessage) (*DocumentState, error) {
+	state := &DocumentState{
+		Content:      "",
+		Language:     "plaintext",
+		LastModified: 0,
+		Users:        make(map[string]string),
+		Version:      0,
+	}
+	if data, ok := values[0].(string); ok {
+		plaintext, err := s.decode(ctx, docID, []byte(data))
+		if err != nil {
+			return nil, err
+		}
+		// Documents stored in an older shape are loaded in the current one
+		if plaintext, err = migrate.Upgrade(plaintext); err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to migrate document state")
+		}
+		state = &DocumentState{}
+		if err := json.Unmarshal(plaintext, state); err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal document state")
+		}
+		if err := s.resolveTabs(ctx, docID, state); err != nil {
+			return nil, err
 		}
 
-		client = singleClient
+		// The version field is authoritative for compare-and-set
+		state.Version = 0
+		if v, ok := values[1].(string); ok {
+			state.Version, _ = strconv.ParseInt(v, 10, 64)
+		}
 	}
+	if err := s.applyOps(ctx, docID, state, entries); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
 
-	return &Storage{
-		client: client,
-		ctx:    ctx,
-	}, nil
+// loadBatch is how many documents LoadDocuments reads per round trip
+const loadBatch = 100
+
+// LoadDocuments loads several documents like LoadDocument, reading their
+// snapshots and operation logs in one round trip per loadBatch documents
+// rather than one per document. It returns a state and an error for each ID,
+// in order; documents that aren't stored get an empty state.
+func (s *Storage) LoadDocuments(ctx context.Context, docIDs []string) (_ []*DocumentState, errs []error) {
+	ctx, span := tracing.Start(ctx, "storage.LoadDocuments", attribute.Int("documents", len(docIDs)))
+	defer span.End()
+	defer func(start time.Time) { s.observe("load_batch", start, errors.Join(errs...), "documents", len(docIDs)) }(time.Now())
+
+	states := make([]*DocumentState, len(docIDs))
+	errs = make([]error, len(docIDs))
+	for start := 0; start < len(docIDs); start += loadBatch {
+		end := min(start+loadBatch, len(docIDs))
+		s.loadDocuments(ctx, docIDs[start:end], states[start:end], errs[start:end])
+	}
+	return states, errs
 }
 
-// SaveDocument saves the document state to Redis
-func (s *Storage) SaveDocument(docID string, state *DocumentState) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// loadDocuments loads a batch of documents with one pipeline into states and errs
+func (s *Storage) loadDocuments(ctx context.Context, docIDs []string, states []*DocumentState, errs []error) {
+	s.mu.RLock()
+	pipe := s.client.Pipeline()
+	hashes := make([]*redis.SliceCmd, len(docIDs))
+	logs := make([]*redis.XMessageSliceCmd, len(docIDs))
+	for i, docID := range docIDs {
+		hashes[i] = pipe.HMGet(ctx, fmt.Sprintf("doc:%s", docID), "data", "version")
+		logs[i] = pipe.XRange(ctx, fmt.Sprintf("doc:%s:ops", docID), "-", "+")
+	}
+	// Failures are reported by the commands they belong to, unless none ran
+	_, err := pipe.Exec(ctx)
+	s.mu.RUnlock()
+	if err != nil && ctx.Err() != nil {
+		for i := range errs {
+			errs[i] = apperr.Wrap(apperr.CodeInternal, err, "failed to load document state")
+		}
+		return
+	}
 
-	// Get current version
-	currentVersion, err := s.client.HGet(s.ctx, fmt.Sprintf("doc:%s", docID), "version").Int64()
-	if err != nil && err != redis.Nil {
-		return fmt.Errorf("failed to get current version: %w", err)
+	for i, docID := range docIDs {
+		values, err := hashes[i].Result()
+		if err != nil {
+			errs[i] = apperr.Wrap(apperr.CodeInternal, err, "failed to load document state")
+			continue
+		}
+		entries, err := logs[i].Result()
+		if err != nil {
+			errs[i] = apperr.Wrap(apperr.CodeInternal, err, "failed to read operation log")
+			continue
+		}
+		state, err := s.decodeDocument(ctx, docID, values, entries)
+		if errors.Is(err, errBlobReplaced) {
+			// Saved meanwhile, so load the new version on its own
+			state, err = s.reloadDocument(ctx, docID)
+		}
+		states[i], errs[i] = state, err
 	}
+}
 
-	// Increment version
-	state.Version = currentVersion + 1
-	state.LastModified = time.Now().UnixMilli()
+// DeleteDocument removes a document's state from Redis, moving it to the
+// trash unless the trash TTL is zero
+func (s *Storage) DeleteDocument(ctx context.Context, docID string) (err error) {
+	defer func(start time.Time) { s.observe("delete", start, err, "doc_id", docID) }(time.Now())
 
-	// Marshal state
-	data, err := json.Marshal(state)
+	defer s.writes.lock(docID)()
+	// The blobs can't change while the write lock is held, so only the
+	// Redis writes need s.mu
+	blobs, err := s.storedBlobs(ctx, docID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal document state: %w", err)
+		return err
+	}
+	replaced, err := s.trashedBlobs(ctx, docID)
+	if err != nil {
+		return err
 	}
 
-	// Save to Redis using pipeline for atomic operation
+	s.mu.Lock()
 	pipe := s.client.Pipeline()
-	pipe.HSet(s.ctx, fmt.Sprintf("doc:%s", docID), "data", data)
-	pipe.Publish(s.ctx, fmt.Sprintf("doc:%s:updates", docID), data)
-	// Set 7-day expiration
-	pipe.Expire(s.ctx, fmt.Sprintf("doc:%s", docID), 7*24*time.Hour)
-	_, err = pipe.Exec(s.ctx)
+	trashed := false
+	if s.trashTTL > 0 {
+		if trashed, err = s.trashDocument(ctx, pipe, docID); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	pipe.Del(ctx, fmt.Sprintf("doc:%s", docID))
+	pipe.Del(ctx, fmt.Sprintf("doc:%s:ops", docID))
+	pipe.Del(ctx, fmt.Sprintf("doc:%s:activity", docID))
+	pipe.HDel(ctx, templatesKey, docID)
+	pipe.SRem(ctx, pinnedKey, docID)
+	channel, prefix := s.channel(docID, "deleted")
+	pipe.Publish(ctx, channel, prefix)
+	_, err = pipe.Exec(ctx)
+	s.mu.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to save document state: %w", err)
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to delete document")
+	}
+	// A document created under the same ID gets a key of its own
+	s.forgetDataKey(docID)
+	if s.offload != nil {
+		if trashed {
+			// The trash references the blobs until CollectTrash removes them,
+			// and no longer those of the copy it replaced
+			s.removeBlobs(ctx, docID, unreferenced(replaced, blobs))
+		} else {
+			s.removeBlobs(ctx, docID, blobs)
+		}
 	}
-
 	return nil
 }
 
-// LoadDocument loads the document state from Redis
-func (s *Storage) LoadDocument(docID string) (*DocumentState, error) {
+// SubscribeToUpdates delivers the document's updates saved by any instance until ctx is cancelled
+func (s *Storage) SubscribeToUpdates(ctx context.Context, docID string, handler func(*DocumentState)) *Subscription {
+	return s.subscribe(ctx, docID, "updates", func(msg string) error {
+		payload, err := s.decode(ctx, docID, []byte(msg))
+		if err != nil {
+			return err
+		}
+		var state DocumentState
+		if err := json.Unmarshal(payload, &state); err != nil {
+			return apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal update")
+		}
+		if err := s.resolveTabs(ctx, docID, &state); err != nil {
+			// A newer update replaced it and follows
+			if errors.Is(err, errBlobReplaced) {
+				return nil
+			}
+			return err
+		}
+		handler(&state)
+		return nil
+	})
+}
+
+// SubscribeToDeletion calls handler when the document is deleted or shredded by any instance
+func (s *Storage) SubscribeToDeletion(ctx context.Context, docID string, handler func()) *Subscription {
+	return s.subscribe(ctx, docID, "deleted", func(string) error {
+		// Whichever instance deleted or shredded it, nothing of it may be used here
+		s.forgetDataKey(docID)
+		if s.offload != nil {
+			s.offload.cache.removePrefix(blobPrefix(docID))
+		}
+		handler()
+		return nil
+	})
+}
+
+// DocumentUsage describes how much Redis memory a document is using
+type DocumentUsage struct {
+	ID            string `json:"id"`
+	PersistedSize int64  `json:"persistedSize"` // size of the serialized state in bytes
+	MemoryUsage   int64  `json:"memoryUsage"`   // bytes reported by MEMORY USAGE
+	Version       int64  `json:"version"`
+	TTLSeconds    int64  `json:"ttlSeconds"` // -1 when the key never expires
+	// OffloadedSize is the size in bytes of the tab contents offloaded to blobs,
+	// which don't count towards MemoryUsage
+	OffloadedSize int64 `json:"offloadedSize"`
+}
+
+// DocumentVersion returns the stored version of a document, or 0 if it isn't persisted
+func (s *Storage) DocumentVersion(ctx context.Context, docID string) (int64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	data, err := s.client.HGet(s.ctx, fmt.Sprintf("doc:%s", docID), "data").Bytes()
+	version, err := s.client.HGet(ctx, fmt.Sprintf("doc:%s", docID), "version").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
 	if err != nil {
-		if err == redis.Nil {
-			return &DocumentState{
-				Content:      "",
-				Language:     "plaintext",
-				LastModified: 0,
-				Users:        make(map[string]string),
-				Version:      0,
-			}, nil
-		}
-		return nil, fmt.Errorf("failed to load document state: %w", err)
+		return 0, apperr.Wrap(apperr.CodeInternal, err, "failed to read document version")
 	}
+	return version, nil
+}
 
-	var state DocumentState
-	if err := json.Unmarshal(data, &state); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal document state: %w", err)
+// ListDocumentIDs returns the IDs of all documents persisted in Redis. A
+// cluster's keys are spread over its masters, so each of them is scanned.
+func (s *Storage) ListDocumentIDs(ctx context.Context) ([]string, error) {
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		return scanDocumentIDs(ctx, s.client)
 	}
-
-	return &state, nil
+	var mu sync.Mutex
+	var ids []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		found, err := scanDocumentIDs(ctx, master)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
 }
 
-// DeleteDocument removes a document's state from Redis
-func (s *Storage) DeleteDocument(docID string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// scanDocumentIDs returns the IDs of the documents persisted on one Redis server
+func scanDocumentIDs(ctx context.Context, client redisClient) ([]string, error) {
+	var ids []string
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, "doc:*", 100).Result()
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to scan document keys")
+		}
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, "doc:")
+			// Skip pub/sub style and auxiliary keys
+			if strings.Contains(id, ":") {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return ids, nil
+}
 
+// DocumentUsage reports the persisted size, memory usage, version and
+// remaining TTL of a document, and the size of its offloaded tab contents
+func (s *Storage) DocumentUsage(ctx context.Context, docID string) (*DocumentUsage, error) {
+	key := fmt.Sprintf("doc:%s", docID)
+	s.mu.RLock()
 	pipe := s.client.Pipeline()
-	pipe.Del(s.ctx, fmt.Sprintf("doc:%s", docID))
-	pipe.Publish(s.ctx, fmt.Sprintf("doc:%s:deleted", docID), "")
-	_, err := pipe.Exec(s.ctx)
-	if err != nil {
-		return fmt.Errorf("failed to delete document: %w", err)
+	sizeCmd := pipe.HStrLen(ctx, key, "data")
+	memCmd := pipe.MemoryUsage(ctx, key)
+	ttlCmd := pipe.TTL(ctx, key)
+	versionCmd := pipe.HGet(ctx, key, "version")
+	blobsCmd := pipe.HGet(ctx, key, "blobs")
+	_, err := pipe.Exec(ctx)
+	s.mu.RUnlock()
+	if err != nil && err != redis.Nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to inspect document")
 	}
 
-	return nil
-}
-
-// SubscribeToUpdates subscribes to document updates
-func (s *Storage) SubscribeToUpdates(docID string, handler func(*DocumentState)) error {
-	pubsub := s.client.Subscribe(s.ctx, fmt.Sprintf("doc:%s:updates", docID))
-	defer pubsub.Close()
+	if ttlCmd.Val() == -2 {
+		return nil, ErrNotFound
+	}
 
-	ch := pubsub.Channel()
-	for msg := range ch {
-		var state DocumentState
-		if err := json.Unmarshal([]byte(msg.Payload), &state); err != nil {
-			return fmt.Errorf("failed to unmarshal update: %w", err)
+	usage := &DocumentUsage{
+		ID:            docID,
+		PersistedSize: sizeCmd.Val(),
+		MemoryUsage:   memCmd.Val(),
+	}
+	if ttl := ttlCmd.Val(); ttl < 0 {
+		usage.TTLSeconds = int64(ttl)
+	} else {
+		usage.TTLSeconds = int64(ttl.Seconds())
+	}
+	usage.Version, _ = versionCmd.Int64()
+	// Blob stores can be slow, so Redis isn't held up while they're asked
+	if blobs := strings.Fields(blobsCmd.Val()); len(blobs) > 0 && s.offload != nil {
+		if usage.OffloadedSize, err = s.blobsSize(ctx, blobs); err != nil {
+			return nil, err
 		}
-		handler(&state)
 	}
+	return usage, nil
+}
 
+// Ping checks that Redis is reachable
+func (s *Storage) Ping(ctx context.Context) error {
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeUnavailable, err, "Redis is unreachable")
+	}
 	return nil
 }
 
 // Close closes the Redis connection
 func (s *Storage) Close() error {
+	if s.shards != nil {
+		s.shards.close()
+	}
 	return s.client.Close()
 }
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shiftregister-vg/gopad/pkg/envelope"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+// newTestStorage returns a storage backed by mr, with encryption enabled when
+// master is set
+func newTestStorage(t *testing.T, mr *miniredis.Miniredis, master []byte) *Storage {
+	t.Helper()
+	logger.Setup(logger.ConfigFromEnv())
+	s, err := New(context.Background(), "redis://"+mr.Addr(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if master != nil {
+		wrapper, err := envelope.NewLocalKeyWrapper(master)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.EnableEncryption(wrapper)
+	}
+	return s
+}
+
+// memBlobs is a BlobStore in memory
+type memBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (m *memBlobs) Put(_ context.Context, name string, data []byte, _ string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[name] = data
+	return nil
+}
+
+func (m *memBlobs) Get(_ context.Context, name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return data, nil
+}
+
+func (m *memBlobs) Size(_ context.Context, name string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[name]
+	if !ok {
+		return 0, fs.ErrNotExist
+	}
+	return int64(len(data)), nil
+}
+
+func (m *memBlobs) Delete(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, name)
+	return nil
+}
+
+func (m *memBlobs) has(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.blobs[name]
+	return ok
+}
+
+// offloadedState returns a document with one tab large enough to be offloaded
+func offloadedState(content string) *DocumentState {
+	return &DocumentState{Language: "go", Tabs: []Tab{{ID: "1", Name: "main", Content: content}}, ActiveTabId: "1"}
+}
+
+func TestSaveConflictDiscardsUploadedBlobs(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	a, b := newTestStorage(t, mr, nil), newTestStorage(t, mr, nil)
+	blobs := &memBlobs{blobs: make(map[string][]byte)}
+	a.EnableOffload(blobs, 4, 0)
+	b.EnableOffload(blobs, 4, 0)
+
+	if err := a.SaveDocument(ctx, "doc", offloadedState("first")); err != nil {
+		t.Fatal(err)
+	}
+	won := offloadedState("winner")
+	won.Version = 1
+	if err := a.SaveDocument(ctx, "doc", won); err != nil {
+		t.Fatal(err)
+	}
+	stale := offloadedState("stale")
+	stale.Version = 1
+	if err := b.SaveDocument(ctx, "doc", stale); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+	if blobs.has(blobName("doc", "stale")) {
+		t.Error("blob uploaded by the failed save was kept")
+	}
+
+	// A save racing the winner may have uploaded the same content
+	b.discardBlobs(ctx, "doc", []string{blobName("doc", "winner")})
+	if !blobs.has(blobName("doc", "winner")) {
+		t.Fatal("blob of the winning save was removed")
+	}
+	loaded, err := b.LoadDocument(ctx, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Tabs[0].Content != "winner" {
+		t.Errorf("expected the winning content, got %q", loaded.Tabs[0].Content)
+	}
+}
+
+func TestCollectTrash(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	s := newTestStorage(t, mr, nil)
+	blobs := &memBlobs{blobs: make(map[string][]byte)}
+	s.EnableOffload(blobs, 4, 0)
+	expire := func(docID string) {
+		t.Helper()
+		entry := mr.HGet(trashedKey, docID)
+		if entry == "" {
+			t.Fatalf("%s isn't listed as trashed", docID)
+		}
+		_, names, _ := strings.Cut(entry, " ")
+		mr.HSet(trashedKey, docID, "0 "+names)
+	}
+
+	for _, docID := range []string{"kept", "expired", "restored"} {
+		if err := s.SaveDocument(ctx, docID, offloadedState(docID+" content")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteDocument(ctx, docID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expire("expired")
+	expire("restored")
+	if err := s.RestoreDocument(ctx, "restored"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CollectTrash(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !blobs.has(blobName("kept", "kept content")) {
+		t.Error("blob of a document still in the trash was removed")
+	}
+	if blobs.has(blobName("expired", "expired content")) {
+		t.Error("blob of an expired trashed document was kept")
+	}
+	if !blobs.has(blobName("restored", "restored content")) {
+		t.Error("blob of a restored document was removed")
+	}
+	loaded, err := s.LoadDocument(ctx, "restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Tabs[0].Content != "restored content" {
+		t.Errorf("expected the restored content, got %q", loaded.Tabs[0].Content)
+	}
+}
+
+func TestDocumentUsage(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	s := newTestStorage(t, mr, nil)
+	blobs := &memBlobs{blobs: make(map[string][]byte)}
+	s.EnableOffload(blobs, 4, 0)
+
+	state := offloadedState("offloaded")
+	state.Tabs = append(state.Tabs, Tab{ID: "2", Name: "small", Content: "abc"}, Tab{ID: "3", Name: "log", Content: "offloaded too"})
+	if err := s.SaveDocument(ctx, "doc", state); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := s.DocumentUsage(ctx, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("offloaded") + len("offloaded too")); usage.OffloadedSize != want {
+		t.Errorf("expected %d offloaded bytes, got %d", want, usage.OffloadedSize)
+	}
+	if usage.Version != 1 || usage.PersistedSize == 0 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+
+	// A blob removed by a newer save meanwhile is left out
+	blobs.Delete(ctx, blobName("doc", "offloaded"))
+	if usage, err = s.DocumentUsage(ctx, "doc"); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("offloaded too")); usage.OffloadedSize != want {
+		t.Errorf("expected %d offloaded bytes, got %d", want, usage.OffloadedSize)
+	}
+
+	if _, err := s.DocumentUsage(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing document, got %v", err)
+	}
+}
+
+func TestSaveAfterShredByAnotherInstance(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	master := make([]byte, 32)
+	a, b := newTestStorage(t, mr, master), newTestStorage(t, mr, master)
+
+	state := &DocumentState{Language: "go", Tabs: []Tab{{ID: "1", Name: "main", Content: "secret"}}, ActiveTabId: "1"}
+	if err := b.SaveDocument(ctx, "doc", state); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ShredDocument(ctx, "doc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// b still has the shredded key cached, and must not save with it
+	recreated := &DocumentState{Language: "go", Tabs: []Tab{{ID: "1", Name: "main", Content: "new"}}, ActiveTabId: "1"}
+	if err := b.SaveDocument(ctx, "doc", recreated); !errors.Is(err, ErrKeyDestroyed) {
+		t.Fatalf("expected ErrKeyDestroyed, got %v", err)
+	}
+	// The next save generates a new key that both instances can read with
+	if err := b.SaveDocument(ctx, "doc", recreated); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := a.LoadDocument(ctx, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Tabs[0].Content != "new" {
+		t.Errorf("expected the new content, got %q", loaded.Tabs[0].Content)
+	}
+}
+
+func TestKeyringEvict(t *testing.T) {
+	k := &keyring{keys: make(map[string]cachedKey)}
+	now := time.Now()
+	for i := 0; i < maxCachedKeys; i++ {
+		expires := now.Add(dataKeyTTL)
+		if i%2 == 0 {
+			expires = now.Add(-time.Second)
+		}
+		k.keys[strconv.Itoa(i)] = cachedKey{expires: expires}
+	}
+	k.evict()
+	if n := len(k.keys); n != maxCachedKeys/2 {
+		t.Fatalf("expected the %d expired keys to be dropped, %d left", maxCachedKeys/2, n)
+	}
+	for docID, cached := range k.keys {
+		if !now.Before(cached.expires) {
+			t.Fatalf("expired key of %s kept", docID)
+		}
+	}
+
+	// Without expired keys one makes room
+	for i := 0; len(k.keys) < maxCachedKeys; i++ {
+		k.keys["fresh-"+strconv.Itoa(i)] = cachedKey{expires: now.Add(dataKeyTTL)}
+	}
+	k.evict()
+	if n := len(k.keys); n != maxCachedKeys-1 {
+		t.Fatalf("expected %d keys after making room, got %d", maxCachedKeys-1, n)
+	}
+}
+
+func TestListDocumentIDs(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	single := newTestStorage(t, mr, nil)
+	cluster, err := New(ctx, "redis+cluster://"+mr.Addr(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.Close() })
+
+	for _, docID := range []string{"a", "b"} {
+		if err := single.SaveDocument(ctx, docID, offloadedState(docID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Operation logs and other keys of a document aren't documents
+	mr.Set("doc:a:ops", "")
+	for name, s := range map[string]*Storage{"single": single, "cluster": cluster} {
+		ids, err := s.ListDocumentIDs(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, []string{"a", "b"}) {
+			t.Errorf("%s: expected documents a and b, got %v", name, ids)
+		}
+	}
+}
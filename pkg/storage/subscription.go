@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+)
+
+const (
+	// resubscribeBackoff and resubscribeBackoffMax bound the wait before
+	// subscribing again after the connection was lost
+	resubscribeBackoff    = 100 * time.Millisecond
+	resubscribeBackoffMax = 10 * time.Second
+	// subscriptionPing is how long a subscription waits for messages before
+	// checking that its connection is still alive
+	subscriptionPing = 30 * time.Second
+)
+
+// errNoPong is returned when a subscription's connection didn't answer a ping
+var errNoPong = errors.New("no reply to ping")
+
+// Subscription delivers messages published through Redis to a handler until
+// it's closed or the context it was started with is cancelled. When the
+// connection is lost it subscribes again, backing off with jitter while Redis
+// is unreachable. Messages published in between are lost, which Interrupted
+// reports. Messages the handler can't decode are logged and skipped.
+type Subscription struct {
+	cancel      context.CancelFunc
+	done        chan struct{}
+	interrupted atomic.Bool
+}
+
+// startSubscription runs run in the background with a context that closing
+// the subscription cancels
+func startSubscription(ctx context.Context, run func(ctx context.Context, sub *Subscription)) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(sub.done)
+		run(ctx, sub)
+	}()
+	return sub
+}
+
+// Close stops the subscription and waits for its handler to return. It must
+// not be called from the handler.
+func (sub *Subscription) Close() {
+	sub.cancel()
+	<-sub.done
+}
+
+// Done is closed once the subscription has stopped
+func (sub *Subscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Interrupted reports whether messages may have been lost since it was last
+// called, because the connection was lost or couldn't subscribe
+func (sub *Subscription) Interrupted() bool {
+	return sub.interrupted.Swap(false)
+}
+
+// subscribeChannel starts a subscription to a channel
+func (s *Storage) subscribeChannel(ctx context.Context, channel string, handler func(payload string) error) *Subscription {
+	return startSubscription(ctx, func(ctx context.Context, sub *Subscription) {
+		sub.run(ctx, func() *redis.PubSub {
+			return s.client.Subscribe(ctx, channel)
+		}, handler, func(start time.Time, err error) {
+			s.observe("subscribe", start, err, "channel", channel)
+		})
+	})
+}
+
+// subscribePattern starts a subscription to the channels matching pattern
+func (s *Storage) subscribePattern(ctx context.Context, pattern string, handler func(payload string) error) *Subscription {
+	return startSubscription(ctx, func(ctx context.Context, sub *Subscription) {
+		sub.run(ctx, func() *redis.PubSub {
+			return s.client.PSubscribe(ctx, pattern)
+		}, handler, func(start time.Time, err error) {
+			s.observe("subscribe", start, err, "pattern", pattern)
+		})
+	})
+}
+
+// run receives messages over connections opened by open until ctx is
+// cancelled, opening a new one whenever one fails. Each attempt to subscribe
+// is passed to observe once it's confirmed or has failed.
+func (sub *Subscription) run(ctx context.Context, open func() *redis.PubSub, handler func(payload string) error, observe func(start time.Time, err error)) {
+	failures := 0
+	for {
+		start := time.Now()
+		pubsub := open()
+		// Closing the connection ends a read waiting for messages
+		stop := context.AfterFunc(ctx, func() { pubsub.Close() })
+		confirmed, err := receive(ctx, pubsub, handler, func() { observe(start, nil) })
+		stop()
+		pubsub.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if !confirmed {
+			observe(start, err)
+		}
+		sub.interrupted.Store(true)
+		// Only back off further while subscribing keeps failing
+		if confirmed {
+			failures = 0
+		}
+		failures++
+		delay := Backoff(failures, resubscribeBackoff, resubscribeBackoffMax)
+		logger.Warn("Subscription interrupted, subscribing again", "retry_in", delay.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// receive hands the payloads of messages on pubsub to handler until the
+// connection fails, pinging it when it's quiet. It calls confirm when the
+// subscription is confirmed and reports whether it was before then.
+func receive(ctx context.Context, pubsub *redis.PubSub, handler func(payload string) error, confirm func()) (bool, error) {
+	confirmed, pinged := false, false
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, subscriptionPing)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return confirmed, err
+			}
+			// A connection dropped without notice only shows by not answering
+			if pinged {
+				return confirmed, errNoPong
+			}
+			if err := pubsub.Ping(ctx); err != nil {
+				return confirmed, err
+			}
+			pinged = true
+			continue
+		}
+		pinged = false
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if !confirmed {
+				confirm()
+			}
+			confirmed = true
+		case *redis.Message:
+			if err := handler(msg.Payload); err != nil {
+				logger.Warn("Skipping message that couldn't be decoded", "channel", msg.Channel, "error", err)
+			}
+		}
+	}
+}
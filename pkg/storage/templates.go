@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// templatesKey is the hash of documents flagged as templates, by document ID
+const templatesKey = "templates"
+
+// Template describes a document new documents can be created from
+type Template struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Created     int64  `json:"created"` // unix milliseconds
+}
+
+// ErrTemplateNotFound is returned when unflagging a document that isn't a template
+var ErrTemplateNotFound = apperr.New(apperr.CodeNotFound, "template not found")
+
+// SaveTemplate flags a document as a template, replacing its earlier description
+func (s *Storage) SaveTemplate(ctx context.Context, docID string, template *Template) error {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal template")
+	}
+	if err := s.client.HSet(ctx, templatesKey, docID, data).Err(); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to save template")
+	}
+	return nil
+}
+
+// DeleteTemplate unflags a template, returning ErrTemplateNotFound if the
+// document isn't one. The document itself is kept.
+func (s *Storage) DeleteTemplate(ctx context.Context, docID string) error {
+	removed, err := s.client.HDel(ctx, templatesKey, docID).Result()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to delete template")
+	}
+	if removed == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// Templates returns every document flagged as a template by document ID.
+// Templates whose document has expired are dropped along the way.
+func (s *Storage) Templates(ctx context.Context) (map[string]*Template, error) {
+	entries, err := s.client.HGetAll(ctx, templatesKey).Result()
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list templates")
+	}
+	templates := make(map[string]*Template, len(entries))
+	var expired []string
+	for docID, data := range entries {
+		exists, err := s.client.Exists(ctx, fmt.Sprintf("doc:%s", docID)).Result()
+		if err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list templates")
+		}
+		if exists == 0 {
+			expired = append(expired, docID)
+			continue
+		}
+		var template Template
+		if err := json.Unmarshal([]byte(data), &template); err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal template")
+		}
+		templates[docID] = &template
+	}
+	if len(expired) > 0 {
+		if err := s.client.HDel(ctx, templatesKey, expired...).Err(); err != nil {
+			return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to list templates")
+		}
+	}
+	return templates, nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+)
+
+// Deleted documents are moved to the trash rather than dropped, so a delete
+// made by mistake can be undone until the trash TTL passes. The trash keeps
+// the document hash, with its wrapped key and blob references, and its
+// operation log under trash:<id> keys. Blobs outlive the keys, so the ones
+// trashed documents reference are listed in trashedKey for CollectTrash.
+
+// defaultTrashTTL is how long deleted documents can be restored unless SetTrashTTL says otherwise
+const defaultTrashTTL = 3 * 24 * time.Hour
+
+// trashedKey maps trashed documents that reference blobs to when their copy
+// expires as Unix seconds followed by the blob names
+const trashedKey = "trashed"
+
+// ErrNotInTrash is returned when restoring a document that isn't in the trash
+var ErrNotInTrash = apperr.New(apperr.CodeNotFound, "the document isn't in the trash")
+
+// restoreScript writes a trashed document hash back unless a document with its ID exists.
+// KEYS[1] = document key, ARGV = TTL seconds, then the hash's fields and values
+var restoreScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+redis.call('EXPIRE', KEYS[1], ARGV[1])
+return 1
+`)
+
+// collectScript forgets a trashed document's blobs unless its entry changed since it was read.
+// KEYS[1] = trashedKey, ARGV = document ID, entry read
+var collectScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// SetTrashTTL sets how long deleted documents are kept in the trash; zero
+// deletes them right away
+func (s *Storage) SetTrashTTL(ttl time.Duration) {
+	s.trashTTL = ttl
+}
+
+// trashDocument queues copying a document's hash and operation log to the
+// trash on pipe and returns whether there was a stored state to keep
+// Note: Caller must hold s.mu
+func (s *Storage) trashDocument(ctx context.Context, pipe redis.Pipeliner, docID string) (bool, error) {
+	fields, err := s.client.HGetAll(ctx, fmt.Sprintf("doc:%s", docID)).Result()
+	if err != nil {
+		return false, apperr.Wrap(apperr.CodeInternal, err, "failed to read document")
+	}
+	// Operations logged before the first save have no snapshot to go with
+	if len(fields) == 0 {
+		return false, nil
+	}
+	ops, err := s.client.XRange(ctx, fmt.Sprintf("doc:%s:ops", docID), "-", "+").Result()
+	if err != nil {
+		return false, apperr.Wrap(apperr.CodeInternal, err, "failed to read operation log")
+	}
+	// A document deleted again replaces the copy in the trash
+	key := fmt.Sprintf("trash:%s", docID)
+	pipe.Del(ctx, key)
+	pipe.Del(ctx, key+":ops")
+	pipe.HSet(ctx, key, hashValues(fields)...)
+	pipe.Expire(ctx, key, s.trashTTL)
+	copyOps(ctx, pipe, key+":ops", ops, s.trashTTL)
+	if blobs := fields["blobs"]; blobs != "" {
+		pipe.HSet(ctx, trashedKey, docID, fmt.Sprintf("%d %s", time.Now().Add(s.trashTTL).Unix(), blobs))
+	} else {
+		pipe.HDel(ctx, trashedKey, docID)
+	}
+	return true, nil
+}
+
+// trashedBlobs returns the blobs the trashed copy of a document references
+func (s *Storage) trashedBlobs(ctx context.Context, docID string) ([]string, error) {
+	if s.offload == nil {
+		return nil, nil
+	}
+	entry, err := s.client.HGet(ctx, trashedKey, docID).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to read trash")
+	}
+	if fields := strings.Fields(entry); len(fields) > 1 {
+		return fields[1:], nil
+	}
+	return nil, nil
+}
+
+// CollectTrash deletes the blobs of trashed documents whose copy expired,
+// except those a document created under the same ID references. Of several
+// instances calling it only one removes each document's blobs.
+func (s *Storage) CollectTrash(ctx context.Context) error {
+	if s.offload == nil {
+		return nil
+	}
+	entries, err := s.client.HGetAll(ctx, trashedKey).Result()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to read trash")
+	}
+	now := time.Now().Unix()
+	for docID, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if expires, _ := strconv.ParseInt(fields[0], 10, 64); expires > now {
+			continue
+		}
+		if err := s.collectTrashed(ctx, docID, entry, fields[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectTrashed deletes the blobs of an expired trash entry read as entry
+func (s *Storage) collectTrashed(ctx context.Context, docID, entry string, blobs []string) error {
+	defer s.writes.lock(docID)()
+	claimed, err := collectScript.Run(ctx, s.client, []string{trashedKey}, docID, entry).Int()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to collect trash")
+	}
+	// Deleted again or restored meanwhile, or collected by another instance
+	if claimed == 0 {
+		return nil
+	}
+	stored, err := s.storedBlobs(ctx, docID)
+	if err != nil {
+		return err
+	}
+	s.removeBlobs(ctx, docID, unreferenced(blobs, stored))
+	return nil
+}
+
+// RestoreDocument moves a deleted document back out of the trash. It's kept
+// for defaultExpiry until it's saved again. ErrVersionConflict is returned
+// when a document with its ID was created since it was deleted.
+func (s *Storage) RestoreDocument(ctx context.Context, docID string) error {
+	defer s.writes.lock(docID)()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fmt.Sprintf("trash:%s", docID)
+	fields, err := s.client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to read trash")
+	}
+	if len(fields) == 0 {
+		return ErrNotInTrash
+	}
+	ops, err := s.client.XRange(ctx, key+":ops", "-", "+").Result()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to read operation log")
+	}
+
+	docKey := fmt.Sprintf("doc:%s", docID)
+	args := append([]interface{}{int64(defaultExpiry.Seconds())}, hashValues(fields)...)
+	restored, err := restoreScript.Run(ctx, s.client, []string{docKey}, args...).Int()
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to restore document")
+	}
+	if restored == 0 {
+		return ErrVersionConflict
+	}
+	// The restored hash brings its own wrapped key back
+	s.forgetDataKey(docID)
+
+	pipe := s.client.Pipeline()
+	pipe.Del(ctx, docKey+":ops")
+	copyOps(ctx, pipe, docKey+":ops", ops, defaultExpiry)
+	pipe.Del(ctx, key)
+	pipe.Del(ctx, key+":ops")
+	// The restored document references the blobs again
+	pipe.HDel(ctx, trashedKey, docID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to restore operation log")
+	}
+	return nil
+}
+
+// copyOps queues appending entries to the stream at key on pipe, keeping their IDs
+func copyOps(ctx context.Context, pipe redis.Pipeliner, key string, entries []redis.XMessage, ttl time.Duration) {
+	if len(entries) == 0 {
+		return
+	}
+	for _, entry := range entries {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: entry.ID, Values: entry.Values})
+	}
+	pipe.Expire(ctx, key, ttl)
+}
+
+// hashValues flattens hash fields into the field and value arguments of HSET
+func hashValues(fields map[string]string) []interface{} {
+	values := make([]interface{}, 0, 2*len(fields))
+	for field, value := range fields {
+		values = append(values, field, value)
+	}
+	return values
+}
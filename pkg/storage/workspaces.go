@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/policy"
+)
+
+// policiesChannel carries every workspace policy change, so instances can
+// refresh the policies of the documents they have loaded
+const policiesChannel = "workspace:policies"
+
+// policyUpdate is published on policiesChannel
+type policyUpdate struct {
+	Workspace string         `json:"workspace"`
+	Policy    *policy.Policy `json:"policy"`
+}
+
+// SaveWorkspacePolicy stores a workspace's policy and notifies all instances
+func (s *Storage) SaveWorkspacePolicy(ctx context.Context, workspace string, p *policy.Policy) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal workspace policy")
+	}
+	update, err := json.Marshal(policyUpdate{Workspace: workspace, Policy: p})
+	if err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to marshal workspace policy")
+	}
+	pipe := s.client.Pipeline()
+	pipe.Set(ctx, fmt.Sprintf("workspace:%s:policy", workspace), data, 0)
+	pipe.Publish(ctx, policiesChannel, update)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return apperr.Wrap(apperr.CodeInternal, err, "failed to save workspace policy")
+	}
+	return nil
+}
+
+// WorkspacePolicy loads a workspace's policy, returning nil if none is set
+func (s *Storage) WorkspacePolicy(ctx context.Context, workspace string) (*policy.Policy, error) {
+	data, err := s.client.Get(ctx, fmt.Sprintf("workspace:%s:policy", workspace)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to load workspace policy")
+	}
+	var p policy.Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal workspace policy")
+	}
+	return &p, nil
+}
+
+// SubscribeToPolicies calls handler whenever any instance saves a workspace
+// policy until ctx is cancelled
+func (s *Storage) SubscribeToPolicies(ctx context.Context, handler func(workspace string, p *policy.Policy)) *Subscription {
+	return s.subscribeChannel(ctx, policiesChannel, func(msg string) error {
+		var update policyUpdate
+		if err := json.Unmarshal([]byte(msg), &update); err != nil {
+			return apperr.Wrap(apperr.CodeInternal, err, "failed to unmarshal policy update")
+		}
+		handler(update.Workspace, update.Policy)
+		return nil
+	})
+}
+
+// NextDocumentNumber returns the next number in a workspace's sequence of
+// document IDs, starting at 1; the empty workspace has a sequence of its own
+func (s *Storage) NextDocumentNumber(ctx context.Context, workspace string) (int64, error) {
+	key := "docs:seq"
+	if workspace != "" {
+		key = fmt.Sprintf("workspace:%s:seq", workspace)
+	}
+	n, err := s.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, apperr.Wrap(apperr.CodeInternal, err, "failed to allocate document number")
+	}
+	return n, nil
+}
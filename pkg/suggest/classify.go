@@ -0,0 +1,212 @@
+package suggest
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// classifyLimit is how much of the content Classify looks at
+	classifyLimit = 16 << 10
+	// featureCap bounds how many lines one feature scores for, so a long run of
+	// similar lines can't outweigh everything else
+	featureCap = 3
+	// minScore is the score the winning language needs before it's trusted
+	minScore = 8
+)
+
+// feature is a line pattern typical of some languages, worth weight points to each
+type feature struct {
+	pattern *regexp.Regexp
+	weights map[string]int
+}
+
+func match(pattern string, weights map[string]int) feature {
+	return feature{pattern: regexp.MustCompile(pattern), weights: weights}
+}
+
+// features are matched against each trimmed, non-blank line
+var features = []feature{
+	// Python
+	match(`^(async )?def \w+\(.*\)\s*(->\s*[\w\[\], .]+)?:$`, map[string]int{"python": 5}),
+	match(`^class \w+(\(.*\))?:$`, map[string]int{"python": 4}),
+	match(`^(if|elif|while|for|with|try|except|else|finally)\b.*:$`, map[string]int{"python": 2}),
+	match(`^from [\w.]+ import `, map[string]int{"python": 4}),
+	match(`^import [\w.]+(, [\w.]+)*$`, map[string]int{"python": 2}),
+	match(`\bself\.\w+`, map[string]int{"python": 2}),
+	match(`__name__ == ['"]__main__['"]`, map[string]int{"python": 5}),
+
+	// JavaScript and TypeScript
+	match(`\bconsole\.(log|error|warn)\(`, map[string]int{"javascript": 3, "typescript": 3}),
+	match(`^(const|let|var) \w+ = `, map[string]int{"javascript": 2, "typescript": 2}),
+	match(`\bfunction\s*\w*\s*\(.*\{$`, map[string]int{"javascript": 3, "typescript": 3, "php": 1}),
+	match(`\brequire\(['"][\w./@-]+['"]\)`, map[string]int{"javascript": 4, "typescript": 1}),
+	match(`^import .* from ['"][^'"]+['"];?$`, map[string]int{"javascript": 3, "typescript": 3}),
+	match(`^export (default |const |function |class |async )`, map[string]int{"javascript": 3, "typescript": 3}),
+	match(`\b(document|window)\.\w+`, map[string]int{"javascript": 2, "typescript": 2}),
+	match(`===|!==`, map[string]int{"javascript": 2, "typescript": 2, "php": 1}),
+	match(`\w\??:\s*(string|number|boolean|any|void|unknown|never)(\[\])?\s*[,;)=|]`, map[string]int{"typescript": 5}),
+	match(`^(export )?(interface|type) \w+(<.*>)? (=|\{)`, map[string]int{"typescript": 4}),
+	match(`\bas (string|number|any|unknown|const)\b`, map[string]int{"typescript": 3}),
+
+	// Go
+	match(`^package \w+$`, map[string]int{"go": 5}),
+	match(`^func (\(\w+ \*?\w+\) )?\w+\(`, map[string]int{"go": 5}),
+	match(`\w+(, \w+)* := `, map[string]int{"go": 3}),
+	match(`^import \($`, map[string]int{"go": 4}),
+	match(`\bfmt\.\w+\(`, map[string]int{"go": 4}),
+	match(`\berr != nil\b`, map[string]int{"go": 5}),
+	match(`^type \w+ (struct|interface) \{$`, map[string]int{"go": 5}),
+
+	// Java, C# and Kotlin
+	match(`^(public |private |protected )?(abstract |static )?(final )?class \w+`, map[string]int{"java": 2, "csharp": 2}),
+	match(`\bSystem\.out\.print`, map[string]int{"java": 5}),
+	match(`^import [\w.]+(\.\*)?;$`, map[string]int{"java": 4}),
+	match(`^package [\w.]+;$`, map[string]int{"java": 5}),
+	match(`\bpublic static void main\(String`, map[string]int{"java": 5}),
+	match(`^@Override$`, map[string]int{"java": 3, "kotlin": 1}),
+	match(`^(private|public|protected) (static )?(final |readonly )?\w+(<[\w<>, ?]+>)? \w+( = .*)?;$`, map[string]int{"java": 2, "csharp": 2}),
+	match(`^using [\w.]+;$`, map[string]int{"csharp": 5}),
+	match(`^namespace [\w.]+\s*\{?$`, map[string]int{"csharp": 4, "cpp": 2}),
+	match(`\bConsole\.Write(Line)?\(`, map[string]int{"csharp": 5}),
+	match(`\{ get; (private )?set; \}`, map[string]int{"csharp": 5}),
+	match(`^fun \w+\(`, map[string]int{"kotlin": 5}),
+	match(`^(val|var) \w+(: \w+)? = `, map[string]int{"kotlin": 3, "swift": 1}),
+	match(`^data class\b`, map[string]int{"kotlin": 5}),
+
+	// C and C++
+	match(`^#include\s*[<"]`, map[string]int{"c": 4, "cpp": 4}),
+	match(`\bprintf\(`, map[string]int{"c": 2, "cpp": 1}),
+	match(`\bint main\(`, map[string]int{"c": 4, "cpp": 4}),
+	match(`\b(malloc|free|sizeof)\(`, map[string]int{"c": 3, "cpp": 1}),
+	match(`\bstd::|\bcout\b|\bcin\b`, map[string]int{"cpp": 5}),
+	match(`^template ?<`, map[string]int{"cpp": 5}),
+	match(`^#define \w+`, map[string]int{"c": 3, "cpp": 3}),
+
+	// Rust
+	match(`^(pub )?fn \w+(<.*>)?\(`, map[string]int{"rust": 5}),
+	match(`^let mut \w+`, map[string]int{"rust": 5}),
+	match(`\b(println|vec|format)!\(|\bvec!\[`, map[string]int{"rust": 5}),
+	match(`^use \w+(::\w+)+.*;$`, map[string]int{"rust": 5}),
+	match(`^impl\b`, map[string]int{"rust": 5}),
+	match(`&mut \w+|&self\b`, map[string]int{"rust": 4}),
+
+	// Ruby, Lua and Perl
+	match(`^def \w+[?!]?(\(.*\))?$`, map[string]int{"ruby": 4}),
+	match(`^end$`, map[string]int{"ruby": 3, "lua": 3}),
+	match(`^require ['"][\w/]+['"]$`, map[string]int{"ruby": 4, "lua": 1}),
+	match(`^puts\b`, map[string]int{"ruby": 3}),
+	match(`\.each( do)? \|\w+(, \w+)*\|`, map[string]int{"ruby": 5}),
+	match(`^(module|class) \w+( < [\w:]+)?$`, map[string]int{"ruby": 4}),
+	match(`\battr_(reader|accessor|writer)\b`, map[string]int{"ruby": 5}),
+	match(`^local \w+ = `, map[string]int{"lua": 4}),
+	match(`^(local )?function [\w.:]+\(.*\)$`, map[string]int{"lua": 4}),
+	match(`~=`, map[string]int{"lua": 2}),
+	match(`^use (strict|warnings);$`, map[string]int{"perl": 6}),
+	match(`^my [$@%]\w+`, map[string]int{"perl": 5}),
+	match(`^sub \w+ \{$`, map[string]int{"perl": 4}),
+
+	// PHP
+	match(`^<\?php`, map[string]int{"php": 10}),
+	match(`^\$\w+ = `, map[string]int{"php": 3, "perl": 2}),
+	match(`\$this->`, map[string]int{"php": 5}),
+	match(`^namespace [\w\\]+;$`, map[string]int{"php": 5}),
+
+	// Shell
+	match(`^#!.*\b(ba|z|k|da)?sh\b`, map[string]int{"shell": 10}),
+	match(`^(if|while|until) \[\[? .* \]\]?(; ?(then|do))?$`, map[string]int{"shell": 4}),
+	match(`^(then|fi|done|esac|do)$`, map[string]int{"shell": 4}),
+	match(`\bthen$`, map[string]int{"shell": 2, "lua": 2}),
+	match(`^echo\b`, map[string]int{"shell": 2, "php": 1}),
+	match(`^export [A-Z_][A-Z0-9_]*=`, map[string]int{"shell": 4}),
+	match(`^[A-Z_][A-Z0-9_]*=\S`, map[string]int{"shell": 2}),
+	match(`^(sudo|apt|apt-get|brew|npm|pip|cd|ls|mkdir|rm|curl|git|docker|kubectl) `, map[string]int{"shell": 3}),
+	match(`\|\s*(grep|awk|sed|xargs|sort|head|tail|wc)\b`, map[string]int{"shell": 4}),
+
+	// SQL
+	match(`(?i)^(select|insert into|update \w+ set|delete from|create (table|index|view|database)|alter table|drop table)\b`, map[string]int{"sql": 5}),
+	match(`(?i)^(from|where|join|left join|inner join|group by|order by|having|limit)\b`, map[string]int{"sql": 2}),
+	match(`(?i)\b(varchar|primary key|not null|foreign key)\b`, map[string]int{"sql": 4}),
+
+	// Markup, styles and data
+	match(`(?i)^<!doctype html`, map[string]int{"html": 10}),
+	match(`(?i)^</?(html|head|body|div|span|p|a|ul|ol|li|table|tr|td|script|style|meta|link|h[1-6]|section|nav|footer|header|form|input|button)\b[^>]*>`, map[string]int{"html": 3}),
+	match(`^<\?xml`, map[string]int{"xml": 10}),
+	match(`^[.#][\w-]+.*\{$|^(body|html|a|h[1-6]|p|div|span|ul|li|:root)\s*(,.*)?\{$`, map[string]int{"css": 3}),
+	match(`^[a-z-]+:\s*[^;]+;$`, map[string]int{"css": 2}),
+	match(`^@(media|import|font-face|keyframes)\b`, map[string]int{"css": 5}),
+	match(`\b\d+(px|em|rem|vh|vw)\b`, map[string]int{"css": 3}),
+	match(`^[\w-]+:( [^{;]*)?$`, map[string]int{"yaml": 2}),
+	match(`^- [\w-]+: `, map[string]int{"yaml": 3}),
+	match(`^---$`, map[string]int{"yaml": 2, "markdown": 1}),
+	match(`^#{1,6} \S`, map[string]int{"markdown": 2}),
+	match(`\[[^]]+\]\([^)]+\)`, map[string]int{"markdown": 3}),
+	match("^```", map[string]int{"markdown": 4}),
+	match(`\*\*\S.*\S\*\*`, map[string]int{"markdown": 2}),
+	match(`^\d+\. \S`, map[string]int{"markdown": 2}),
+}
+
+// dialects maps languages to the language they extend, whose features they share
+var dialects = map[string]string{
+	"typescript": "javascript",
+	"cpp":        "c",
+}
+
+// Classify guesses the language of code from features typical of each
+// language throughout it, for content without a telltale first line. It
+// returns "" unless one language clearly stands out; a dialect only wins over
+// the language it extends with features of its own.
+func Classify(content string) string {
+	if len(content) > classifyLimit {
+		content = content[:classifyLimit]
+	}
+	scores := make(map[string]int)
+	matches := make([]int, len(features))
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		for i, feat := range features {
+			if matches[i] == featureCap || !feat.pattern.MatchString(line) {
+				continue
+			}
+			matches[i]++
+			for language, weight := range feat.weights {
+				scores[language] += weight
+			}
+		}
+	}
+
+	languages := make([]string, 0, len(scores))
+	for language := range scores {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	best := ""
+	for _, language := range languages {
+		if scores[language] > scores[best] || scores[language] == scores[best] && dialects[best] == language {
+			best = language
+		}
+	}
+	runnerUp := 0
+	for language, score := range scores {
+		if language != best && dialects[language] != best && dialects[best] != language && score > runnerUp {
+			runnerUp = score
+		}
+	}
+	if scores[best] < minScore || scores[best] < 2*runnerUp {
+		return ""
+	}
+	return best
+}
+
+// Detect returns the language content is written in, from its first lines
+// when they give it away and by classifying it otherwise
+func Detect(content string) string {
+	if language := For(content).Language; language != "" {
+		return language
+	}
+	return Classify(content)
+}
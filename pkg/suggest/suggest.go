@@ -0,0 +1,306 @@
+// Package suggest guesses a tab's language and file name from its content,
+// using shebangs, file headers and other telltale first lines, and a title for
+// documents from their notes and comments. Languages are the identifiers the
+// editor uses, such as "python" or "shell".
+package suggest
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Suggestion is what content looks like; either field is empty when unknown
+type Suggestion struct {
+	Name     string `json:"name,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// interpreters maps shebang interpreters, without version suffixes, to languages
+var interpreters = map[string]string{
+	"sh":     "shell",
+	"bash":   "shell",
+	"zsh":    "shell",
+	"dash":   "shell",
+	"ksh":    "shell",
+	"python": "python",
+	"node":   "javascript",
+	"deno":   "typescript",
+	"bun":    "javascript",
+	"ruby":   "ruby",
+	"perl":   "perl",
+	"php":    "php",
+	"lua":    "lua",
+	"pwsh":   "powershell",
+	"groovy": "groovy",
+	"swift":  "swift",
+	"scala":  "scala",
+}
+
+// extensions maps file extensions to languages
+var extensions = map[string]string{
+	"c":      "c",
+	"h":      "c",
+	"cc":     "cpp",
+	"cpp":    "cpp",
+	"hpp":    "cpp",
+	"cs":     "csharp",
+	"css":    "css",
+	"dart":   "dart",
+	"go":     "go",
+	"groovy": "groovy",
+	"html":   "html",
+	"htm":    "html",
+	"java":   "java",
+	"js":     "javascript",
+	"mjs":    "javascript",
+	"json":   "json",
+	"kt":     "kotlin",
+	"lua":    "lua",
+	"md":     "markdown",
+	"m":      "objective-c",
+	"pl":     "perl",
+	"php":    "php",
+	"ps1":    "powershell",
+	"py":     "python",
+	"rb":     "ruby",
+	"rs":     "rust",
+	"scala":  "scala",
+	"sh":     "shell",
+	"sql":    "sql",
+	"swift":  "swift",
+	"ts":     "typescript",
+	"vb":     "vb",
+	"xml":    "xml",
+	"yaml":   "yaml",
+	"yml":    "yaml",
+}
+
+// defaultExtensions is the extension given to files of each language
+var defaultExtensions = map[string]string{
+	"c":           "c",
+	"cpp":         "cpp",
+	"csharp":      "cs",
+	"css":         "css",
+	"dart":        "dart",
+	"go":          "go",
+	"groovy":      "groovy",
+	"html":        "html",
+	"java":        "java",
+	"javascript":  "js",
+	"json":        "json",
+	"kotlin":      "kt",
+	"lua":         "lua",
+	"markdown":    "md",
+	"objective-c": "m",
+	"perl":        "pl",
+	"php":         "php",
+	"powershell":  "ps1",
+	"python":      "py",
+	"ruby":        "rb",
+	"rust":        "rs",
+	"scala":       "scala",
+	"shell":       "sh",
+	"sql":         "sql",
+	"swift":       "swift",
+	"typescript":  "ts",
+	"vb":          "vb",
+	"xml":         "xml",
+	"yaml":        "yaml",
+}
+
+var (
+	// fileComment matches a first line naming the file, e.g. "// main.go" or "# file: deploy.sh"
+	fileComment = regexp.MustCompile(`^(?://|#|--|;|/\*|<!--)\s*(?:file(?:name)?:\s*)?([\w-]+(?:\.[\w-]+)*\.(\w+))\s*(?:\*/|-->)?$`)
+	goPackage   = regexp.MustCompile(`^package ([a-z_][a-z0-9_]*)$`)
+	dockerFrom  = regexp.MustCompile(`(?i)^FROM\s+\S+`)
+	makeTarget  = regexp.MustCompile(`^[\w.-]+:([^=]|$)`)
+	sqlStart    = regexp.MustCompile(`(?i)^(SELECT|INSERT INTO|UPDATE \w+ SET|DELETE FROM|CREATE (TABLE|INDEX|VIEW)|ALTER TABLE|WITH \w+ AS)\b`)
+	rustStart   = regexp.MustCompile(`^(use \w+(::\w+)*|fn main\(\)|(pub )?(fn|struct|enum|mod) \w+)`)
+	cInclude    = regexp.MustCompile(`^#include\s*[<"]`)
+	cppMarkers  = regexp.MustCompile(`#include\s*<(iostream|vector|string|map|memory)>|\bstd::|\bnamespace\b`)
+	javaStart   = regexp.MustCompile(`^(package [\w.]+;|import (static )?[\w.]+(\.\*)?;|public (final )?(class|interface|enum) \w+)`)
+	csharpStart = regexp.MustCompile(`^(using System(\.[\w.]+)?;|namespace [\w.]+)`)
+	mdHeading   = regexp.MustCompile(`^#{1,6} \S`)
+	mdBody      = regexp.MustCompile("\n\\s*([-*] |\\d+\\. |```|>)|\\[[^]]+\\]\\([^)]+\\)|\\*\\*\\S")
+	// commentLine captures the text of a line comment or a block comment on one line
+	commentLine = regexp.MustCompile(`^(?://+|#+\s|--|;+|/\*+|<!--|\*)\s*(.*?)\s*(?:\*/|-->)?$`)
+	// directive matches comments meant for tools rather than readers
+	directive = regexp.MustCompile(`(?i)^(-\*-|eslint|prettier|go:|\+build|@ts-|@flow|jshint|pylint|noqa|type:|coding[:=]|vim?:|fmt:|nolint|region\b)`)
+)
+
+// For returns the language and file name content suggests
+func For(content string) Suggestion {
+	lines := leadingLines(content, 20)
+	if len(lines) == 0 {
+		return Suggestion{}
+	}
+	first := lines[0]
+	var s Suggestion
+
+	if strings.HasPrefix(first, "#!") {
+		s.Language = interpreters[shebangInterpreter(first)]
+		if len(lines) > 1 {
+			// A file name may follow the shebang
+			first = lines[1]
+		}
+	}
+	if m := fileComment.FindStringSubmatch(first); m != nil {
+		// Only trust names with a known extension, so "# v1.2" isn't taken for one
+		if language, ok := extensions[strings.ToLower(m[2])]; ok {
+			s.Name = m[1]
+			if s.Language == "" {
+				s.Language = language
+			}
+		}
+	}
+	if s.Language == "" {
+		s.Language, s.Name = fromHeader(content, lines, s.Name)
+	}
+	return s
+}
+
+// Extension returns the file extension for a language, or "" if unknown
+func Extension(language string) string {
+	return defaultExtensions[language]
+}
+
+// HasExtension reports whether name already ends in a known file extension
+func HasExtension(name string) bool {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	_, ok := extensions[strings.ToLower(ext)]
+	return ok
+}
+
+// Heading returns the text of the first Markdown heading in notes, or "" if there is none
+func Heading(notes string) string {
+	for _, line := range strings.Split(notes, "\n") {
+		line = strings.TrimSpace(line)
+		if !mdHeading.MatchString(line) {
+			continue
+		}
+		text := strings.TrimSpace(strings.TrimRight(strings.TrimLeft(line, "#"), "# "))
+		if text != "" {
+			return text
+		}
+	}
+	return ""
+}
+
+// Comment returns the text of the comment code starts with, after any shebang,
+// or "" if it doesn't start with one meant for readers. Comments naming the
+// file and tool directives such as "eslint-disable" don't count.
+func Comment(code string) string {
+	lines := leadingLines(code, 2)
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#!") {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 || fileComment.MatchString(lines[0]) {
+		return ""
+	}
+	m := commentLine.FindStringSubmatch(lines[0])
+	if m == nil || directive.MatchString(m[1]) || !strings.ContainsFunc(m[1], unicode.IsLetter) {
+		return ""
+	}
+	return m[1]
+}
+
+// fromHeader recognizes a language from how content starts, along with the
+// usual file name for it if name isn't known yet
+func fromHeader(content string, lines []string, name string) (string, string) {
+	first := lines[0]
+	lower := strings.ToLower(first)
+	switch {
+	case strings.HasPrefix(first, "<?php"):
+		return "php", name
+	case strings.HasPrefix(first, "<?xml"):
+		return "xml", name
+	case strings.HasPrefix(lower, "<!doctype html") || strings.HasPrefix(lower, "<html"):
+		return "html", name
+	case first == "---" || strings.HasPrefix(first, "%YAML"):
+		return "yaml", name
+	case (first[0] == '{' || first[0] == '[') && json.Valid([]byte(content)):
+		return "json", name
+	}
+
+	for _, line := range lines {
+		// Skip comments before the first statement
+		if strings.HasPrefix(line, "//") || strings.HasPrefix(line, "/*") || strings.HasPrefix(line, "*") {
+			continue
+		}
+		switch {
+		case goPackage.MatchString(line):
+			if name == "" && line == "package main" {
+				name = "main.go"
+			}
+			return "go", name
+		case javaStart.MatchString(line):
+			return "java", name
+		case csharpStart.MatchString(line):
+			return "csharp", name
+		case cInclude.MatchString(line):
+			if cppMarkers.MatchString(content) {
+				return "cpp", name
+			}
+			return "c", name
+		case rustStart.MatchString(line):
+			return "rust", name
+		case sqlStart.MatchString(line):
+			return "sql", name
+		case dockerFrom.MatchString(line):
+			// The editor has no Dockerfile language, but the file has a well-known name
+			if name == "" {
+				name = "Dockerfile"
+			}
+			return "", name
+		case mdHeading.MatchString(line) && mdBody.MatchString(content):
+			// Headings alone could be script comments
+			return "markdown", name
+		case makeTarget.MatchString(line) && strings.Contains(content, "\n\t"):
+			if name == "" {
+				name = "Makefile"
+			}
+			return "", name
+		}
+		break
+	}
+	return "", name
+}
+
+// shebangInterpreter returns the interpreter a shebang line runs, without any
+// version suffix, looking through env
+func shebangInterpreter(line string) string {
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				interpreter = path.Base(f)
+				break
+			}
+		}
+	}
+	return strings.TrimRight(interpreter, "0123456789.")
+}
+
+// leadingLines returns up to n of content's first non-blank lines, trimmed
+func leadingLines(content string, n int) []string {
+	var lines []string
+	for _, line := range strings.SplitN(content, "\n", 200) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == n {
+			break
+		}
+	}
+	return lines
+}
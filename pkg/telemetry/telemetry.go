@@ -0,0 +1,75 @@
+package telemetry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// Feature names recorded by the server
+const (
+	FeatureTabCreate = "tab_create"
+	FeatureRun       = "run"
+	FeatureExport    = "export"
+)
+
+// window is how long a document counts once towards the distinct documents of a
+// feature; the documents seen are forgotten after it so memory stays bounded
+const window = 24 * time.Hour
+
+// Recorder counts anonymous feature usage per document.
+// A nil Recorder is valid and records nothing, which is how telemetry is switched off.
+type Recorder struct {
+	usage     *metrics.Counter
+	documents *metrics.Counter
+	mu        sync.Mutex
+	seen      map[string]map[string]bool // feature -> hashed doc ID -> seen in the current window
+	since     time.Time                  // start of the current window
+}
+
+// New creates a recorder when enabled is true and returns nil otherwise
+func New(enabled bool, registry *metrics.Registry) *Recorder {
+	if !enabled {
+		return nil
+	}
+	return &Recorder{
+		usage:     registry.Counter("gopad_feature_usage_total", "Number of times a feature was used"),
+		documents: registry.Counter("gopad_feature_documents_total", "Number of distinct documents that used a feature, counted once a day"),
+		seen:      make(map[string]map[string]bool),
+		since:     time.Now(),
+	}
+}
+
+// Record counts one use of feature in the given document.
+// Document IDs are hashed and never leave the process.
+func (r *Recorder) Record(docID, feature string) {
+	if r == nil {
+		return
+	}
+	labels := metrics.Labels{"feature": feature}
+	r.usage.Inc(labels)
+
+	sum := sha256.Sum256([]byte(docID))
+	hashed := hex.EncodeToString(sum[:8])
+
+	r.mu.Lock()
+	if now := time.Now(); now.Sub(r.since) >= window {
+		r.seen = make(map[string]map[string]bool)
+		r.since = now
+	}
+	docs, ok := r.seen[feature]
+	if !ok {
+		docs = make(map[string]bool)
+		r.seen[feature] = docs
+	}
+	first := !docs[hashed]
+	docs[hashed] = true
+	r.mu.Unlock()
+
+	if first {
+		r.documents.Inc(labels)
+	}
+}
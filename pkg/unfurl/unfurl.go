@@ -0,0 +1,212 @@
+package unfurl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/apperr"
+	"github.com/shiftregister-vg/gopad/pkg/safehttp"
+	"golang.org/x/net/html"
+)
+
+const (
+	// maxBodySize bounds how much of a page is read looking for metadata
+	maxBodySize = 512 << 10
+	// maxCacheEntries bounds the number of cached previews
+	maxCacheEntries = 1000
+)
+
+var (
+	// ErrInvalidURL is returned for URLs that aren't absolute http(s) URLs
+	ErrInvalidURL = apperr.New(apperr.CodeValidation, "link previews need an http or https URL")
+	// ErrBlockedAddress is returned when a URL resolves to a private or local address
+	ErrBlockedAddress = apperr.New(apperr.CodeValidation, "link previews are not available for this address")
+	// ErrFetchFailed is returned when the page can't be retrieved
+	ErrFetchFailed = apperr.New(apperr.CodeValidation, "could not fetch the page for a link preview")
+)
+
+// Metadata describes a linked page
+type Metadata struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+type cacheEntry struct {
+	meta    *Metadata
+	expires time.Time
+}
+
+// Fetcher retrieves and caches link metadata. Requests to loopback, private,
+// link-local and other non-public addresses are refused, including after
+// redirects and DNS resolution.
+type Fetcher struct {
+	client *http.Client
+	ttl    time.Duration
+	mu     sync.Mutex
+	cache  map[string]cacheEntry
+}
+
+// New creates a fetcher that caches results for ttl
+func New(ttl time.Duration) *Fetcher {
+	return &Fetcher{
+		client: safehttp.NewClient(10 * time.Second),
+		ttl:    ttl,
+		cache:  make(map[string]cacheEntry),
+	}
+}
+
+// Fetch returns metadata for rawURL, from the cache when possible
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Metadata, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, ErrInvalidURL
+	}
+	u.Fragment = ""
+	key := u.String()
+
+	f.mu.Lock()
+	entry, ok := f.cache[key]
+	f.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.meta, nil
+	}
+
+	meta, err := f.fetch(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f.store(key, meta)
+	return meta, nil
+}
+
+func (f *Fetcher) fetch(ctx context.Context, pageURL string) (*Metadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, ErrInvalidURL
+	}
+	req.Header.Set("User-Agent", "gopad-unfurl/1.0")
+	req.Header.Set("Accept", "text/html")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		switch {
+		case errors.Is(err, safehttp.ErrBlockedAddress):
+			return nil, ErrBlockedAddress
+		case errors.Is(err, safehttp.ErrInvalidScheme):
+			return nil, ErrInvalidURL
+		}
+		return nil, apperr.Wrap(apperr.CodeValidation, err, ErrFetchFailed.Message)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrFetchFailed
+	}
+
+	meta := parse(io.LimitReader(resp.Body, maxBodySize))
+	meta.URL = pageURL
+	if meta.Title == "" {
+		meta.Title = resp.Request.URL.Host
+	}
+	if meta.Image != "" {
+		// Resolve relative image URLs against the final page URL
+		if ref, err := resp.Request.URL.Parse(meta.Image); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			meta.Image = ref.String()
+		} else {
+			meta.Image = ""
+		}
+	}
+	return meta, nil
+}
+
+// store caches meta, dropping expired entries (or an arbitrary one) when full
+func (f *Fetcher) store(key string, meta *Metadata) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= maxCacheEntries {
+		now := time.Now()
+		for k, e := range f.cache {
+			if now.After(e.expires) {
+				delete(f.cache, k)
+			}
+		}
+		for k := range f.cache {
+			if len(f.cache) < maxCacheEntries {
+				break
+			}
+			delete(f.cache, k)
+		}
+	}
+	f.cache[key] = cacheEntry{meta: meta, expires: time.Now().Add(f.ttl)}
+}
+
+// parse extracts the title, description, site name and image from the page head,
+// preferring Open Graph tags over <title> and <meta name="description">
+func parse(r io.Reader) *Metadata {
+	meta := &Metadata{}
+	var title, description string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return finish(meta, title, description)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				if z.Next() == html.TextToken && title == "" {
+					title = strings.TrimSpace(string(z.Text()))
+				}
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+				var property, content string
+				for {
+					key, val, more := z.TagAttr()
+					switch string(key) {
+					case "property", "name":
+						property = strings.ToLower(string(val))
+					case "content":
+						content = strings.TrimSpace(string(val))
+					}
+					if !more {
+						break
+					}
+				}
+				switch property {
+				case "og:title":
+					meta.Title = content
+				case "og:description":
+					meta.Description = content
+				case "og:site_name":
+					meta.SiteName = content
+				case "og:image":
+					meta.Image = content
+				case "description":
+					description = content
+				}
+			case "body":
+				// Metadata lives in the head; stop before reading the page itself
+				return finish(meta, title, description)
+			}
+		}
+	}
+}
+
+func finish(meta *Metadata, title, description string) *Metadata {
+	if meta.Title == "" {
+		meta.Title = title
+	}
+	if meta.Description == "" {
+		meta.Description = description
+	}
+	return meta
+}
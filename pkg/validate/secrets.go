@@ -0,0 +1,24 @@
+package validate
+
+import "sort"
+
+// Finding is a credential-like string found in content
+type Finding struct {
+	Pattern string `json:"pattern"` // name of the matching entry in Patterns
+	Line    int    `json:"line"`
+}
+
+// ScanSecrets looks for every built-in credential pattern in content and
+// returns the first match of each, ordered by pattern name
+func ScanSecrets(content string) []Finding {
+	var findings []Finding
+	for name, re := range Patterns {
+		if loc := re.FindStringIndex(content); loc != nil {
+			findings = append(findings, Finding{Pattern: name, Line: lineOf(content, loc[0])})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		return findings[i].Pattern < findings[j].Pattern
+	})
+	return findings
+}
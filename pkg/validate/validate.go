@@ -0,0 +1,161 @@
+// Package validate checks tab content before it is accepted, for pads used
+// to draft configuration or code that gets deployed
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Mode controls what happens to content that fails validation
+type Mode string
+
+const (
+	// ModeReject refuses the change
+	ModeReject Mode = "reject"
+	// ModeFlag accepts the change and reports the violations to clients
+	ModeFlag Mode = "flag"
+)
+
+// Patterns are the built-in forbidden patterns, by name
+var Patterns = map[string]*regexp.Regexp{
+	"aws-access-key": regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	"private-key":    regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`),
+	"github-token":   regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+	"slack-token":    regexp.MustCompile(`\bxox[baprs]-[A-Za-z0-9-]{10,}\b`),
+}
+
+// Config selects the checks to run. The zero value runs none.
+type Config struct {
+	MaxLineLength int      // longest allowed line in characters; zero disables
+	Forbidden     []string // names of built-in patterns from Patterns
+	Pattern       string   // additional forbidden regular expression
+	Syntax        bool     // check JSON and YAML syntax of tabs named *.json, *.yaml or *.yml
+}
+
+// Violation describes one failed check
+type Violation struct {
+	Rule    string `json:"rule"` // maxLineLength, forbiddenPattern, jsonSyntax or yamlSyntax
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+// Validator runs the configured checks
+type Validator struct {
+	maxLineLength int
+	forbidden     []namedPattern
+	syntax        bool
+}
+
+type namedPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// New creates a validator, or returns nil when cfg enables no checks
+func New(cfg Config) (*Validator, error) {
+	v := &Validator{
+		maxLineLength: cfg.MaxLineLength,
+		syntax:        cfg.Syntax,
+	}
+	for _, name := range cfg.Forbidden {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		re, ok := Patterns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown forbidden pattern %q", name)
+		}
+		v.forbidden = append(v.forbidden, namedPattern{name, re})
+	}
+	if cfg.Pattern != "" {
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forbidden pattern: %w", err)
+		}
+		v.forbidden = append(v.forbidden, namedPattern{"custom", re})
+	}
+	if v.maxLineLength <= 0 && len(v.forbidden) == 0 && !v.syntax {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// Check validates the content of the tab with the given name. A nil validator finds nothing.
+func (v *Validator) Check(name, content string) []Violation {
+	if v == nil {
+		return nil
+	}
+	var violations []Violation
+	if v.maxLineLength > 0 {
+		for i, line := range strings.Split(content, "\n") {
+			if n := utf8.RuneCountInString(line); n > v.maxLineLength {
+				violations = append(violations, Violation{
+					Rule:    "maxLineLength",
+					Line:    i + 1,
+					Message: fmt.Sprintf("line is %d characters long, the limit is %d", n, v.maxLineLength),
+				})
+			}
+		}
+	}
+	for _, pattern := range v.forbidden {
+		if loc := pattern.re.FindStringIndex(content); loc != nil {
+			violations = append(violations, Violation{
+				Rule:    "forbiddenPattern",
+				Line:    lineOf(content, loc[0]),
+				Message: fmt.Sprintf("content matches forbidden pattern %s", pattern.name),
+			})
+		}
+	}
+	if v.syntax {
+		violations = append(violations, checkSyntax(name, content)...)
+	}
+	return violations
+}
+
+// yamlLine finds the line number in YAML parser errors
+var yamlLine = regexp.MustCompile(`line (\d+)`)
+
+// checkSyntax parses JSON and YAML tabs, recognized by the extension of their name
+func checkSyntax(name, content string) []Violation {
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		var v interface{}
+		if err := json.Unmarshal([]byte(content), &v); err != nil {
+			violation := Violation{Rule: "jsonSyntax", Message: err.Error()}
+			if syntaxErr, ok := err.(*json.SyntaxError); ok {
+				violation.Line = lineOf(content, int(syntaxErr.Offset))
+			}
+			return []Violation{violation}
+		}
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(content), &v); err != nil {
+			violation := Violation{Rule: "yamlSyntax", Message: err.Error()}
+			if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+				violation.Line, _ = strconv.Atoi(m[1])
+			}
+			return []Violation{violation}
+		}
+	}
+	return nil
+}
+
+// lineOf returns the 1-based line number of a byte offset in content
+func lineOf(content string, offset int) int {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	return strings.Count(content[:offset], "\n") + 1
+}
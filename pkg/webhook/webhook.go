@@ -0,0 +1,161 @@
+// Package webhook posts document events to URLs configured by the operator.
+// Each payload is signed with HMAC-SHA256 over the request body, sent hex
+// encoded in the X-GoPad-Signature header as "sha256=<signature>", so
+// receivers can check it came from this deployment.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/shiftregister-vg/gopad/pkg/logger"
+	"github.com/shiftregister-vg/gopad/pkg/metrics"
+)
+
+// Event types
+const (
+	DocumentCreated  = "documentCreated"  // first saved
+	DocumentActive   = "documentActive"   // edited after being idle
+	DocumentInactive = "documentInactive" // not edited for a while after an edit
+	UserJoined       = "userJoined"
+	DocumentExpiring = "documentExpiring" // its TTL is about to pass
+	DocumentExpired  = "documentExpired"  // removed from storage after its TTL
+)
+
+const (
+	// queueSize bounds the events waiting for delivery; more are dropped
+	queueSize    = 256
+	maxAttempts  = 3
+	retryBackoff = time.Second
+)
+
+var deliveries = metrics.NewCounter("gopad_webhook_deliveries_total", "Number of webhook deliveries by event type and result")
+
+// Event is the JSON body of a webhook request
+type Event struct {
+	Type       string `json:"type"`
+	DocumentID string `json:"documentId"`
+	Time       int64  `json:"time"`                // unix milliseconds
+	User       string `json:"user,omitempty"`      // display name, for userJoined and documentActive
+	ExpiresAt  int64  `json:"expiresAt,omitempty"` // unix milliseconds, for documentExpiring
+}
+
+// Sender delivers events to every configured URL in the background, retrying
+// failed deliveries a few times
+type Sender struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+	queue  chan Event
+	done   chan struct{}
+}
+
+// New creates a sender posting to urls and starts delivering
+func New(urls []string, secret []byte) *Sender {
+	s := &Sender{
+		urls:   urls,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Send queues an event for delivery without waiting for it. Events are dropped
+// when receivers can't keep up.
+func (s *Sender) Send(event Event) {
+	if event.Time == 0 {
+		event.Time = time.Now().UnixMilli()
+	}
+	select {
+	case s.queue <- event:
+	default:
+		deliveries.Inc(metrics.Labels{"event": event.Type, "result": "dropped"})
+		logger.Warn("Webhook queue full, dropping event", "event", event.Type, "doc_id", event.DocumentID)
+	}
+}
+
+// Close delivers the events already queued and stops the sender
+func (s *Sender) Close() {
+	close(s.queue)
+	<-s.done
+}
+
+// Sign returns the signature header value for body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver posts an event to every URL and waits until that's done, for
+// programs that can't afford to drop events
+func (s *Sender) Deliver(event Event) {
+	if event.Time == 0 {
+		event.Time = time.Now().UnixMilli()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Error marshaling webhook event", "error", err)
+		return
+	}
+	for _, url := range s.urls {
+		s.deliver(url, event, body)
+	}
+}
+
+func (s *Sender) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		s.Deliver(event)
+	}
+}
+
+// deliver posts one event to one URL, retrying on network errors and 5xx responses
+func (s *Sender) deliver(url string, event Event, body []byte) {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(retryBackoff * time.Duration(attempt-1))
+		}
+		var retry bool
+		if retry, err = s.post(url, event, body); err == nil {
+			deliveries.Inc(metrics.Labels{"event": event.Type, "result": "ok"})
+			return
+		}
+		if !retry {
+			break
+		}
+	}
+	deliveries.Inc(metrics.Labels{"event": event.Type, "result": "failed"})
+	logger.Warn("Webhook delivery failed", "url", url, "event", event.Type, "doc_id", event.DocumentID, "error", err)
+}
+
+// post sends a request and reports whether a failure is worth retrying
+func (s *Sender) post(url string, event Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gopad-webhook/1.0")
+	req.Header.Set("X-GoPad-Event", event.Type)
+	req.Header.Set("X-GoPad-Signature", Sign(s.secret, body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
@@ -132,8 +132,8 @@ interface TabRenameMessage {
   name: string;
 }
 
-interface FullStateMessage {
-  type: 'fullState' | 'init';
+interface InitMessage {
+  type: 'init';
   tabs: Tab[];
   activeTabId: string;
   language: string;
@@ -153,7 +153,7 @@ interface TabNotesUpdateMessage {
   notes: string;
 }
 
-type WebSocketMessage = UpdateMessage | UserListMessage | LanguageMessage | CursorMessage | TabFocusMessage | TabCreateMessage | TabRenameMessage | FullStateMessage | TabUpdateMessage | TabNotesUpdateMessage;
+type WebSocketMessage = UpdateMessage | UserListMessage | LanguageMessage | CursorMessage | TabFocusMessage | TabCreateMessage | TabRenameMessage | InitMessage | TabUpdateMessage | TabNotesUpdateMessage;
 
 function generateRoomId() {
   return Math.random().toString(36).substring(2, 10);
@@ -328,7 +328,7 @@ function RoomEditor() {
   const centerPanelRef = useRef<HTMLDivElement>(null);
   const reconnectInterval = useRef<NodeJS.Timeout | null>(null);
 
-  const handleInit = (data: FullStateMessage) => {
+  const handleInit = (data: InitMessage) => {
     if (data.tabs && Array.isArray(data.tabs)) {
       setTabs(data.tabs);
       setActiveTabId(data.activeTabId || data.tabs[0]?.id || '1');
@@ -431,8 +431,7 @@ function RoomEditor() {
           const msgType = (data as { type: string }).type;
           switch (msgType) {
             case 'init':
-            case 'fullState':
-              handleInit(data as FullStateMessage);
+              handleInit(data as InitMessage);
               break;
             case 'update':
               setTabs(prevTabs => prevTabs.map(tab =>